@@ -0,0 +1,511 @@
+// Command z21ctl sends commands to a z21-gateway and tails its events from
+// the terminal, speaking the NATS API of the gateway through pkg/client.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+
+	"github.com/trains-io/z21-gateway/pkg/client"
+	"github.com/trains-io/z21-gateway/pkg/gateway"
+)
+
+var usageStr = `z21ctl sends commands to a z21-gateway and tails its events.
+
+Usage: z21ctl [options] <command> [args]
+
+Commands:
+	drive <loco> <speed> [forward|reverse]
+	                               drive a loco by address or name, speed in
+	                               percent (default: forward)
+	turnout <turnout> <0|1>        switch a turnout by address or name
+	signal <signal> <aspect>       set a signal aspect
+	power off                      switch the track power off
+	cv read <cvs>                  read CVs on the programming track, e.g.
+	                               1-8,29
+	cv write <cv> <value>          write a CV on the programming track
+	state [prefix]                 print the cached last events, e.g. can.
+	seen [within]                  print the locos seen on the track, e.g. 10m
+	status                         print the next z21 status
+	gateways                       list the gateways on the bus
+	events [pattern...]            print events as they arrive, e.g. loco.3
+	                               can.> (default: all events)
+	send <command> [payload]       send any command with a JSON payload
+	tui                            live status, occupancy and events with a
+	                               command prompt
+
+Options:
+	-nc, --nats_url <host>         NATS server URL (default: nats://127.0.0.1:4222)
+	    --nats_user <user>         NATS user; the password is read from
+	                               --nats_password_file, --nats_creds_cmd or
+	                               Z21_NATS_PASSWORD
+	    --nats_password_file <file>
+	                               file holding the NATS password
+	    --nats_token_file <file>   file holding the NATS token; without it
+	                               the token is read from --nats_creds_cmd or
+	                               Z21_NATS_TOKEN
+	    --nats_creds <file>        NATS credentials (JWT and seed) file
+	    --nats_nkey <file>         NATS NKey seed file
+	    --nats_creds_cmd <cmd>     command printing the NATS password or token
+	-n, --z21_name <z21_name>      z21 name (default: main)
+	    --client_id <id>           Client-Id selecting the command profile
+	    --timeout <d>              command timeout (default: 5s)
+	    --json                     print replies and events as JSON lines
+	-h, --help                     show this help
+
+Environment Variables:
+	NATS_URL (overridden by --nats_url)
+	Z21_NATS_USER (overridden by --nats_user)
+	Z21_NATS_PASSWORD_FILE (overridden by --nats_password_file)
+	Z21_NATS_TOKEN_FILE (overridden by --nats_token_file)
+	Z21_NATS_CREDS (overridden by --nats_creds)
+	Z21_NATS_NKEY (overridden by --nats_nkey)
+	Z21_NATS_CREDS_CMD (overridden by --nats_creds_cmd)
+	Z21_NAME (overridden by --z21_name)
+	Z21_CLIENT_ID (overridden by --client_id)
+`
+
+var errUsage = errors.New("invalid arguments")
+
+// ctl runs one command against the gateway.
+type ctl struct {
+	c       *client.Client
+	nc      *nats.Conn
+	jsonOut bool
+}
+
+func main() {
+	err := run(os.Args[1:])
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		fmt.Printf("%s\n", usageStr)
+	case errors.Is(err, errUsage):
+		fmt.Fprintf(os.Stderr, "z21ctl: %s\n\n%s\n", err, usageStr)
+		os.Exit(2)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "z21ctl: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	fs := flag.NewFlagSet("z21ctl", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	var (
+		natsURL  string
+		natsAuth gateway.NATSAuth
+		name     string
+		clientID string
+		timeout  time.Duration
+		jsonOut  bool
+	)
+	fs.StringVar(&natsURL, "nats_url", getenv("NATS_URL", nats.DefaultURL), "NATS server URL")
+	fs.StringVar(&natsURL, "nc", getenv("NATS_URL", nats.DefaultURL), "NATS server URL (shorthand)")
+	fs.StringVar(&natsAuth.User, "nats_user", getenv("Z21_NATS_USER", ""), "NATS user")
+	fs.StringVar(&natsAuth.PasswordFile, "nats_password_file", getenv("Z21_NATS_PASSWORD_FILE", ""), "NATS password file")
+	fs.StringVar(&natsAuth.TokenFile, "nats_token_file", getenv("Z21_NATS_TOKEN_FILE", ""), "NATS token file")
+	fs.StringVar(&natsAuth.CredsFile, "nats_creds", getenv("Z21_NATS_CREDS", ""), "NATS credentials file")
+	fs.StringVar(&natsAuth.NkeyFile, "nats_nkey", getenv("Z21_NATS_NKEY", ""), "NATS NKey seed file")
+	fs.StringVar(&natsAuth.CredsCmd, "nats_creds_cmd", getenv("Z21_NATS_CREDS_CMD", ""), "NATS password or token command")
+	fs.StringVar(&name, "z21_name", getenv("Z21_NAME", "main"), "Z21 name")
+	fs.StringVar(&name, "n", getenv("Z21_NAME", "main"), "Z21 name (shorthand)")
+	fs.StringVar(&clientID, "client_id", getenv("Z21_CLIENT_ID", ""), "Client ID")
+	fs.DurationVar(&timeout, "timeout", client.DefaultTimeout, "Command timeout")
+	fs.BoolVar(&jsonOut, "json", false, "JSON output")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return fmt.Errorf("%w: %s", errUsage, err)
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("%w: missing command", errUsage)
+	}
+	if timeout <= 0 {
+		return fmt.Errorf("%w: --timeout must be positive", errUsage)
+	}
+
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).With().Timestamp().Logger()
+	opts, err := natsAuth.Options(logger)
+	if err != nil {
+		return err
+	}
+	nc, err := nats.Connect(natsURL, append(opts, nats.Name("z21ctl"))...)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	copts := []client.Option{client.WithTimeout(timeout)}
+	if clientID != "" {
+		copts = append(copts, client.WithClientID(clientID))
+	}
+	t := &ctl{c: client.New(nc, name, copts...), nc: nc, jsonOut: jsonOut}
+	return t.run(ctx, fs.Arg(0), fs.Args()[1:])
+}
+
+func (t *ctl) run(ctx context.Context, command string, args []string) error {
+	switch command {
+	case "drive", "turnout", "signal", "power":
+		name, payload, err := parseCommand(command, args)
+		if err != nil {
+			return err
+		}
+		return t.send(ctx, name, payload)
+	case "tui":
+		return t.tui(ctx)
+	case "cv":
+		return t.cv(ctx, args)
+	case "state":
+		return t.state(ctx, args)
+	case "seen":
+		return t.seen(ctx, args)
+	case "status":
+		return t.status(ctx)
+	case "gateways":
+		return t.gateways(ctx)
+	case "events":
+		return t.events(ctx, args)
+	case "send":
+		return t.sendRaw(ctx, args)
+	}
+	return fmt.Errorf("%w: unknown command %q", errUsage, command)
+}
+
+// parseCommand turns the arguments of the drive, turnout, signal and power
+// commands into the gateway command and its payload.
+func parseCommand(command string, args []string) (string, any, error) {
+	switch command {
+	case "drive":
+		req, err := driveRequest(args)
+		return "loco.drive", req, err
+	case "turnout":
+		req, err := turnoutRequest(args)
+		return "turnout.set", req, err
+	case "signal":
+		if len(args) != 2 {
+			return "", nil, fmt.Errorf("%w: signal <signal> <aspect>", errUsage)
+		}
+		return "signal.set", client.SignalRequest{Name: args[0], Aspect: args[1]}, nil
+	case "power":
+		if len(args) != 1 || args[0] != "off" {
+			return "", nil, fmt.Errorf("%w: power off, the gateway cannot switch the track power on", errUsage)
+		}
+		return "power.off", nil, nil
+	}
+	return "", nil, fmt.Errorf("%w: unknown command %q", errUsage, command)
+}
+
+func driveRequest(args []string) (client.DriveRequest, error) {
+	req := client.DriveRequest{Forward: true}
+	if len(args) < 2 || len(args) > 3 {
+		return req, fmt.Errorf("%w: drive <loco> <speed> [forward|reverse]", errUsage)
+	}
+	if addr, err := strconv.ParseUint(args[0], 10, 16); err == nil {
+		req.Address = uint16(addr)
+	} else {
+		req.Name = args[0]
+	}
+	speed, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		return req, fmt.Errorf("%w: invalid speed %q", errUsage, args[1])
+	}
+	req.Speed = speed
+	if len(args) == 3 {
+		switch args[2] {
+		case "forward", "fwd":
+			req.Forward = true
+		case "reverse", "rev":
+			req.Forward = false
+		default:
+			return req, fmt.Errorf("%w: invalid direction %q", errUsage, args[2])
+		}
+	}
+	return req, nil
+}
+
+func turnoutRequest(args []string) (client.TurnoutRequest, error) {
+	var req client.TurnoutRequest
+	if len(args) != 2 || (args[1] != "0" && args[1] != "1") {
+		return req, fmt.Errorf("%w: turnout <turnout> <0|1>", errUsage)
+	}
+	req.Output = args[1][0] - '0'
+	if addr, err := strconv.ParseUint(args[0], 10, 16); err == nil {
+		req.Address = uint16(addr)
+	} else {
+		req.Name = args[0]
+	}
+	return req, nil
+}
+
+func (t *ctl) cv(ctx context.Context, args []string) error {
+	var (
+		j   *client.Job
+		err error
+	)
+	switch {
+	case len(args) == 2 && args[0] == "read":
+		j, err = t.c.ReadCVs(ctx, args[1])
+	case len(args) == 3 && args[0] == "write":
+		cv, cvErr := strconv.ParseUint(args[1], 10, 16)
+		value, valueErr := strconv.ParseUint(args[2], 10, 8)
+		if cvErr != nil || valueErr != nil || cv == 0 {
+			return fmt.Errorf("%w: cv write <cv> <0-255>", errUsage)
+		}
+		j, err = t.c.WriteCVs(ctx, map[uint16]uint8{uint16(cv): uint8(value)})
+	default:
+		return fmt.Errorf("%w: cv read <cvs> or cv write <cv> <value>", errUsage)
+	}
+	if err != nil {
+		return err
+	}
+	if j, err = t.c.WaitJob(ctx, j.ID); err != nil {
+		return err
+	}
+	if t.jsonOut {
+		return printJSON(j)
+	}
+	if j.State != client.JobDone {
+		return fmt.Errorf("job %s %s: %s", j.ID, j.State, j.Error)
+	}
+
+	if args[0] == "write" {
+		var res client.CVRestore
+		if err := json.Unmarshal(j.Result, &res); err != nil {
+			return err
+		}
+		if len(res.Failed) > 0 {
+			return fmt.Errorf("CV%d not written", res.Failed[0])
+		}
+		fmt.Printf("CV%s = %s\n", args[1], args[2])
+		return nil
+	}
+	var backup client.CVBackup
+	if err := json.Unmarshal(j.Result, &backup); err != nil {
+		return err
+	}
+	cvs := make([]uint16, 0, len(backup.CVs))
+	for cv := range backup.CVs {
+		cvs = append(cvs, cv)
+	}
+	slices.Sort(cvs)
+	for _, cv := range cvs {
+		fmt.Printf("CV%d = %d\n", cv, backup.CVs[cv])
+	}
+	for _, cv := range backup.Failed {
+		fmt.Printf("CV%d failed\n", cv)
+	}
+	return nil
+}
+
+func (t *ctl) state(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("%w: state [prefix]", errUsage)
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	states, err := t.c.State(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, s := range states {
+		if t.jsonOut {
+			if err := printJSON(s); err != nil {
+				return err
+			}
+			continue
+		}
+		stale := ""
+		if s.Stale {
+			stale = " (stale)"
+		}
+		fmt.Printf("%s %s %s%s\n", s.TS, s.Subject, s.Event, stale)
+	}
+	return nil
+}
+
+func (t *ctl) seen(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("%w: seen [within]", errUsage)
+	}
+	within := ""
+	if len(args) == 1 {
+		within = args[0]
+	}
+	locos, err := t.c.SeenLocos(ctx, within)
+	if err != nil {
+		return err
+	}
+	for _, l := range locos {
+		if t.jsonOut {
+			if err := printJSON(l); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Printf("%5d %-16s %s %s %s\n", l.Address, l.Name, l.LastSeen, l.Source, l.Detector)
+	}
+	return nil
+}
+
+func (t *ctl) status(ctx context.Context) error {
+	statuses := make(chan client.Status, 1)
+	sub, err := t.c.SubscribeStatus(func(s client.Status) {
+		select {
+		case statuses <- s:
+		default:
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	select {
+	case s := <-statuses:
+		if t.jsonOut {
+			return printJSON(s)
+		}
+		fmt.Printf("reachable:   %t\n", s.Reachable)
+		for _, f := range [][2]string{
+			{"serial", s.Serial},
+			{"model", s.Model},
+			{"firmware", s.Firmware},
+			{"uptime", s.Uptime},
+			{"track power", s.TrackPower},
+			{"last event", s.LastBroadcast},
+		} {
+			if f[1] != "" {
+				fmt.Printf("%-12s %s\n", f[0]+":", f[1])
+			}
+		}
+		return nil
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func (t *ctl) gateways(ctx context.Context) error {
+	gateways, err := client.Discover(ctx, t.nc)
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(gateways, func(a, b client.GatewayInfo) int { return strings.Compare(a.Name, b.Name) })
+	for _, g := range gateways {
+		if t.jsonOut {
+			if err := printJSON(g); err != nil {
+				return err
+			}
+			continue
+		}
+		z21 := "offline"
+		if g.Z21Online {
+			z21 = "online"
+		}
+		fmt.Printf("%-16s %-8s z21 %-8s %-10s %s\n", g.Name, g.State, z21, g.Version, g.StartedAt)
+	}
+	return nil
+}
+
+func (t *ctl) events(ctx context.Context, args []string) error {
+	patterns := args
+	if len(patterns) == 0 {
+		patterns = []string{">"}
+	}
+	for _, pattern := range patterns {
+		sub, err := t.c.SubscribeEvents(pattern, t.printEvent)
+		if err != nil {
+			return err
+		}
+		defer sub.Unsubscribe()
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (t *ctl) printEvent(ev client.Event) {
+	if t.jsonOut {
+		printJSON(struct {
+			Subject string          `json:"subject"`
+			Seq     uint64          `json:"seq,omitempty"`
+			TS      time.Time       `json:"ts"`
+			Payload json.RawMessage `json:"payload"`
+		}{ev.Subject, ev.Seq, ev.TS, ev.Payload})
+		return
+	}
+	subject := strings.TrimPrefix(ev.Subject, t.c.Subject("event."))
+	fmt.Printf("%s %s %s\n", ev.TS.Local().Format("15:04:05.000"), subject, ev.Payload)
+}
+
+func (t *ctl) sendRaw(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("%w: send <command> [payload]", errUsage)
+	}
+	var payload any
+	if len(args) == 2 {
+		if !json.Valid([]byte(args[1])) {
+			return fmt.Errorf("%w: payload is not JSON", errUsage)
+		}
+		payload = json.RawMessage(args[1])
+	}
+	reply, err := t.c.Request(ctx, args[0], payload)
+	if reply != nil {
+		if err := printJSON(reply); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// send sends a command, printing ok or with --json the reply.
+func (t *ctl) send(ctx context.Context, command string, payload any) error {
+	reply, err := t.c.Request(ctx, command, payload)
+	if err != nil {
+		return err
+	}
+	if t.jsonOut {
+		return printJSON(reply)
+	}
+	if reply.DryRun {
+		fmt.Println("ok (dry run)")
+		return nil
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+func printJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", data)
+	return nil
+}
+
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+
+	"github.com/trains-io/z21-gateway/pkg/client"
+)
+
+const (
+	// TUIEvents is the number of recent events kept for the event list.
+	TUIEvents = 200
+
+	canDetectorOccupancy = 0x01
+)
+
+var (
+	titleStyle    = lipgloss.NewStyle().Bold(true)
+	sectionStyle  = lipgloss.NewStyle().Bold(true).Underline(true)
+	okStyle       = lipgloss.NewStyle().Foreground(lipgloss.Color("2"))
+	badStyle      = lipgloss.NewStyle().Foreground(lipgloss.Color("1"))
+	occupiedStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("0")).Background(lipgloss.Color("3"))
+	freeStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
+	dimStyle      = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
+)
+
+type (
+	statusMsg client.Status
+	eventMsg  client.Event
+	replyMsg  struct {
+		line string
+		err  error
+	}
+)
+
+// tuiModel is the state of the terminal UI: the last z21 status, the
+// occupancy of the detectors and blocks, the recent events and the prompt.
+type tuiModel struct {
+	ctx context.Context
+	t   *ctl
+
+	width, height int
+
+	status    client.Status
+	hasStatus bool
+	occupancy map[string]bool
+	events    []string
+
+	input   []rune
+	history []string
+	// histPos indexes history while browsing it with up and down.
+	histPos int
+	reply   replyMsg
+}
+
+// tui runs the terminal UI until the user quits or ctx is done.
+func (t *ctl) tui(ctx context.Context) error {
+	m := &tuiModel{ctx: ctx, t: t, occupancy: make(map[string]bool)}
+	m.loadOccupancy()
+
+	p := tea.NewProgram(m, tea.WithAltScreen(), tea.WithContext(ctx))
+	statusSub, err := t.c.SubscribeStatus(func(s client.Status) { p.Send(statusMsg(s)) })
+	if err != nil {
+		return err
+	}
+	defer statusSub.Unsubscribe()
+	eventSub, err := t.c.SubscribeEvents(">", func(ev client.Event) { p.Send(eventMsg(ev)) })
+	if err != nil {
+		return err
+	}
+	defer eventSub.Unsubscribe()
+
+	_, err = p.Run()
+	if errors.Is(err, tea.ErrProgramKilled) && ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// loadOccupancy seeds the occupancy from the state cache of the gateway, so
+// that detectors show up before they change.
+func (m *tuiModel) loadOccupancy() {
+	for _, prefix := range []string{"can.", "block."} {
+		states, err := m.t.c.State(m.ctx, prefix)
+		if err != nil {
+			m.reply = replyMsg{err: err}
+			return
+		}
+		prefixLen := len(m.t.c.Subject("event."))
+		for _, s := range states {
+			if len(s.Subject) <= prefixLen {
+				continue
+			}
+			tokens := strings.Split(s.Subject[prefixLen:], ".")
+			m.updateOccupancy(tokens[0], tokens[1:], s.Event)
+		}
+	}
+}
+
+func (m *tuiModel) Init() tea.Cmd {
+	return nil
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+	case statusMsg:
+		m.status, m.hasStatus = client.Status(msg), true
+	case eventMsg:
+		m.addEvent(client.Event(msg))
+	case replyMsg:
+		m.reply = msg
+	case tea.KeyMsg:
+		return m, m.key(msg)
+	}
+	return m, nil
+}
+
+func (m *tuiModel) key(msg tea.KeyMsg) tea.Cmd {
+	switch msg.Type {
+	case tea.KeyCtrlC, tea.KeyEsc:
+		return tea.Quit
+	case tea.KeyEnter:
+		line := strings.TrimSpace(string(m.input))
+		m.input = m.input[:0]
+		if line == "" {
+			return nil
+		}
+		if line == "quit" || line == "exit" {
+			return tea.Quit
+		}
+		m.history = append(m.history, line)
+		m.histPos = len(m.history)
+		return m.send(line)
+	case tea.KeyBackspace:
+		if len(m.input) > 0 {
+			m.input = m.input[:len(m.input)-1]
+		}
+	case tea.KeyCtrlU:
+		m.input = m.input[:0]
+	case tea.KeyUp:
+		if m.histPos > 0 {
+			m.histPos--
+			m.input = []rune(m.history[m.histPos])
+		}
+	case tea.KeyDown:
+		if m.histPos < len(m.history)-1 {
+			m.histPos++
+			m.input = []rune(m.history[m.histPos])
+		} else {
+			m.histPos = len(m.history)
+			m.input = m.input[:0]
+		}
+	case tea.KeyRunes, tea.KeySpace:
+		m.input = append(m.input, msg.Runes...)
+	}
+	return nil
+}
+
+// send runs a prompt line, the drive, turnout, signal, power and send
+// commands of z21ctl, in the background.
+func (m *tuiModel) send(line string) tea.Cmd {
+	return func() tea.Msg {
+		fields := strings.Fields(line)
+		var (
+			command string
+			payload any
+			err     error
+		)
+		if fields[0] == "send" {
+			if len(fields) < 2 {
+				return replyMsg{line: line, err: errors.New("send <command> [payload]")}
+			}
+			// the payload may contain spaces
+			var raw string
+			command, raw, _ = strings.Cut(strings.TrimSpace(strings.TrimPrefix(line, "send")), " ")
+			if raw = strings.TrimSpace(raw); raw != "" {
+				if !json.Valid([]byte(raw)) {
+					return replyMsg{line: line, err: errors.New("payload is not JSON")}
+				}
+				payload = json.RawMessage(raw)
+			}
+		} else if command, payload, err = parseCommand(fields[0], fields[1:]); err != nil {
+			return replyMsg{line: line, err: err}
+		}
+		reply, err := m.t.c.Request(m.ctx, command, payload)
+		if err != nil {
+			return replyMsg{line: line, err: err}
+		}
+		if len(reply.Data) > 0 {
+			return replyMsg{line: fmt.Sprintf("%s: ok %s", line, reply.Data)}
+		}
+		return replyMsg{line: line + ": ok"}
+	}
+}
+
+func (m *tuiModel) addEvent(ev client.Event) {
+	m.updateOccupancy(ev.Kind, ev.Source, ev.Payload)
+	subject := strings.TrimPrefix(ev.Subject, m.t.c.Subject("event."))
+	line := fmt.Sprintf("%s %s %s", ev.TS.Local().Format("15:04:05.000"), subject, ev.Payload)
+	m.events = append(m.events, line)
+	if len(m.events) > TUIEvents {
+		m.events = m.events[len(m.events)-TUIEvents:]
+	}
+}
+
+// updateOccupancy tracks the CAN detector ports from their occupancy
+// readings, like the block tracker of the gateway, and the blocks from their
+// block events.
+func (m *tuiModel) updateOccupancy(kind string, source []string, payload json.RawMessage) {
+	switch kind {
+	case "can":
+		var reading struct {
+			Type   int
+			Value1 int
+		}
+		if json.Unmarshal(payload, &reading) != nil || reading.Type != canDetectorOccupancy || len(source) < 2 {
+			return
+		}
+		m.occupancy["can."+strings.Join(source, ".")] = reading.Value1 != 0
+	case "block":
+		var block struct {
+			Block    string `json:"block"`
+			Occupied bool   `json:"occupied"`
+		}
+		if json.Unmarshal(payload, &block) != nil || block.Block == "" {
+			return
+		}
+		m.occupancy["block."+block.Block] = block.Occupied
+	}
+}
+
+func (m *tuiModel) View() string {
+	var b strings.Builder
+	b.WriteString(m.statusLine())
+	b.WriteString("\n\n")
+
+	grid := m.occupancyGrid()
+	b.WriteString(sectionStyle.Render("Occupancy"))
+	b.WriteString("\n")
+	for _, row := range grid {
+		b.WriteString(row)
+		b.WriteString("\n")
+	}
+	b.WriteString("\n")
+
+	// header, occupancy, events title, prompt and reply
+	rows := max(m.height-len(grid)-7, 1)
+	b.WriteString(sectionStyle.Render("Events"))
+	b.WriteString("\n")
+	events := m.events[max(len(m.events)-rows, 0):]
+	for _, line := range events {
+		b.WriteString(truncate(line, m.width))
+		b.WriteString("\n")
+	}
+	for range rows - len(events) {
+		b.WriteString("\n")
+	}
+
+	switch {
+	case m.reply.err != nil:
+		b.WriteString(badStyle.Render(truncate(m.reply.err.Error(), m.width)))
+	case m.reply.line != "":
+		b.WriteString(dimStyle.Render(truncate(m.reply.line, m.width)))
+	default:
+		b.WriteString(dimStyle.Render("drive <loco> <speed> [reverse] · turnout <turnout> <0|1> · signal · power off · send · esc quits"))
+	}
+	b.WriteString("\n> ")
+	b.WriteString(string(m.input))
+	return b.String()
+}
+
+func (m *tuiModel) statusLine() string {
+	parts := []string{titleStyle.Render("z21 " + m.t.c.Device())}
+	switch {
+	case !m.hasStatus:
+		parts = append(parts, dimStyle.Render("waiting for status"))
+	case m.status.Reachable:
+		parts = append(parts, okStyle.Render("reachable"))
+	default:
+		parts = append(parts, badStyle.Render("unreachable"))
+	}
+	if m.status.Model != "" {
+		parts = append(parts, m.status.Model+" "+m.status.Firmware)
+	}
+	if p := m.status.TrackPower; p != "" {
+		style := badStyle
+		if p == "on" {
+			style = okStyle
+		}
+		parts = append(parts, "track power "+style.Render(p))
+	}
+	if m.status.Uptime != "" {
+		parts = append(parts, "up "+m.status.Uptime)
+	}
+	if m.status.LastBroadcast != "" {
+		if ts, err := time.Parse(time.RFC3339, m.status.LastBroadcast); err == nil {
+			parts = append(parts, "last event "+time.Since(ts).Round(time.Second).String()+" ago")
+		}
+	}
+	return strings.Join(parts, "  ")
+}
+
+// occupancyGrid renders the detectors and blocks in columns as wide as the
+// longest name.
+func (m *tuiModel) occupancyGrid() []string {
+	if len(m.occupancy) == 0 {
+		return []string{dimStyle.Render("no detectors seen yet")}
+	}
+	names := make([]string, 0, len(m.occupancy))
+	width := 0
+	for name := range m.occupancy {
+		names = append(names, name)
+		width = max(width, len(name))
+	}
+	slices.Sort(names)
+
+	cols := max((m.width+1)/(width+3), 1)
+	var rows []string
+	for i := 0; i < len(names); i += cols {
+		cells := make([]string, 0, cols)
+		for _, name := range names[i:min(i+cols, len(names))] {
+			cell := fmt.Sprintf(" %-*s ", width, name)
+			if m.occupancy[name] {
+				cells = append(cells, occupiedStyle.Render(cell))
+			} else {
+				cells = append(cells, freeStyle.Render(cell))
+			}
+		}
+		rows = append(rows, strings.Join(cells, " "))
+	}
+	return rows
+}
+
+func truncate(s string, width int) string {
+	if r := []rune(s); width > 0 && len(r) > width {
+		return string(r[:width])
+	}
+	return s
+}
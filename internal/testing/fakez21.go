@@ -0,0 +1,698 @@
+package testing
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	FakeSerialNumber = 123456
+	// FakeHardwareType is a black Z21 (2013), firmware 1.43.
+	FakeHardwareType = 0x00000202
+	FakeFirmware     = 0x00000143
+
+	// FakeStateInterval is the period of the system state broadcasts.
+	FakeStateInterval = time.Second
+)
+
+// LAN protocol headers, see the Z21 LAN protocol specification.
+const (
+	lanGetSerialNumber    = 0x10
+	lanGetCode            = 0x18
+	lanGetHWInfo          = 0x1a
+	lanLogoff             = 0x30
+	lanX                  = 0x40
+	lanSetBroadcastFlags  = 0x50
+	lanGetBroadcastFlags  = 0x51
+	lanGetTurnoutMode     = 0x70
+	lanSetTurnoutMode     = 0x71
+	lanRMBusDataChanged   = 0x80
+	lanRMBusGetData       = 0x81
+	lanSystemStateChanged = 0x84
+	lanSystemStateGetData = 0x85
+	lanCANDetector        = 0xc4
+	lanCANDeviceGetDesc   = 0xc8
+)
+
+// Broadcast flags of a client.
+const (
+	flagDrivingSwitching = 0x00000001
+	flagRMBus            = 0x00000002
+	flagSystemState      = 0x00000100
+	flagAllLocos         = 0x00010000
+	flagCANDetector      = 0x00080000
+)
+
+// Central state bits of the system state.
+const (
+	centralEmergencyStop   = 0x01
+	centralTrackVoltageOff = 0x02
+	centralShortCircuit    = 0x04
+)
+
+const (
+	canDetectorOccupancy   = 0x01
+	canDetectorAllNetworks = 0xd000
+	rmBusGroups            = 2
+	rmBusModulesPerGroup   = 10
+
+	fakeMainCurrent         = 120
+	fakeTemperature         = 35
+	fakeSupplyVoltage       = 18500
+	fakeVCCVoltage          = 18200
+	fakeCapabilities        = 0xff
+	fakeXBusVersion         = 0x30
+	fakeCommandStationID    = 0x12
+	fakeCANDetectorModuleID = 0
+)
+
+// FakeLoco is the state of a loco driven on the fake z21.
+type FakeLoco struct {
+	Speed      uint8
+	Forward    bool
+	SpeedSteps uint8
+	// Functions has bit n set for Fn on.
+	Functions uint32
+}
+
+type fakeClient struct {
+	flags uint32
+	locos map[uint16]bool
+}
+
+type canDetector struct {
+	networkID uint16
+	port      uint8
+}
+
+// FakeZ21 is an in-process z21 answering the datasets of the Z21 LAN
+// protocol the gateway sends over UDP: serial number, hardware info,
+// broadcast flags, system state, track power, locos, turnouts, extended
+// accessories and CV programming. Occupancy and track power changes are
+// injected by the test and broadcast to the logged on clients like the
+// z21 does.
+type FakeZ21 struct {
+	conn *net.UDPConn
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	mu           sync.Mutex
+	offline      bool
+	centralState uint8
+	clients      map[string]*fakeClient
+	locos        map[uint16]*FakeLoco
+	turnouts     map[uint16]uint8
+	turnoutModes map[uint16]uint8
+	accessories  map[uint16]uint8
+	cvs          map[uint16]uint8
+	pom          map[uint16]map[uint16]uint8
+	accessoryCVs map[uint16]map[uint16]uint8
+	mm           map[uint16]uint8
+	detectors    map[canDetector]bool
+	rmBus        [rmBusGroups][rmBusModulesPerGroup]byte
+}
+
+// NewFakeZ21 starts a fake z21 on a random local UDP port.
+func NewFakeZ21() (*FakeZ21, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	z := &FakeZ21{
+		conn:         conn,
+		done:         make(chan struct{}),
+		clients:      map[string]*fakeClient{},
+		locos:        map[uint16]*FakeLoco{},
+		turnouts:     map[uint16]uint8{},
+		turnoutModes: map[uint16]uint8{},
+		accessories:  map[uint16]uint8{},
+		cvs:          map[uint16]uint8{},
+		pom:          map[uint16]map[uint16]uint8{},
+		accessoryCVs: map[uint16]map[uint16]uint8{},
+		mm:           map[uint16]uint8{},
+		detectors:    map[canDetector]bool{},
+	}
+	z.wg.Add(2)
+	go z.serve()
+	go z.stateLoop()
+	return z, nil
+}
+
+// Addr returns the address to pass as --z21_addr.
+func (z *FakeZ21) Addr() string {
+	return z.conn.LocalAddr().String()
+}
+
+// Close stops the fake z21.
+func (z *FakeZ21) Close() error {
+	close(z.done)
+	err := z.conn.Close()
+	z.wg.Wait()
+	return err
+}
+
+// SetOffline makes the fake z21 drop all datasets, like a z21 that lost
+// its network, until it is set online again.
+func (z *FakeZ21) SetOffline(offline bool) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.offline = offline
+}
+
+// SetTrackPower switches the track power like the z21 keys do.
+func (z *FakeZ21) SetTrackPower(on bool) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.setTrackPower(on)
+}
+
+// ShortCircuit reports a short circuit on the main track, which turns off
+// the track power.
+func (z *FakeZ21) ShortCircuit() {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.centralState |= centralShortCircuit | centralTrackVoltageOff
+	z.broadcast(flagDrivingSwitching, xDataset(0x61, 0x08))
+}
+
+// SetOccupancy reports port of the CAN occupancy detector networkID as
+// occupied or free.
+func (z *FakeZ21) SetOccupancy(networkID uint16, port uint8, occupied bool) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	d := canDetector{networkID: networkID, port: port}
+	z.detectors[d] = occupied
+	z.broadcast(flagCANDetector, canDetectorDataset(d, occupied))
+}
+
+// SetFeedback reports input (1-8) of the R-BUS feedback module (1-20) as
+// occupied or free.
+func (z *FakeZ21) SetFeedback(module, input uint8, occupied bool) {
+	if module < 1 || module > rmBusGroups*rmBusModulesPerGroup || input < 1 || input > 8 {
+		return
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	group, i := (module-1)/rmBusModulesPerGroup, (module-1)%rmBusModulesPerGroup
+	if occupied {
+		z.rmBus[group][i] |= 1 << (input - 1)
+	} else {
+		z.rmBus[group][i] &^= 1 << (input - 1)
+	}
+	z.broadcast(flagRMBus, z.rmBusDataset(group))
+}
+
+// Loco returns the state of loco addr, false if no client drove or asked
+// for it.
+func (z *FakeZ21) Loco(addr uint16) (FakeLoco, bool) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	l, ok := z.locos[addr]
+	if !ok {
+		return FakeLoco{}, false
+	}
+	return *l, true
+}
+
+// Turnout returns the position of turnout addr, 0 if it was never switched,
+// 1 or 2 for output 0 or 1.
+func (z *FakeZ21) Turnout(addr uint16) uint8 {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.turnouts[addr]
+}
+
+// TurnoutMode returns the mode of turnout addr, 0 for DCC and 1 for MM.
+func (z *FakeZ21) TurnoutMode(addr uint16) uint8 {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.turnoutModes[addr]
+}
+
+// AccessoryCV returns CV cv of accessory decoder decoder as written on the
+// main track.
+func (z *FakeZ21) AccessoryCV(decoder, cv uint16) uint8 {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.accessoryCVs[decoder][cv]
+}
+
+// Accessory returns the last value sent to extended accessory addr.
+func (z *FakeZ21) Accessory(addr uint16) uint8 {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.accessories[addr]
+}
+
+// SetCV sets CV cv (1-1024) of the decoder on the programming track.
+func (z *FakeZ21) SetCV(cv uint16, value uint8) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.cvs[cv] = value
+}
+
+// CV returns CV cv (1-1024) of the decoder on the programming track.
+func (z *FakeZ21) CV(cv uint16) uint8 {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.cvs[cv]
+}
+
+// POMCV returns CV cv of loco addr as written on the main track.
+func (z *FakeZ21) POMCV(addr, cv uint16) uint8 {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.pom[addr][cv]
+}
+
+// MMRegister returns register reg (1-256) of the Motorola decoder on the
+// programming track as written.
+func (z *FakeZ21) MMRegister(reg uint16) uint8 {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.mm[reg]
+}
+
+func (z *FakeZ21) serve() {
+	defer z.wg.Done()
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := z.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		z.mu.Lock()
+		if !z.offline {
+			z.handlePacket(addr, buf[:n])
+		}
+		z.mu.Unlock()
+	}
+}
+
+func (z *FakeZ21) stateLoop() {
+	defer z.wg.Done()
+	ticker := time.NewTicker(FakeStateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-z.done:
+			return
+		case <-ticker.C:
+			z.mu.Lock()
+			if !z.offline {
+				z.broadcast(flagSystemState, z.systemStateDataset())
+			}
+			z.mu.Unlock()
+		}
+	}
+}
+
+// handlePacket answers every dataset of a packet, a packet may carry more
+// than one.
+func (z *FakeZ21) handlePacket(addr *net.UDPAddr, packet []byte) {
+	key := addr.String()
+	c, ok := z.clients[key]
+	if !ok {
+		c = &fakeClient{locos: map[uint16]bool{}}
+		z.clients[key] = c
+	}
+	for len(packet) >= 4 {
+		n := int(binary.LittleEndian.Uint16(packet))
+		if n < 4 || n > len(packet) {
+			return
+		}
+		header := binary.LittleEndian.Uint16(packet[2:])
+		if reply := z.handle(key, c, header, packet[4:n]); reply != nil {
+			z.send(addr, reply)
+		}
+		packet = packet[n:]
+	}
+}
+
+func (z *FakeZ21) handle(key string, c *fakeClient, header uint16, data []byte) []byte {
+	switch header {
+	case lanGetSerialNumber:
+		return dataset(lanGetSerialNumber, le32(FakeSerialNumber))
+	case lanGetCode:
+		// no feature restrictions
+		return dataset(lanGetCode, []byte{0x00})
+	case lanGetHWInfo:
+		return dataset(lanGetHWInfo, append(le32(FakeHardwareType), le32(FakeFirmware)...))
+	case lanLogoff:
+		delete(z.clients, key)
+	case lanSetBroadcastFlags:
+		if len(data) >= 4 {
+			c.flags = binary.LittleEndian.Uint32(data)
+		}
+	case lanGetBroadcastFlags:
+		return dataset(lanGetBroadcastFlags, le32(c.flags))
+	case lanGetTurnoutMode:
+		if len(data) >= 2 {
+			addr := binary.BigEndian.Uint16(data)
+			return dataset(lanGetTurnoutMode, []byte{data[0], data[1], z.turnoutModes[addr]})
+		}
+	case lanSetTurnoutMode:
+		if len(data) >= 3 && data[2] <= 1 {
+			z.turnoutModes[binary.BigEndian.Uint16(data)] = data[2]
+		}
+	case lanSystemStateGetData:
+		return z.systemStateDataset()
+	case lanRMBusGetData:
+		if len(data) >= 1 && data[0] < rmBusGroups {
+			return z.rmBusDataset(data[0])
+		}
+	case lanCANDetector:
+		if len(data) >= 3 && data[0] == 0x00 {
+			return z.canDetectorDatasets(binary.LittleEndian.Uint16(data[1:]))
+		}
+	case lanCANDeviceGetDesc:
+		if len(data) >= 2 {
+			return z.canDescriptionDataset(binary.LittleEndian.Uint16(data))
+		}
+	case lanX:
+		return z.handleX(c, data)
+	}
+	return nil
+}
+
+func (z *FakeZ21) handleX(c *fakeClient, data []byte) []byte {
+	if len(data) < 2 || xor(data) != 0 {
+		// the z21 ignores X-BUS commands with a wrong checksum
+		return nil
+	}
+	x := data[:len(data)-1]
+	switch {
+	case match(x, 0x21, 0x21):
+		return xDataset(0x63, 0x21, fakeXBusVersion, fakeCommandStationID)
+	case match(x, 0x21, 0x24):
+		return xDataset(0x62, 0x22, z.centralState)
+	case match(x, 0x21, 0x80):
+		z.setTrackPower(false)
+	case match(x, 0x21, 0x81):
+		z.setTrackPower(true)
+	case match(x, 0x80):
+		z.centralState |= centralEmergencyStop
+		z.broadcast(flagDrivingSwitching, xDataset(0x81, 0x00))
+	case match(x, 0xf1, 0x0a):
+		return xDataset(0xf3, 0x0a, FakeFirmware>>8, FakeFirmware&0xff)
+	case match(x, 0xe3, 0xf0) && len(x) == 4:
+		addr := locoAddr(x[2], x[3])
+		c.locos[addr] = true
+		return z.locoInfoDataset(addr)
+	case len(x) == 4 && match(x, 0xe3, 0x44):
+		addr := locoAddr(x[2], x[3])
+		delete(z.locos, addr)
+		for _, c := range z.clients {
+			delete(c.locos, addr)
+		}
+	case len(x) == 5 && x[0] == 0xe4 && x[1]&0xf0 == 0x10:
+		addr := locoAddr(x[2], x[3])
+		l := z.loco(addr)
+		l.SpeedSteps = speedSteps(x[1] & 0x0f)
+		l.Forward = x[4]&0x80 != 0
+		l.Speed = x[4] & 0x7f
+		c.locos[addr] = true
+		z.broadcastLoco(addr)
+	case len(x) == 5 && x[0] == 0xe4 && x[1] == 0xf8:
+		addr := locoAddr(x[2], x[3])
+		l := z.loco(addr)
+		n := x[4] & 0x3f
+		if n >= 32 {
+			return nil
+		}
+		bit := uint32(1) << n
+		switch x[4] >> 6 {
+		case 0:
+			l.Functions &^= bit
+		case 1:
+			l.Functions |= bit
+		case 2:
+			l.Functions ^= bit
+		}
+		c.locos[addr] = true
+		z.broadcastLoco(addr)
+	case len(x) == 3 && x[0] == 0x43:
+		addr := uint16(x[1])<<8 | uint16(x[2])
+		return xDataset(0x43, x[1], x[2], z.turnouts[addr])
+	case len(x) == 4 && x[0] == 0x53:
+		addr := uint16(x[1])<<8 | uint16(x[2])
+		if x[3]&0x08 != 0 {
+			z.turnouts[addr] = 1 + x[3]&0x01
+		}
+		z.broadcast(flagDrivingSwitching, xDataset(0x43, x[1], x[2], z.turnouts[addr]))
+	case len(x) == 4 && x[0] == 0x44:
+		addr := uint16(x[1])<<8 | uint16(x[2])
+		return xDataset(0x44, x[1], x[2], z.accessories[addr], 0x00)
+	case len(x) == 5 && x[0] == 0x54:
+		addr := uint16(x[1])<<8 | uint16(x[2])
+		z.accessories[addr] = x[3]
+		z.broadcast(flagDrivingSwitching, xDataset(0x44, x[1], x[2], x[3], 0x00))
+	case len(x) == 3 && match(x, 0x22, 0x11):
+		cv, ok := registerCVs[x[2]]
+		if !ok {
+			return xDataset(0x61, 0x13)
+		}
+		return cvResultDataset(cv-1, z.cvs[cv])
+	case len(x) == 4 && match(x, 0x23, 0x12):
+		cv, ok := registerCVs[x[2]]
+		if !ok {
+			return xDataset(0x61, 0x13)
+		}
+		z.cvs[cv] = x[3]
+		return cvResultDataset(cv-1, x[3])
+	case len(x) == 5 && match(x, 0x24, 0xff):
+		// Motorola decoders do not acknowledge, the write is not answered
+		z.mm[uint16(x[3])+1] = x[4]
+	case len(x) == 4 && match(x, 0x23, 0x11):
+		cv := uint16(x[2])<<8 | uint16(x[3])
+		return cvResultDataset(cv, z.cvs[cv+1])
+	case len(x) == 5 && match(x, 0x24, 0x12):
+		cv := uint16(x[2])<<8 | uint16(x[3])
+		z.cvs[cv+1] = x[4]
+		return cvResultDataset(cv, x[4])
+	case len(x) == 7 && match(x, 0xe6, 0x30):
+		addr := locoAddr(x[2], x[3])
+		cv := uint16(x[4]&0x03)<<8 | uint16(x[5])
+		if z.pom[addr] == nil {
+			z.pom[addr] = map[uint16]uint8{}
+		}
+		switch x[4] & 0xfc {
+		case 0xec:
+			z.pom[addr][cv+1] = x[6]
+		case 0xe4:
+			return cvResultDataset(cv, z.pom[addr][cv+1])
+		}
+	case len(x) == 7 && match(x, 0xe6, 0x31):
+		// only whole decoders are addressed, not their outputs
+		decoder := (uint16(x[2])<<8 | uint16(x[3])) >> 4
+		cv := uint16(x[4]&0x03)<<8 | uint16(x[5])
+		if z.accessoryCVs[decoder] == nil {
+			z.accessoryCVs[decoder] = map[uint16]uint8{}
+		}
+		switch x[4] & 0xfc {
+		case 0xec:
+			z.accessoryCVs[decoder][cv+1] = x[6]
+		case 0xe4:
+			return cvResultDataset(cv, z.accessoryCVs[decoder][cv+1])
+		}
+	default:
+		return xDataset(0x61, 0x82)
+	}
+	return nil
+}
+
+func (z *FakeZ21) setTrackPower(on bool) {
+	if on {
+		z.centralState &^= centralEmergencyStop | centralTrackVoltageOff | centralShortCircuit
+		z.broadcast(flagDrivingSwitching, xDataset(0x61, 0x01))
+	} else {
+		z.centralState |= centralTrackVoltageOff
+		z.broadcast(flagDrivingSwitching, xDataset(0x61, 0x00))
+	}
+}
+
+func (z *FakeZ21) loco(addr uint16) *FakeLoco {
+	l, ok := z.locos[addr]
+	if !ok {
+		l = &FakeLoco{Forward: true, SpeedSteps: 128}
+		z.locos[addr] = l
+	}
+	return l
+}
+
+// broadcastLoco sends the loco info to the clients that asked for the loco
+// or for all locos.
+func (z *FakeZ21) broadcastLoco(addr uint16) {
+	reply := z.locoInfoDataset(addr)
+	if z.offline {
+		return
+	}
+	for key, c := range z.clients {
+		if (c.flags&flagDrivingSwitching != 0 && c.locos[addr]) || c.flags&flagAllLocos != 0 {
+			z.sendTo(key, reply)
+		}
+	}
+}
+
+func (z *FakeZ21) broadcast(flag uint32, reply []byte) {
+	if z.offline {
+		return
+	}
+	for key, c := range z.clients {
+		if c.flags&flag != 0 {
+			z.sendTo(key, reply)
+		}
+	}
+}
+
+func (z *FakeZ21) sendTo(key string, reply []byte) {
+	addr, err := net.ResolveUDPAddr("udp", key)
+	if err != nil {
+		return
+	}
+	z.send(addr, reply)
+}
+
+func (z *FakeZ21) send(addr *net.UDPAddr, reply []byte) {
+	// a client gone away is the client's problem, like on the z21
+	_, _ = z.conn.WriteToUDP(reply, addr)
+}
+
+func (z *FakeZ21) systemStateDataset() []byte {
+	data := make([]byte, 16)
+	binary.LittleEndian.PutUint16(data[0:], fakeMainCurrent)
+	binary.LittleEndian.PutUint16(data[4:], fakeMainCurrent)
+	binary.LittleEndian.PutUint16(data[6:], fakeTemperature)
+	binary.LittleEndian.PutUint16(data[8:], fakeSupplyVoltage)
+	binary.LittleEndian.PutUint16(data[10:], fakeVCCVoltage)
+	data[12] = z.centralState
+	data[15] = fakeCapabilities
+	return dataset(lanSystemStateChanged, data)
+}
+
+func (z *FakeZ21) locoInfoDataset(addr uint16) []byte {
+	l := z.loco(addr)
+	msb, lsb := byte(addr>>8), byte(addr)
+	if addr >= 128 {
+		msb |= 0xc0
+	}
+	db2 := map[uint8]byte{14: 0, 28: 2, 128: 4}[l.SpeedSteps]
+	db3 := l.Speed & 0x7f
+	if l.Forward {
+		db3 |= 0x80
+	}
+	f := l.Functions
+	db4 := byte(f&0x01)<<4 | byte(f>>1)&0x0f
+	return xDataset(0xef, msb, lsb, db2, db3, db4, byte(f>>5), byte(f>>13), byte(f>>21))
+}
+
+func (z *FakeZ21) rmBusDataset(group uint8) []byte {
+	return dataset(lanRMBusDataChanged, append([]byte{group}, z.rmBus[group][:]...))
+}
+
+// canDetectorDatasets reports the ports of networkID, or of all detectors,
+// in one packet.
+func (z *FakeZ21) canDetectorDatasets(networkID uint16) []byte {
+	var packet []byte
+	for d, occupied := range z.detectors {
+		if networkID == canDetectorAllNetworks || d.networkID == networkID {
+			packet = append(packet, canDetectorDataset(d, occupied)...)
+		}
+	}
+	return packet
+}
+
+// canDescriptionDataset answers LAN_CAN_DEVICE_GET_DESCRIPTION for the
+// detectors that reported occupancy, named after their NetID. Other NetIDs
+// are not answered.
+func (z *FakeZ21) canDescriptionDataset(networkID uint16) []byte {
+	for d := range z.detectors {
+		if d.networkID == networkID {
+			name := make([]byte, 16)
+			copy(name, "detector "+strconv.Itoa(int(networkID)))
+			return dataset(lanCANDeviceGetDesc, append(binary.LittleEndian.AppendUint16(nil, networkID), name...))
+		}
+	}
+	return nil
+}
+
+func canDetectorDataset(d canDetector, occupied bool) []byte {
+	// free without track voltage, as the gateway takes any other value
+	// for occupied, or occupied with track voltage
+	value := uint16(0x0000)
+	if occupied {
+		value = 0x1100
+	}
+	data := make([]byte, 10)
+	binary.LittleEndian.PutUint16(data[0:], d.networkID)
+	binary.LittleEndian.PutUint16(data[2:], fakeCANDetectorModuleID)
+	data[4] = d.port
+	data[5] = canDetectorOccupancy
+	binary.LittleEndian.PutUint16(data[6:], value)
+	return dataset(lanCANDetector, data)
+}
+
+// registerCVs maps the registers of register mode to the CVs of the
+// decoder; register 6, the page register, is not emulated.
+var registerCVs = map[byte]uint16{1: 1, 2: 2, 3: 3, 4: 4, 5: 29, 7: 7, 8: 8}
+
+func cvResultDataset(cv uint16, value uint8) []byte {
+	return xDataset(0x64, 0x14, byte(cv>>8), byte(cv), value)
+}
+
+func dataset(header uint16, data []byte) []byte {
+	b := make([]byte, 4, 4+len(data))
+	binary.LittleEndian.PutUint16(b, uint16(4+len(data)))
+	binary.LittleEndian.PutUint16(b[2:], header)
+	return append(b, data...)
+}
+
+// xDataset wraps an X-BUS message, appending its checksum.
+func xDataset(x ...byte) []byte {
+	return dataset(lanX, append(x, xor(x)))
+}
+
+func xor(b []byte) byte {
+	var x byte
+	for _, c := range b {
+		x ^= c
+	}
+	return x
+}
+
+func match(x []byte, prefix ...byte) bool {
+	if len(x) < len(prefix) {
+		return false
+	}
+	for i, b := range prefix {
+		if x[i] != b {
+			return false
+		}
+	}
+	return true
+}
+
+func locoAddr(msb, lsb byte) uint16 {
+	return uint16(msb&0x3f)<<8 | uint16(lsb)
+}
+
+func speedSteps(code byte) uint8 {
+	switch code {
+	case 0:
+		return 14
+	case 2:
+		return 28
+	}
+	return 128
+}
+
+func le32(v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, v)
+}
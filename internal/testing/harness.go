@@ -0,0 +1,153 @@
+// Package testing is an end-to-end test harness of the z21-gateway. It runs
+// an embedded NATS server, a fake z21 and a gateway bridging them in
+// process, so tests can exercise the subjects and payloads without a layout
+// or a NATS deployment.
+//
+//	h, err := testing.Start()
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer h.Close()
+//
+//	err = h.Client.DriveLoco(ctx, 3, 40, true)
+//	loco, _ := h.Z21.Loco(3)
+package testing
+
+import (
+	"context"
+	"os"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+
+	"github.com/trains-io/z21-gateway/pkg/client"
+	"github.com/trains-io/z21-gateway/pkg/gateway"
+)
+
+// DeviceName is the name of the fake z21, the subjects start with
+// z21.test.
+const DeviceName = "test"
+
+// Harness is a running gateway between an embedded NATS server and a fake
+// z21.
+type Harness struct {
+	NATS    *server.Server
+	NC      *nats.Conn
+	Z21     *FakeZ21
+	Gateway *gateway.Gateway
+	// Client is a client of the gateway on NC.
+	Client *client.Client
+
+	cancel   context.CancelFunc
+	storeDir string
+}
+
+type options struct {
+	args      []string
+	jetstream bool
+	logger    zerolog.Logger
+}
+
+type Option func(*options)
+
+// WithArgs passes command line options to the gateway, e.g.
+// "--legacy_subjects".
+func WithArgs(args ...string) Option {
+	return func(o *options) { o.args = append(o.args, args...) }
+}
+
+// WithJetStream enables JetStream on the NATS server, in a temporary
+// directory removed by Close.
+func WithJetStream() Option {
+	return func(o *options) { o.jetstream = true }
+}
+
+// WithLogger sets the gateway logger, which discards everything by default.
+func WithLogger(logger zerolog.Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// Start starts the NATS server, the fake z21 and the gateway. The
+// environment variables of the gateway apply, the options take precedence.
+func Start(opts ...Option) (*Harness, error) {
+	o := options{logger: zerolog.Nop()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	h := &Harness{}
+	ok := false
+	defer func() {
+		if !ok {
+			h.Close()
+		}
+	}()
+
+	var err error
+	if o.jetstream {
+		if h.storeDir, err = os.MkdirTemp("", "z21-gateway-test-"); err != nil {
+			return nil, err
+		}
+	}
+	if h.NATS, err = StartNATS(h.storeDir); err != nil {
+		return nil, err
+	}
+	if h.NC, err = nats.Connect(h.NATS.ClientURL()); err != nil {
+		return nil, err
+	}
+	if h.Z21, err = NewFakeZ21(); err != nil {
+		return nil, err
+	}
+
+	args := append([]string{
+		"--z21_name", DeviceName,
+		"--z21_addr", h.Z21.Addr(),
+		"--nats_url", h.NATS.ClientURL(),
+	}, o.args...)
+	cfg, err := gateway.ParseConfig(args)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Logger = o.logger
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	gw, err := gateway.New(ctx, h.NC, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := gw.Start(); err != nil {
+		gw.Shutdown(gateway.ShutdownError, err.Error())
+		gw.Stop()
+		return nil, err
+	}
+	h.Gateway = gw
+	h.Client = client.New(h.NC, DeviceName)
+	ok = true
+	return h, nil
+}
+
+// Close stops the gateway, the fake z21 and the NATS server.
+func (h *Harness) Close() {
+	if h.Gateway != nil {
+		h.Gateway.Shutdown(gateway.ShutdownAdmin, "harness closed")
+		h.Gateway.Stop()
+	}
+	if h.cancel != nil {
+		h.cancel()
+	}
+	if h.Z21 != nil {
+		h.Z21.Close()
+	}
+	if h.NC != nil {
+		h.NC.Close()
+	}
+	if h.NATS != nil {
+		h.NATS.Shutdown()
+		h.NATS.WaitForShutdown()
+	}
+	if h.storeDir != "" {
+		os.RemoveAll(h.storeDir)
+	}
+}
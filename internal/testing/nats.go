@@ -0,0 +1,35 @@
+package testing
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// NATSReadyTimeout bounds the startup of the embedded NATS server.
+const NATSReadyTimeout = 5 * time.Second
+
+// StartNATS starts an in-process NATS server on a random local port. With a
+// storeDir it also enables JetStream, keeping its streams, KV and Object
+// Store buckets there.
+func StartNATS(storeDir string) (*server.Server, error) {
+	opts := &server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: storeDir != "",
+		StoreDir:  storeDir,
+	}
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		return nil, err
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(NATSReadyTimeout) {
+		ns.Shutdown()
+		return nil, fmt.Errorf("NATS server not ready after %s", NATSReadyTimeout)
+	}
+	return ns, nil
+}
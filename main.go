@@ -8,7 +8,7 @@ import (
 	"runtime/debug"
 	"syscall"
 
-	"github.com/nats-io/nats.go"
+	"github.com/trains-io/z21-gateway/pkg/gateway"
 )
 
 var (
@@ -32,11 +32,40 @@ func readDepencyVersion(modulePath string) string {
 }
 
 func main() {
-	if len(os.Args) > 1 && os.Args[1] == "version" {
-		fmt.Printf("%s version: %s %s %s\n", os.Args[0], version, commit, date)
-		os.Exit(0)
+	gateway.Version = version
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "version":
+			fmt.Printf("%s version: %s %s %s\n", os.Args[0], version, commit, date)
+			os.Exit(0)
+		case "watchdog":
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+			gateway.RunWatchdog()
+			return
+		case "validate-layout":
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+			gateway.RunValidateLayout()
+			return
+		case "synthetic":
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+			gateway.RunSynthetic()
+			return
+		case "replay":
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+			gateway.RunReplay()
+			return
+		case "bench":
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+			gateway.RunBench()
+			return
+		case "conformance":
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+			gateway.RunConformance()
+			return
+		}
 	}
-	cfg := LoadConfig()
+	cfg := gateway.LoadConfig()
 
 	cfg.Logger.Info().Msg("starting Z21 Gateway")
 	cfg.Logger.Info().
@@ -45,39 +74,22 @@ func main() {
 		Str("build", date).
 		Str("context", cfg.Z21Name).
 		Str("z21", cfg.Z21Addr).
-		Str("nats", cfg.NATSURL).
+		Str("nats", gateway.RedactURLs(cfg.NATSURL)).
 		Str("z21.go", readDepencyVersion("github.com/trains-io/z21.go")).
 		Msg("config")
 
-	opts := []nats.Option{
-		nats.Name("z21gw"),
-		nats.DisconnectErrHandler(func(c *nats.Conn, err error) {
-			cfg.Logger.Warn().
-				Err(err).
-				Str("status", "disconnected").
-				Msg("NATS conn")
-		}),
-		nats.ReconnectHandler(func(c *nats.Conn) {
-			cfg.Logger.Info().
-				Str("status", "reconnected").
-				Msg("NATS conn")
-		}),
-	}
-	nc, err := nats.Connect(cfg.NATSURL, opts...)
-	if err != nil {
-		cfg.Logger.Fatal().
-			Err(err).
-			Msg("NATS conn")
-	}
+	nc := gateway.ConnectNATS(cfg, "z21gw")
 	defer nc.Drain()
-	cfg.Logger.Info().
-		Str("url", cfg.NATSURL).
-		Msg("NATS conn")
+	for _, hook := range cfg.LogHooks {
+		hook.Attach(nc)
+	}
 
-	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	gw, err := NewGateway(ctx, nc, cfg.Z21Name, cfg.Z21Addr, cfg.Logger)
+	gw, err := gateway.New(ctx, nc, cfg)
 	if err != nil {
 		cfg.Logger.Fatal().
 			Err(err).
@@ -88,11 +100,26 @@ func main() {
 		Str("context", cfg.Z21Name).
 		Msg("Z21 conn")
 
-	gw.Start()
+	if err := gw.Start(); err != nil {
+		gw.Shutdown(gateway.ShutdownError, err.Error())
+		gw.Stop()
+		cfg.Logger.Fatal().
+			Err(err).
+			Msg("Z21 Gateway start")
+	}
 	cfg.Logger.Info().Msg("Z21 Gateway started")
 
-	<-ctx.Done()
+	select {
+	case sig := <-sigs:
+		gw.Shutdown(gateway.ShutdownSignal, sig.String())
+	case <-gw.Done():
+	}
 	gw.Stop()
 
+	if gw.StopReason() == gateway.ShutdownGuardrail {
+		nc.Drain()
+		cfg.Logger.Error().Msg("Z21 Gateway stopped by a guardrail")
+		os.Exit(gateway.GuardrailExitCode)
+	}
 	cfg.Logger.Info().Msg("Z21 Gateway stopped cleanly")
 }
@@ -0,0 +1,169 @@
+// Package client is a Go client of the z21-gateway. It wraps the NATS
+// subjects and payloads of one gateway, so consumers need not build subject
+// strings and decode schema envelopes themselves.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	// DefaultTimeout is the command timeout unless the context has an
+	// earlier deadline.
+	DefaultTimeout = 5 * time.Second
+
+	RequestIDHeader     = "Request-Id"
+	ClientIDHeader      = "Client-Id"
+	SchemaVersionHeader = "Z21-Schema-Version"
+	SeqHeader           = "Z21-Seq"
+	TimestampHeader     = "Z21-Timestamp"
+)
+
+// Client talks to the gateway of one z21 over a NATS connection.
+type Client struct {
+	nc       *nats.Conn
+	device   string
+	timeout  time.Duration
+	clientID string
+}
+
+type Option func(*Client)
+
+// WithTimeout sets the command timeout.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.timeout = d }
+}
+
+// WithClientID sends commands with the Client-Id header, which selects the
+// command profile of the client.
+func WithClientID(id string) Option {
+	return func(c *Client) { c.clientID = id }
+}
+
+// New returns a client of the gateway of the z21 named device, e.g. "main".
+func New(nc *nats.Conn, device string, opts ...Option) *Client {
+	c := &Client{nc: nc, device: device, timeout: DefaultTimeout}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Device returns the name of the z21.
+func (c *Client) Device() string {
+	return c.device
+}
+
+// Subject returns z21.<device>.<suffix>.
+func (c *Client) Subject(suffix string) string {
+	return "z21." + c.device + "." + suffix
+}
+
+// Reply is the reply of a command.
+type Reply struct {
+	Type      string          `json:"type"`
+	RequestID string          `json:"request_id"`
+	Device    string          `json:"device"`
+	Ok        bool            `json:"ok"`
+	Data      json.RawMessage `json:"reply,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	ErrorCode string          `json:"error_code,omitempty"`
+	DryRun    bool            `json:"dry_run,omitempty"`
+	TS        string          `json:"ts"`
+}
+
+// Decode decodes the data of the reply into v.
+func (r *Reply) Decode(v any) error {
+	if len(r.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Data, v)
+}
+
+// Error is returned for a command the gateway answered with ok false.
+type Error struct {
+	Command   string
+	RequestID string
+	// Code is the error_code of the reply, e.g. timeout or z21_offline.
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s (%s)", e.Command, e.Message, e.Code)
+}
+
+// Request sends a command with payload, which may be nil, and returns its
+// reply. A reply with ok false is returned as *Error along with the reply.
+func (c *Client) Request(ctx context.Context, command string, payload any) (*Reply, error) {
+	data := []byte("{}")
+	if payload != nil {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	msg := nats.NewMsg(c.Subject("cmd." + command))
+	msg.Header.Set(RequestIDHeader, nuid.Next())
+	if c.clientID != "" {
+		msg.Header.Set(ClientIDHeader, c.clientID)
+	}
+	msg.Data = data
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	resp, err := c.nc.RequestMsgWithContext(ctx, msg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", command, err)
+	}
+
+	reply := &Reply{}
+	if err := decodePayload(resp, reply); err != nil {
+		return nil, fmt.Errorf("%s: invalid reply: %w", command, err)
+	}
+	if !reply.Ok {
+		return reply, &Error{Command: command, RequestID: reply.RequestID, Code: reply.ErrorCode, Message: reply.Error}
+	}
+	return reply, nil
+}
+
+// envelope is the schema version 2 wrapper of every payload.
+type envelope struct {
+	SchemaVersion int             `json:"schema_version"`
+	Device        string          `json:"device"`
+	Kind          string          `json:"kind"`
+	Seq           uint64          `json:"seq,omitempty"`
+	TS            string          `json:"ts"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// payload returns the payload of a message in any schema version.
+func payload(msg *nats.Msg) (json.RawMessage, error) {
+	if v, err := strconv.Atoi(msg.Header.Get(SchemaVersionHeader)); err != nil || v < 2 {
+		return msg.Data, nil
+	}
+	var env envelope
+	if err := json.Unmarshal(msg.Data, &env); err != nil {
+		return nil, err
+	}
+	return env.Payload, nil
+}
+
+func decodePayload(msg *nats.Msg, v any) error {
+	data, err := payload(msg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,243 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// DriveRequest is the payload of loco.drive.
+type DriveRequest struct {
+	Address uint16 `json:"address,omitempty"`
+	// Name is resolved to the address through the loco names of the
+	// gateway.
+	Name string `json:"name,omitempty"`
+	// Speed in percent of full speed.
+	Speed   float64 `json:"speed"`
+	Forward bool    `json:"forward"`
+}
+
+// PurgeRequest is the payload of loco.purge.
+type PurgeRequest struct {
+	Address uint16 `json:"address,omitempty"`
+	Name    string `json:"name,omitempty"`
+	// Forward is the direction the loco is stopped in.
+	Forward bool `json:"forward"`
+}
+
+// FunctionsRequest is the payload of loco.functions.
+type FunctionsRequest struct {
+	Address uint16 `json:"address,omitempty"`
+	Name    string `json:"name,omitempty"`
+	// Functions holds the state of Fn in bit n, set for the functions
+	// selected by Mask, F0 to F12 if 0.
+	Functions uint32 `json:"functions"`
+	Mask      uint32 `json:"mask,omitempty"`
+}
+
+// POMReadRequest is the payload of cv.pom.read.
+type POMReadRequest struct {
+	Address uint16 `json:"address,omitempty"`
+	Name    string `json:"name,omitempty"`
+	CV      uint16 `json:"cv"`
+}
+
+// TurnoutRequest is the payload of turnout.set.
+type TurnoutRequest struct {
+	Address uint16 `json:"address,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Output  uint8  `json:"output"`
+}
+
+// TurnoutModeRequest is the payload of turnout.mode.get and
+// turnout.mode.set.
+type TurnoutModeRequest struct {
+	Address uint16 `json:"address,omitempty"`
+	Name    string `json:"name,omitempty"`
+	// Mode is dcc or mm, set only for turnout.mode.set.
+	Mode string `json:"mode,omitempty"`
+}
+
+// AccessoryCVRequest is the payload of accessory.cv.read and
+// accessory.cv.write.
+type AccessoryCVRequest struct {
+	Address uint16 `json:"address,omitempty"`
+	Name    string `json:"name,omitempty"`
+	CV      uint16 `json:"cv"`
+	// Value is set only for accessory.cv.write.
+	Value *uint8 `json:"value,omitempty"`
+}
+
+// SignalRequest is the payload of signal.set.
+type SignalRequest struct {
+	Name   string `json:"name"`
+	Aspect string `json:"aspect"`
+}
+
+// RouteRequest is the payload of route.set.
+type RouteRequest struct {
+	Route string `json:"route"`
+}
+
+// CachedState is an entry of the state cache returned by State.
+type CachedState struct {
+	Subject string          `json:"subject"`
+	Event   json.RawMessage `json:"event"`
+	TS      string          `json:"ts"`
+	Stale   bool            `json:"stale"`
+}
+
+// SeenLoco is a loco returned by SeenLocos.
+type SeenLoco struct {
+	Address   uint16 `json:"address"`
+	Name      string `json:"name,omitempty"`
+	FirstSeen string `json:"first_seen"`
+	LastSeen  string `json:"last_seen"`
+	Source    string `json:"source"`
+	Detector  string `json:"detector,omitempty"`
+}
+
+// CANDevice is a CAN bus device returned by CANDevices.
+type CANDevice struct {
+	NetID    uint16 `json:"net_id"`
+	Kind     string `json:"kind,omitempty"`
+	Name     string `json:"name,omitempty"`
+	LastSeen string `json:"last_seen,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// DriveLoco drives the loco at address with speed in percent.
+func (c *Client) DriveLoco(ctx context.Context, address uint16, speed float64, forward bool) error {
+	_, err := c.Request(ctx, "loco.drive", DriveRequest{Address: address, Speed: speed, Forward: forward})
+	return err
+}
+
+// DriveLocoByName drives the loco of a configured name.
+func (c *Client) DriveLocoByName(ctx context.Context, name string, speed float64, forward bool) error {
+	_, err := c.Request(ctx, "loco.drive", DriveRequest{Name: name, Speed: speed, Forward: forward})
+	return err
+}
+
+// PurgeLoco stops the loco at address and removes it from the locos the
+// z21 keeps refreshing, releasing it for good.
+func (c *Client) PurgeLoco(ctx context.Context, address uint16, forward bool) error {
+	_, err := c.Request(ctx, "loco.purge", PurgeRequest{Address: address, Forward: forward})
+	return err
+}
+
+// SetFunctions sets the functions of the loco at address selected by mask
+// to their bits in functions, all together.
+func (c *Client) SetFunctions(ctx context.Context, address uint16, functions, mask uint32) error {
+	_, err := c.Request(ctx, "loco.functions", FunctionsRequest{Address: address, Functions: functions, Mask: mask})
+	return err
+}
+
+// ReadPOMCV reads CV cv of the loco at address on the main track. It needs
+// RailCom on the z21 and the decoder.
+func (c *Client) ReadPOMCV(ctx context.Context, address, cv uint16) (uint8, error) {
+	reply, err := c.Request(ctx, "cv.pom.read", POMReadRequest{Address: address, CV: cv})
+	if err != nil {
+		return 0, err
+	}
+	var res struct {
+		Value uint8 `json:"value"`
+	}
+	return res.Value, reply.Decode(&res)
+}
+
+// SetTurnout switches the turnout at address to output 0 or 1.
+func (c *Client) SetTurnout(ctx context.Context, address uint16, output uint8) error {
+	_, err := c.Request(ctx, "turnout.set", TurnoutRequest{Address: address, Output: output})
+	return err
+}
+
+// TurnoutMode returns whether the turnout at address is addressed by dcc
+// or mm.
+func (c *Client) TurnoutMode(ctx context.Context, address uint16) (string, error) {
+	reply, err := c.Request(ctx, "turnout.mode.get", TurnoutModeRequest{Address: address})
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		Mode string `json:"mode"`
+	}
+	return res.Mode, reply.Decode(&res)
+}
+
+// SetTurnoutMode switches the turnout at address to dcc or mm addressing.
+func (c *Client) SetTurnoutMode(ctx context.Context, address uint16, mode string) error {
+	_, err := c.Request(ctx, "turnout.mode.set", TurnoutModeRequest{Address: address, Mode: mode})
+	return err
+}
+
+// ReadAccessoryCV reads CV cv of the accessory decoder of the turnout at
+// address on the main track. It needs RailCom on the z21 and the decoder.
+func (c *Client) ReadAccessoryCV(ctx context.Context, address, cv uint16) (uint8, error) {
+	reply, err := c.Request(ctx, "accessory.cv.read", AccessoryCVRequest{Address: address, CV: cv})
+	if err != nil {
+		return 0, err
+	}
+	var res struct {
+		Value uint8 `json:"value"`
+	}
+	return res.Value, reply.Decode(&res)
+}
+
+// WriteAccessoryCV writes CV cv of the accessory decoder of the turnout at
+// address on the main track. The write is not verified.
+func (c *Client) WriteAccessoryCV(ctx context.Context, address, cv uint16, value uint8) error {
+	_, err := c.Request(ctx, "accessory.cv.write", AccessoryCVRequest{Address: address, CV: cv, Value: &value})
+	return err
+}
+
+// SetSignal sets a configured signal to one of its aspects.
+func (c *Client) SetSignal(ctx context.Context, name, aspect string) error {
+	_, err := c.Request(ctx, "signal.set", SignalRequest{Name: name, Aspect: aspect})
+	return err
+}
+
+// PowerOff switches the track power off.
+func (c *Client) PowerOff(ctx context.Context) error {
+	_, err := c.Request(ctx, "power.off", nil)
+	return err
+}
+
+// State returns the cached last events whose subject, after
+// z21.<device>.event., starts with prefix, e.g. "can.".
+func (c *Client) State(ctx context.Context, prefix string) ([]CachedState, error) {
+	reply, err := c.Request(ctx, "state.get", map[string]string{"prefix": prefix})
+	if err != nil {
+		return nil, err
+	}
+	var states []CachedState
+	return states, reply.Decode(&states)
+}
+
+// SeenLocos returns the locos seen on the track within the given duration,
+// e.g. "10m", or all of them if within is empty.
+func (c *Client) SeenLocos(ctx context.Context, within string) ([]SeenLoco, error) {
+	var payload any
+	if within != "" {
+		payload = map[string]string{"within": within}
+	}
+	reply, err := c.Request(ctx, "loco.seen", payload)
+	if err != nil {
+		return nil, err
+	}
+	var locos []SeenLoco
+	return locos, reply.Decode(&locos)
+}
+
+// CANDevices returns the CAN bus devices seen by the gateway and those
+// given by netIDs, with the names stored in them.
+func (c *Client) CANDevices(ctx context.Context, netIDs ...uint16) ([]CANDevice, error) {
+	var payload any
+	if len(netIDs) > 0 {
+		payload = map[string][]uint16{"net_ids": netIDs}
+	}
+	reply, err := c.Request(ctx, "can.devices", payload)
+	if err != nil {
+		return nil, err
+	}
+	var devices []CANDevice
+	return devices, reply.Decode(&devices)
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Event is an event published by the gateway on
+// z21.<device>.event.<kind>[.<source>...].
+type Event struct {
+	Subject string
+	// Kind is the event kind, e.g. can, rbus or loco.
+	Kind string
+	// Source holds the subject tokens identifying the event source, e.g.
+	// the network ID and port of a CAN detector.
+	Source  []string
+	Seq     uint64
+	TS      time.Time
+	Payload json.RawMessage
+}
+
+// Decode decodes the payload of the event into v.
+func (e *Event) Decode(v any) error {
+	return json.Unmarshal(e.Payload, v)
+}
+
+// Status is the z21 status published on z21.<device>.status.
+type Status struct {
+	Reachable     bool   `json:"reachable"`
+	Serial        string `json:"serial,omitempty"`
+	HardwareType  string `json:"hardware_type,omitempty"`
+	Model         string `json:"model,omitempty"`
+	Firmware      string `json:"firmware,omitempty"`
+	Uptime        string `json:"uptime,omitempty"`
+	TrackPower    string `json:"track_power,omitempty"`
+	LastBroadcast string `json:"last_broadcast,omitempty"`
+	TS            string `json:"ts"`
+}
+
+// SubscribeEvents calls handler for every event matching pattern, the
+// subject after z21.<device>.event., e.g. "can.>", "loco.3" or
+// "systemstate". Malformed messages are skipped.
+func (c *Client) SubscribeEvents(pattern string, handler func(Event)) (*nats.Subscription, error) {
+	subject := c.Subject("event." + pattern)
+	prefix := c.Subject("event.")
+	return c.nc.Subscribe(subject, func(msg *nats.Msg) {
+		data, err := payload(msg)
+		if err != nil {
+			return
+		}
+		tokens := strings.Split(strings.TrimPrefix(msg.Subject, prefix), ".")
+		ev := Event{
+			Subject: msg.Subject,
+			Kind:    tokens[0],
+			Source:  tokens[1:],
+			Payload: data,
+		}
+		ev.Seq, _ = strconv.ParseUint(msg.Header.Get(SeqHeader), 10, 64)
+		ev.TS, _ = time.Parse(time.RFC3339Nano, msg.Header.Get(TimestampHeader))
+		handler(ev)
+	})
+}
+
+// SubscribeOccupancy calls handler for every occupancy event of the CAN
+// detectors and the R-Bus feedback modules.
+func (c *Client) SubscribeOccupancy(handler func(Event)) ([]*nats.Subscription, error) {
+	var subs []*nats.Subscription
+	for _, pattern := range []string{"can.>", "rbus.>"} {
+		sub, err := c.SubscribeEvents(pattern, handler)
+		if err != nil {
+			for _, s := range subs {
+				s.Unsubscribe()
+			}
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+// SubscribeStatus calls handler for every z21 status.
+func (c *Client) SubscribeStatus(handler func(Status)) (*nats.Subscription, error) {
+	return c.nc.Subscribe(c.Subject("status"), func(msg *nats.Msg) {
+		var status struct {
+			Status
+			// schema version 1 publishes the serial under a malformed key
+			LegacySerial string `json:"serial:omitempty"`
+		}
+		if err := decodePayload(msg, &status); err != nil {
+			return
+		}
+		if status.Serial == "" {
+			status.Serial = status.LegacySerial
+		}
+		handler(status.Status)
+	})
+}
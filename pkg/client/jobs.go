@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Job states.
+const (
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+)
+
+// Job is the status of a long-running command like prog.backup.
+type Job struct {
+	ID         string          `json:"id"`
+	Kind       string          `json:"kind"`
+	State      string          `json:"state"`
+	Progress   float64         `json:"progress"`
+	Message    string          `json:"message,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	ErrorCode  string          `json:"error_code,omitempty"`
+	StartedAt  string          `json:"started_at"`
+	FinishedAt string          `json:"finished_at,omitempty"`
+}
+
+// Finished reports whether the job is done, failed or canceled.
+func (j *Job) Finished() bool {
+	return j.State != JobRunning
+}
+
+// CVBackup is the result of a ReadCVs job.
+type CVBackup struct {
+	CVs    map[uint16]uint8 `json:"cvs"`
+	Failed []uint16         `json:"failed,omitempty"`
+}
+
+// CVRestore is the result of a WriteCVs job.
+type CVRestore struct {
+	Written []uint16 `json:"written"`
+	Skipped []uint16 `json:"skipped,omitempty"`
+	Failed  []uint16 `json:"failed,omitempty"`
+}
+
+// Job returns the status of job id.
+func (c *Client) Job(ctx context.Context, id string) (*Job, error) {
+	return c.requestJob(ctx, "job.get", map[string]string{"id": id})
+}
+
+// WaitJob waits until job id finishes and returns its final status.
+func (c *Client) WaitJob(ctx context.Context, id string) (*Job, error) {
+	done := make(chan *Job, 1)
+	sub, err := c.nc.Subscribe(c.Subject(fmt.Sprintf("job.%s.done", id)), func(msg *nats.Msg) {
+		var j Job
+		if err := decodePayload(msg, &j); err == nil {
+			select {
+			case done <- &j:
+			default:
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	// the job may have finished before the subscription
+	j, err := c.Job(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if j.Finished() {
+		return j, nil
+	}
+	select {
+	case j := <-done:
+		return j, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ReadCVs starts a job reading the CVs of the decoder on the programming
+// track, cvs being a CV range like "1-8,29". The result of the finished job
+// is a CVBackup.
+func (c *Client) ReadCVs(ctx context.Context, cvs string) (*Job, error) {
+	return c.requestJob(ctx, "prog.backup", map[string]string{"cvs": cvs})
+}
+
+// WriteCVs starts a job writing cvs to the decoder on the programming track.
+// The result of the finished job is a CVRestore.
+func (c *Client) WriteCVs(ctx context.Context, cvs map[uint16]uint8) (*Job, error) {
+	values := make(map[string]uint8, len(cvs))
+	for cv, v := range cvs {
+		values[strconv.Itoa(int(cv))] = v
+	}
+	return c.requestJob(ctx, "prog.restore", map[string]any{"cvs": values})
+}
+
+// ReadRegister starts a job reading register reg (1-8) of the decoder on the
+// programming track in register mode, for decoders without direct CV mode.
+func (c *Client) ReadRegister(ctx context.Context, reg uint16) (*Job, error) {
+	return c.requestJob(ctx, "prog.register.read", map[string]uint16{"register": reg})
+}
+
+// WriteRegister starts a job writing register reg (1-8) of the decoder on
+// the programming track in register mode.
+func (c *Client) WriteRegister(ctx context.Context, reg uint16, value uint8) (*Job, error) {
+	return c.requestJob(ctx, "prog.register.write", map[string]any{"register": reg, "value": value})
+}
+
+// WriteMMRegister starts a job writing register reg (1-256) of the Motorola
+// decoder on the programming track.
+func (c *Client) WriteMMRegister(ctx context.Context, reg uint16, value uint8) (*Job, error) {
+	return c.requestJob(ctx, "prog.mm.write", map[string]any{"register": reg, "value": value})
+}
+
+// SetRoute starts a job setting a configured route, whose steps may be on
+// the z21s of other gateways. The result of the finished job lists the
+// reply to every step.
+func (c *Client) SetRoute(ctx context.Context, route string) (*Job, error) {
+	return c.requestJob(ctx, "route.set", RouteRequest{Route: route})
+}
+
+func (c *Client) requestJob(ctx context.Context, command string, payload any) (*Job, error) {
+	reply, err := c.Request(ctx, command, payload)
+	if err != nil {
+		return nil, err
+	}
+	var j Job
+	return &j, reply.Decode(&j)
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	RegistrySubject         = "z21.registry"
+	RegistryDiscoverSubject = RegistrySubject + ".discover"
+
+	// DefaultDiscoverWait is how long Discover collects answers unless the
+	// context has an earlier deadline.
+	DefaultDiscoverWait = time.Second
+)
+
+// GatewayInfo is the registry entry a gateway announces on z21.registry.
+type GatewayInfo struct {
+	Name    string `json:"name"`
+	ID      string `json:"id"`
+	Version string `json:"version"`
+	// State is online, or stopped when the gateway left.
+	State          string `json:"state"`
+	Subjects       string `json:"subjects"`
+	SchemaVersions []int  `json:"schema_versions"`
+	Z21Online      bool   `json:"z21_online"`
+	// Capabilities is the reply of capabilities.get.
+	Capabilities json.RawMessage `json:"capabilities"`
+	StartedAt    string          `json:"started_at"`
+	Interval     string          `json:"interval"`
+	TS           string          `json:"ts"`
+}
+
+// Client returns a client of the gateway.
+func (i *GatewayInfo) Client(nc *nats.Conn, opts ...Option) *Client {
+	return New(nc, i.Name, opts...)
+}
+
+// Discover asks all gateways on the bus for their registry entry and
+// returns the answers in the order they arrived until the context is done,
+// or for DefaultDiscoverWait if it has no deadline.
+func Discover(ctx context.Context, nc *nats.Conn) ([]GatewayInfo, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultDiscoverWait)
+		defer cancel()
+	}
+	inbox := nc.NewRespInbox()
+	msgs := make(chan *nats.Msg, 64)
+	sub, err := nc.ChanSubscribe(inbox, msgs)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+	if err := nc.PublishRequest(RegistryDiscoverSubject, inbox, nil); err != nil {
+		return nil, err
+	}
+
+	var gateways []GatewayInfo
+	for {
+		select {
+		case <-ctx.Done():
+			return gateways, nil
+		case msg := <-msgs:
+			var info GatewayInfo
+			if err := json.Unmarshal(msg.Data, &info); err != nil {
+				continue
+			}
+			gateways = append(gateways, info)
+		}
+	}
+}
+
+// SubscribeRegistry calls handler for every registry entry announced,
+// periodically by each gateway and once more when it stops.
+func SubscribeRegistry(nc *nats.Conn, handler func(GatewayInfo)) (*nats.Subscription, error) {
+	return nc.Subscribe(RegistrySubject, func(msg *nats.Msg) {
+		var info GatewayInfo
+		if err := json.Unmarshal(msg.Data, &info); err != nil {
+			return
+		}
+		handler(info)
+	})
+}
@@ -0,0 +1,142 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// AccessoryCVRequest is the payload of accessory.cv.read. The decoder is
+// the one driving the turnout Address.
+type AccessoryCVRequest struct {
+	Address uint16 `json:"address"`
+	// Name is resolved to Address through the configured turnout names.
+	Name string `json:"name,omitempty"`
+	CV   uint16 `json:"cv" payload:"required"`
+}
+
+// AccessoryCVWriteRequest is the payload of accessory.cv.write.
+type AccessoryCVWriteRequest struct {
+	AccessoryCVRequest
+	Value uint8 `json:"value" payload:"required"`
+}
+
+// AccessoryCVResult is the reply to accessory.cv.read and
+// accessory.cv.write.
+type AccessoryCVResult struct {
+	Address uint16 `json:"address"`
+	// Decoder is the DCC accessory decoder address, four turnouts each.
+	Decoder uint16 `json:"decoder"`
+	CV      uint16 `json:"cv"`
+	Value   uint8  `json:"value"`
+}
+
+// accessoryPOMFrame returns LAN_X_CV_POM_ACCESSORY_WRITE_BYTE or, with
+// write unset, LAN_X_CV_POM_ACCESSORY_READ_BYTE for CV cv of an accessory
+// decoder. The decoder address is followed by CDDD 0000, which addresses
+// the whole decoder rather than one of its outputs.
+func accessoryPOMFrame(decoder, cv uint16, value uint8, write bool) []byte {
+	option := byte(0xe4)
+	if write {
+		option = 0xec
+	}
+	addr := decoder << 4
+	cv--
+	return xFrame(0xe6, 0x31, byte(addr>>8), byte(addr), option|byte(cv>>8)&0x03, byte(cv), value)
+}
+
+// accessoryCV validates an accessory CV request and returns the result
+// with the decoder of the turnout.
+func (g *Gateway) accessoryCV(req *AccessoryCVRequest) (*AccessoryCVResult, error) {
+	addr, err := g.names.resolveTurnout(req.Name, req.Address)
+	if err != nil {
+		return nil, err
+	}
+	req.Address = addr
+	if err := g.validateAccessory(req.Address); err != nil {
+		return nil, err
+	}
+	if req.CV == 0 || req.CV > MaxCV {
+		return nil, fmt.Errorf("cv must be between 1 and %d", MaxCV)
+	}
+	// the z21 numbers turnouts from 0, four to a decoder
+	decoder := uint16(int(req.Address)+g.accessoryOffset-1) / 4
+	return &AccessoryCVResult{Address: req.Address, Decoder: decoder, CV: req.CV}, nil
+}
+
+func (g *Gateway) handleAccessoryCVRead(cr *cmdRequest, req *AccessoryCVRequest) CmdReply {
+	res, err := g.accessoryCV(req)
+	if err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	if !g.hasFeature("railcom") || !g.hasFeature("pom_read") {
+		return CmdReply{
+			Ok:        false,
+			Error:     fmt.Sprintf("%s requires RailCom, which the firmware of this z21 does not support", cr.name),
+			ErrorCode: ErrCodeUnsupportedByDevice,
+			TS:        time.Now().Format(time.RFC3339),
+		}
+	}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, Data: res, TS: time.Now().Format(time.RFC3339)}
+	}
+	if !g.isOnline.Load() {
+		return CmdReply{Ok: false, Error: "z21 is offline", ErrorCode: ErrCodeZ21Offline, TS: time.Now().Format(time.RFC3339)}
+	}
+
+	sent := time.Now()
+	res.Value, err = g.progFrameRequest(g.ctx, accessoryPOMFrame(res.Decoder, req.CV, 0, false), POMReadTimeout)
+	cr.timing.z21 += time.Since(sent)
+	if err != nil {
+		var ce *codedError
+		code := g.errorCode(err)
+		if errors.As(err, &ce) {
+			code = ce.code
+		}
+		msg := err.Error()
+		if code == ErrCodeTimeout || code == ErrCodeProgNack {
+			code = ErrCodeRailComRequired
+			msg = fmt.Sprintf("no RailCom answer from accessory decoder %d, %s requires a decoder with RailCom enabled", res.Decoder, cr.name)
+		}
+		cr.logger.Warn().
+			Err(err).
+			Uint16("decoder", res.Decoder).
+			Uint16("cv", req.CV).
+			Msg("accessory CV read failed")
+		return CmdReply{Ok: false, Error: msg, ErrorCode: code, TS: time.Now().Format(time.RFC3339)}
+	}
+	return CmdReply{Ok: true, Data: res, TS: time.Now().Format(time.RFC3339)}
+}
+
+// handleAccessoryCVWrite writes a CV of an accessory decoder on the main
+// track. The z21 does not answer POM writes, so the write is not verified.
+func (g *Gateway) handleAccessoryCVWrite(cr *cmdRequest, req *AccessoryCVWriteRequest) CmdReply {
+	res, err := g.accessoryCV(&req.AccessoryCVRequest)
+	if err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	res.Value = req.Value
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, Data: res, TS: time.Now().Format(time.RFC3339)}
+	}
+	if !g.isOnline.Load() {
+		return CmdReply{Ok: false, Error: "z21 is offline", ErrorCode: ErrCodeZ21Offline, TS: time.Now().Format(time.RFC3339)}
+	}
+
+	sent := time.Now()
+	err = g.sendZ21Frames(accessoryPOMFrame(res.Decoder, req.CV, res.Value, true))
+	cr.timing.z21 += time.Since(sent)
+	if err != nil {
+		cr.logger.Error().
+			Err(err).
+			Uint16("decoder", res.Decoder).
+			Msg("failed to write accessory CV")
+		return CmdReply{Ok: false, Error: err.Error(), ErrorCode: ErrCodeZ21Offline, TS: time.Now().Format(time.RFC3339)}
+	}
+	cr.logger.Info().
+		Uint16("decoder", res.Decoder).
+		Uint16("cv", req.CV).
+		Uint8("value", res.Value).
+		Msg("accessory CV written")
+	return CmdReply{Ok: true, Data: res, TS: time.Now().Format(time.RFC3339)}
+}
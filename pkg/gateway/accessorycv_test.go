@@ -0,0 +1,25 @@
+package gateway
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAccessoryPOMFrame(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		decoder uint16
+		cv      uint16
+		value   uint8
+		write   bool
+		want    []byte
+	}{
+		{"read CV 1 of decoder 1", 1, 1, 0, false, []byte{0x0c, 0x00, 0x40, 0x00, 0xe6, 0x31, 0x00, 0x10, 0xe4, 0x00, 0x00, 0x23}},
+		{"write CV 33 of decoder 12", 12, 33, 3, true, []byte{0x0c, 0x00, 0x40, 0x00, 0xe6, 0x31, 0x00, 0xc0, 0xec, 0x20, 0x03, 0xd8}},
+		{"write CV 1024 of decoder 511", 511, 1024, 0xaa, true, []byte{0x0c, 0x00, 0x40, 0x00, 0xe6, 0x31, 0x1f, 0xf0, 0xef, 0xff, 0xaa, 0x82}},
+	} {
+		if got := accessoryPOMFrame(tt.decoder, tt.cv, tt.value, tt.write); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: % x, want % x", tt.name, got, tt.want)
+		}
+	}
+}
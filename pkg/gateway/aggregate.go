@@ -0,0 +1,224 @@
+package gateway
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// LayoutStatusInterval is the interval the watchdog publishes the
+	// layout status at, besides whenever the state of a device changes.
+	LayoutStatusInterval = 5 * time.Second
+
+	// LayoutStatusSubject is where the watchdog publishes the status of
+	// all devices combined. The subject is below the registry, so it does
+	// not match the subjects of a gateway.
+	LayoutStatusSubject = RegistrySubject + ".layout"
+
+	LayoutReachable = "reachable"
+	LayoutDegraded  = "degraded"
+	LayoutOffline   = "offline"
+
+	// layoutCurrentMaxAge bounds the age of the system state a device
+	// contributes its current from; the Z21 sends it every second.
+	layoutCurrentMaxAge = 10 * time.Second
+)
+
+// LayoutStatus is the status of all devices on the bus, published on
+// LayoutStatusSubject for wall displays and other consumers that do not
+// care which device is which.
+type LayoutStatus struct {
+	// State is reachable if all z21s are reachable, offline if none is
+	// and degraded otherwise.
+	State     string `json:"state"`
+	Count     int    `json:"count"`
+	Reachable int    `json:"reachable"`
+	// MainCurrentMA is the main track current of the reachable z21s in
+	// mA, from their latest system state.
+	MainCurrentMA float64        `json:"main_current_ma"`
+	Devices       []LayoutDevice `json:"devices"`
+	TS            string         `json:"ts"`
+}
+
+// LayoutDevice is one device of a LayoutStatus.
+type LayoutDevice struct {
+	Name string `json:"name"`
+	// Gateway is the gateway state, online, or offline if the watchdog
+	// declared the gateway gone.
+	Gateway       string   `json:"gateway"`
+	Reachable     bool     `json:"reachable"`
+	TrackPower    string   `json:"track_power,omitempty"`
+	MainCurrentMA *float64 `json:"main_current_ma,omitempty"`
+}
+
+type layoutDevice struct {
+	gateway    string
+	reachable  bool
+	trackPower string
+	current    float64
+	currentAt  time.Time
+}
+
+// layoutTracker combines the status of the gateways followed by the
+// watchdog.
+type layoutTracker struct {
+	mu      sync.Mutex
+	devices map[string]*layoutDevice
+	// changed is set when a device changed state since the last publish.
+	changed bool
+}
+
+func newLayoutTracker() *layoutTracker {
+	return &layoutTracker{devices: make(map[string]*layoutDevice)}
+}
+
+// device returns the device of a gateway, adding it. The caller holds mu.
+func (l *layoutTracker) device(name string) *layoutDevice {
+	d, ok := l.devices[name]
+	if !ok {
+		d = &layoutDevice{gateway: GatewayOnline}
+		l.devices[name] = d
+		l.changed = true
+	}
+	return d
+}
+
+// setGateway records the gateway state of a device; stopped gateways
+// leave the layout.
+func (l *layoutTracker) setGateway(name, state string, z21Online bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if state == GatewayStopped {
+		if _, ok := l.devices[name]; ok {
+			delete(l.devices, name)
+			l.changed = true
+		}
+		return
+	}
+	d := l.device(name)
+	if state == GatewayOffline {
+		z21Online = false
+	}
+	if d.gateway != state || d.reachable != z21Online {
+		l.changed = true
+	}
+	d.gateway, d.reachable = state, z21Online
+}
+
+func (l *layoutTracker) setStatus(name string, status *StatusMsg) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d := l.device(name)
+	if d.reachable != status.Reachable || d.trackPower != status.TrackPower {
+		l.changed = true
+	}
+	d.gateway = GatewayOnline
+	d.reachable, d.trackPower = status.Reachable, status.TrackPower
+}
+
+func (l *layoutTracker) setCurrent(name string, current float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d := l.device(name)
+	d.current, d.currentAt = current, time.Now()
+}
+
+// status returns the layout status and whether a device changed state
+// since the last call.
+func (l *layoutTracker) status() (*LayoutStatus, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	changed := l.changed
+	l.changed = false
+
+	s := &LayoutStatus{
+		State:   LayoutOffline,
+		Devices: []LayoutDevice{},
+		TS:      time.Now().UTC().Format(time.RFC3339),
+	}
+	for name, d := range l.devices {
+		ld := LayoutDevice{Name: name, Gateway: d.gateway, Reachable: d.reachable}
+		if d.reachable {
+			s.Reachable++
+			ld.TrackPower = d.trackPower
+			if time.Since(d.currentAt) < layoutCurrentMaxAge {
+				current := d.current
+				ld.MainCurrentMA = &current
+				s.MainCurrentMA += current
+			}
+		}
+		s.Devices = append(s.Devices, ld)
+	}
+	slices.SortFunc(s.Devices, func(a, b LayoutDevice) int { return strings.Compare(a.Name, b.Name) })
+	s.Count = len(s.Devices)
+	switch {
+	case s.Reachable == 0:
+	case s.Reachable == s.Count:
+		s.State = LayoutReachable
+	default:
+		s.State = LayoutDegraded
+	}
+	return s, changed
+}
+
+// handleZ21Status follows the reachability and track power of the z21s on
+// z21.*.status.
+func (w *Watchdog) handleZ21Status(msg *nats.Msg) {
+	name := strings.Split(msg.Subject, ".")[1]
+	var status StatusMsg
+	if err := decodePayload(msgSchemaVersion(msg), msg.Data, &status); err != nil {
+		return
+	}
+	w.layout.setStatus(name, &status)
+}
+
+// handleSystemState follows the main track current on
+// z21.*.event.systemstate.
+func (w *Watchdog) handleSystemState(msg *nats.Msg) {
+	name := strings.Split(msg.Subject, ".")[1]
+	var payload map[string]any
+	if err := decodePayload(msgSchemaVersion(msg), msg.Data, &payload); err != nil {
+		return
+	}
+	// the field names are those of the z21.go system state
+	for _, key := range []string{"MainCurrent", "FilteredMainCurrent"} {
+		if current, ok := payload[key].(float64); ok {
+			w.layout.setCurrent(name, current)
+			return
+		}
+	}
+}
+
+// publishLayoutStatus publishes the layout status if force is set or a
+// device changed state.
+func (w *Watchdog) publishLayoutStatus(force bool) {
+	status, changed := w.layout.status()
+	if !changed && !force {
+		return
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return
+	}
+	msg := nats.NewMsg(LayoutStatusSubject)
+	msg.Header.Set(TimestampHeader, time.Now().UTC().Format(time.RFC3339Nano))
+	msg.Data = data
+	if err := w.nc.PublishMsg(msg); err != nil {
+		w.logger.Error().
+			Err(err).
+			Msg("failed to publish layout status")
+		return
+	}
+	if changed {
+		w.logger.Info().
+			Str("state", status.State).
+			Int("devices", status.Count).
+			Int("reachable", status.Reachable).
+			Msg("layout status")
+	}
+}
@@ -0,0 +1,79 @@
+package gateway
+
+import (
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+const (
+	TemperatureWarning  = 60
+	TemperatureCritical = 75
+
+	SeverityOK       = "ok"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// TemperatureAlarm is published on z21.<name>.event.alarm.temperature
+// whenever the severity for a source changes.
+type TemperatureAlarm struct {
+	Source      string  `json:"source"`
+	Severity    string  `json:"severity"`
+	Temperature float64 `json:"temperature"`
+	Limit       float64 `json:"limit,omitempty"`
+	TS          string  `json:"ts"`
+}
+
+// checkTemperature raises temperature alarms from the Z21 system state. It
+// is only called from the events loop.
+//
+// The system state of CAN boosters reports voltage and current but no
+// temperature, and the zLink booster messages that do are not supported, so
+// boosters are logged once as unmonitored instead.
+func (g *Gateway) checkTemperature(ev z21.Serializable) {
+	if g.tempWarning <= 0 && g.tempCritical <= 0 {
+		return
+	}
+	if bs, ok := ev.(*z21.CanBoosterSystemState); ok {
+		if !g.tempUnmonitored[bs.NetworkID] {
+			g.tempUnmonitored[bs.NetworkID] = true
+			g.logger.Warn().
+				Uint16("net_id", bs.NetworkID).
+				Msg("CAN booster reports no temperature, it is not monitored")
+		}
+		return
+	}
+	ss, ok := ev.(*z21.SystemState)
+	if !ok {
+		return
+	}
+	temp := float64(ss.Temperature)
+
+	source := "z21"
+	severity, limit := SeverityOK, 0.0
+	switch {
+	case g.tempCritical > 0 && temp >= g.tempCritical:
+		severity, limit = SeverityCritical, g.tempCritical
+	case g.tempWarning > 0 && temp >= g.tempWarning:
+		severity, limit = SeverityWarning, g.tempWarning
+	}
+
+	prev, seen := g.tempSeverity[source]
+	if prev == severity || (!seen && severity == SeverityOK) {
+		return
+	}
+	g.tempSeverity[source] = severity
+
+	g.publishAlarm("temperature", &TemperatureAlarm{
+		Source:      source,
+		Severity:    severity,
+		Temperature: temp,
+		Limit:       limit,
+		TS:          time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+func (g *Gateway) publishAlarm(kind string, alarm any) {
+	g.publishDerivedEvent("alarm."+kind, "event.alarm", alarm)
+}
@@ -0,0 +1,28 @@
+package gateway
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/trains-io/z21.go"
+)
+
+func TestCheckTemperatureCANBooster(t *testing.T) {
+	var log bytes.Buffer
+	g := &Gateway{
+		logger:          zerolog.New(&log),
+		tempWarning:     TemperatureWarning,
+		tempCritical:    TemperatureCritical,
+		tempSeverity:    make(map[string]string),
+		tempUnmonitored: make(map[uint16]bool),
+	}
+	for range 3 {
+		g.checkTemperature(&z21.CanBoosterSystemState{NetworkID: 0x1234})
+	}
+	g.checkTemperature(&z21.CanBoosterSystemState{NetworkID: 0x1235})
+	if n := strings.Count(log.String(), "not monitored"); n != 2 {
+		t.Errorf("logged %d warnings for two boosters, want one each:\n%s", n, log.String())
+	}
+}
@@ -0,0 +1,271 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+var errHostStopped = errors.New("gateway is stopping")
+
+// deviceHost runs the gateways of the z21s attached to a running gateway
+// process with device.attach. They share the NATS connection of the
+// process and the config of the gateway it was started with, the main
+// gateway, which detaches them when it stops.
+type deviceHost struct {
+	ctx  context.Context
+	nc   *nats.Conn
+	base Config
+	main *Gateway
+
+	mu      sync.Mutex
+	devices map[string]*attachedDevice
+	stopped bool
+}
+
+type attachedDevice struct {
+	gw *Gateway
+	// done is closed once the gateway stopped.
+	done chan struct{}
+}
+
+func newDeviceHost(ctx context.Context, nc *nats.Conn, cfg Config, main *Gateway) *deviceHost {
+	return &deviceHost{
+		ctx:     ctx,
+		nc:      nc,
+		base:    cfg,
+		main:    main,
+		devices: make(map[string]*attachedDevice),
+	}
+}
+
+// AttachRequest is the payload of device.attach.
+type AttachRequest struct {
+	Name   string `json:"name"`
+	Addr   string `json:"addr"`
+	Serial uint32 `json:"serial,omitempty"`
+}
+
+// DetachRequest is the payload of device.detach.
+type DetachRequest struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// HostedDevice is an entry of the device.list reply.
+type HostedDevice struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+	// Attached is false for the gateway the process was started with,
+	// which cannot be detached.
+	Attached  bool   `json:"attached"`
+	Reachable bool   `json:"reachable"`
+	StartedAt string `json:"started_at"`
+}
+
+// deviceConfig returns the config of an attached z21: the config of the
+// main gateway with the address of the z21 and its entry in the devices
+// section of the config file. Listeners, plugins and the process-wide
+// checks stay with the main gateway.
+func (h *deviceHost) deviceConfig(req *AttachRequest) (Config, error) {
+	cfg := h.base
+	if req.Name == "" || subjectToken(req.Name) != req.Name {
+		return Config{}, fmt.Errorf("invalid device name %q", req.Name)
+	}
+	if "z21."+req.Name == RegistrySubject {
+		return Config{}, fmt.Errorf("device name %s is reserved for the gateway registry", req.Name)
+	}
+	addr, err := normalizeZ21Addr(req.Addr)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := validateZ21Addr(addr); err != nil {
+		return Config{}, err
+	}
+	cfg.Z21Name, cfg.Z21Addr, cfg.Z21Serial = req.Name, addr, req.Serial
+	cfg.Z21BackupAddr, cfg.Z21BackupSerial = "", 0
+	if dc, ok := cfg.File.Devices[req.Name]; ok {
+		if err := dc.applyTo(&cfg); err != nil {
+			return Config{}, fmt.Errorf("device %s: %w", req.Name, err)
+		}
+	}
+	if cfg.Z21Serial != 0 && cfg.Probe != ProbeSerial {
+		return Config{}, fmt.Errorf("serial requires probe %s", ProbeSerial)
+	}
+
+	cfg.MetricsAddr, cfg.DashboardAddr, cfg.SRCPAddr, cfg.TCPBridgeAddr, cfg.LCCAddr = "", "", "", "", ""
+	cfg.Homie = false
+	cfg.SelfTest = false
+	cfg.Record = false
+	cfg.MaxGoroutines, cfg.MaxHeapMB, cfg.GuardRestart = 0, 0, false
+	cfg.Synthetic = SyntheticConfig{}
+	cfg.Capabilities = nil
+	cfg.Logger = h.base.Logger.With().Str("device", req.Name).Logger()
+	return cfg, nil
+}
+
+// check rejects a z21 whose name or address is taken. The caller holds mu.
+func (h *deviceHost) check(cfg Config) error {
+	if h.stopped {
+		return errHostStopped
+	}
+	gateways := []*Gateway{h.main}
+	for _, d := range h.devices {
+		gateways = append(gateways, d.gw)
+	}
+	for _, gw := range gateways {
+		if gw.name == cfg.Z21Name {
+			return fmt.Errorf("device %s is already attached", cfg.Z21Name)
+		}
+		if gw.failover.addr() == cfg.Z21Addr {
+			return fmt.Errorf("z21 %s is already attached as %s", cfg.Z21Addr, gw.name)
+		}
+	}
+	return nil
+}
+
+// attach starts the gateway of a z21.
+func (h *deviceHost) attach(cfg Config) (*Gateway, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.check(cfg); err != nil {
+		return nil, err
+	}
+	gw, err := New(h.ctx, h.nc, cfg)
+	if err != nil {
+		return nil, err
+	}
+	gw.host = h
+	gw.plugins = nil
+	if err := gw.Start(); err != nil {
+		gw.Shutdown(ShutdownError, err.Error())
+		gw.Stop()
+		return nil, err
+	}
+	d := &attachedDevice{gw: gw, done: make(chan struct{})}
+	h.devices[gw.name] = d
+	go h.wait(d)
+	return gw, nil
+}
+
+// wait stops an attached gateway once it shuts down, whether detached or
+// stopped with gateway.stop.
+func (h *deviceHost) wait(d *attachedDevice) {
+	<-d.gw.Done()
+	d.gw.Stop()
+	h.mu.Lock()
+	delete(h.devices, d.gw.name)
+	h.mu.Unlock()
+	d.gw.logger.Info().
+		Str("reason", d.gw.StopReason()).
+		Msg("device detached")
+	close(d.done)
+}
+
+// detach shuts down the gateway of an attached z21 and waits for it to
+// stop, unless it is the gateway handling the command, which cannot wait
+// for its own stop.
+func (h *deviceHost) detach(name, reason string, from *Gateway) (*Gateway, error) {
+	h.mu.Lock()
+	d, ok := h.devices[name]
+	h.mu.Unlock()
+	if !ok {
+		if name == h.main.name {
+			return nil, fmt.Errorf("device %s was not attached, stop it with gateway.stop", name)
+		}
+		return nil, fmt.Errorf("device %s is not attached", name)
+	}
+	d.gw.Shutdown(ShutdownAdmin, reason)
+	if d.gw != from {
+		<-d.done
+	}
+	return d.gw, nil
+}
+
+// detachAll shuts down all attached gateways when the main gateway stops.
+func (h *deviceHost) detachAll(reason string) {
+	if reason == "" {
+		reason = ShutdownAdmin
+	}
+	h.mu.Lock()
+	h.stopped = true
+	devices := make([]*attachedDevice, 0, len(h.devices))
+	for _, d := range h.devices {
+		devices = append(devices, d)
+	}
+	h.mu.Unlock()
+	for _, d := range devices {
+		d.gw.Shutdown(reason, "main gateway stopped")
+	}
+	for _, d := range devices {
+		<-d.done
+	}
+}
+
+func (h *deviceHost) list() []HostedDevice {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := []HostedDevice{hostedDevice(h.main, false)}
+	for _, name := range sortedKeys(h.devices) {
+		list = append(list, hostedDevice(h.devices[name].gw, true))
+	}
+	return list
+}
+
+func hostedDevice(gw *Gateway, attached bool) HostedDevice {
+	return HostedDevice{
+		Name:      gw.name,
+		Addr:      gw.failover.addr(),
+		Attached:  attached,
+		Reachable: gw.isOnline.Load(),
+		StartedAt: gw.startedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+func (g *Gateway) handleDeviceAttach(cr *cmdRequest, req *AttachRequest) CmdReply {
+	cfg, err := g.host.deviceConfig(req)
+	if err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, TS: time.Now().Format(time.RFC3339)}
+	}
+	gw, err := g.host.attach(cfg)
+	if err != nil {
+		return CmdReply{Ok: false, Error: err.Error(), ErrorCode: ErrCodeValidationFailed, TS: time.Now().Format(time.RFC3339)}
+	}
+	cr.logger.Info().
+		Str("client", cr.msg.Header.Get(ClientIDHeader)).
+		Str("name", gw.name).
+		Str("addr", cfg.Z21Addr).
+		Msg("device attached")
+	return CmdReply{Ok: true, Data: hostedDevice(gw, true), TS: time.Now().Format(time.RFC3339)}
+}
+
+func (g *Gateway) handleDeviceDetach(cr *cmdRequest, req *DetachRequest) CmdReply {
+	reason := req.Reason
+	if reason == "" {
+		reason = "device.detach"
+	}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, TS: time.Now().Format(time.RFC3339)}
+	}
+	gw, err := g.host.detach(req.Name, reason, g)
+	if err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	cr.logger.Warn().
+		Str("client", cr.msg.Header.Get(ClientIDHeader)).
+		Str("name", gw.name).
+		Str("reason", reason).
+		Msg("detach requested")
+	return CmdReply{Ok: true, Data: fmt.Sprintf("detached: %s", gw.name), TS: time.Now().Format(time.RFC3339)}
+}
+
+func (g *Gateway) handleDeviceList(cr *cmdRequest, req *struct{}) CmdReply {
+	return CmdReply{Ok: true, Data: g.host.list(), TS: time.Now().Format(time.RFC3339)}
+}
@@ -0,0 +1,153 @@
+package gateway
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// BatchKinds are the event kinds batched by default, the detector
+	// traffic of occupancy storms.
+	BatchKinds = "can,rbus"
+	// BatchMaxEvents flushes a batch before its window ends.
+	BatchMaxEvents = 256
+)
+
+// EventBatch is published on z21.<name>.batch.<kind> in place of the
+// events of kind received within one batch window.
+type EventBatch struct {
+	Kind   string         `json:"kind"`
+	Events []BatchedEvent `json:"events"`
+}
+
+// BatchedEvent is one event of a batch with the subject, sequence number
+// and timestamp it would have been published with.
+type BatchedEvent struct {
+	Subject string `json:"subject"`
+	Seq     uint64 `json:"seq"`
+	TS      string `json:"ts"`
+	Name    string `json:"name,omitempty"`
+	Payload any    `json:"payload"`
+}
+
+// eventBatch collects the events of one kind. It is only touched from the
+// publisher goroutine.
+type eventBatch struct {
+	events []BatchedEvent
+	// timer flushes the batch at the end of its window, it is stopped by
+	// an early flush.
+	timer *time.Timer
+	// flushes is incremented by every flush, so that a window timer that
+	// fired before an early flush does not flush the following batch.
+	flushes uint64
+}
+
+func parseBatchKinds(s string) ([]string, error) {
+	var kinds []string
+	for f := range strings.SplitSeq(s, ",") {
+		kind := strings.TrimSpace(f)
+		if kind == "" || subjectToken(kind) != kind {
+			return nil, fmt.Errorf("invalid batch kind %q", f)
+		}
+		if !slices.Contains(kinds, kind) {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds, nil
+}
+
+// newEventBatches returns the batches of kinds, none if window is zero.
+func newEventBatches(window time.Duration, kinds []string) map[string]*eventBatch {
+	batches := make(map[string]*eventBatch)
+	if window <= 0 {
+		return batches
+	}
+	for _, kind := range kinds {
+		batches[kind] = &eventBatch{}
+	}
+	return batches
+}
+
+func (g *Gateway) batchSubject(kind string) string {
+	return g.subjectPrefix + "batch." + kind
+}
+
+// batchEvent adds an event to the batch of its kind and reports whether it
+// was batched. The first event of a batch starts its window.
+func (g *Gateway) batchEvent(kind, subject string, seq uint64, ts time.Time, payload any, header nats.Header) bool {
+	b, ok := g.batches[kind]
+	if !ok {
+		return false
+	}
+	b.events = append(b.events, BatchedEvent{
+		Subject: subject,
+		Seq:     seq,
+		TS:      ts.UTC().Format(time.RFC3339Nano),
+		Name:    header.Get(NameHeader),
+		Payload: payload,
+	})
+	g.state.put(subject, payload)
+
+	switch len(b.events) {
+	case BatchMaxEvents:
+		if err := g.flushBatch(kind); err != nil {
+			g.onEventPublishError(err)
+		}
+	case 1:
+		flushes := b.flushes
+		b.timer = time.AfterFunc(g.batchWindow, func() {
+			g.enqueuePublishWait(func() error { return g.flushBatchWindow(kind, flushes) }, g.onEventPublishError)
+		})
+	}
+	return true
+}
+
+// flushBatchWindow flushes the batch of kind at the end of the window that
+// started after the given number of flushes, unless it was flushed early.
+func (g *Gateway) flushBatchWindow(kind string, flushes uint64) error {
+	if g.batches[kind].flushes != flushes {
+		return nil
+	}
+	return g.flushBatch(kind)
+}
+
+// flushBatch publishes the events collected for kind, if any.
+func (g *Gateway) flushBatch(kind string) error {
+	b := g.batches[kind]
+	if len(b.events) == 0 {
+		return nil
+	}
+	batch := EventBatch{Kind: kind, Events: b.events}
+	b.events = nil
+	b.flushes++
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	subject := g.batchSubject(kind)
+	if err := g.publish(subject, "batch."+kind, 0, batch); err != nil {
+		return fmt.Errorf("%s: %w", subject, err)
+	}
+	g.stats.events.Add(uint64(len(batch.Events)))
+	g.stats.batches.Add(1)
+
+	g.logger.Debug().
+		Str("subject", subject).
+		Int("events", len(batch.Events)).
+		Msg("NATS pub")
+	return nil
+}
+
+// flushBatches publishes all pending batches on shutdown.
+func (g *Gateway) flushBatches() {
+	for _, kind := range sortedKeys(g.batches) {
+		if err := g.flushBatch(kind); err != nil {
+			g.onEventPublishError(err)
+		}
+	}
+}
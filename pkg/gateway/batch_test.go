@@ -0,0 +1,51 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+func TestBatchEarlyFlushRestartsWindow(t *testing.T) {
+	g := newTestGateway(t, "--batch_window", "50ms")
+	b := g.batches["can"]
+	received := time.Date(2025, 11, 7, 21, 22, 0, 123456789, time.UTC)
+	ev := &z21.CanDetector{NetworkID: 0x1234, Port: 1, Type: canDetectorOccupancy, Value1: 1}
+	publish := func() {
+		t.Helper()
+		if err := g.publishEventNow(ev, received); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	publish()
+	window := b.flushes
+	for range BatchMaxEvents - 1 {
+		publish()
+	}
+	if g.stats.batches.Load() != 1 || len(b.events) != 0 || b.timer != nil {
+		t.Fatalf("after %d events: %d batches, %d pending events, timer %v", BatchMaxEvents, g.stats.batches.Load(), len(b.events), b.timer)
+	}
+
+	// the window of the flushed batch must not flush this one early
+	publish()
+	if b.timer == nil {
+		t.Fatal("no window timer for the next batch")
+	}
+	if want := "2025-11-07T21:22:00.123456789Z"; b.events[0].TS != want {
+		t.Errorf("batched event ts %q, want %q", b.events[0].TS, want)
+	}
+	if err := g.flushBatchWindow("can", window); err != nil {
+		t.Fatal(err)
+	}
+	if g.stats.batches.Load() != 1 || len(b.events) != 1 {
+		t.Errorf("the window of the flushed batch flushed the next one")
+	}
+	if err := g.flushBatchWindow("can", b.flushes); err != nil {
+		t.Fatal(err)
+	}
+	if g.stats.batches.Load() != 2 || len(b.events) != 0 {
+		t.Errorf("the window did not flush its batch")
+	}
+}
@@ -0,0 +1,265 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	BenchDuration    = 30 * time.Second
+	BenchConcurrency = 4
+	BenchTimeout     = 2 * time.Second
+	BenchMix         = "state.get"
+)
+
+// benchCommand is a command of the bench mix, sent with weight relative to
+// the others.
+type benchCommand struct {
+	name    string
+	weight  int
+	payload []byte
+}
+
+// parseBenchMix parses a semicolon separated list of
+// <command>[:<weight>][=<json payload>], e.g.
+// `state.get:3;loco.drive:1={"address":3,"speed":0}`.
+func parseBenchMix(s string) ([]benchCommand, error) {
+	var mix []benchCommand
+	for entry := range strings.SplitSeq(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		cmd := benchCommand{weight: 1, payload: []byte("{}")}
+		entry, payload, ok := strings.Cut(entry, "=")
+		if ok {
+			if !json.Valid([]byte(payload)) {
+				return nil, fmt.Errorf("invalid bench payload %q", payload)
+			}
+			cmd.payload = []byte(payload)
+		}
+		name, weight, ok := strings.Cut(entry, ":")
+		if ok {
+			w, err := strconv.Atoi(weight)
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("invalid bench weight %q", weight)
+			}
+			cmd.weight = w
+		}
+		if name == "" {
+			return nil, fmt.Errorf("invalid bench command %q", entry)
+		}
+		cmd.name = name
+		mix = append(mix, cmd)
+	}
+	if len(mix) == 0 {
+		return nil, fmt.Errorf("empty bench mix")
+	}
+	return mix, nil
+}
+
+// BenchStats holds the results of one command of the bench mix.
+type BenchStats struct {
+	Requests int `json:"requests"`
+	// Errors counts the failed requests by error code; NATS failures are
+	// counted as nats_timeout and no_responders.
+	Errors    map[string]int `json:"errors"`
+	ErrorRate float64        `json:"error_rate"`
+	P50Millis float64        `json:"p50_ms"`
+	P90Millis float64        `json:"p90_ms"`
+	P99Millis float64        `json:"p99_ms"`
+	MaxMillis float64        `json:"max_ms"`
+
+	latencies []time.Duration
+}
+
+// BenchReport is the result of bench.
+type BenchReport struct {
+	Device      string                 `json:"device"`
+	Duration    string                 `json:"duration"`
+	Concurrency int                    `json:"concurrency"`
+	DryRun      bool                   `json:"dry_run"`
+	Throughput  float64                `json:"throughput"`
+	Total       *BenchStats            `json:"total"`
+	Commands    map[string]*BenchStats `json:"commands"`
+}
+
+func newBenchStats() *BenchStats {
+	return &BenchStats{Errors: make(map[string]int)}
+}
+
+func (s *BenchStats) add(d time.Duration, code string) {
+	s.Requests++
+	s.latencies = append(s.latencies, d)
+	if code != "" {
+		s.Errors[code]++
+	}
+}
+
+func (s *BenchStats) finish() {
+	if s.Requests == 0 {
+		return
+	}
+	errs := 0
+	for _, n := range s.Errors {
+		errs += n
+	}
+	s.ErrorRate = float64(errs) / float64(s.Requests)
+	slices.Sort(s.latencies)
+	percentile := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(s.latencies)))) - 1
+		return millis(s.latencies[max(i, 0)])
+	}
+	s.P50Millis = percentile(0.5)
+	s.P90Millis = percentile(0.9)
+	s.P99Millis = percentile(0.99)
+	s.MaxMillis = millis(s.latencies[len(s.latencies)-1])
+}
+
+// BenchOptions configures a bench run.
+type BenchOptions struct {
+	Duration    time.Duration
+	Concurrency int
+	Timeout     time.Duration
+	Mix         []benchCommand
+	DryRun      bool
+}
+
+// bench drives the gateway name with Concurrency clients sending commands
+// of the mix back to back for Duration.
+func bench(ctx context.Context, nc *nats.Conn, name string, opts BenchOptions) *BenchReport {
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+
+	total := 0
+	for _, cmd := range opts.Mix {
+		total += cmd.weight
+	}
+	pick := func() benchCommand {
+		n := rand.IntN(total)
+		for _, cmd := range opts.Mix {
+			if n < cmd.weight {
+				return cmd
+			}
+			n -= cmd.weight
+		}
+		return opts.Mix[0]
+	}
+
+	report := &BenchReport{
+		Device:      name,
+		Concurrency: opts.Concurrency,
+		DryRun:      opts.DryRun,
+		Total:       newBenchStats(),
+		Commands:    make(map[string]*BenchStats),
+	}
+	for _, cmd := range opts.Mix {
+		report.Commands[cmd.name] = newBenchStats()
+	}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	started := time.Now()
+	for range opts.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				cmd := pick()
+				d, code := benchRequest(nc, name, cmd, opts)
+				// requests cut short by the end of the run are not counted
+				if ctx.Err() != nil {
+					return
+				}
+				mu.Lock()
+				report.Commands[cmd.name].add(d, code)
+				report.Total.add(d, code)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	elapsed := time.Since(started)
+	report.Duration = elapsed.Truncate(time.Millisecond).String()
+	report.Throughput = float64(report.Total.Requests) / elapsed.Seconds()
+	report.Total.finish()
+	for _, s := range report.Commands {
+		s.finish()
+	}
+	return report
+}
+
+// benchRequest sends one command and returns its latency and error code,
+// empty on success.
+func benchRequest(nc *nats.Conn, name string, cmd benchCommand, opts BenchOptions) (time.Duration, string) {
+	payload := cmd.payload
+	if opts.DryRun {
+		var fields map[string]any
+		if err := json.Unmarshal(payload, &fields); err == nil && fields != nil {
+			fields["dry_run"] = true
+			payload, _ = json.Marshal(fields)
+		}
+	}
+
+	start := time.Now()
+	resp, err := nc.Request(fmt.Sprintf("z21.%s.cmd.%s", name, cmd.name), payload, opts.Timeout)
+	d := time.Since(start)
+	switch {
+	case errors.Is(err, nats.ErrNoResponders):
+		return d, "no_responders"
+	case errors.Is(err, nats.ErrTimeout):
+		return d, "nats_timeout"
+	case err != nil:
+		return d, "nats_error"
+	}
+
+	var reply CmdReply
+	if err := decodePayload(msgSchemaVersion(resp), resp.Data, &reply); err != nil {
+		return d, "invalid_reply"
+	}
+	if !reply.Ok {
+		if reply.ErrorCode == "" {
+			return d, "unknown"
+		}
+		return d, string(reply.ErrorCode)
+	}
+	return d, ""
+}
+
+func (r *BenchReport) write(w io.Writer, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+
+	fmt.Fprintf(w, "bench %s: %s, concurrency %d, %.1f req/s\n", r.Device, r.Duration, r.Concurrency, r.Throughput)
+	fmt.Fprintf(w, "  %-20s %8s %7s %8s %8s %8s %8s\n", "command", "requests", "errors", "p50", "p90", "p99", "max")
+	line := func(name string, s *BenchStats) {
+		fmt.Fprintf(w, "  %-20s %8d %6.2f%% %6.1fms %6.1fms %6.1fms %6.1fms\n",
+			name, s.Requests, 100*s.ErrorRate, s.P50Millis, s.P90Millis, s.P99Millis, s.MaxMillis)
+		for _, code := range sortedKeys(s.Errors) {
+			fmt.Fprintf(w, "    %-18s %8d\n", code, s.Errors[code])
+		}
+	}
+	for _, name := range sortedKeys(r.Commands) {
+		line(name, r.Commands[name])
+	}
+	line("total", r.Total)
+	return nil
+}
@@ -0,0 +1,56 @@
+package gateway
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BlockConfig lists the detectors reporting occupancy of a block. Detectors
+// are given by name or by their event subject below event., e.g.
+// "can.1234.2".
+type BlockConfig struct {
+	Detectors []string `yaml:"detectors"`
+}
+
+// detectorKinds are the event kinds reporting occupancy.
+var detectorKinds = map[string]bool{
+	"can":  true,
+	"rbus": true,
+}
+
+// blockIndex maps detector sources to the block they belong to.
+type blockIndex struct {
+	blocks  map[string][]string
+	sources map[string]string
+}
+
+func newBlockIndex(blocks map[string]BlockConfig, names NameConfig) (*blockIndex, error) {
+	idx := &blockIndex{
+		blocks:  make(map[string][]string),
+		sources: make(map[string]string),
+	}
+	for block, bc := range blocks {
+		if block == "" || strings.ContainsAny(block, ".*> \t") {
+			return nil, fmt.Errorf("invalid block name %q", block)
+		}
+		for _, det := range bc.Detectors {
+			source := det
+			if s, ok := names.Detectors[det]; ok {
+				source = s
+			}
+			if !detectorKinds[strings.SplitN(source, ".", 2)[0]] {
+				return nil, fmt.Errorf("block %q: %q is neither a detector name nor a detector source", block, det)
+			}
+			if other, ok := idx.sources[source]; ok {
+				return nil, fmt.Errorf("detector %s belongs to blocks %q and %q", source, other, block)
+			}
+			idx.sources[source] = block
+			idx.blocks[block] = append(idx.blocks[block], source)
+		}
+	}
+	return idx, nil
+}
+
+func (idx *blockIndex) names() []string {
+	return sortedKeys(idx.blocks)
+}
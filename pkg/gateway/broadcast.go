@@ -0,0 +1,117 @@
+package gateway
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+const (
+	BroadcastTimeout = 2 * time.Minute
+)
+
+// broadcastFlags names the broadcast flags of the Z21 LAN protocol for
+// --broadcast_flags.
+var broadcastFlags = map[string]z21.Mask32{
+	"driving":           0x00000001,
+	"rbus":              0x00000002,
+	"railcom":           0x00000004,
+	"system":            z21.Mask32(z21.SYSTEM_UPDATES),
+	"all_locos":         0x00010000,
+	"can_booster":       0x00020000,
+	"railcom_all":       0x00040000,
+	"can_detector":      z21.Mask32(z21.CAN_DETECTOR_UPDATES),
+	"loconet":           z21LocoNetUpdates,
+	"loconet_locos":     0x02000000,
+	"loconet_switches":  0x04000000,
+	"loconet_detectors": 0x08000000,
+}
+
+// z21LocoNetFlags are the broadcast flags only a Z21 with a LocoNet
+// interface sends messages for.
+const z21LocoNetFlags = z21LocoNetUpdates | 0x02000000 | 0x04000000 | 0x08000000
+
+// parseBroadcastFlags parses a comma separated list of broadcast flag
+// names; an empty list returns 0, the default subscription.
+func parseBroadcastFlags(s string) (z21.Mask32, error) {
+	var flags z21.Mask32
+	for f := range strings.SplitSeq(s, ",") {
+		name := strings.TrimSpace(f)
+		if name == "" {
+			continue
+		}
+		flag, ok := broadcastFlags[name]
+		if !ok {
+			return 0, fmt.Errorf("invalid broadcast flag %q, expected one of %s", name,
+				strings.Join(slices.Sorted(maps.Keys(broadcastFlags)), ", "))
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
+
+// subscriptionFlags returns the broadcast flags to subscribe to: those of
+// --broadcast_flags if set, otherwise the system state and the CAN
+// detectors. Flags of features the device lacks are dropped.
+func (g *Gateway) subscriptionFlags() z21.Mask32 {
+	flags := g.broadcastFlags
+	if flags == 0 {
+		flags = z21.Mask32(z21.SYSTEM_UPDATES) | z21.Mask32(z21.CAN_DETECTOR_UPDATES)
+	}
+	if g.dccPackets {
+		flags |= z21LocoNetUpdates
+	}
+	if !g.hasFeature("can_detector") {
+		flags &^= z21.Mask32(z21.CAN_DETECTOR_UPDATES)
+	}
+	if !g.hasFeature("loconet") {
+		flags &^= z21LocoNetFlags
+	}
+	return flags
+}
+
+// broadcastHealthLoop warns when no broadcast arrived for broadcastTimeout
+// although the Z21 answers the heartbeat, which means it dropped the
+// gateway from its broadcast subscribers. The subscription is re-asserted in
+// that case, and additionally every broadcastRefresh if set.
+func (g *Gateway) broadcastHealthLoop() {
+	defer g.wg.Done()
+
+	check := time.NewTicker(g.broadcastTimeout / 4)
+	defer check.Stop()
+
+	var refresh <-chan time.Time
+	if g.broadcastRefresh > 0 {
+		t := time.NewTicker(g.broadcastRefresh)
+		defer t.Stop()
+		refresh = t.C
+	}
+
+	warned := false
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-refresh:
+			if g.isOnline.Load() {
+				g.subscribeBroadcast()
+			}
+		case <-check.C:
+			since := time.Since(time.Unix(0, g.lastBroadcast.Load()))
+			if !g.isOnline.Load() || since < g.broadcastTimeout {
+				warned = false
+				continue
+			}
+			if !warned {
+				g.publishWarning("broadcast_silent", "no Z21 broadcast received although the Z21 is reachable",
+					map[string]any{"silent_for": since.Truncate(time.Second).String()})
+				warned = true
+			}
+			g.subscribeBroadcast()
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+// CANDescriptionTimeout bounds can.devices, which asks all devices for
+// their description at once.
+const CANDescriptionTimeout = time.Second
+
+// CANDevice is an entry of the reply to can.devices.
+type CANDevice struct {
+	NetID uint16 `json:"net_id"`
+	// Kind is detector or booster for devices seen in their broadcasts,
+	// unset for devices only given in the request.
+	Kind string `json:"kind,omitempty"`
+	// Name is the description stored in the device, unset if it did not
+	// answer.
+	Name     string `json:"name,omitempty"`
+	LastSeen string `json:"last_seen,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// canDevices records the CAN bus devices reported in broadcasts by their
+// NetID.
+type canDevices struct {
+	mu      sync.Mutex
+	devices map[uint16]*CANDevice
+}
+
+func newCANDevices() *canDevices {
+	return &canDevices{devices: make(map[uint16]*CANDevice)}
+}
+
+// recordCANDevice adds the sender of CAN detector and booster broadcasts to
+// the CAN devices. It is only called from the events loop.
+func (g *Gateway) recordCANDevice(ev z21.Serializable) {
+	var netID uint16
+	var kind string
+	switch ev := ev.(type) {
+	case *z21.CanDetector:
+		netID, kind = ev.NetworkID, "detector"
+	case *z21.CanBoosterSystemState:
+		netID, kind = ev.NetworkID, "booster"
+	default:
+		return
+	}
+	c := g.canDevices
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.devices[netID]
+	if !ok {
+		d = &CANDevice{NetID: netID}
+		c.devices[d.NetID] = d
+	}
+	d.Kind = kind
+	d.LastSeen = time.Now().UTC().Format(time.RFC3339)
+}
+
+type canDevicesRequest struct {
+	// NetIDs adds devices that have not broadcast anything yet, e.g. a
+	// booster without the can_booster broadcast flag.
+	NetIDs []uint16 `json:"net_ids,omitempty"`
+}
+
+// handleCANDevices asks every known CAN device for its description with
+// LAN_CAN_DEVICE_GET_DESCRIPTION.
+func (g *Gateway) handleCANDevices(cr *cmdRequest, req *canDevicesRequest) CmdReply {
+	byID := make(map[uint16]*CANDevice)
+	g.canDevices.mu.Lock()
+	for id, d := range g.canDevices.devices {
+		entry := *d
+		byID[id] = &entry
+	}
+	g.canDevices.mu.Unlock()
+	for _, id := range req.NetIDs {
+		if _, ok := byID[id]; !ok {
+			byID[id] = &CANDevice{NetID: id}
+		}
+	}
+	devices := make([]*CANDevice, 0, len(byID))
+	for _, d := range byID {
+		devices = append(devices, d)
+	}
+	slices.SortFunc(devices, func(a, b *CANDevice) int { return int(a.NetID) - int(b.NetID) })
+
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, Data: devices, TS: time.Now().Format(time.RFC3339)}
+	}
+	if len(devices) == 0 {
+		return CmdReply{Ok: true, Data: devices, TS: time.Now().Format(time.RFC3339)}
+	}
+	if !g.isOnline.Load() {
+		return CmdReply{Ok: false, Error: "z21 is offline", ErrorCode: ErrCodeZ21Offline, TS: time.Now().Format(time.RFC3339)}
+	}
+
+	frames := make([][]byte, 0, len(devices))
+	for _, d := range devices {
+		frames = append(frames, lanFrame(lanCANDeviceGetDescription, byte(d.NetID), byte(d.NetID>>8)))
+	}
+	ctx, cancel := context.WithTimeout(g.ctx, CANDescriptionTimeout)
+	defer cancel()
+	sent := time.Now()
+	answered := make(map[uint16]bool, len(devices))
+	err := g.exchangeFrames(ctx, frames, func(header uint16, data []byte) bool {
+		if header != lanCANDeviceGetDescription || len(data) < 2 {
+			return false
+		}
+		d, ok := byID[binary.LittleEndian.Uint16(data)]
+		if !ok || answered[d.NetID] {
+			return false
+		}
+		answered[d.NetID] = true
+		name, _, _ := bytes.Cut(data[2:], []byte{0x00})
+		d.Name = string(name)
+		return len(answered) == len(devices)
+	})
+	cr.timing.z21 += time.Since(sent)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) && g.ctx.Err() == nil:
+		for _, d := range devices {
+			if !answered[d.NetID] {
+				d.Error = "no answer"
+			}
+		}
+	case err != nil:
+		return CmdReply{Ok: false, Error: err.Error(), ErrorCode: g.errorCode(err), TS: time.Now().Format(time.RFC3339)}
+	}
+	return CmdReply{Ok: true, Data: devices, TS: time.Now().Format(time.RFC3339)}
+}
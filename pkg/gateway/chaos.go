@@ -0,0 +1,154 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+// ChaosConfig injects faults for testing downstream automation against
+// failure modes of the Z21 and NATS.
+type ChaosConfig struct {
+	// Timeout is the fraction of Z21 requests failing with a timeout.
+	Timeout float64
+	// Delay is added to the fraction DelayRate of Z21 requests.
+	Delay     time.Duration
+	DelayRate float64
+	// Drop is the fraction of Z21 events dropped.
+	Drop float64
+	// Disconnect forces a NATS reconnect at this interval.
+	Disconnect time.Duration
+	// Faults are injected for For out of every Every, starting with the
+	// gateway; zero Every means always.
+	Every time.Duration
+	For   time.Duration
+}
+
+func (c *ChaosConfig) enabled() bool {
+	return c.Timeout > 0 || c.DelayRate > 0 || c.Drop > 0 || c.Disconnect > 0
+}
+
+// parseChaos parses a comma separated list of faults, e.g.
+// "timeout=0.1,delay=0.2:500ms,drop=0.05,disconnect=10m,every=30m,for=5m".
+func parseChaos(s string) (ChaosConfig, error) {
+	var c ChaosConfig
+	if s == "" {
+		return c, nil
+	}
+	rate := func(v string) (float64, error) {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			return 0, fmt.Errorf("invalid rate %q, must be within 0-1", v)
+		}
+		return f, nil
+	}
+	duration := func(v string) (time.Duration, error) {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", v)
+		}
+		return d, nil
+	}
+
+	for fault := range strings.SplitSeq(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(fault), "=")
+		if !ok {
+			return c, fmt.Errorf("invalid chaos fault %q", fault)
+		}
+		var err error
+		switch key {
+		case "timeout":
+			c.Timeout, err = rate(value)
+		case "delay":
+			r, d, ok := strings.Cut(value, ":")
+			if !ok {
+				return c, fmt.Errorf("invalid delay %q, must be <rate>:<duration>", value)
+			}
+			if c.DelayRate, err = rate(r); err == nil {
+				c.Delay, err = duration(d)
+			}
+		case "drop":
+			c.Drop, err = rate(value)
+		case "disconnect":
+			c.Disconnect, err = duration(value)
+		case "every":
+			c.Every, err = duration(value)
+		case "for":
+			c.For, err = duration(value)
+		default:
+			return c, fmt.Errorf("unknown chaos fault %q", key)
+		}
+		if err != nil {
+			return c, fmt.Errorf("chaos %s: %w", key, err)
+		}
+	}
+	if (c.Every > 0) != (c.For > 0) || c.For > c.Every {
+		return c, fmt.Errorf("chaos every and for must be set together, for not exceeding every")
+	}
+	return c, nil
+}
+
+// chaosActive reports whether faults are injected right now.
+func (g *Gateway) chaosActive() bool {
+	if !g.chaos.enabled() {
+		return false
+	}
+	if g.chaos.Every == 0 {
+		return true
+	}
+	return time.Since(g.startedAt)%g.chaos.Every < g.chaos.For
+}
+
+// z21SendRcv sends a request to the Z21. All Z21 requests go through here,
+// so chaos mode can inject timeouts and delays.
+func (g *Gateway) z21SendRcv(ctx context.Context, req z21.Serializable) (z21.Serializable, error) {
+	if g.chaosActive() {
+		// requests without a deadline would hang forever
+		if _, ok := ctx.Deadline(); ok && rand.Float64() < g.chaos.Timeout {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		if rand.Float64() < g.chaos.DelayRate {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(g.chaos.Delay):
+			}
+		}
+	}
+	return g.zc.Load().SendRcv(ctx, req)
+}
+
+// chaosDropEvent reports whether chaos mode drops an event.
+func (g *Gateway) chaosDropEvent() bool {
+	return g.chaosActive() && rand.Float64() < g.chaos.Drop
+}
+
+func (g *Gateway) chaosDisconnectLoop() {
+	defer g.wg.Done()
+	ticker := time.NewTicker(g.chaos.Disconnect)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-ticker.C:
+			if !g.chaosActive() {
+				continue
+			}
+			g.logger.Warn().
+				Msg("chaos: forcing NATS reconnect")
+			if err := g.nc.ForceReconnect(); err != nil {
+				g.logger.Error().
+					Err(err).
+					Msg("chaos: NATS reconnect")
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Version is the gateway version reported in the service discovery, set
+// by the z21-gateway binary.
+var Version = "dev"
+
+// ConnectNATS connects to the NATS server of cfg as client name, exiting
+// on failure like the z21-gateway binary does.
+func ConnectNATS(cfg Config, name string) *nats.Conn {
+	opts := []nats.Option{
+		nats.Name(name),
+		nats.DisconnectErrHandler(func(c *nats.Conn, err error) {
+			cfg.Logger.Warn().
+				Err(err).
+				Str("status", "disconnected").
+				Msg("NATS conn")
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			cfg.Logger.Info().
+				Str("status", "reconnected").
+				Msg("NATS conn")
+		}),
+	}
+	authOpts, err := cfg.NATSAuth.Options(cfg.Logger)
+	if err != nil {
+		cfg.Logger.Fatal().
+			Err(err).
+			Msg("NATS credentials")
+	}
+	opts = append(opts, authOpts...)
+	nc, err := nats.Connect(cfg.NATSURL, opts...)
+	if err != nil {
+		cfg.Logger.Fatal().
+			Err(err).
+			Msg("NATS conn")
+	}
+	cfg.Logger.Info().
+		Str("url", RedactURLs(cfg.NATSURL)).
+		Msg("NATS conn")
+	return nc
+}
+
+// RunWatchdog runs the watchdog subcommand of the z21-gateway binary.
+func RunWatchdog() {
+	cfg := LoadConfig()
+
+	cfg.Logger.Info().
+		Str("version", Version).
+		Str("nats", RedactURLs(cfg.NATSURL)).
+		Dur("timeout", cfg.LivenessTimeout).
+		Msg("starting Z21 Gateway watchdog")
+
+	nc := ConnectNATS(cfg, "z21gw-watchdog")
+	defer nc.Drain()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	if err := NewWatchdog(nc, cfg).Run(ctx); err != nil {
+		cfg.Logger.Fatal().
+			Err(err).
+			Msg("watchdog")
+	}
+	cfg.Logger.Info().Msg("Z21 Gateway watchdog stopped cleanly")
+}
+
+// RunValidateLayout runs the validate-layout subcommand of the z21-gateway binary.
+func RunValidateLayout() {
+	cfg := LoadConfig()
+
+	nc := ConnectNATS(cfg, "z21gw-validate-layout")
+	defer nc.Close()
+
+	report, err := validateLayout(nc, cfg, cfg.ValidateDuration)
+	if err != nil {
+		cfg.Logger.Fatal().
+			Err(err).
+			Msg("validate-layout")
+	}
+	report.write(os.Stdout, cfg.JSONOutput)
+	if !report.ok() {
+		os.Exit(1)
+	}
+}
+
+// RunBench runs the bench subcommand of the z21-gateway binary.
+func RunBench() {
+	cfg := LoadConfig()
+
+	nc := ConnectNATS(cfg, "z21gw-bench")
+	defer nc.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	cfg.Logger.Info().
+		Str("context", cfg.Z21Name).
+		Dur("duration", cfg.Bench.Duration).
+		Int("concurrency", cfg.Bench.Concurrency).
+		Msg("bench")
+
+	report := bench(ctx, nc, cfg.Z21Name, cfg.Bench)
+	report.write(os.Stdout, cfg.JSONOutput)
+}
+
+// RunConformance runs the conformance subcommand of the z21-gateway binary.
+func RunConformance() {
+	cfg := LoadConfig()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	// the probes talk to the Z21 only, the gateway is not started
+	gw, err := New(ctx, nil, cfg)
+	if err != nil {
+		cfg.Logger.Fatal().
+			Err(err).
+			Msg("Z21 conn")
+	}
+	defer gw.closeZ21()
+
+	report := gw.runConformance(cfg.Z21Addr, cfg.Conformance)
+	report.write(os.Stdout, cfg.JSONOutput)
+}
+
+// RunSynthetic runs the synthetic subcommand of the z21-gateway binary.
+func RunSynthetic() {
+	cfg := LoadConfig()
+	if !cfg.Synthetic.enabled() {
+		cfg.Synthetic.Rate = SyntheticRate
+	}
+
+	nc := ConnectNATS(cfg, "z21gw-synthetic")
+	defer nc.Drain()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	s := newSynthGenerator(nc, cfg.Z21Name, cfg.SchemaVersions, cfg.Synthetic, cfg.Logger)
+	if err := s.Run(ctx); err != nil {
+		cfg.Logger.Fatal().
+			Err(err).
+			Msg("synthetic events")
+	}
+}
+
+// RunReplay runs the replay subcommand of the z21-gateway binary.
+func RunReplay() {
+	cfg := LoadConfig()
+	if cfg.Replay.Recording == "" {
+		fmt.Fprintln(os.Stderr, "replay: --replay is required")
+		os.Exit(2)
+	}
+
+	nc := ConnectNATS(cfg, "z21gw-replay")
+	defer nc.Drain()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	r := &replayer{
+		nc:       nc,
+		device:   cfg.Z21Name,
+		versions: cfg.SchemaVersions,
+		opts:     cfg.Replay,
+		logger:   cfg.Logger,
+	}
+	if err := r.Run(ctx); err != nil {
+		cfg.Logger.Fatal().
+			Err(err).
+			Msg("replay")
+	}
+}
@@ -0,0 +1,153 @@
+package gateway
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+	"github.com/trains-io/z21.go"
+)
+
+// cmdRequest is a command in flight.
+type cmdRequest struct {
+	name    string
+	msg     *nats.Msg
+	profile *Profile
+	// dryRun is set by a "dry_run": true payload field; the command is
+	// validated and resolved but not sent to the Z21.
+	dryRun bool
+	// logger tags every line logged for the command with its request ID,
+	// device and command name.
+	logger zerolog.Logger
+	timing *cmdTiming
+}
+
+// commandLogger returns the logger of a command with the given request ID.
+func (g *Gateway) commandLogger(name, id string) zerolog.Logger {
+	return g.logger.With().
+		Str("request_id", id).
+		Str("device", g.name).
+		Str("command", name).
+		Logger()
+}
+
+func newCmdRequest(g *Gateway, name string, msg *nats.Msg, logger zerolog.Logger, timing *cmdTiming) *cmdRequest {
+	var opts struct {
+		DryRun bool `json:"dry_run"`
+	}
+	// payloads that are not JSON objects are rejected by the handler
+	_ = json.Unmarshal(msg.Data, &opts)
+
+	return &cmdRequest{
+		name:    name,
+		msg:     msg,
+		profile: g.clientProfile(msg),
+		dryRun:  opts.DryRun,
+		logger:  logger,
+		timing:  timing,
+	}
+}
+
+type command struct {
+	// local handles the command in the gateway, which builds the Z21
+	// request itself if one is needed.
+	local func(g *Gateway, cr *cmdRequest) CmdReply
+}
+
+// commands maps the subject suffix after z21.<name>.cmd. to its command.
+// It is set in init, as the device commands start gateways which look up
+// their commands in it, and route.set runs its steps as commands.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"accessory.cv.read":   {local: localCommand((*Gateway).handleAccessoryCVRead)},
+		"accessory.cv.write":  {local: localCommand((*Gateway).handleAccessoryCVWrite)},
+		"can.devices":         {local: localCommand((*Gateway).handleCANDevices)},
+		"can.discover":        {local: localCommand((*Gateway).handleCanDiscover)},
+		"state.get":           {local: localCommand((*Gateway).handleStateGet)},
+		"stats.events":        {local: localCommand((*Gateway).handleStatsEvents)},
+		"capabilities.get":    {local: localCommand((*Gateway).handleCapabilitiesGet)},
+		"gateway.stop":        {local: localCommand((*Gateway).handleGatewayStop)},
+		"power.off":           {local: localCommand((*Gateway).handlePowerOff)},
+		"debug.raw":           {local: localCommand((*Gateway).handleDebugRaw)},
+		"debug.pcap.start":    {local: localCommand((*Gateway).handlePcapStart)},
+		"debug.pcap.stop":     {local: localCommand((*Gateway).handlePcapStop)},
+		"device.attach":       {local: localCommand((*Gateway).handleDeviceAttach)},
+		"device.detach":       {local: localCommand((*Gateway).handleDeviceDetach)},
+		"device.list":         {local: localCommand((*Gateway).handleDeviceList)},
+		"loco.drive":          {local: localCommand((*Gateway).handleDrive)},
+		"loco.seen":           {local: localCommand((*Gateway).handleLocoSeen)},
+		"loco.purge":          {local: localCommand((*Gateway).handlePurge)},
+		"loco.functions":      {local: localCommand((*Gateway).handleFunctions)},
+		"turnout.mode.get":    {local: localCommand((*Gateway).handleTurnoutModeGet)},
+		"turnout.mode.set":    {local: localCommand((*Gateway).handleTurnoutModeSet)},
+		"turnout.set":         {local: localCommand((*Gateway).handleTurnoutSet)},
+		"route.set":           {local: localCommand((*Gateway).handleRouteSet)},
+		"signal.set":          {local: localCommand((*Gateway).handleSignalSet)},
+		"cv.speedmatch":       {local: localCommand((*Gateway).handleSpeedMatch)},
+		"cv.template.apply":   {local: localCommand((*Gateway).handleTemplateApply)},
+		"cv.pom.read":         {local: localCommand((*Gateway).handlePOMRead)},
+		"cv.template.list":    {local: localCommand((*Gateway).handleTemplateList)},
+		"job.get":             {local: localCommand((*Gateway).handleJobGet)},
+		"job.cancel":          {local: localCommand((*Gateway).handleJobCancel)},
+		"lcc.send":            {local: localCommand((*Gateway).handleLCCSend)},
+		"prog.backup":         {local: localCommand((*Gateway).handleBackup)},
+		"prog.restore":        {local: localCommand((*Gateway).handleRestore)},
+		"prog.register.read":  {local: localCommand((*Gateway).handleRegisterRead)},
+		"prog.register.write": {local: localCommand((*Gateway).handleRegisterWrite)},
+		"prog.mm.write":       {local: localCommand((*Gateway).handleMMWrite)},
+		"record.start":        {local: localCommand((*Gateway).handleRecordStart)},
+		"record.stop":         {local: localCommand((*Gateway).handleRecordStop)},
+	}
+}
+
+// localCommand adapts a handler taking a payload of type T decoded by
+// decodeCommand. An empty payload decodes to the zero T.
+func localCommand[T any](handle func(*Gateway, *cmdRequest, *T) CmdReply) func(*Gateway, *cmdRequest) CmdReply {
+	return func(g *Gateway, cr *cmdRequest) CmdReply {
+		req := new(T)
+		if len(cr.msg.Data) > 0 {
+			if err := decodeCommand(cr.msg.Data, req); err != nil {
+				return g.handleError(cr, err)
+			}
+		}
+		return handle(g, cr, req)
+	}
+}
+
+type canDiscoverRequest struct{}
+
+func (g *Gateway) handleCanDiscover(cr *cmdRequest, req *canDiscoverRequest) CmdReply {
+	return g.handleRequest(cr, &z21.CanDetector{})
+}
+
+// unknownCommand is the command name the latency histograms and the service
+// stats record unknown commands under, so that clients cannot create a
+// series per made up name.
+const unknownCommand = "unknown"
+
+// metricCommand returns name if it is a command of the gateway or of a
+// plugin, unknownCommand otherwise.
+func (g *Gateway) metricCommand(name string) string {
+	if _, ok := commands[name]; ok {
+		return name
+	}
+	if _, ok := g.pluginCommands[name]; ok {
+		return name
+	}
+	return unknownCommand
+}
+
+func (g *Gateway) supportedCommands() []string {
+	names := make([]string, 0, len(commands)+len(g.pluginCommands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	for name := range g.pluginCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
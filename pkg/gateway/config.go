@@ -0,0 +1,1234 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+	"github.com/trains-io/z21.go"
+)
+
+type Config struct {
+	Z21Name         string
+	InstanceID      string
+	Z21Addr         string
+	Z21Serial       uint32
+	Z21BackupAddr   string
+	Z21BackupSerial uint32
+	FailoverAfter   time.Duration
+	// Bind is the local address or interface the Z21 sockets are bound
+	// to, empty for the one the routing table picks.
+	Bind string
+	// UDPReadBuffer and UDPWriteBuffer are the buffer sizes of the relay
+	// sockets in bytes, 0 for the OS default; UDPReaders is the number of
+	// goroutines reading the datagrams of the Z21.
+	UDPReadBuffer     int
+	UDPWriteBuffer    int
+	UDPReaders        int
+	NATSURL           string
+	NATSAuth          NATSAuth
+	MirrorURL         string
+	MirrorCreds       string
+	MirrorBuffer      int
+	LegacySubjects    bool
+	SchemaVersions    []int
+	NodeRED           bool
+	Homie             bool
+	HomieInterval     time.Duration
+	DCCPackets        bool
+	HeartbeatInterval time.Duration
+	CommandPools      map[string]int
+	CommandQueue      int
+	SlowCommand       time.Duration
+	Replies           string
+	BatchWindow       time.Duration
+	BatchKinds        []string
+	StateLimit        int
+	MaxGoroutines     int
+	MaxHeapMB         int
+	GuardRestart      bool
+	Probe             string
+	ProbeTimeout      time.Duration
+	StatusInterval    time.Duration
+	MetricsInterval   time.Duration
+	MetricsAddr       string
+	DashboardAddr     string
+	SRCPAddr          string
+	PurgeOnRelease    bool
+	TCPBridgeAddr     string
+	TCPBridgeClients  int
+	LCCAddr           string
+	LCCNodeID         uint64
+	LivenessTimeout   time.Duration
+	BroadcastTimeout  time.Duration
+	BroadcastRefresh  time.Duration
+	BroadcastFlags    z21.Mask32
+	WebhookURL        string
+	CurrentRules      []CurrentRule
+	RatedCurrent      float64
+
+	TemperatureWarning  float64
+	TemperatureCritical float64
+
+	SelfTest          bool
+	SelfTestMandatory []string
+	SelfTestTurnout   uint16
+
+	IdlePowerOff    time.Duration
+	PowerOffAt      time.Duration
+	PowerOffWarning time.Duration
+
+	AccessoryOffset int
+	BackupDir       string
+
+	TLSConfig *tls.Config
+
+	JetStreamStream     string
+	JetStreamMaxDeliver int
+	IdempotencyWindow   time.Duration
+	LayoutBucket        string
+
+	Record          bool
+	RecordingBucket string
+	PcapDir         string
+
+	Chaos     ChaosConfig
+	Synthetic SyntheticConfig
+
+	Capabilities *CapabilityReport
+	Conformance  ConformanceOptions
+
+	File     *FileConfig
+	Profiles map[string]Profile
+	Names    *nameIndex
+	Blocks   *blockIndex
+	// SpeedSteps holds the configured speed step modes by loco address.
+	SpeedSteps map[uint16]uint8
+
+	ValidateDuration time.Duration
+	JSONOutput       bool
+
+	Bench BenchOptions
+
+	Replay ReplayOptions
+
+	Logger zerolog.Logger
+	// LogHooks are attached to the NATS connection once it is connected.
+	LogHooks []LogHook
+	// LogSample logs 1 in LogSample published events per event kind.
+	LogSample int
+}
+
+var usageStr = `The z21-gateway is a lightweight gateway application that bridges a z21 device
+to a NATS message bus.
+
+Usage: z21-gateway [options]
+       z21-gateway watchdog [options]
+       z21-gateway validate-layout [options]
+       z21-gateway synthetic [options]
+       z21-gateway bench [options]
+       z21-gateway replay [options]
+       z21-gateway conformance [options]
+       z21-gateway version
+
+Gateway Options:
+	-zc, --z21_addr <host[:port]>  z21 address, IPv6 as [addr]:port
+	                               (default: 127.0.0.1:21105)
+	    --z21_serial <serial>      only accept the z21 of this serial number
+	                               on the z21 address (default: any)
+	    --z21_backup_addr <host[:port]>
+	                               backup z21 switched to when the z21 is
+	                               unreachable (default: none)
+	    --z21_backup_serial <serial>
+	                               only accept the backup z21 of this serial
+	                               number (default: any)
+	    --failover_after <d>       unreachability after which the gateway
+	                               switches z21 (default: 30s)
+	    --bind <addr|interface>    local address or interface the z21
+	                               sockets are bound to (default: any)
+	    --udp_read_buffer <bytes>  receive buffer of the z21 relay sockets
+	                               (default: OS default)
+	    --udp_write_buffer <bytes> send buffer of the z21 relay sockets
+	                               (default: OS default)
+	    --udp_readers <n>          goroutines reading the datagrams of the
+	                               z21 (default: 1)
+	-nc, --nats_url <host>         NATS server URL (default: nats://127.0.0.1:4222)
+	    --nats_user <user>         NATS user; the password is read from
+	                               --nats_password_file, --nats_creds_cmd or
+	                               Z21_NATS_PASSWORD
+	    --nats_password_file <file>
+	                               file holding the NATS password
+	    --nats_token_file <file>   file holding the NATS token; without it
+	                               the token is read from --nats_creds_cmd or
+	                               Z21_NATS_TOKEN
+	    --nats_creds <file>        NATS credentials (JWT and seed) file
+	    --nats_nkey <file>         NATS NKey seed file
+	    --nats_creds_cmd <cmd>     command printing the NATS password or token,
+	                               run with sh -c on every connect
+	    --mirror_url <url>         second NATS server the published messages
+	                               are mirrored to (default: none)
+	    --mirror_creds <file>      NATS credentials file of the mirror
+	    --mirror_buffer <MiB>      reconnect buffer of the mirror (default: 8)
+	-n, --name
+	    --z21_name <z21_name>      z21 name (default: main)
+	    --instance_id <id>         ID of the gateway process in its messages
+	                               (default: the host name and a random
+	                               suffix)
+	-c, --config <file>            YAML config file
+	    --legacy_subjects          publish events on the pre-taxonomy
+	                               event.<String()> subjects (default: false)
+	    --schema_version <v[,v]>   payload schema versions to publish, the first
+	                               one being the primary (default: 1)
+	    --nodered                  also publish flat Node-RED payloads on
+	                               z21.<name>.nodered.<subject> (default: false)
+	    --homie                    publish a Homie 4 device on homie.z21-<name>
+	                               (default: false)
+	    --homie_interval <d>       interval the Homie device is announced at
+	                               (default: 1m)
+	    --dcc_packets              publish the DCC packets decoded from LocoNet
+	                               immediate packets (default: false)
+	    --heartbeat_interval <d>   z21 reachability probe interval (default: 5s)
+	    --command_pools <pools>    command slots per class, e.g. drive=16
+	                               (default: drive=8,accessory=1,prog=1,
+	                               other=4)
+	    --command_queue <n>        commands per class waiting for a slot
+	                               before further ones are rejected as busy
+	                               (default: 64)
+	    --slow_command <d>         warn about commands taking longer than <d>
+	                               end to end (default: 0, disabled)
+	    --replies <mode>           commands without a reply inbox: fallback
+	                               answers on z21.<name>.reply, required
+	                               rejects them (default: fallback)
+	    --batch_window <d>         publish the events of the batched kinds
+	                               received within <d> as one message
+	                               (default: 0, disabled)
+	    --batch_kinds <kinds>      event kinds to batch (default: can,rbus)
+	    --state_limit <n>          event subjects kept for state.get
+	                               (default: 16384)
+	    --max_goroutines <n>       warn above <n> goroutines, 0 disables
+	                               (default: 1000)
+	    --max_heap_mb <n>          warn above <n> MiB heap, 0 disables
+	                               (default: 256)
+	    --guard_restart            stop with exit status 3 for a restart
+	                               while a limit stays exceeded
+	                               (default: false)
+	    --probe <request>          z21 reachability probe request: serial,
+	                               status, hwinfo, systemstate
+	                               (default: serial)
+	    --probe_timeout <d>        z21 reachability probe timeout
+	                               (default: 500ms)
+	    --status_interval <d>      status keepalive interval; changes are
+	                               published immediately (default: 20s)
+	    --metrics_interval <d>     interval metrics are published on
+	                               z21.<name>.metrics; 0 disables (default: 15s)
+	    --metrics_addr <addr>      serve Prometheus metrics on
+	                               http://<addr>/metrics (default: disabled)
+	    --dashboard_addr <addr>    serve the web dashboard on http://<addr>/
+	                               (default: disabled)
+	    --srcp_addr <addr>         serve SRCP, e.g. for Rocrail, on <addr>
+	                               (default: disabled)
+	    --purge_on_release         stop and purge the locos of an SRCP session
+	                               when it releases them or ends
+	                               (default: false)
+	    --tcp_bridge_addr <addr>   tunnel the Z21 LAN protocol over TCP on
+	                               <addr> (default: disabled)
+	    --tcp_bridge_clients <n>   concurrent TCP bridge clients (default: 4)
+	    --lcc_addr <addr>          OpenLCB GridConnect TCP hub, or CAN-USB
+	                               adapter device path (default: disabled)
+	    --lcc_node_id <id>         OpenLCB node ID of the gateway, e.g.
+	                               05.01.01.01.22.01
+	    --broadcast_timeout <d>    warn and re-subscribe when no broadcast was
+	                               received for this long; 0 disables
+	                               (default: 2m)
+	    --broadcast_refresh <d>    re-assert the broadcast subscription at this
+	                               interval; 0 disables (default: 0)
+	    --broadcast_flags <flags>  comma separated broadcast flags to subscribe
+	                               to, e.g. system,can_booster (default:
+	                               system,can_detector)
+	    --webhook_url <url>        URL warnings are posted to by webhook actions
+	    --current_rules <rules>    comma separated track current rules
+	                               <mA>[%]:<duration>:<action>[+<action>...]
+	                               with actions warn, webhook, poweroff
+	                               (e.g. 2500:5s:warn,90%:2s:warn+poweroff)
+	    --rated_current <mA>       rated main track current current rules in
+	                               percent refer to (default: by model)
+	    --temp_warning <°C>        temperature raising a warning alarm;
+	                               0 disables (default: 60)
+	    --temp_critical <°C>       temperature raising a critical alarm;
+	                               0 disables (default: 75)
+	    --selftest                 run the self-test on start and refuse to
+	                               start if a mandatory step fails
+	    --selftest_mandatory <s>   comma separated mandatory self-test steps
+	                               (default: serial,hwinfo,systemstate)
+	    --selftest_turnout <addr>  turnout toggled by the self-test; 0 skips
+	                               the step (default: 0)
+	    --idle_poweroff <d>        switch the track power off after this long
+	                               without drive or accessory commands or
+	                               occupancy changes; 0 disables (default: 0)
+	    --poweroff_at <HH:MM>      switch the track power off every day at this
+	                               local time (default: disabled)
+	    --poweroff_warning <d>     lead time of the warning published before a
+	                               power-off (default: 1m)
+	    --accessory_offset <n>     added to accessory addresses sent to the z21
+	                               and subtracted from broadcasts, e.g. 4 for
+	                               decoders numbered per DCC spec (default: 0)
+	    --backup_dir <dir>         directory named CV backups are stored in
+	                               (default: disabled)
+	    --tls_cert <file>          TLS certificate of the HTTP listeners
+	    --tls_key <file>           TLS key of the HTTP listeners
+	    --tls_client_ca <file>     require client certificates signed by this
+	                               CA on the HTTP listeners
+	    --jetstream_stream <name>  also consume commands from this JetStream
+	                               work-queue stream (default: disabled)
+	    --jetstream_max_deliver <n>
+	                               deliveries of a queued command failing for
+	                               a transient reason (default: 5)
+	    --idempotency_window <d>   how long queued commands are deduplicated
+	                               by message ID (default: 2m)
+	    --layout_bucket <name>     JetStream KV bucket the blocks and trains
+	                               are shared in with the other gateways of
+	                               the layout (default: disabled)
+	    --record                   record the session into the Object Store
+	                               until the gateway stops
+	    --recording_bucket <name>  Object Store bucket of recordings
+	                               (default: z21-recordings)
+	    --pcap_dir <dir>           directory of debug.pcap captures
+	                               (default: the temporary directory)
+	    --chaos <faults>           inject faults for testing, e.g.
+	                               timeout=0.1,drop=0.05 (default: disabled)
+	    --capabilities <file>      reject the commands a conformance report
+	                               marks as unsupported (default: disabled)
+	    --synthetic <settings>     also publish synthetic events as device
+	                               <name>-synthetic, e.g. rate=200,locos=20
+	                               (default: disabled)
+	    --log_format <format>      log output format: console, json
+	                               (default: console)
+	    --nats_log_level <level>   also publish log records of this level and
+	                               above on z21.<name>.gateway.log, e.g. warn
+	                               (default: disabled)
+	    --log_sample <n>           log 1 in <n> published events per event
+	                               kind, plus a summary every minute
+	                               (default: 1, every event)
+
+Watchdog Options:
+	    --liveness_timeout <d>     gateway status silence after which the
+	                               watchdog announces a gateway as offline
+	                               (default: 1m30s)
+
+Validate Layout Options:
+	    --validate_duration <d>    how long to listen for detector events
+	                               (default: 1m)
+	    --json                     print the report as JSON
+
+Bench Options:
+	    --bench_duration <d>       how long to send commands (default: 30s)
+	    --bench_concurrency <n>    number of concurrent clients (default: 4)
+	    --bench_timeout <d>        request timeout (default: 2s)
+	    --bench_mix <mix>          commands and weights, e.g.
+	                               'state.get:3;loco.drive:1={"address":3}'
+	                               (default: state.get)
+	    --bench_dry_run            send the commands as dry runs
+	    --json                     print the report as JSON
+
+Replay Options:
+	    --replay <recording>       recording file, or object in the
+	                               --recording_bucket, to replay
+	    --replay_speed <factor>    replay speed, 2 is twice as fast
+	                               (default: 1)
+
+Conformance Options:
+	    --conformance_loco <addr>  loco to drive at speed 0 and read CV 1 of
+	                               on the main track (default: skipped)
+	    --conformance_turnout <addr>
+	                               turnout to switch to output 1 and back
+	                               (default: skipped)
+	    --conformance_prog         read CV 8 on the programming track
+	    --json                     print the report as JSON
+
+Environment Variables:
+	Z21_NAME (overridden by --z21_name)
+	Z21_INSTANCE_ID (overridden by --instance_id)
+	Z21_ADDR (overridden by --z21_addr)
+	Z21_SERIAL (overridden by --z21_serial)
+	Z21_BACKUP_ADDR (overridden by --z21_backup_addr)
+	Z21_BACKUP_SERIAL (overridden by --z21_backup_serial)
+	Z21_FAILOVER_AFTER (overridden by --failover_after)
+	Z21_BIND (overridden by --bind)
+	Z21_UDP_READ_BUFFER (overridden by --udp_read_buffer)
+	Z21_UDP_WRITE_BUFFER (overridden by --udp_write_buffer)
+	Z21_UDP_READERS (overridden by --udp_readers)
+	NATS_URL (overridden by --nats_url)
+	Z21_NATS_USER (overridden by --nats_user)
+	Z21_NATS_PASSWORD_FILE (overridden by --nats_password_file)
+	Z21_NATS_TOKEN_FILE (overridden by --nats_token_file)
+	Z21_NATS_CREDS (overridden by --nats_creds)
+	Z21_NATS_NKEY (overridden by --nats_nkey)
+	Z21_NATS_CREDS_CMD (overridden by --nats_creds_cmd)
+	Z21_NATS_PASSWORD (NATS password, if no file or command is set)
+	Z21_NATS_TOKEN (NATS token, if no file or command is set)
+	Z21_MIRROR_URL (overridden by --mirror_url)
+	Z21_MIRROR_CREDS (overridden by --mirror_creds)
+	Z21_MIRROR_BUFFER (overridden by --mirror_buffer)
+	Z21_CONFIG (overridden by --config)
+	Z21_LEGACY_SUBJECTS (overridden by --legacy_subjects)
+	Z21_SCHEMA_VERSION (overridden by --schema_version)
+	Z21_NODERED (overridden by --nodered)
+	Z21_HOMIE (overridden by --homie)
+	Z21_HOMIE_INTERVAL (overridden by --homie_interval)
+	Z21_DCC_PACKETS (overridden by --dcc_packets)
+	Z21_HEARTBEAT_INTERVAL (overridden by --heartbeat_interval)
+	Z21_COMMAND_POOLS (overridden by --command_pools)
+	Z21_COMMAND_QUEUE (overridden by --command_queue)
+	Z21_SLOW_COMMAND (overridden by --slow_command)
+	Z21_REPLIES (overridden by --replies)
+	Z21_BATCH_WINDOW (overridden by --batch_window)
+	Z21_BATCH_KINDS (overridden by --batch_kinds)
+	Z21_STATE_LIMIT (overridden by --state_limit)
+	Z21_MAX_GOROUTINES (overridden by --max_goroutines)
+	Z21_MAX_HEAP_MB (overridden by --max_heap_mb)
+	Z21_GUARD_RESTART (overridden by --guard_restart)
+	Z21_PROBE (overridden by --probe)
+	Z21_PROBE_TIMEOUT (overridden by --probe_timeout)
+	Z21_STATUS_INTERVAL (overridden by --status_interval)
+	Z21_METRICS_INTERVAL (overridden by --metrics_interval)
+	Z21_METRICS_ADDR (overridden by --metrics_addr)
+	Z21_DASHBOARD_ADDR (overridden by --dashboard_addr)
+	Z21_SRCP_ADDR (overridden by --srcp_addr)
+	Z21_PURGE_ON_RELEASE (overridden by --purge_on_release)
+	Z21_TCP_BRIDGE_ADDR (overridden by --tcp_bridge_addr)
+	Z21_TCP_BRIDGE_CLIENTS (overridden by --tcp_bridge_clients)
+	Z21_LCC_ADDR (overridden by --lcc_addr)
+	Z21_LCC_NODE_ID (overridden by --lcc_node_id)
+	Z21_BROADCAST_TIMEOUT (overridden by --broadcast_timeout)
+	Z21_BROADCAST_REFRESH (overridden by --broadcast_refresh)
+	Z21_BROADCAST_FLAGS (overridden by --broadcast_flags)
+	Z21_WEBHOOK_URL (overridden by --webhook_url)
+	Z21_CURRENT_RULES (overridden by --current_rules)
+	Z21_RATED_CURRENT (overridden by --rated_current)
+	Z21_TEMP_WARNING (overridden by --temp_warning)
+	Z21_TEMP_CRITICAL (overridden by --temp_critical)
+	Z21_SELFTEST (overridden by --selftest)
+	Z21_SELFTEST_MANDATORY (overridden by --selftest_mandatory)
+	Z21_SELFTEST_TURNOUT (overridden by --selftest_turnout)
+	Z21_IDLE_POWEROFF (overridden by --idle_poweroff)
+	Z21_POWEROFF_AT (overridden by --poweroff_at)
+	Z21_POWEROFF_WARNING (overridden by --poweroff_warning)
+	Z21_ACCESSORY_OFFSET (overridden by --accessory_offset)
+	Z21_BACKUP_DIR (overridden by --backup_dir)
+	Z21_TLS_CERT (overridden by --tls_cert)
+	Z21_TLS_KEY (overridden by --tls_key)
+	Z21_TLS_CLIENT_CA (overridden by --tls_client_ca)
+	Z21_JETSTREAM_STREAM (overridden by --jetstream_stream)
+	Z21_JETSTREAM_MAX_DELIVER (overridden by --jetstream_max_deliver)
+	Z21_IDEMPOTENCY_WINDOW (overridden by --idempotency_window)
+	Z21_LAYOUT_BUCKET (overridden by --layout_bucket)
+	Z21_RECORD (overridden by --record)
+	Z21_RECORDING_BUCKET (overridden by --recording_bucket)
+	Z21_PCAP_DIR (overridden by --pcap_dir)
+	Z21_CHAOS (overridden by --chaos)
+	Z21_CAPABILITIES (overridden by --capabilities)
+	Z21_SYNTHETIC (overridden by --synthetic)
+	Z21_LOG_FORMAT (overridden by --log_format)
+	Z21_NATS_LOG_LEVEL (overridden by --nats_log_level)
+	Z21_LOG_SAMPLE (overridden by --log_sample)
+	Z21_LIVENESS_TIMEOUT (overridden by --liveness_timeout)
+	Z21_VALIDATE_DURATION (overridden by --validate_duration)
+	Z21_BENCH_DURATION (overridden by --bench_duration)
+	Z21_BENCH_CONCURRENCY (overridden by --bench_concurrency)
+	Z21_BENCH_TIMEOUT (overridden by --bench_timeout)
+	Z21_BENCH_MIX (overridden by --bench_mix)
+	Z21_REPLAY_SPEED (overridden by --replay_speed)
+`
+
+// ParseConfig parses the command line arguments args, without the program
+// name, on top of the Z21_* environment variables and the defaults.
+func ParseConfig(args []string) (Config, error) {
+	fs := flag.NewFlagSet("z21-gateway", flag.ContinueOnError)
+	// LoadConfig prints the errors and the usage
+	fs.SetOutput(io.Discard)
+
+	defaultZ21Name := getenv("Z21_NAME", z21.DefaultName)
+	defaultInstanceID := getenv("Z21_INSTANCE_ID", "")
+	defaultZ21Addr := getenv("Z21_ADDR", z21.DefaultURL)
+	defaultZ21Serial := getenvUint("Z21_SERIAL", 0)
+	defaultZ21BackupAddr := getenv("Z21_BACKUP_ADDR", "")
+	defaultZ21BackupSerial := getenvUint("Z21_BACKUP_SERIAL", 0)
+	defaultFailoverAfter := getenvDuration("Z21_FAILOVER_AFTER", FailoverAfter)
+	defaultBind := getenv("Z21_BIND", "")
+	defaultUDPReadBuffer := getenvInt("Z21_UDP_READ_BUFFER", 0)
+	defaultUDPWriteBuffer := getenvInt("Z21_UDP_WRITE_BUFFER", 0)
+	defaultUDPReaders := getenvInt("Z21_UDP_READERS", 1)
+	defaultNATSURL := getenv("NATS_URL", nats.DefaultURL)
+	defaultNATSAuth := NATSAuth{
+		User:         getenv("Z21_NATS_USER", ""),
+		PasswordFile: getenv("Z21_NATS_PASSWORD_FILE", ""),
+		TokenFile:    getenv("Z21_NATS_TOKEN_FILE", ""),
+		CredsFile:    getenv("Z21_NATS_CREDS", ""),
+		NkeyFile:     getenv("Z21_NATS_NKEY", ""),
+		CredsCmd:     getenv("Z21_NATS_CREDS_CMD", ""),
+	}
+	defaultMirrorURL := getenv("Z21_MIRROR_URL", "")
+	defaultMirrorCreds := getenv("Z21_MIRROR_CREDS", "")
+	defaultMirrorBuffer := getenvInt("Z21_MIRROR_BUFFER", MirrorBuffer)
+	defaultConfigFile := getenv("Z21_CONFIG", "")
+	defaultLegacySubjects := getenvBool("Z21_LEGACY_SUBJECTS", false)
+	defaultSchemaVersion := getenv("Z21_SCHEMA_VERSION", "1")
+	defaultNodeRED := getenvBool("Z21_NODERED", false)
+	defaultHomie := getenvBool("Z21_HOMIE", false)
+	defaultHomieInterval := getenvDuration("Z21_HOMIE_INTERVAL", HomieInterval)
+	defaultDCCPackets := getenvBool("Z21_DCC_PACKETS", false)
+	defaultHeartbeatInterval := getenvDuration("Z21_HEARTBEAT_INTERVAL", HeartbeatInterval)
+	defaultCommandPools := getenv("Z21_COMMAND_POOLS", "")
+	defaultCommandQueue := getenvInt("Z21_COMMAND_QUEUE", CommandQueue)
+	defaultSlowCommand := getenvDuration("Z21_SLOW_COMMAND", 0)
+	defaultReplies := getenv("Z21_REPLIES", RepliesFallback)
+	defaultBatchWindow := getenvDuration("Z21_BATCH_WINDOW", 0)
+	defaultBatchKinds := getenv("Z21_BATCH_KINDS", BatchKinds)
+	defaultStateLimit := getenvInt("Z21_STATE_LIMIT", StateLimit)
+	defaultMaxGoroutines := getenvInt("Z21_MAX_GOROUTINES", MaxGoroutines)
+	defaultMaxHeapMB := getenvInt("Z21_MAX_HEAP_MB", MaxHeapMB)
+	defaultGuardRestart := getenvBool("Z21_GUARD_RESTART", false)
+	defaultProbe := getenv("Z21_PROBE", ProbeSerial)
+	defaultProbeTimeout := getenvDuration("Z21_PROBE_TIMEOUT", RequestTimeout)
+	defaultStatusInterval := getenvDuration("Z21_STATUS_INTERVAL", StatusInterval)
+	defaultMetricsInterval := getenvDuration("Z21_METRICS_INTERVAL", MetricsInterval)
+	defaultMetricsAddr := getenv("Z21_METRICS_ADDR", "")
+	defaultDashboardAddr := getenv("Z21_DASHBOARD_ADDR", "")
+	defaultSRCPAddr := getenv("Z21_SRCP_ADDR", "")
+	defaultPurgeOnRelease := getenvBool("Z21_PURGE_ON_RELEASE", false)
+	defaultTCPBridgeAddr := getenv("Z21_TCP_BRIDGE_ADDR", "")
+	defaultTCPBridgeClients := getenvInt("Z21_TCP_BRIDGE_CLIENTS", TCPBridgeClients)
+	defaultLCCAddr := getenv("Z21_LCC_ADDR", "")
+	defaultLCCNodeID := getenv("Z21_LCC_NODE_ID", "")
+	defaultLivenessTimeout := getenvDuration("Z21_LIVENESS_TIMEOUT", LivenessTimeout)
+	defaultValidateDuration := getenvDuration("Z21_VALIDATE_DURATION", ValidateDuration)
+	defaultBenchDuration := getenvDuration("Z21_BENCH_DURATION", BenchDuration)
+	defaultBenchConcurrency := getenvInt("Z21_BENCH_CONCURRENCY", BenchConcurrency)
+	defaultBenchTimeout := getenvDuration("Z21_BENCH_TIMEOUT", BenchTimeout)
+	defaultBenchMix := getenv("Z21_BENCH_MIX", BenchMix)
+	defaultReplaySpeed := getenvFloat("Z21_REPLAY_SPEED", ReplaySpeed)
+	defaultBroadcastTimeout := getenvDuration("Z21_BROADCAST_TIMEOUT", BroadcastTimeout)
+	defaultBroadcastRefresh := getenvDuration("Z21_BROADCAST_REFRESH", 0)
+	defaultBroadcastFlags := getenv("Z21_BROADCAST_FLAGS", "")
+	defaultWebhookURL := getenv("Z21_WEBHOOK_URL", "")
+	defaultCurrentRules := getenv("Z21_CURRENT_RULES", "")
+	defaultRatedCurrent := getenvFloat("Z21_RATED_CURRENT", 0)
+	defaultTempWarning := getenvFloat("Z21_TEMP_WARNING", TemperatureWarning)
+	defaultTempCritical := getenvFloat("Z21_TEMP_CRITICAL", TemperatureCritical)
+	defaultSelfTest := getenvBool("Z21_SELFTEST", false)
+	defaultSelfTestMandatory := getenv("Z21_SELFTEST_MANDATORY", "serial,hwinfo,systemstate")
+	defaultSelfTestTurnout := getenvUint("Z21_SELFTEST_TURNOUT", 0)
+	defaultIdlePowerOff := getenvDuration("Z21_IDLE_POWEROFF", 0)
+	defaultPowerOffAt := getenv("Z21_POWEROFF_AT", "")
+	defaultPowerOffWarning := getenvDuration("Z21_POWEROFF_WARNING", PowerOffWarning)
+	defaultAccessoryOffset := getenvInt("Z21_ACCESSORY_OFFSET", 0)
+	defaultBackupDir := getenv("Z21_BACKUP_DIR", "")
+	defaultTLSCert := getenv("Z21_TLS_CERT", "")
+	defaultTLSKey := getenv("Z21_TLS_KEY", "")
+	defaultTLSClientCA := getenv("Z21_TLS_CLIENT_CA", "")
+	defaultJetStreamStream := getenv("Z21_JETSTREAM_STREAM", "")
+	defaultJetStreamMaxDeliver := getenvInt("Z21_JETSTREAM_MAX_DELIVER", JetStreamMaxDeliver)
+	defaultIdempotencyWindow := getenvDuration("Z21_IDEMPOTENCY_WINDOW", IdempotencyWindow)
+	defaultLayoutBucket := getenv("Z21_LAYOUT_BUCKET", "")
+	defaultRecord := getenvBool("Z21_RECORD", false)
+	defaultRecordingBucket := getenv("Z21_RECORDING_BUCKET", RecordingBucket)
+	defaultPcapDir := getenv("Z21_PCAP_DIR", os.TempDir())
+	defaultChaos := getenv("Z21_CHAOS", "")
+	defaultCapabilities := getenv("Z21_CAPABILITIES", "")
+	defaultSynthetic := getenv("Z21_SYNTHETIC", "")
+	defaultLogFormat := getenv("Z21_LOG_FORMAT", "console")
+	defaultNATSLogLevel := getenv("Z21_NATS_LOG_LEVEL", "")
+	defaultLogSample := getenvInt("Z21_LOG_SAMPLE", 1)
+
+	var (
+		z21Name         string
+		instanceID      string
+		z21Addr         string
+		z21Serial       uint
+		z21BackupAddr   string
+		z21BackupSerial uint
+		failoverAfter   time.Duration
+		bind            string
+		udpReadBuffer   int
+		udpWriteBuffer  int
+		udpReaders      int
+		natsURL         string
+		natsAuth        NATSAuth
+		mirrorURL       string
+		mirrorCreds     string
+		mirrorBuffer    int
+		configFile      string
+		legacySubjects  bool
+		schemaVersion   string
+		nodeRED         bool
+		homie           bool
+		homieInterval   time.Duration
+		dccPackets      bool
+
+		heartbeatInterval time.Duration
+		commandPools      string
+		commandQueue      int
+		slowCommand       time.Duration
+		replies           string
+		batchWindow       time.Duration
+		batchKinds        string
+		stateLimit        int
+		maxGoroutines     int
+		maxHeapMB         int
+		guardRestart      bool
+		probe             string
+		probeTimeout      time.Duration
+		statusInterval    time.Duration
+		metricsInterval   time.Duration
+		metricsAddr       string
+		dashboardAddr     string
+		srcpAddr          string
+		purgeOnRelease    bool
+		tcpBridgeAddr     string
+		tcpBridgeClients  int
+		lccAddr           string
+		lccNodeID         string
+		livenessTimeout   time.Duration
+		broadcastTimeout  time.Duration
+		broadcastRefresh  time.Duration
+		broadcastFlags    string
+
+		webhookURL   string
+		currentRules string
+		ratedCurrent float64
+		tempWarning  float64
+		tempCritical float64
+
+		selfTest          bool
+		selfTestMandatory string
+		selfTestTurnout   uint
+
+		idlePowerOff    time.Duration
+		powerOffAt      string
+		powerOffWarning time.Duration
+
+		accessoryOffset int
+		backupDir       string
+
+		tlsCert     string
+		tlsKey      string
+		tlsClientCA string
+
+		jsStream     string
+		jsMaxDeliver int
+		idemWindow   time.Duration
+		layoutBucket string
+
+		record          bool
+		recordingBucket string
+		pcapDir         string
+
+		chaos        string
+		synthetic    string
+		capabilities string
+
+		logFormat    string
+		natsLogLevel string
+		logSample    int
+
+		validateDuration time.Duration
+		jsonOutput       bool
+
+		benchDuration    time.Duration
+		benchConcurrency int
+		benchTimeout     time.Duration
+		benchMix         string
+		benchDryRun      bool
+
+		replay      string
+		replaySpeed float64
+
+		conformanceLoco    uint
+		conformanceTurnout uint
+		conformanceProg    bool
+	)
+
+	fs.StringVar(&z21Name, "z21_name", defaultZ21Name, "Z21 name")
+	fs.StringVar(&z21Name, "n", defaultZ21Name, "Z21 name (shorthand)")
+	fs.StringVar(&instanceID, "instance_id", defaultInstanceID, "Gateway instance ID")
+
+	fs.StringVar(&z21Addr, "z21_addr", defaultZ21Addr, "Z21 address")
+	fs.StringVar(&z21Addr, "zc", defaultZ21Addr, "Z21 address (shorthand)")
+	fs.UintVar(&z21Serial, "z21_serial", defaultZ21Serial, "Z21 serial number")
+	fs.StringVar(&z21BackupAddr, "z21_backup_addr", defaultZ21BackupAddr, "Backup Z21 address")
+	fs.UintVar(&z21BackupSerial, "z21_backup_serial", defaultZ21BackupSerial, "Backup Z21 serial number")
+	fs.DurationVar(&failoverAfter, "failover_after", defaultFailoverAfter, "Failover delay")
+	fs.StringVar(&bind, "bind", defaultBind, "Local address or interface of the Z21 sockets")
+	fs.IntVar(&udpReadBuffer, "udp_read_buffer", defaultUDPReadBuffer, "Receive buffer of the Z21 relay sockets")
+	fs.IntVar(&udpWriteBuffer, "udp_write_buffer", defaultUDPWriteBuffer, "Send buffer of the Z21 relay sockets")
+	fs.IntVar(&udpReaders, "udp_readers", defaultUDPReaders, "Goroutines reading the Z21 datagrams")
+
+	fs.StringVar(&natsURL, "nats_url", defaultNATSURL, "NATS server URL")
+	fs.StringVar(&natsURL, "nc", defaultNATSURL, "NATS server URL (shorthand)")
+	fs.StringVar(&natsAuth.User, "nats_user", defaultNATSAuth.User, "NATS user")
+	fs.StringVar(&natsAuth.PasswordFile, "nats_password_file", defaultNATSAuth.PasswordFile, "NATS password file")
+	fs.StringVar(&natsAuth.TokenFile, "nats_token_file", defaultNATSAuth.TokenFile, "NATS token file")
+	fs.StringVar(&natsAuth.CredsFile, "nats_creds", defaultNATSAuth.CredsFile, "NATS credentials file")
+	fs.StringVar(&natsAuth.NkeyFile, "nats_nkey", defaultNATSAuth.NkeyFile, "NATS NKey seed file")
+	fs.StringVar(&natsAuth.CredsCmd, "nats_creds_cmd", defaultNATSAuth.CredsCmd, "NATS password or token command")
+	fs.StringVar(&mirrorURL, "mirror_url", defaultMirrorURL, "Mirror NATS server URL")
+	fs.StringVar(&mirrorCreds, "mirror_creds", defaultMirrorCreds, "Mirror NATS credentials file")
+	fs.IntVar(&mirrorBuffer, "mirror_buffer", defaultMirrorBuffer, "Mirror reconnect buffer in MiB")
+
+	fs.StringVar(&configFile, "config", defaultConfigFile, "Config file")
+	fs.StringVar(&configFile, "c", defaultConfigFile, "Config file (shorthand)")
+
+	fs.BoolVar(&legacySubjects, "legacy_subjects", defaultLegacySubjects, "Publish events on legacy subjects")
+
+	fs.StringVar(&schemaVersion, "schema_version", defaultSchemaVersion, "Payload schema versions")
+	fs.BoolVar(&nodeRED, "nodered", defaultNodeRED, "Also publish Node-RED payloads")
+	fs.BoolVar(&homie, "homie", defaultHomie, "Publish a Homie device")
+	fs.DurationVar(&homieInterval, "homie_interval", defaultHomieInterval, "Homie announcement interval")
+	fs.BoolVar(&dccPackets, "dcc_packets", defaultDCCPackets, "Publish decoded DCC packets")
+
+	fs.DurationVar(&heartbeatInterval, "heartbeat_interval", defaultHeartbeatInterval, "Z21 reachability probe interval")
+	fs.StringVar(&commandPools, "command_pools", defaultCommandPools, "Command slots per class")
+	fs.IntVar(&commandQueue, "command_queue", defaultCommandQueue, "Queued commands per class")
+	fs.DurationVar(&slowCommand, "slow_command", defaultSlowCommand, "Slow command warning threshold")
+	fs.StringVar(&replies, "replies", defaultReplies, "Handling of commands without a reply inbox")
+	fs.DurationVar(&batchWindow, "batch_window", defaultBatchWindow, "Event batch window")
+	fs.StringVar(&batchKinds, "batch_kinds", defaultBatchKinds, "Event kinds to batch")
+	fs.IntVar(&stateLimit, "state_limit", defaultStateLimit, "Cached event subjects")
+	fs.IntVar(&maxGoroutines, "max_goroutines", defaultMaxGoroutines, "Goroutine guardrail")
+	fs.IntVar(&maxHeapMB, "max_heap_mb", defaultMaxHeapMB, "Heap guardrail in MiB")
+	fs.BoolVar(&guardRestart, "guard_restart", defaultGuardRestart, "Restart when a guardrail stays exceeded")
+	fs.StringVar(&probe, "probe", defaultProbe, "Z21 reachability probe request")
+	fs.DurationVar(&probeTimeout, "probe_timeout", defaultProbeTimeout, "Z21 reachability probe timeout")
+	fs.DurationVar(&statusInterval, "status_interval", defaultStatusInterval, "Status keepalive interval")
+	fs.DurationVar(&metricsInterval, "metrics_interval", defaultMetricsInterval, "Metrics publish interval")
+	fs.StringVar(&metricsAddr, "metrics_addr", defaultMetricsAddr, "Prometheus metrics listen address")
+	fs.StringVar(&dashboardAddr, "dashboard_addr", defaultDashboardAddr, "Web dashboard listen address")
+	fs.StringVar(&srcpAddr, "srcp_addr", defaultSRCPAddr, "SRCP listen address")
+	fs.BoolVar(&purgeOnRelease, "purge_on_release", defaultPurgeOnRelease, "Purge the locos released by SRCP sessions")
+	fs.StringVar(&tcpBridgeAddr, "tcp_bridge_addr", defaultTCPBridgeAddr, "Z21 TCP bridge listen address")
+	fs.IntVar(&tcpBridgeClients, "tcp_bridge_clients", defaultTCPBridgeClients, "Concurrent Z21 TCP bridge clients")
+	fs.StringVar(&lccAddr, "lcc_addr", defaultLCCAddr, "OpenLCB GridConnect address")
+	fs.StringVar(&lccNodeID, "lcc_node_id", defaultLCCNodeID, "OpenLCB node ID")
+
+	fs.DurationVar(&broadcastTimeout, "broadcast_timeout", defaultBroadcastTimeout, "Z21 broadcast silence timeout")
+	fs.DurationVar(&broadcastRefresh, "broadcast_refresh", defaultBroadcastRefresh, "Z21 broadcast subscription refresh interval")
+	fs.StringVar(&broadcastFlags, "broadcast_flags", defaultBroadcastFlags, "Z21 broadcast flags")
+
+	fs.StringVar(&webhookURL, "webhook_url", defaultWebhookURL, "Webhook URL")
+	fs.StringVar(&currentRules, "current_rules", defaultCurrentRules, "Track current rules")
+	fs.Float64Var(&ratedCurrent, "rated_current", defaultRatedCurrent, "Rated main track current in mA")
+	fs.Float64Var(&tempWarning, "temp_warning", defaultTempWarning, "Temperature warning limit")
+	fs.Float64Var(&tempCritical, "temp_critical", defaultTempCritical, "Temperature critical limit")
+
+	fs.BoolVar(&selfTest, "selftest", defaultSelfTest, "Run the self-test on start")
+	fs.StringVar(&selfTestMandatory, "selftest_mandatory", defaultSelfTestMandatory, "Mandatory self-test steps")
+	fs.UintVar(&selfTestTurnout, "selftest_turnout", defaultSelfTestTurnout, "Self-test turnout address")
+
+	fs.DurationVar(&idlePowerOff, "idle_poweroff", defaultIdlePowerOff, "Idle track power-off timeout")
+	fs.StringVar(&powerOffAt, "poweroff_at", defaultPowerOffAt, "Daily track power-off time")
+	fs.DurationVar(&powerOffWarning, "poweroff_warning", defaultPowerOffWarning, "Track power-off warning lead time")
+
+	fs.IntVar(&accessoryOffset, "accessory_offset", defaultAccessoryOffset, "Accessory address offset")
+	fs.StringVar(&backupDir, "backup_dir", defaultBackupDir, "CV backup directory")
+
+	fs.StringVar(&tlsCert, "tls_cert", defaultTLSCert, "HTTP listener TLS certificate")
+	fs.StringVar(&tlsKey, "tls_key", defaultTLSKey, "HTTP listener TLS key")
+	fs.StringVar(&tlsClientCA, "tls_client_ca", defaultTLSClientCA, "HTTP listener TLS client CA")
+
+	fs.StringVar(&jsStream, "jetstream_stream", defaultJetStreamStream, "JetStream command stream")
+	fs.IntVar(&jsMaxDeliver, "jetstream_max_deliver", defaultJetStreamMaxDeliver, "JetStream command max deliveries")
+	fs.DurationVar(&idemWindow, "idempotency_window", defaultIdempotencyWindow, "Queued command deduplication window")
+	fs.StringVar(&layoutBucket, "layout_bucket", defaultLayoutBucket, "Shared layout state KV bucket")
+
+	fs.BoolVar(&record, "record", defaultRecord, "Record the session")
+	fs.StringVar(&recordingBucket, "recording_bucket", defaultRecordingBucket, "Recording Object Store bucket")
+	fs.StringVar(&pcapDir, "pcap_dir", defaultPcapDir, "Capture directory")
+
+	fs.StringVar(&chaos, "chaos", defaultChaos, "Chaos mode faults")
+	fs.StringVar(&synthetic, "synthetic", defaultSynthetic, "Synthetic event generator settings")
+	fs.StringVar(&capabilities, "capabilities", defaultCapabilities, "Capability report file")
+
+	fs.StringVar(&logFormat, "log_format", defaultLogFormat, "Log output format")
+	fs.StringVar(&natsLogLevel, "nats_log_level", defaultNATSLogLevel, "NATS log hook level")
+	fs.IntVar(&logSample, "log_sample", defaultLogSample, "Log 1 in n published events")
+
+	fs.DurationVar(&livenessTimeout, "liveness_timeout", defaultLivenessTimeout, "Watchdog gateway liveness timeout")
+
+	fs.DurationVar(&validateDuration, "validate_duration", defaultValidateDuration, "Layout validation duration")
+	fs.BoolVar(&jsonOutput, "json", false, "JSON output")
+
+	fs.DurationVar(&benchDuration, "bench_duration", defaultBenchDuration, "Bench duration")
+	fs.IntVar(&benchConcurrency, "bench_concurrency", defaultBenchConcurrency, "Bench concurrency")
+	fs.DurationVar(&benchTimeout, "bench_timeout", defaultBenchTimeout, "Bench request timeout")
+	fs.StringVar(&benchMix, "bench_mix", defaultBenchMix, "Bench command mix")
+	fs.BoolVar(&benchDryRun, "bench_dry_run", false, "Bench dry runs")
+
+	fs.StringVar(&replay, "replay", "", "Recording to replay")
+	fs.Float64Var(&replaySpeed, "replay_speed", defaultReplaySpeed, "Replay speed")
+
+	fs.UintVar(&conformanceLoco, "conformance_loco", 0, "Conformance loco address")
+	fs.UintVar(&conformanceTurnout, "conformance_turnout", 0, "Conformance turnout address")
+	fs.BoolVar(&conformanceProg, "conformance_prog", false, "Conformance programming track read")
+
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	if "z21."+z21Name == RegistrySubject {
+		return Config{}, fmt.Errorf("--z21_name %s is reserved for the gateway registry", z21Name)
+	}
+	if instanceID == "" {
+		instanceID = newInstanceID()
+	}
+	if err := validateInstanceID(instanceID); err != nil {
+		return Config{}, err
+	}
+	var err error
+	if z21Addr, err = normalizeZ21Addr(z21Addr); err != nil {
+		return Config{}, err
+	}
+	if err := validateZ21Addr(z21Addr); err != nil {
+		return Config{}, err
+	}
+	if _, err := bindAddr(bind, z21Addr); err != nil {
+		return Config{}, err
+	}
+	if udpReadBuffer < 0 || udpWriteBuffer < 0 {
+		return Config{}, errors.New("--udp_read_buffer and --udp_write_buffer must not be negative")
+	}
+	if udpReaders < 1 {
+		return Config{}, errors.New("--udp_readers must be at least 1")
+	}
+	if z21BackupAddr != "" {
+		if z21BackupAddr, err = normalizeZ21Addr(z21BackupAddr); err != nil {
+			return Config{}, err
+		}
+		if err := validateZ21Addr(z21BackupAddr); err != nil {
+			return Config{}, err
+		}
+		if z21BackupAddr == z21Addr {
+			return Config{}, errors.New("--z21_backup_addr must differ from --z21_addr")
+		}
+		if _, err := bindAddr(bind, z21BackupAddr); err != nil {
+			return Config{}, err
+		}
+	} else if z21BackupSerial != 0 {
+		return Config{}, errors.New("--z21_backup_serial requires --z21_backup_addr")
+	}
+	if failoverAfter <= 0 {
+		return Config{}, errors.New("--failover_after must be positive")
+	}
+	pools, err := parseCommandPools(commandPools)
+	if err != nil {
+		return Config{}, err
+	}
+	if commandQueue < 0 {
+		return Config{}, errors.New("--command_queue must not be negative")
+	}
+	if slowCommand < 0 {
+		return Config{}, errors.New("--slow_command must not be negative")
+	}
+	if err := validateReplies(replies); err != nil {
+		return Config{}, err
+	}
+	if batchWindow < 0 {
+		return Config{}, errors.New("--batch_window must not be negative")
+	}
+	if stateLimit < 1 {
+		return Config{}, errors.New("--state_limit must be positive")
+	}
+	if homie && homieInterval <= 0 {
+		return Config{}, errors.New("--homie_interval must be positive")
+	}
+	if tcpBridgeClients < 1 {
+		return Config{}, errors.New("--tcp_bridge_clients must be positive")
+	}
+	var lccNode uint64
+	if lccAddr != "" {
+		if lccNodeID == "" {
+			return Config{}, errors.New("--lcc_addr requires --lcc_node_id")
+		}
+		if lccNode, err = parseLCCID(lccNodeID, 6); err != nil {
+			return Config{}, fmt.Errorf("--lcc_node_id: %w", err)
+		}
+	}
+	if maxGoroutines < 0 || maxHeapMB < 0 {
+		return Config{}, errors.New("--max_goroutines and --max_heap_mb must not be negative")
+	}
+	if purgeOnRelease && srcpAddr == "" {
+		return Config{}, errors.New("--purge_on_release requires --srcp_addr")
+	}
+	if guardRestart && maxGoroutines == 0 && maxHeapMB == 0 {
+		return Config{}, errors.New("--guard_restart requires --max_goroutines or --max_heap_mb")
+	}
+	kinds, err := parseBatchKinds(batchKinds)
+	if err != nil {
+		return Config{}, err
+	}
+	fileConfig, err := loadFileConfig(configFile)
+	if err != nil {
+		return Config{}, err
+	}
+	if dc, ok := fileConfig.Devices[z21Name]; ok {
+		deviceSettings{&broadcastFlags, &heartbeatInterval, &probe, &probeTimeout, &ratedCurrent}.apply(fs, dc)
+	}
+	subscription, err := parseBroadcastFlags(broadcastFlags)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := validateProbe(probe); err != nil {
+		return Config{}, err
+	}
+	if z21Serial != 0 && probe != ProbeSerial {
+		return Config{}, fmt.Errorf("--z21_serial requires --probe %s", ProbeSerial)
+	}
+	if z21Serial > math.MaxUint32 {
+		return Config{}, fmt.Errorf("invalid z21 serial number %d", z21Serial)
+	}
+	if z21BackupSerial != 0 && probe != ProbeSerial {
+		return Config{}, fmt.Errorf("--z21_backup_serial requires --probe %s", ProbeSerial)
+	}
+	if z21BackupSerial > math.MaxUint32 {
+		return Config{}, fmt.Errorf("invalid z21 serial number %d", z21BackupSerial)
+	}
+
+	chaosConfig, err := parseChaos(chaos)
+	if err != nil {
+		return Config{}, err
+	}
+	syntheticConfig, err := parseSynthetic(synthetic)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := natsAuth.validate(); err != nil {
+		return Config{}, err
+	}
+	if mirrorBuffer <= 0 {
+		return Config{}, fmt.Errorf("--mirror_buffer must be positive")
+	}
+	if mirrorCreds != "" && mirrorURL == "" {
+		return Config{}, fmt.Errorf("--mirror_creds requires --mirror_url")
+	}
+	if mirrorURL != "" && mirrorURL == natsURL {
+		return Config{}, fmt.Errorf("--mirror_url must differ from --nats_url")
+	}
+
+	profiles, err := resolveProfiles(fileConfig)
+	if err != nil {
+		return Config{}, fmt.Errorf("%s: %w", configFile, err)
+	}
+
+	if err := validateSignals(fileConfig.Signals); err != nil {
+		return Config{}, fmt.Errorf("%s: %w", configFile, err)
+	}
+	if err := validateRoutes(fileConfig.Routes); err != nil {
+		return Config{}, fmt.Errorf("%s: %w", configFile, err)
+	}
+	if err := validateTemplates(fileConfig.Templates); err != nil {
+		return Config{}, fmt.Errorf("%s: %w", configFile, err)
+	}
+	if err := validateLCC(fileConfig.LCC); err != nil {
+		return Config{}, fmt.Errorf("%s: %w", configFile, err)
+	}
+	if err := validateDevices(fileConfig.Devices); err != nil {
+		return Config{}, fmt.Errorf("%s: %w", configFile, err)
+	}
+	names, err := newNameIndex(fileConfig.Names, fileConfig.Signals)
+	if err != nil {
+		return Config{}, fmt.Errorf("%s: %w", configFile, err)
+	}
+
+	blocks, err := newBlockIndex(fileConfig.Blocks, fileConfig.Names)
+	if err != nil {
+		return Config{}, fmt.Errorf("%s: %w", configFile, err)
+	}
+	speedSteps, err := resolveSpeedSteps(fileConfig.SpeedSteps, fileConfig.Names)
+	if err != nil {
+		return Config{}, fmt.Errorf("%s: %w", configFile, err)
+	}
+
+	mix, err := parseBenchMix(benchMix)
+	if err != nil {
+		return Config{}, err
+	}
+	if benchDuration <= 0 || benchTimeout <= 0 || benchConcurrency < 1 {
+		return Config{}, errors.New("bench duration, timeout and concurrency must be positive")
+	}
+	if replaySpeed <= 0 {
+		return Config{}, errors.New("replay speed must be positive")
+	}
+
+	if conformanceLoco > MaxLocoAddress || conformanceTurnout > math.MaxUint16 {
+		return Config{}, errors.New("invalid conformance loco or turnout address")
+	}
+	capabilityReport, err := loadCapabilities(capabilities)
+	if err != nil {
+		return Config{}, err
+	}
+
+	if jsMaxDeliver < 1 {
+		return Config{}, errors.New("--jetstream_max_deliver must be at least 1")
+	}
+	if idemWindow <= 0 {
+		return Config{}, errors.New("--idempotency_window must be positive")
+	}
+	if err := validateBucketName("layout_bucket", layoutBucket); err != nil {
+		return Config{}, err
+	}
+
+	tlsConfig, err := loadTLSConfig(tlsCert, tlsKey, tlsClientCA)
+	if err != nil {
+		return Config{}, err
+	}
+
+	schemaVersions, err := parseSchemaVersions(schemaVersion)
+	if err != nil {
+		return Config{}, err
+	}
+	if metricsInterval < 0 {
+		return Config{}, errors.New("metrics interval must not be negative")
+	}
+	if heartbeatInterval <= 0 || probeTimeout <= 0 || statusInterval <= 0 || livenessTimeout <= 0 {
+		return Config{}, errors.New("intervals and timeouts must be positive")
+	}
+	rules, err := parseCurrentRules(currentRules)
+	if err != nil {
+		return Config{}, err
+	}
+	if ratedCurrent < 0 {
+		return Config{}, errors.New("--rated_current must not be negative")
+	}
+	mandatory, err := parseSelfTestSteps(selfTestMandatory)
+	if err != nil {
+		return Config{}, err
+	}
+	if selfTestTurnout > math.MaxUint16 {
+		return Config{}, fmt.Errorf("invalid self-test turnout address %d", selfTestTurnout)
+	}
+	powerOffClock := time.Duration(-1)
+	if powerOffAt != "" {
+		if powerOffClock, err = parseClock(powerOffAt); err != nil {
+			return Config{}, err
+		}
+	}
+	if idlePowerOff < 0 || powerOffWarning < 0 {
+		return Config{}, errors.New("power-off timeout and warning must not be negative")
+	}
+	for _, rule := range rules {
+		if slices.Contains(rule.Actions, ActionWebhook) && webhookURL == "" {
+			return Config{}, errors.New("webhook action requires --webhook_url")
+		}
+	}
+	if broadcastTimeout < 0 || broadcastRefresh < 0 {
+		return Config{}, errors.New("broadcast timeout and refresh must not be negative")
+	}
+
+	if logSample < 1 {
+		return Config{}, errors.New("--log_sample must be positive")
+	}
+	logger, logHooks, err := newLogger(z21Name, logFormat, natsLogLevel)
+	if err != nil {
+		return Config{}, err
+	}
+
+	return Config{
+		Z21Name:           z21Name,
+		InstanceID:        instanceID,
+		Z21Addr:           z21Addr,
+		Z21Serial:         uint32(z21Serial),
+		Z21BackupAddr:     z21BackupAddr,
+		Z21BackupSerial:   uint32(z21BackupSerial),
+		FailoverAfter:     failoverAfter,
+		Bind:              bind,
+		UDPReadBuffer:     udpReadBuffer,
+		UDPWriteBuffer:    udpWriteBuffer,
+		UDPReaders:        udpReaders,
+		NATSURL:           natsURL,
+		NATSAuth:          natsAuth,
+		MirrorURL:         mirrorURL,
+		MirrorCreds:       mirrorCreds,
+		MirrorBuffer:      mirrorBuffer,
+		LegacySubjects:    legacySubjects,
+		SchemaVersions:    schemaVersions,
+		NodeRED:           nodeRED,
+		Homie:             homie,
+		HomieInterval:     homieInterval,
+		DCCPackets:        dccPackets,
+		HeartbeatInterval: heartbeatInterval,
+		CommandPools:      pools,
+		CommandQueue:      commandQueue,
+		SlowCommand:       slowCommand,
+		Replies:           replies,
+		BatchWindow:       batchWindow,
+		BatchKinds:        kinds,
+		StateLimit:        stateLimit,
+		MaxGoroutines:     maxGoroutines,
+		MaxHeapMB:         maxHeapMB,
+		GuardRestart:      guardRestart,
+		Probe:             probe,
+		ProbeTimeout:      probeTimeout,
+		StatusInterval:    statusInterval,
+		MetricsInterval:   metricsInterval,
+		MetricsAddr:       metricsAddr,
+		DashboardAddr:     dashboardAddr,
+		SRCPAddr:          srcpAddr,
+		PurgeOnRelease:    purgeOnRelease,
+		TCPBridgeAddr:     tcpBridgeAddr,
+		TCPBridgeClients:  tcpBridgeClients,
+		LCCAddr:           lccAddr,
+		LCCNodeID:         lccNode,
+		LivenessTimeout:   livenessTimeout,
+		BroadcastTimeout:  broadcastTimeout,
+		BroadcastRefresh:  broadcastRefresh,
+		BroadcastFlags:    subscription,
+		WebhookURL:        webhookURL,
+		CurrentRules:      rules,
+		RatedCurrent:      ratedCurrent,
+
+		TemperatureWarning:  tempWarning,
+		TemperatureCritical: tempCritical,
+
+		SelfTest:          selfTest,
+		SelfTestMandatory: mandatory,
+		SelfTestTurnout:   uint16(selfTestTurnout),
+
+		IdlePowerOff:    idlePowerOff,
+		PowerOffAt:      powerOffClock,
+		PowerOffWarning: powerOffWarning,
+
+		AccessoryOffset: accessoryOffset,
+		BackupDir:       backupDir,
+
+		TLSConfig: tlsConfig,
+
+		JetStreamStream:     jsStream,
+		JetStreamMaxDeliver: jsMaxDeliver,
+		IdempotencyWindow:   idemWindow,
+		LayoutBucket:        layoutBucket,
+
+		Record:          record,
+		RecordingBucket: recordingBucket,
+		PcapDir:         pcapDir,
+
+		Chaos:     chaosConfig,
+		Synthetic: syntheticConfig,
+
+		Capabilities: capabilityReport,
+		Conformance: ConformanceOptions{
+			Loco:    uint16(conformanceLoco),
+			Turnout: uint16(conformanceTurnout),
+			Prog:    conformanceProg,
+		},
+
+		File:     fileConfig,
+		Profiles: profiles,
+		Names:    names,
+		Blocks:   blocks,
+
+		SpeedSteps: speedSteps,
+
+		ValidateDuration: validateDuration,
+		JSONOutput:       jsonOutput,
+
+		Bench: BenchOptions{
+			Duration:    benchDuration,
+			Concurrency: benchConcurrency,
+			Timeout:     benchTimeout,
+			Mix:         mix,
+			DryRun:      benchDryRun,
+		},
+
+		Replay: ReplayOptions{
+			Recording: replay,
+			Bucket:    recordingBucket,
+			Speed:     replaySpeed,
+		},
+
+		Logger:    logger,
+		LogHooks:  logHooks,
+		LogSample: logSample,
+	}, nil
+}
+
+// LoadConfig parses the command line of the z21-gateway binary, printing
+// the usage for -h and exiting on invalid options.
+func LoadConfig() Config {
+	cfg, err := ParseConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Printf("%s\n", usageStr)
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(2)
+	}
+	return cfg
+}
+
+// DefaultConfig returns the configuration of a gateway started without
+// options, i.e. the defaults overridden by the Z21_* environment variables,
+// for embedding the gateway.
+func DefaultConfig() (Config, error) {
+	return ParseConfig(nil)
+}
+
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func getenvBool(key string, def bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+func getenvDuration(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
+func getenvFloat(key string, def float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return def
+}
+
+func getenvUint(key string, def uint) uint {
+	if v := os.Getenv(key); v != "" {
+		if u, err := strconv.ParseUint(v, 10, 0); err == nil {
+			return uint(u)
+		}
+	}
+	return def
+}
+
+func getenvInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			return i
+		}
+	}
+	return def
+}
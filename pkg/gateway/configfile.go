@@ -0,0 +1,112 @@
+package gateway
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileConfig holds the settings that only the config file can express.
+// Scalar options stay command line flags and environment variables.
+type FileConfig struct {
+	// Include lists config files loaded before this one, relative to it.
+	Include []string `yaml:"include"`
+
+	Profiles       map[string]Profile `yaml:"profiles"`
+	Clients        map[string]string  `yaml:"clients"`
+	DefaultProfile string             `yaml:"default_profile"`
+	Names          NameConfig         `yaml:"names"`
+	// SpeedSteps holds the speed step mode of locos by name or address.
+	SpeedSteps map[string]int          `yaml:"speed_steps"`
+	Signals    map[string]SignalConfig `yaml:"signals"`
+	Routes     map[string]RouteConfig  `yaml:"routes"`
+	Blocks     map[string]BlockConfig  `yaml:"blocks"`
+	Templates  map[string]CVTemplate   `yaml:"templates"`
+	Plugins    map[string]PluginConfig `yaml:"plugins"`
+	Filters    []FilterConfig          `yaml:"filters"`
+	LCC        LCCConfig               `yaml:"lcc"`
+	// Devices holds per-z21 settings keyed by --z21_name.
+	Devices map[string]DeviceConfig `yaml:"devices"`
+}
+
+func loadFileConfig(path string) (*FileConfig, error) {
+	fc := &FileConfig{}
+	if path == "" {
+		return fc, nil
+	}
+	if err := loadFileConfigInto(fc, path, nil); err != nil {
+		return nil, err
+	}
+	fc.Include = nil
+	return fc, nil
+}
+
+// loadFileConfigInto loads the includes of path and then path itself into
+// fc, so later files override earlier ones: maps are merged by key, other
+// values are replaced.
+func loadFileConfigInto(fc *FileConfig, path string, stack []string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(stack, abs) {
+		return fmt.Errorf("%s: include cycle", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if data, err = expandEnv(data); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	var includes struct {
+		Include []string `yaml:"include"`
+	}
+	if err := yaml.Unmarshal(data, &includes); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, inc := range includes.Include {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(path), inc)
+		}
+		if err := loadFileConfigInto(fc, inc, append(stack, abs)); err != nil {
+			return err
+		}
+	}
+
+	if err := yaml.Unmarshal(data, fc); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+var envRef = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces ${VAR} and ${VAR:-default} with the value of the
+// environment variable VAR; $${ escapes a literal ${.
+func expandEnv(data []byte) ([]byte, error) {
+	var err error
+	out := envRef.ReplaceAllFunc(data, func(ref []byte) []byte {
+		if ref[1] == '$' {
+			return ref[1:]
+		}
+		m := envRef.FindSubmatch(ref)
+		if v, ok := os.LookupEnv(string(m[1])); ok {
+			return []byte(v)
+		}
+		if m[2] != nil {
+			return m[3]
+		}
+		if err == nil {
+			err = fmt.Errorf("environment variable %s is not set", m[1])
+		}
+		return ref
+	})
+	return out, err
+}
@@ -0,0 +1,213 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+// conformanceProbe exercises the Z21 requests behind some gateway commands.
+type conformanceProbe struct {
+	name string
+	// commands are the gateway commands relying on the probed requests.
+	commands []string
+	run      func(g *Gateway, opts ConformanceOptions) (any, error)
+	// skip reports why the probe cannot run with opts, if so.
+	skip func(opts ConformanceOptions) string
+}
+
+// ConformanceOptions selects the hardware the conformance probes may
+// operate.
+type ConformanceOptions struct {
+	// Loco is driven at speed 0 and read on the main track.
+	Loco    uint16
+	Turnout uint16
+	// Prog allows reading CV 8 on the programming track.
+	Prog bool
+}
+
+var conformanceProbes = []conformanceProbe{
+	{
+		name: "serial",
+		run: func(g *Gateway, _ ConformanceOptions) (any, error) {
+			return g.sendRcv(&z21.SerialNumber{})
+		},
+	},
+	{
+		name: "hwinfo",
+		run: func(g *Gateway, _ ConformanceOptions) (any, error) {
+			return g.sendRcv(&z21.HWInfo{})
+		},
+	},
+	{
+		name: "systemstate",
+		run: func(g *Gateway, _ ConformanceOptions) (any, error) {
+			return g.sendRcv(&z21.SystemState{})
+		},
+	},
+	{
+		name:     "can.discover",
+		commands: []string{"can.discover"},
+		run: func(g *Gateway, _ ConformanceOptions) (any, error) {
+			return g.sendRcv(&z21.CanDetector{})
+		},
+	},
+	{
+		name:     "loco.drive",
+		commands: []string{"loco.drive", "cv.speedmatch"},
+		run: func(g *Gateway, opts ConformanceOptions) (any, error) {
+			return nil, g.driveLoco(opts.Loco, 0, true)
+		},
+		skip: func(opts ConformanceOptions) string {
+			if opts.Loco == 0 {
+				return "no --conformance_loco"
+			}
+			return ""
+		},
+	},
+	{
+		name:     "cv.pom_read",
+		commands: []string{"cv.pom.read", "cv.template.apply"},
+		run: func(g *Gateway, opts ConformanceOptions) (any, error) {
+			return g.cvRequest(g.ctx, &z21.CVPOMRead{Address: opts.Loco, CV: 1}, 0)
+		},
+		skip: func(opts ConformanceOptions) string {
+			if opts.Loco == 0 {
+				return "no --conformance_loco"
+			}
+			return ""
+		},
+	},
+	{
+		name:     "turnout.set",
+		commands: []string{"turnout.set"},
+		run: func(g *Gateway, opts ConformanceOptions) (any, error) {
+			if err := g.switchTurnout(opts.Turnout, 1); err != nil {
+				return nil, err
+			}
+			return nil, g.switchTurnout(opts.Turnout, 0)
+		},
+		skip: func(opts ConformanceOptions) string {
+			if opts.Turnout == 0 {
+				return "no --conformance_turnout"
+			}
+			return ""
+		},
+	},
+	{
+		name:     "prog.read",
+		commands: []string{"prog.backup", "prog.restore"},
+		run: func(g *Gateway, _ ConformanceOptions) (any, error) {
+			return g.cvRequest(g.ctx, &z21.CVRead{CV: 8}, 0)
+		},
+		skip: func(opts ConformanceOptions) string {
+			if !opts.Prog {
+				return "no --conformance_prog"
+			}
+			return ""
+		},
+	},
+}
+
+// ConformanceResult is the outcome of a single conformance probe.
+type ConformanceResult struct {
+	Probe     string   `json:"probe"`
+	Commands  []string `json:"commands,omitempty"`
+	Supported bool     `json:"supported"`
+	Skipped   string   `json:"skipped,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Duration  string   `json:"duration"`
+	Result    any      `json:"result,omitempty"`
+}
+
+// CapabilityReport is the result of conformance. Loaded with
+// --capabilities, the gateway rejects the commands of unsupported probes.
+type CapabilityReport struct {
+	Device string              `json:"device"`
+	Addr   string              `json:"addr"`
+	Probes []ConformanceResult `json:"probes"`
+	// Unsupported lists the gateway commands the device does not support.
+	Unsupported []string `json:"unsupported"`
+	TS          string   `json:"ts"`
+}
+
+// runConformance runs all conformance probes against the Z21 of g, which
+// need not be started.
+func (g *Gateway) runConformance(addr string, opts ConformanceOptions) *CapabilityReport {
+	report := &CapabilityReport{Device: g.name, Addr: addr, Unsupported: []string{}}
+	reachable := true
+	for _, probe := range conformanceProbes {
+		res := ConformanceResult{Probe: probe.name, Commands: probe.commands}
+		switch {
+		case !reachable:
+			// a silent Z21 would make every command look unsupported
+			res.Skipped = "z21 not reachable"
+		case probe.skip != nil:
+			res.Skipped = probe.skip(opts)
+		}
+		if res.Skipped == "" {
+			start := time.Now()
+			result, err := probe.run(g, opts)
+			res.Duration = time.Since(start).Truncate(time.Millisecond).String()
+			if err != nil {
+				res.Error = err.Error()
+				reachable = probe.name != "serial"
+				report.Unsupported = append(report.Unsupported, probe.commands...)
+			} else {
+				res.Supported = true
+				res.Result = result
+			}
+		}
+		report.Probes = append(report.Probes, res)
+
+		g.logger.Info().
+			Str("probe", res.Probe).
+			Bool("supported", res.Supported).
+			Str("skipped", res.Skipped).
+			Str("error", res.Error).
+			Msg("conformance")
+	}
+	report.TS = time.Now().UTC().Format(time.RFC3339)
+	return report
+}
+
+func (r *CapabilityReport) write(w io.Writer, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+
+	fmt.Fprintf(w, "conformance %s (%s)\n", r.Device, r.Addr)
+	for _, res := range r.Probes {
+		switch {
+		case res.Skipped != "":
+			fmt.Fprintf(w, "  %-14s skipped: %s\n", res.Probe, res.Skipped)
+		case res.Supported:
+			fmt.Fprintf(w, "  %-14s supported (%s)\n", res.Probe, res.Duration)
+		default:
+			fmt.Fprintf(w, "  %-14s unsupported: %s\n", res.Probe, res.Error)
+		}
+	}
+	return nil
+}
+
+// loadCapabilities reads a capability report written by conformance.
+func loadCapabilities(path string) (*CapabilityReport, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var report CapabilityReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &report, nil
+}
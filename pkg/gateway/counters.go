@@ -0,0 +1,160 @@
+package gateway
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+// CounterWindow is the time the rolling event counters cover, in minutes.
+const CounterWindow = 60
+
+// EventCount is a rolling count of events.
+type EventCount struct {
+	LastMinute  uint64 `json:"1m"`
+	Last15      uint64 `json:"15m"`
+	LastHour    uint64 `json:"1h"`
+	Total       uint64 `json:"total"`
+	LastEventTS string `json:"last_event_ts"`
+}
+
+// EventCounters is the reply of stats.events.
+type EventCounters struct {
+	// Types counts the received events per event kind, e.g. can or loco.
+	Types map[string]EventCount `json:"types"`
+	// Detectors counts the occupancy events per detector module, e.g.
+	// can.1234 for the CAN detector of network ID 1234 or rbus.0 for the
+	// first R-Bus group.
+	Detectors map[string]EventCount `json:"detectors"`
+	// Dropped counts the events dropped with a full publish queue since the
+	// gateway started. They are counted above, but neither published nor
+	// cached.
+	Dropped uint64 `json:"dropped"`
+}
+
+// rollingCount counts events per minute over the last CounterWindow
+// minutes.
+type rollingCount struct {
+	buckets [CounterWindow]uint64
+	// minute is the unix minute of the newest bucket.
+	minute int64
+	total  uint64
+	last   time.Time
+}
+
+// advance clears the buckets of the minutes passed since the newest one.
+func (c *rollingCount) advance(minute int64) {
+	for m := c.minute + 1; m <= minute && m <= c.minute+CounterWindow; m++ {
+		c.buckets[m%CounterWindow] = 0
+	}
+	c.minute = max(c.minute, minute)
+}
+
+func (c *rollingCount) add(now time.Time) {
+	minute := now.Unix() / 60
+	c.advance(minute)
+	c.buckets[minute%CounterWindow]++
+	c.total++
+	c.last = now
+}
+
+func (c *rollingCount) sum(minutes int) uint64 {
+	var n uint64
+	for i := range int64(minutes) {
+		n += c.buckets[(c.minute-i)%CounterWindow]
+	}
+	return n
+}
+
+func (c *rollingCount) count(now time.Time) EventCount {
+	c.advance(now.Unix() / 60)
+	return EventCount{
+		LastMinute:  c.sum(1),
+		Last15:      c.sum(15),
+		LastHour:    c.sum(CounterWindow),
+		Total:       c.total,
+		LastEventTS: c.last.UTC().Format(time.RFC3339),
+	}
+}
+
+// eventCounters counts the received events per kind and per detector
+// module.
+type eventCounters struct {
+	mu        sync.Mutex
+	types     map[string]*rollingCount
+	detectors map[string]*rollingCount
+}
+
+func newEventCounters() *eventCounters {
+	return &eventCounters{
+		types:     make(map[string]*rollingCount),
+		detectors: make(map[string]*rollingCount),
+	}
+}
+
+func (c *eventCounters) add(kind, detector string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addCount(c.types, kind, now)
+	if detector != "" {
+		addCount(c.detectors, detector, now)
+	}
+}
+
+func addCount(counts map[string]*rollingCount, key string, now time.Time) {
+	rc, ok := counts[key]
+	if !ok {
+		rc = &rollingCount{minute: now.Unix() / 60}
+		counts[key] = rc
+	}
+	rc.add(now)
+}
+
+func (c *eventCounters) snapshot(now time.Time) EventCounters {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := EventCounters{
+		Types:     make(map[string]EventCount, len(c.types)),
+		Detectors: make(map[string]EventCount, len(c.detectors)),
+	}
+	for key, rc := range c.types {
+		s.Types[key] = rc.count(now)
+	}
+	for key, rc := range c.detectors {
+		s.Detectors[key] = rc.count(now)
+	}
+	return s
+}
+
+// detectorModule returns the detector module an occupancy event comes
+// from: the network ID of a CAN detector or the R-Bus group.
+func detectorModule(ev z21.Serializable) string {
+	switch ev.(type) {
+	case *z21.CanDetector, *z21.RBusData:
+	default:
+		return ""
+	}
+	tokens := eventTokens(ev)
+	if len(tokens) < 2 {
+		return ""
+	}
+	return strings.Join(tokens[:2], ".")
+}
+
+// countEvent updates the event counters. It is only called from the events
+// loop.
+func (g *Gateway) countEvent(ev z21.Serializable) {
+	g.counters.add(eventKind(ev), detectorModule(ev), time.Now())
+}
+
+func (g *Gateway) handleStatsEvents(cr *cmdRequest, req *struct{}) CmdReply {
+	counters := g.counters.snapshot(time.Now())
+	counters.Dropped = g.stats.eventsDropped.Load()
+	return CmdReply{
+		Ok:   true,
+		Data: counters,
+		TS:   time.Now().Format(time.RFC3339),
+	}
+}
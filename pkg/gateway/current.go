@@ -0,0 +1,169 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+const (
+	ActionWarn     = "warn"
+	ActionWebhook  = "webhook"
+	ActionPowerOff = "poweroff"
+)
+
+// CurrentRule triggers Actions when the main track current stays above
+// Threshold (mA) for at least Sustain. With Percent set, Threshold is in
+// percent of the rated current of the Z21.
+type CurrentRule struct {
+	Threshold float64
+	Percent   bool
+	Sustain   time.Duration
+	Actions   []string
+}
+
+type currentRuleState struct {
+	above     time.Time
+	triggered bool
+}
+
+// parseCurrentRules parses a comma separated list of
+// <mA>[%]:<duration>:<action>[+<action>...] rules.
+func parseCurrentRules(s string) ([]CurrentRule, error) {
+	var rules []CurrentRule
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		parts := strings.Split(r, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid current rule %q: want <mA>:<duration>:<actions>", r)
+		}
+		value, percent := strings.CutSuffix(parts[0], "%")
+		threshold, err := strconv.ParseFloat(value, 64)
+		if err != nil || threshold <= 0 {
+			return nil, fmt.Errorf("invalid current rule %q: bad threshold", r)
+		}
+		sustain, err := time.ParseDuration(parts[1])
+		if err != nil || sustain < 0 {
+			return nil, fmt.Errorf("invalid current rule %q: bad duration", r)
+		}
+		actions := strings.Split(parts[2], "+")
+		for _, a := range actions {
+			switch a {
+			case ActionWarn, ActionWebhook, ActionPowerOff:
+			default:
+				return nil, fmt.Errorf("invalid current rule %q: unknown action %q", r, a)
+			}
+		}
+		rules = append(rules, CurrentRule{Threshold: threshold, Percent: percent, Sustain: sustain, Actions: actions})
+	}
+	return rules, nil
+}
+
+// checkCurrent evaluates the current rules against a system state event.
+// It is only called from the events loop.
+func (g *Gateway) checkCurrent(ev z21.Serializable) {
+	ss, ok := ev.(*z21.SystemState)
+	if len(g.currentRules) == 0 || !ok {
+		return
+	}
+	current := float64(ss.MainCurrent)
+
+	now := time.Now()
+	for i, rule := range g.currentRules {
+		state := &g.currentStates[i]
+		threshold, ok := g.currentThreshold(rule)
+		if !ok {
+			continue
+		}
+		if current <= threshold {
+			state.above = time.Time{}
+			state.triggered = false
+			continue
+		}
+		if state.above.IsZero() {
+			state.above = now
+		}
+		if state.triggered || now.Sub(state.above) < rule.Sustain {
+			continue
+		}
+		state.triggered = true
+		g.triggerCurrentRule(rule, threshold, current, now.Sub(state.above))
+	}
+}
+
+// currentThreshold returns the threshold of a rule in mA; rules in percent
+// are skipped while the rated current is not known.
+func (g *Gateway) currentThreshold(rule CurrentRule) (float64, bool) {
+	if !rule.Percent {
+		return rule.Threshold, true
+	}
+	rated := g.ratedCurrent()
+	return rated * rule.Threshold / 100, rated > 0
+}
+
+func (g *Gateway) hasRelativeCurrentRules() bool {
+	for _, rule := range g.currentRules {
+		if rule.Percent {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Gateway) triggerCurrentRule(rule CurrentRule, threshold, current float64, sustained time.Duration) {
+	warning := &WarningMsg{
+		Code:    "track_current",
+		Message: fmt.Sprintf("main track current %.0f mA above %.0f mA", current, threshold),
+		Details: map[string]any{
+			"current_ma":   current,
+			"threshold_ma": threshold,
+			"sustained":    sustained.Truncate(time.Millisecond).String(),
+			"actions":      rule.Actions,
+		},
+		TS: time.Now().UTC().Format(time.RFC3339),
+	}
+	if rule.Percent {
+		warning.Details["threshold_percent"] = rule.Threshold
+	}
+
+	for _, action := range rule.Actions {
+		switch action {
+		case ActionWarn:
+			g.publishWarning(warning.Code, warning.Message, warning.Details)
+		case ActionWebhook:
+			// Stop waits for the delivery, which WebhookTimeout bounds
+			g.wg.Add(1)
+			go func() {
+				defer g.wg.Done()
+				if err := g.postWebhook(warning); err != nil {
+					g.logger.Error().
+						Err(err).
+						Msg("webhook")
+				}
+			}()
+		case ActionPowerOff:
+			g.trackPowerOff("track current above threshold")
+		}
+	}
+}
+
+func (g *Gateway) trackPowerOff(reason string) {
+	ctx, cancel := context.WithTimeout(g.ctx, RequestTimeout)
+	defer cancel()
+
+	g.logger.Warn().
+		Str("reason", reason).
+		Msg("switching track power off")
+	if _, err := g.z21SendRcv(ctx, &z21.TrackPowerOff{}); err != nil {
+		g.logger.Error().
+			Err(err).
+			Msg("failed to switch track power off")
+	}
+}
@@ -0,0 +1,250 @@
+package gateway
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	// DashboardStatusInterval is the interval the stream sends the z21
+	// status at, so that track power and uptime stay current.
+	DashboardStatusInterval = time.Second
+	// DashboardCommandTimeout bounds the commands sent over the stream.
+	DashboardCommandTimeout = 5 * time.Second
+	// dashboardStreamBuffer is the number of messages queued for a stream
+	// client; a client falling further behind is disconnected.
+	dashboardStreamBuffer = 256
+	dashboardReadLimit    = MaxPayloadSize + 1024
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// StreamMessage is a message the WebSocket stream on /ws sends:
+//   - hello, once, with the device name and gateway version
+//   - status, the z21 status, every DashboardStatusInterval
+//   - event, an event published on z21.<name>.event.<subject>
+//   - reply, the reply to the command with the same ID
+//   - error, a command that could not be sent
+type StreamMessage struct {
+	Type    string          `json:"type"`
+	Subject string          `json:"subject,omitempty"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// StreamCommand is a command sent to the WebSocket stream, the subject
+// suffix after z21.<name>.cmd. and its payload.
+type StreamCommand struct {
+	ID      string          `json:"id"`
+	Command string          `json:"command"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type streamHello struct {
+	Device  string `json:"device"`
+	Version string `json:"version"`
+}
+
+// dashboardMux serves the embedded dashboard on /, its WebSocket stream on
+// /ws, the Server-Sent Events stream on /events and the GraphQL API on
+// /graphql.
+func (g *Gateway) dashboardMux() *http.ServeMux {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServerFS(files))
+	mux.HandleFunc("GET /ws", g.handleStream)
+	mux.HandleFunc("GET /events", g.handleSSE)
+	graphQL := g.graphQLHandler()
+	mux.Handle("GET /graphql", graphQL)
+	mux.Handle("POST /graphql", graphQL)
+	return mux
+}
+
+// handleStream relays the events of the gateway to a WebSocket client and
+// sends its commands over NATS, like any other client of the gateway, so
+// command profiles and queues apply.
+func (g *Gateway) handleStream(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		g.logger.Warn().
+			Err(err).
+			Str("remote", r.RemoteAddr).
+			Msg("dashboard stream rejected")
+		return
+	}
+	defer conn.CloseNow()
+	conn.SetReadLimit(dashboardReadLimit)
+
+	// the HTTP server does not wait for hijacked connections on shutdown
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stop := context.AfterFunc(g.ctx, cancel)
+	defer stop()
+
+	out := make(chan StreamMessage, dashboardStreamBuffer)
+	var slow atomic.Bool
+	send := func(m StreamMessage) {
+		select {
+		case out <- m:
+		default:
+			slow.Store(true)
+			cancel()
+		}
+	}
+
+	sub, err := g.nc.Subscribe(g.eventPrefix+">", func(msg *nats.Msg) {
+		if m, ok := g.streamEvent(msg); ok {
+			send(m)
+		}
+	})
+	if err != nil {
+		conn.Close(websocket.StatusInternalError, "subscription failed")
+		return
+	}
+	defer sub.Unsubscribe()
+
+	g.logger.Info().
+		Str("remote", r.RemoteAddr).
+		Msg("dashboard stream connected")
+
+	hello, _ := json.Marshal(streamHello{Device: g.name, Version: Version})
+	send(StreamMessage{Type: "hello", Payload: hello})
+	send(g.streamStatus())
+
+	go func() {
+		g.readStream(ctx, conn, send)
+		cancel()
+	}()
+
+	ticker := time.NewTicker(DashboardStatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			switch {
+			case slow.Load():
+				conn.Close(websocket.StatusPolicyViolation, "slow consumer")
+			case g.ctx.Err() != nil:
+				conn.Close(websocket.StatusGoingAway, "gateway stopped")
+			}
+			g.logger.Info().
+				Str("remote", r.RemoteAddr).
+				Bool("slow", slow.Load()).
+				Msg("dashboard stream disconnected")
+			return
+		case <-ticker.C:
+			send(g.streamStatus())
+		case m := <-out:
+			data, err := json.Marshal(m)
+			if err != nil {
+				continue
+			}
+			if err := conn.Write(ctx, websocket.MessageText, data); err != nil {
+				cancel()
+			}
+		}
+	}
+}
+
+// readStream reads commands from a stream client until it disconnects.
+func (g *Gateway) readStream(ctx context.Context, conn *websocket.Conn, send func(StreamMessage)) {
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			return
+		}
+		var cmd StreamCommand
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			send(StreamMessage{Type: "error", Error: "invalid command: " + err.Error()})
+			continue
+		}
+		go g.streamCommand(ctx, cmd, send)
+	}
+}
+
+// streamCommand sends a stream command over NATS and the reply back to the
+// client.
+func (g *Gateway) streamCommand(ctx context.Context, cmd StreamCommand, send func(StreamMessage)) {
+	reply, err := g.requestCommand(ctx, cmd.Command, cmd.Payload)
+	if err != nil {
+		send(StreamMessage{Type: "error", ID: cmd.ID, Error: err.Error()})
+		return
+	}
+	send(StreamMessage{Type: "reply", ID: cmd.ID, Payload: reply})
+}
+
+// requestCommand sends a command to the gateway over NATS, like any client
+// without a client ID, and returns the encoded reply.
+func (g *Gateway) requestCommand(ctx context.Context, command string, payload []byte) (json.RawMessage, error) {
+	if command == "" || strings.ContainsAny(command, " *>") {
+		return nil, errors.New("invalid command name")
+	}
+	msg := nats.NewMsg(g.subjectPrefix + "cmd." + command)
+	msg.Header.Set(RequestIDHeader, nuid.Next())
+	msg.Data = payload
+	if len(msg.Data) == 0 {
+		msg.Data = []byte("{}")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, DashboardCommandTimeout)
+	defer cancel()
+	resp, err := g.nc.RequestMsgWithContext(ctx, msg)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = errors.New("no reply from the gateway")
+		}
+		return nil, err
+	}
+	var reply json.RawMessage
+	if err := decodePayload(msgSchemaVersion(resp), resp.Data, &reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// streamEvent returns the stream message of an event published by the
+// gateway.
+func (g *Gateway) streamEvent(msg *nats.Msg) (StreamMessage, bool) {
+	var payload json.RawMessage
+	if err := decodePayload(msgSchemaVersion(msg), msg.Data, &payload); err != nil {
+		return StreamMessage{}, false
+	}
+	return StreamMessage{
+		Type:    "event",
+		Subject: strings.TrimPrefix(msg.Subject, g.eventPrefix),
+		Payload: payload,
+	}, true
+}
+
+// streamStatus returns the current z21 status as a stream message.
+func (g *Gateway) streamStatus() StreamMessage {
+	data, _ := json.Marshal(g.currentStatus().v2())
+	return StreamMessage{Type: "status", Payload: data}
+}
+
+// currentStatus returns the z21 status as last probed, without a probe of
+// its own, so without serial and link quality.
+func (g *Gateway) currentStatus() *StatusMsg {
+	status := &StatusMsg{
+		Reachable: g.isOnline.Load(),
+		TS:        time.Now().Format(time.RFC3339),
+	}
+	g.completeStatus(status)
+	return status
+}
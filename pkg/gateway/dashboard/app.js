@@ -0,0 +1,240 @@
+"use strict";
+
+// The dashboard talks to the gateway over the WebSocket stream on /ws: it
+// receives the status and events and sends commands, see StreamMessage and
+// StreamCommand.
+
+const maxEvents = 200;
+const canDetectorOccupancy = 0x01;
+
+const $ = (id) => document.getElementById(id);
+
+let ws;
+let nextID = 1;
+let retryDelay = 500;
+const pending = new Map();
+const occupancy = new Map();
+let forward = true;
+
+function connect() {
+  const proto = location.protocol === "https:" ? "wss:" : "ws:";
+  ws = new WebSocket(`${proto}//${location.host}/ws`);
+  ws.onopen = () => {
+    retryDelay = 500;
+    setBadge($("connection"), "connected", "ok");
+  };
+  ws.onclose = () => {
+    setBadge($("connection"), "disconnected", "bad");
+    for (const done of pending.values()) {
+      done({ error: "disconnected" });
+    }
+    pending.clear();
+    setTimeout(connect, retryDelay);
+    retryDelay = Math.min(retryDelay * 2, 10000);
+  };
+  ws.onmessage = (e) => handle(JSON.parse(e.data));
+}
+
+function handle(msg) {
+  switch (msg.type) {
+    case "hello":
+      $("device").textContent = `z21 ${msg.payload.device}`;
+      document.title = `z21-gateway ${msg.payload.device}`;
+      loadState(msg.payload.device);
+      break;
+    case "status":
+      showStatus(msg.payload);
+      break;
+    case "event":
+      addEvent(msg.subject, msg.payload);
+      break;
+    case "reply":
+    case "error": {
+      const done = pending.get(msg.id);
+      if (done) {
+        pending.delete(msg.id);
+        done(msg);
+      } else if (msg.error) {
+        showReply(msg.error, true);
+      }
+      break;
+    }
+  }
+}
+
+// request sends a command and resolves with its reply, rejecting failed
+// commands with their error.
+function request(command, payload) {
+  return new Promise((resolve, reject) => {
+    if (!ws || ws.readyState !== WebSocket.OPEN) {
+      reject(new Error("not connected"));
+      return;
+    }
+    const id = String(nextID++);
+    pending.set(id, (msg) => {
+      if (msg.error) {
+        reject(new Error(msg.error));
+      } else if (!msg.payload.ok) {
+        reject(new Error(msg.payload.error));
+      } else {
+        resolve(msg.payload.reply);
+      }
+    });
+    ws.send(JSON.stringify({ id, command, payload }));
+  });
+}
+
+// loadState seeds the occupancy and system state from the state cache.
+async function loadState(device) {
+  const prefix = `z21.${device}.event.`;
+  occupancy.clear();
+  try {
+    const states = (await request("state.get", {})) || [];
+    for (const s of states) {
+      apply(s.subject.slice(prefix.length), s.event);
+    }
+  } catch (err) {
+    showReply(`state.get: ${err.message}`, true);
+  }
+  renderOccupancy();
+}
+
+function showStatus(s) {
+  setBadge($("reachable"), s.reachable ? "reachable" : "unreachable", s.reachable ? "ok" : "bad");
+  const power = s.track_power || "";
+  setBadge($("power"), power ? `track power ${power}` : "", power === "on" ? "ok" : power ? "bad" : "");
+  $("power").hidden = !power;
+  $("model").textContent = s.model ? `${s.model} ${s.firmware || ""}` : "";
+  $("uptime").textContent = s.uptime ? `up ${s.uptime}` : "";
+}
+
+function addEvent(subject, payload) {
+  apply(subject, payload);
+  renderOccupancy();
+
+  const li = document.createElement("li");
+  li.textContent = `${new Date().toLocaleTimeString()} ${subject} ${JSON.stringify(payload)}`;
+  const list = $("events");
+  list.prepend(li);
+  while (list.childElementCount > maxEvents) {
+    list.lastElementChild.remove();
+  }
+}
+
+// apply updates the occupancy and system state from an event, the CAN
+// detector ports like the block tracker of the gateway.
+function apply(subject, payload) {
+  if (!payload) {
+    return;
+  }
+  const tokens = subject.split(".");
+  switch (tokens[0]) {
+    case "can":
+      if (tokens.length >= 3 && payload.Type === canDetectorOccupancy) {
+        occupancy.set(subject, payload.Value1 !== 0);
+      }
+      break;
+    case "block":
+      if (payload.block) {
+        occupancy.set(`block.${payload.block}`, payload.occupied);
+      }
+      break;
+    case "systemstate":
+      renderSystemState(payload);
+      break;
+  }
+}
+
+function renderOccupancy() {
+  const grid = $("occupancy");
+  if (occupancy.size === 0) {
+    return;
+  }
+  grid.replaceChildren(
+    ...[...occupancy.keys()].sort().map((name) => {
+      const cell = document.createElement("span");
+      cell.className = occupancy.get(name) ? "detector occupied" : "detector";
+      cell.textContent = name;
+      return cell;
+    }),
+  );
+}
+
+function renderSystemState(state) {
+  const table = $("systemstate");
+  table.replaceChildren(
+    ...Object.entries(state).map(([key, value]) => {
+      const row = document.createElement("tr");
+      row.insertCell().textContent = key;
+      row.insertCell().textContent = JSON.stringify(value);
+      return row;
+    }),
+  );
+}
+
+function setBadge(el, text, cls) {
+  el.textContent = text;
+  el.className = `badge ${cls}`;
+}
+
+function showReply(text, error) {
+  const el = $("reply");
+  el.textContent = text;
+  el.className = error ? "error" : "dim";
+}
+
+// target returns the address or name payload field of a loco or turnout
+// input.
+function target(value) {
+  value = value.trim();
+  return /^\d+$/.test(value) ? { address: Number(value) } : { name: value };
+}
+
+async function send(command, payload) {
+  try {
+    await request(command, payload);
+    showReply(`${command}: ok`, false);
+  } catch (err) {
+    showReply(`${command}: ${err.message}`, true);
+  }
+}
+
+function drive() {
+  if (!$("loco").value.trim()) {
+    showReply("enter a loco", true);
+    return;
+  }
+  send("loco.drive", { ...target($("loco").value), speed: Number($("speed").value), forward });
+}
+
+$("speed").addEventListener("input", () => {
+  $("speed-value").textContent = `${$("speed").value}%`;
+});
+$("speed").addEventListener("change", drive);
+
+for (const button of document.querySelectorAll("[data-forward]")) {
+  button.addEventListener("click", () => {
+    forward = button.dataset.forward === "true";
+    drive();
+  });
+}
+
+$("stop").addEventListener("click", () => {
+  $("speed").value = 0;
+  $("speed-value").textContent = "0%";
+  drive();
+});
+
+for (const button of document.querySelectorAll("[data-output]")) {
+  button.addEventListener("click", () => {
+    if (!$("turnout-id").value.trim()) {
+      showReply("enter a turnout", true);
+      return;
+    }
+    send("turnout.set", { ...target($("turnout-id").value), output: Number(button.dataset.output) });
+  });
+}
+
+$("power-off").addEventListener("click", () => send("power.off", {}));
+
+connect();
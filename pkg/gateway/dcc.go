@@ -0,0 +1,303 @@
+package gateway
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+// z21LocoNetUpdates is the broadcast flag for LocoNet messages other than
+// loco and switch messages, which include the immediate packets.
+const z21LocoNetUpdates = 0x01000000
+
+// LocoNet OPC_IMM_PACKET, a DCC packet a LocoNet device asks the command
+// station to send: 0xED 0x0B 0x7F <REPS> <DHI> <IM1..IM5> <CHK>.
+const (
+	lnImmPacket       = 0xED
+	lnImmPacketLen    = 0x0B
+	lnImmPacketSend   = 0x7F
+	lnImmPacketHeader = 5
+)
+
+// DCCPacket is published on z21.<name>.event.dcc.<type>[.<address>] for
+// each DCC packet decoded with --dcc_packets.
+type DCCPacket struct {
+	// Packet is the packet in hex including its error detection byte,
+	// as sent on the rails.
+	Packet string `json:"packet"`
+	Source string `json:"source"`
+	Repeat int    `json:"repeat"`
+	// Type is loco, accessory, extended_accessory, broadcast, idle or
+	// reserved, by the address partition of the packet.
+	Type        string `json:"type"`
+	Address     int    `json:"address,omitempty"`
+	LongAddress bool   `json:"long_address,omitempty"`
+	// Decoder and Port are the accessory decoder address and output pair
+	// in the packet; Address is the output address per RCN-213.
+	Decoder       *int            `json:"decoder,omitempty"`
+	Port          *int            `json:"port,omitempty"`
+	Instruction   string          `json:"instruction,omitempty"`
+	Speed         *int            `json:"speed,omitempty"`
+	SpeedSteps    int             `json:"speed_steps,omitempty"`
+	Forward       *bool           `json:"forward,omitempty"`
+	EmergencyStop bool            `json:"emergency_stop,omitempty"`
+	Functions     map[string]bool `json:"functions,omitempty"`
+	CV            int             `json:"cv,omitempty"`
+	CVOp          string          `json:"cv_op,omitempty"`
+	Bit           *int            `json:"bit,omitempty"`
+	Value         *int            `json:"value,omitempty"`
+	Output        *int            `json:"output,omitempty"`
+	Active        *bool           `json:"active,omitempty"`
+	TS            string          `json:"ts"`
+}
+
+// exportDCC publishes the DCC packet carried by a LocoNet immediate packet
+// received from the Z21. It is only called from the events loop.
+func (g *Gateway) exportDCC(ev z21.Serializable) {
+	ln, ok := ev.(*z21.LocoNetData)
+	if !g.dccPackets || !ok {
+		return
+	}
+	packet, repeat, ok := locoNetImmPacket(ln.Data)
+	if !ok {
+		return
+	}
+	p := decodeDCC(packet)
+	p.Source = "loconet"
+	p.Repeat = repeat
+	p.TS = time.Now().UTC().Format(time.RFC3339Nano)
+
+	tokens := "dcc." + p.Type
+	if p.Type == "loco" || p.Type == "accessory" || p.Type == "extended_accessory" {
+		tokens += "." + strconv.Itoa(p.Address)
+	}
+	g.publishDerivedEvent(tokens, "event.dcc", p)
+}
+
+// locoNetImmPacket returns the DCC packet, without its error detection
+// byte, and the repeat count of a LocoNet OPC_IMM_PACKET message.
+func locoNetImmPacket(msg []byte) ([]byte, int, bool) {
+	if len(msg) < lnImmPacketHeader+2 || msg[0] != lnImmPacket ||
+		msg[1] != lnImmPacketLen || msg[2] != lnImmPacketSend {
+		return nil, 0, false
+	}
+	if len(msg) >= lnImmPacketLen {
+		var chk byte
+		for _, b := range msg[:lnImmPacketLen] {
+			chk ^= b
+		}
+		if chk != 0xFF {
+			return nil, 0, false
+		}
+	}
+	reps, dhi := msg[3], msg[4]
+	n := int(reps>>4) & 0x07
+	if n < 2 || n > 5 || len(msg) < lnImmPacketHeader+n {
+		return nil, 0, false
+	}
+	packet := make([]byte, n)
+	for i := range packet {
+		packet[i] = msg[lnImmPacketHeader+i]&0x7F | (dhi>>i&0x01)<<7
+	}
+	return packet, int(reps & 0x07), true
+}
+
+// decodeDCC decodes a DCC packet without its error detection byte per
+// NMRA S-9.2.1 and RCN-212/213.
+func decodeDCC(packet []byte) DCCPacket {
+	var chk byte
+	for _, b := range packet {
+		chk ^= b
+	}
+	p := DCCPacket{Packet: hex.EncodeToString(append(packet[:len(packet):len(packet)], chk))}
+
+	a := packet[0]
+	switch {
+	case a == 0x00:
+		p.Type = "broadcast"
+		decodeDCCInstruction(&p, packet[1:])
+	case a <= 0x7F:
+		p.Type = "loco"
+		p.Address = int(a)
+		decodeDCCInstruction(&p, packet[1:])
+	case a <= 0xBF && len(packet) >= 2:
+		decodeDCCAccessory(&p, packet)
+	case a <= 0xE7 && len(packet) >= 2:
+		p.Type = "loco"
+		p.Address = int(a&0x3F)<<8 | int(packet[1])
+		p.LongAddress = true
+		decodeDCCInstruction(&p, packet[2:])
+	case a == 0xFF && len(packet) == 2 && packet[1] == 0x00:
+		p.Type = "idle"
+	default:
+		p.Type = "reserved"
+	}
+	return p
+}
+
+// decodeDCCAccessory decodes a basic or extended accessory packet,
+// 10AAAAAA 1AAACDDD or 10AAAAAA 0AAA0AA1 XXXXXXXX.
+func decodeDCCAccessory(p *DCCPacket, packet []byte) {
+	b0, b1 := packet[0], packet[1]
+	// the high address bits are sent in ones complement
+	decoder := int(b0&0x3F) | int(^b1>>4&0x07)<<6
+	port := int(b1>>1) & 0x03
+	p.Decoder, p.Port = &decoder, &port
+	raw := decoder<<2 | port
+	// RCN-213 numbers the outputs of decoder 1 from 1
+	p.Address = raw - 3
+
+	if b1&0x80 != 0 {
+		p.Type = "accessory"
+		p.Instruction = "output"
+		output, active := int(b1&0x01), b1&0x08 != 0
+		p.Output, p.Active = &output, &active
+		if len(packet) > 2 {
+			// POM for accessory decoders
+			decodeDCCInstruction(p, packet[2:])
+		}
+		return
+	}
+	p.Type = "extended_accessory"
+	if len(packet) > 2 && b1&0x01 != 0 {
+		p.Instruction = "aspect"
+		aspect := int(packet[2])
+		p.Value = &aspect
+		return
+	}
+	if len(packet) > 2 {
+		decodeDCCInstruction(p, packet[2:])
+	}
+}
+
+// dccFunctionGroups maps feature expansion instructions to the first
+// function of the eight they set.
+var dccFunctionGroups = map[byte]int{
+	0xDE: 13,
+	0xDF: 21,
+	0xD8: 29,
+	0xD9: 37,
+	0xDA: 45,
+	0xDB: 53,
+	0xDC: 61,
+}
+
+// decodeDCCInstruction decodes the instruction of a multi-function decoder
+// packet.
+func decodeDCCInstruction(p *DCCPacket, instr []byte) {
+	if len(instr) == 0 {
+		return
+	}
+	i := instr[0]
+	switch i >> 5 {
+	case 0b000:
+		if i&0xF0 == 0x10 {
+			p.Instruction = "consist_control"
+		} else {
+			p.Instruction = "decoder_control"
+		}
+	case 0b001:
+		switch {
+		case i == 0x3F && len(instr) >= 2:
+			p.Instruction = "speed"
+			p.SpeedSteps = 128
+			forward := instr[1]&0x80 != 0
+			p.Forward = &forward
+			setDCCSpeed(p, int(instr[1]&0x7F))
+		case i == 0x3E:
+			p.Instruction = "speed_restriction"
+		case i == 0x3D:
+			p.Instruction = "analog_function"
+		default:
+			p.Instruction = "advanced_operations"
+		}
+	case 0b010, 0b011:
+		p.Instruction = "speed"
+		p.SpeedSteps = 28
+		forward := i&0x20 != 0
+		p.Forward = &forward
+		// the fifth bit is the least significant speed bit
+		setDCCSpeed(p, int(i&0x0F)<<1|int(i>>4&0x01))
+	case 0b100:
+		p.Instruction = "functions"
+		p.Functions = dccFunctions(0, i&0x10 != 0, 1, i&0x0F, 4)
+	case 0b101:
+		p.Instruction = "functions"
+		if i&0x10 != 0 {
+			p.Functions = dccFunctions(-1, false, 5, i&0x0F, 4)
+		} else {
+			p.Functions = dccFunctions(-1, false, 9, i&0x0F, 4)
+		}
+	case 0b110:
+		if first, ok := dccFunctionGroups[i]; ok && len(instr) >= 2 {
+			p.Instruction = "functions"
+			p.Functions = dccFunctions(-1, false, first, instr[1], 8)
+			return
+		}
+		p.Instruction = "feature_expansion"
+	case 0b111:
+		if i&0xF0 != 0xE0 {
+			p.Instruction = "cv_short"
+			return
+		}
+		p.Instruction = "cv"
+		if len(instr) < 3 {
+			return
+		}
+		p.CV = (int(i&0x03)<<8 | int(instr[1])) + 1
+		data := int(instr[2])
+		switch i >> 2 & 0x03 {
+		case 0b01:
+			p.CVOp = "verify"
+		case 0b11:
+			p.CVOp = "write"
+		case 0b10:
+			// 111KDBBB
+			p.CVOp = "bit_verify"
+			if data&0x10 != 0 {
+				p.CVOp = "bit_write"
+			}
+			bit := data & 0x07
+			p.Bit = &bit
+			data = data >> 3 & 0x01
+		default:
+			p.CVOp = "reserved"
+		}
+		p.Value = &data
+	}
+}
+
+// setDCCSpeed sets the speed step of a speed code of p.SpeedSteps. The
+// lowest codes stop, 0 for 128 steps and 0 and 1 for 28, the next ones are
+// emergency stops, and the remaining ones are the steps from 1.
+func setDCCSpeed(p *DCCPacket, code int) {
+	stops := 1
+	if p.SpeedSteps == 28 {
+		stops = 2
+	}
+	speed := 0
+	switch {
+	case code < stops:
+	case code < 2*stops:
+		p.EmergencyStop = true
+	default:
+		speed = code - 2*stops + 1
+	}
+	p.Speed = &speed
+}
+
+// dccFunctions returns the states of n functions from first in bits, and
+// of the function at single, unless it is -1, in state.
+func dccFunctions(single int, state bool, first int, bits byte, n int) map[string]bool {
+	fns := make(map[string]bool, n+1)
+	if single >= 0 {
+		fns[fmt.Sprintf("f%d", single)] = state
+	}
+	for k := range n {
+		fns[fmt.Sprintf("f%d", first+k)] = bits>>k&0x01 != 0
+	}
+	return fns
+}
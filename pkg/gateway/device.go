@@ -0,0 +1,215 @@
+package gateway
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+// Z21 hardware types as reported by LAN_GET_HWINFO.
+const (
+	HWTypeZ21Old    = 0x200
+	HWTypeZ21New    = 0x201
+	HWTypeSmartRail = 0x202
+	HWTypeZ21Small  = 0x203
+	HWTypeZ21Start  = 0x204
+	HWTypeXL        = 0x211
+)
+
+var hardwareModels = map[uint32]string{
+	HWTypeZ21Old:    "Z21 (2012)",
+	HWTypeZ21New:    "Z21",
+	HWTypeSmartRail: "SmartRail",
+	HWTypeZ21Small:  "z21",
+	HWTypeZ21Start:  "z21start",
+	0x205:           "10806 Single Booster",
+	0x206:           "10807 Dual Booster",
+	HWTypeXL:        "10870 XL Series",
+	0x212:           "10869 XL Booster",
+	0x301:           "10836 SwitchDecoder",
+	0x302:           "10837 SignalDecoder",
+}
+
+// deviceFeature is a Z21 feature that depends on the hardware type or the
+// firmware version.
+type deviceFeature struct {
+	// minFirmware is the first firmware version with the feature, BCD
+	// encoded like the firmware version reported by the Z21.
+	minFirmware uint32
+	// hardware lists the hardware types with the feature, all if empty.
+	hardware []uint32
+	// commands are rejected with unsupported_by_device without the
+	// feature.
+	commands []string
+}
+
+var deviceFeatures = map[string]deviceFeature{
+	"railcom": {
+		minFirmware: 0x0129,
+		commands:    []string{"loco.seen"},
+	},
+	"can_detector": {
+		minFirmware: 0x0130,
+		hardware:    []uint32{HWTypeZ21Old, HWTypeZ21New, HWTypeXL},
+		commands:    []string{"can.devices", "can.discover"},
+	},
+	"ext_accessory": {
+		minFirmware: 0x0140,
+		commands:    []string{"signal.set"},
+	},
+	// LocoNet needs the socket of the black Z21
+	"loconet": {
+		minFirmware: 0x0120,
+		hardware:    []uint32{HWTypeZ21Old, HWTypeZ21New},
+	},
+	// cv.template.apply falls back to not verifying on the main track
+	"pom_read": {
+		minFirmware: 0x0122,
+	},
+}
+
+// DeviceInfo describes the connected Z21 and the features it supports.
+type DeviceInfo struct {
+	HardwareType string          `json:"hardware_type"`
+	Model        string          `json:"model"`
+	Firmware     string          `json:"firmware"`
+	Features     map[string]bool `json:"features"`
+	// RatedCurrentMA is the nominal main track current of the model.
+	RatedCurrentMA float64 `json:"rated_current_ma,omitempty"`
+
+	hwType uint32
+}
+
+func newDeviceInfo(hwType, firmware uint32) *DeviceInfo {
+	model, ok := hardwareModels[hwType]
+	if !ok {
+		model = "unknown"
+	}
+	info := &DeviceInfo{
+		HardwareType:   fmt.Sprintf("0x%03x", hwType),
+		Model:          model,
+		Firmware:       fmt.Sprintf("%x.%02x", firmware>>8, firmware&0xff),
+		Features:       make(map[string]bool),
+		RatedCurrentMA: deviceModels[hwType].ratedCurrentMA,
+		hwType:         hwType,
+	}
+	for name, f := range deviceFeatures {
+		info.Features[name] = firmware >= f.minFirmware &&
+			(len(f.hardware) == 0 || slices.Contains(f.hardware, hwType))
+	}
+	return info
+}
+
+// detectDevice queries the hardware type and firmware version of the Z21.
+// Until it succeeds, all features are assumed to be supported.
+func (g *Gateway) detectDevice() {
+	resp, err := g.sendRcv(&z21.HWInfo{})
+	if err != nil {
+		g.logger.Warn().
+			Err(err).
+			Msg("failed to query hardware info, assuming all features")
+		return
+	}
+	hw, ok := resp.(*z21.HWInfo)
+	if !ok {
+		g.logger.Warn().
+			Str("type", eventTypeName(resp)).
+			Msg("unexpected hardware info, assuming all features")
+		return
+	}
+
+	info := newDeviceInfo(hw.HardwareType, hw.FirmwareVersion)
+	g.device.Store(info)
+	// the lock is read again from the next system state
+	g.locked.Store(0)
+	var missing []string
+	for _, name := range sortedKeys(info.Features) {
+		if !info.Features[name] {
+			missing = append(missing, name)
+		}
+	}
+	g.logger.Info().
+		Str("hardware_type", info.HardwareType).
+		Str("model", info.Model).
+		Str("firmware", info.Firmware).
+		Strs("unsupported_features", missing).
+		Msg("Z21 device")
+	if g.hasRelativeCurrentRules() && g.ratedCurrent() == 0 {
+		g.logger.Warn().
+			Str("model", info.Model).
+			Msg("current rules in percent need --rated_current for this model")
+	}
+}
+
+// hasFeature reports whether the Z21 supports the feature, or whether it
+// is not known yet.
+func (g *Gateway) hasFeature(name string) bool {
+	info := g.device.Load()
+	return info == nil || info.Features[name]
+}
+
+// unsupportedByDevice reports whether the Z21 lacks a feature the command
+// needs, by its hardware and firmware or by the loaded capability report.
+func (g *Gateway) unsupportedByDevice(name string) bool {
+	if g.unsupported[name] {
+		return true
+	}
+	for feature, f := range deviceFeatures {
+		if slices.Contains(f.commands, name) && !g.hasFeature(feature) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Gateway) handleUnsupportedByDevice(name string) CmdReply {
+	return CmdReply{
+		Ok:        false,
+		Error:     fmt.Sprintf("command not supported by this device: %s", name),
+		ErrorCode: ErrCodeUnsupportedByDevice,
+		TS:        time.Now().Format(time.RFC3339),
+	}
+}
+
+// Capabilities is the reply of capabilities.get.
+type Capabilities struct {
+	// Device is unset until the Z21 answered the hardware info query.
+	Device *DeviceInfo `json:"device,omitempty"`
+	// Report is the capability report loaded with --capabilities.
+	Report      *CapabilityReport `json:"report,omitempty"`
+	Unsupported []string          `json:"unsupported"`
+	// Locked lists the commands a locked z21start ignores.
+	Locked []string `json:"locked,omitempty"`
+}
+
+func (g *Gateway) handleCapabilitiesGet(_ *cmdRequest, _ *struct{}) CmdReply {
+	return CmdReply{
+		Ok:   true,
+		Data: g.currentCapabilities(),
+		TS:   time.Now().Format(time.RFC3339),
+	}
+}
+
+// currentCapabilities returns the detected device and the commands it does
+// not support.
+func (g *Gateway) currentCapabilities() *Capabilities {
+	caps := &Capabilities{
+		Device:      g.device.Load(),
+		Report:      g.capabilities,
+		Unsupported: []string{},
+		Locked:      g.lockedCommands(),
+	}
+	for name := range g.unsupported {
+		caps.Unsupported = append(caps.Unsupported, name)
+	}
+	for feature, f := range deviceFeatures {
+		if !g.hasFeature(feature) {
+			caps.Unsupported = append(caps.Unsupported, f.commands...)
+		}
+	}
+	slices.Sort(caps.Unsupported)
+	caps.Unsupported = slices.Compact(caps.Unsupported)
+	return caps
+}
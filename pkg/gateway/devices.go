@@ -0,0 +1,98 @@
+package gateway
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DeviceConfig holds the settings of one z21 in the devices section of a
+// config file. Sites running a gateway per z21 share one config file, and
+// each gateway applies the entry of its --z21_name, e.g. a booster-only
+// central that needs a different broadcast subscription than the command
+// station.
+type DeviceConfig struct {
+	BroadcastFlags    []string      `yaml:"broadcast_flags"`
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+	Probe             string        `yaml:"probe"`
+	ProbeTimeout      time.Duration `yaml:"probe_timeout"`
+	RatedCurrent      float64       `yaml:"rated_current"`
+}
+
+// deviceSettings are the flags a DeviceConfig can set.
+type deviceSettings struct {
+	broadcastFlags    *string
+	heartbeatInterval *time.Duration
+	probe             *string
+	probeTimeout      *time.Duration
+	ratedCurrent      *float64
+}
+
+// apply sets the settings of dc that were not given on the command line;
+// the device entry overrides the defaults and environment variables.
+func (s deviceSettings) apply(fs *flag.FlagSet, dc DeviceConfig) {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	if len(dc.BroadcastFlags) > 0 && !given["broadcast_flags"] {
+		*s.broadcastFlags = strings.Join(dc.BroadcastFlags, ",")
+	}
+	if dc.HeartbeatInterval != 0 && !given["heartbeat_interval"] {
+		*s.heartbeatInterval = dc.HeartbeatInterval
+	}
+	if dc.Probe != "" && !given["probe"] {
+		*s.probe = dc.Probe
+	}
+	if dc.ProbeTimeout != 0 && !given["probe_timeout"] {
+		*s.probeTimeout = dc.ProbeTimeout
+	}
+	if dc.RatedCurrent != 0 && !given["rated_current"] {
+		*s.ratedCurrent = dc.RatedCurrent
+	}
+}
+
+// applyTo sets the settings of dc in cfg, for a z21 attached with
+// device.attach.
+func (dc DeviceConfig) applyTo(cfg *Config) error {
+	if len(dc.BroadcastFlags) > 0 {
+		flags, err := parseBroadcastFlags(strings.Join(dc.BroadcastFlags, ","))
+		if err != nil {
+			return err
+		}
+		cfg.BroadcastFlags = flags
+	}
+	if dc.HeartbeatInterval != 0 {
+		cfg.HeartbeatInterval = dc.HeartbeatInterval
+	}
+	if dc.Probe != "" {
+		cfg.Probe = dc.Probe
+	}
+	if dc.ProbeTimeout != 0 {
+		cfg.ProbeTimeout = dc.ProbeTimeout
+	}
+	if dc.RatedCurrent != 0 {
+		cfg.RatedCurrent = dc.RatedCurrent
+	}
+	return nil
+}
+
+// validateDevices checks the entries of all devices, not just the one of
+// --z21_name, as the others may be attached later.
+func validateDevices(devices map[string]DeviceConfig) error {
+	for _, name := range sortedKeys(devices) {
+		dc := devices[name]
+		if _, err := parseBroadcastFlags(strings.Join(dc.BroadcastFlags, ",")); err != nil {
+			return fmt.Errorf("device %s: %w", name, err)
+		}
+		if dc.Probe != "" {
+			if err := validateProbe(dc.Probe); err != nil {
+				return fmt.Errorf("device %s: %w", name, err)
+			}
+		}
+		if dc.HeartbeatInterval < 0 || dc.ProbeTimeout < 0 || dc.RatedCurrent < 0 {
+			return fmt.Errorf("device %s: heartbeat_interval, probe_timeout and rated_current must not be negative", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package gateway
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+const (
+	MaxLocoAddress = 10239
+	// MaxSpeedStep is the highest speed in 128 speed step mode, sent as 127;
+	// 1 is the emergency stop.
+	MaxSpeedStep = 126
+)
+
+// DriveRequest is the payload of the loco.drive command.
+type DriveRequest struct {
+	Address uint16 `json:"address"`
+	// Name is resolved to Address through the configured loco names.
+	Name string `json:"name,omitempty"`
+	// Speed in percent of full speed.
+	Speed   float64 `json:"speed" payload:"required"`
+	Forward bool    `json:"forward" payload:"required"`
+}
+
+func (g *Gateway) handleDrive(cr *cmdRequest, req *DriveRequest) CmdReply {
+	addr, err := g.names.resolveLoco(req.Name, req.Address)
+	if err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	req.Address = addr
+	if req.Address == 0 || req.Address > MaxLocoAddress {
+		return g.handleValidationError(cr, fmt.Errorf("address must be between 1 and %d", MaxLocoAddress))
+	}
+	if req.Speed < 0 || req.Speed > 100 {
+		return g.handleValidationError(cr, fmt.Errorf("speed must be between 0 and 100"))
+	}
+
+	speed := req.Speed
+	if cr.profile != nil {
+		speed = cr.profile.capSpeed(speed)
+	}
+
+	steps := g.speedSteps.mode(req.Address)
+	return g.handleRequest(cr, &z21.LocoDrive{
+		Address:    req.Address,
+		Speed:      speedCode(speed, steps),
+		Forward:    req.Forward,
+		SpeedSteps: steps,
+	})
+}
+
+// speedStep converts a speed in percent to a 128 speed step value, skipping
+// the emergency stop step.
+func speedStep(percent float64) uint8 {
+	step := math.Round(percent / 100 * MaxSpeedStep)
+	if step == 0 {
+		return 0
+	}
+	return uint8(step) + 1
+}
+
+func (g *Gateway) handleValidationError(cr *cmdRequest, err error) CmdReply {
+	cr.logger.Warn().
+		Err(err).
+		Msg("NATS msg")
+	return CmdReply{
+		Ok:        false,
+		Error:     err.Error(),
+		ErrorCode: ErrCodeValidationFailed,
+		TS:        time.Now().Format(time.RFC3339),
+	}
+}
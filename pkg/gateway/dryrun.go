@@ -0,0 +1,29 @@
+package gateway
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+// DryRunResult describes the Z21 request a dry-run command would have sent.
+type DryRunResult struct {
+	Request string `json:"request"`
+	Payload any    `json:"payload"`
+}
+
+func (g *Gateway) handleDryRun(cr *cmdRequest, req z21.Serializable) CmdReply {
+	cr.logger.Debug().
+		Str("request", eventTypeName(req)).
+		Msg("dry run")
+	return CmdReply{
+		Ok:     true,
+		DryRun: true,
+		Data: &DryRunResult{
+			Request: fmt.Sprintf("%s", req),
+			Payload: req,
+		},
+		TS: time.Now().Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,97 @@
+package gateway_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	z21test "github.com/trains-io/z21-gateway/internal/testing"
+	"github.com/trains-io/z21-gateway/pkg/client"
+)
+
+// e2eTimeout bounds each step of an end-to-end test.
+const e2eTimeout = 5 * time.Second
+
+func startHarness(t *testing.T, opts ...z21test.Option) *z21test.Harness {
+	t.Helper()
+	h, err := z21test.Start(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+	return h
+}
+
+// eventually polls cond until it holds or e2eTimeout passes.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(e2eTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestE2ELocoDrive(t *testing.T) {
+	h := startHarness(t)
+	ctx, cancel := context.WithTimeout(context.Background(), e2eTimeout)
+	defer cancel()
+
+	if err := h.Client.DriveLoco(ctx, 3, 40, true); err != nil {
+		t.Fatal(err)
+	}
+	// 40% of the 126 speed steps, after the emergency stop step
+	eventually(t, "loco 3 to drive", func() bool {
+		l, ok := h.Z21.Loco(3)
+		return ok && l.Speed == 51 && l.Forward && l.SpeedSteps == 128
+	})
+
+	if err := h.Client.DriveLoco(ctx, 3, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "loco 3 to stop", func() bool {
+		l, _ := h.Z21.Loco(3)
+		return l.Speed == 0 && !l.Forward
+	})
+}
+
+func TestE2ECANOccupancy(t *testing.T) {
+	h := startHarness(t)
+	ctx, cancel := context.WithTimeout(context.Background(), e2eTimeout)
+	defer cancel()
+
+	events := make(chan client.Event, 16)
+	sub, err := h.Client.SubscribeEvents("can.>", func(ev client.Event) { events <- ev })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	if err := h.NC.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Z21.SetOccupancy(0x1234, 2, true)
+	const subject = "z21." + z21test.DeviceName + ".event.can.4660.2"
+	select {
+	case ev := <-events:
+		if ev.Subject != subject || ev.Kind != "can" {
+			t.Errorf("event on %s of kind %s, want %s of kind can", ev.Subject, ev.Kind, subject)
+		}
+		if len(ev.Payload) == 0 {
+			t.Error("event without payload")
+		}
+	case <-ctx.Done():
+		t.Fatal("no occupancy event")
+	}
+
+	var states []client.CachedState
+	eventually(t, "the occupancy in the state cache", func() bool {
+		states, err = h.Client.State(ctx, "can.")
+		return err == nil && len(states) > 0
+	})
+	if states[0].Subject != subject || states[0].Stale {
+		t.Errorf("state.get returned %+v, want a fresh entry for %s", states, subject)
+	}
+}
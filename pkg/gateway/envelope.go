@@ -0,0 +1,208 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	SchemaV1 = 1
+	SchemaV2 = 2
+
+	SchemaVersionHeader = "Z21-Schema-Version"
+)
+
+// Envelope wraps every payload published in schema version 2.
+type Envelope struct {
+	SchemaVersion int    `json:"schema_version"`
+	Device        string `json:"device"`
+	Kind          string `json:"kind"`
+	Seq           uint64 `json:"seq,omitempty"`
+	TS            string `json:"ts"`
+	Payload       any    `json:"payload"`
+}
+
+// v2Payload is implemented by payloads whose schema version 2
+// representation differs from version 1.
+type v2Payload interface {
+	v2() any
+}
+
+// maxPooledBuffer keeps the buffers of rare large payloads, e.g. state
+// dumps, out of the pool.
+const maxPooledBuffer = 64 << 10
+
+// encodeBuffers are reused for encoding published payloads. The NATS
+// client copies the data of a message while publishing it, so the buffer
+// is free again once PublishMsg returned.
+var encodeBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+func getEncodeBuffer() *bytes.Buffer {
+	buf := encodeBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putEncodeBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		encodeBuffers.Put(buf)
+	}
+}
+
+func (g *Gateway) encode(version int, kind string, seq uint64, ts time.Time, payload any) ([]byte, error) {
+	return encodePayload(version, g.name, kind, seq, ts, payload)
+}
+
+func encodePayload(version int, device, kind string, seq uint64, ts time.Time, payload any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodePayloadTo(&buf, version, device, kind, seq, ts, payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodePayloadTo appends the encoded payload to buf, the same bytes
+// json.Marshal produces.
+func encodePayloadTo(buf *bytes.Buffer, version int, device, kind string, seq uint64, ts time.Time, payload any) error {
+	enc := json.NewEncoder(buf)
+	var err error
+	if version == SchemaV1 {
+		err = enc.Encode(payload)
+	} else {
+		if p, ok := payload.(v2Payload); ok {
+			payload = p.v2()
+		}
+		err = enc.Encode(Envelope{
+			SchemaVersion: version,
+			Device:        device,
+			Kind:          kind,
+			Seq:           seq,
+			TS:            ts.Format(time.RFC3339Nano),
+			Payload:       payload,
+		})
+	}
+	if err != nil {
+		return err
+	}
+	// Encode terminates the value with a newline.
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
+
+// publish publishes payload on subject once per enabled schema version. The
+// first (primary) version uses subject as is, the others are published under
+// z21.<name>.v<N>.<rest of subject>. With --nodered, a flat copy follows on
+// z21.<name>.nodered.<rest of subject>.
+func (g *Gateway) publish(subject, kind string, seq uint64, payload any) error {
+	return g.publishWithHeader(subject, kind, seq, time.Now(), payload, nil)
+}
+
+// publishWithHeader is publish with the timestamp ts, e.g. the time an event
+// was received rather than published, and additional message headers.
+func (g *Gateway) publishWithHeader(subject, kind string, seq uint64, ts time.Time, payload any, header nats.Header) error {
+	g.record(RecordPub, subject, kind, payload)
+	ts = ts.UTC()
+	buf := getEncodeBuffer()
+	defer putEncodeBuffer(buf)
+	for i, version := range g.schemaVersions {
+		buf.Reset()
+		if err := encodePayloadTo(buf, version, g.name, kind, seq, ts, payload); err != nil {
+			return err
+		}
+		msg := g.newMsg(g.versionedSubject(subject, i, version), version, seq, ts)
+		for k, v := range header {
+			msg.Header[k] = v
+		}
+		msg.Data = buf.Bytes()
+		if err := g.publishMsg(msg); err != nil {
+			return err
+		}
+	}
+	if g.nodeRED {
+		return g.publishNodeRED(subject, kind, seq, ts, payload, header)
+	}
+	return nil
+}
+
+// publishReply publishes a command reply in the schema version requested by
+// the caller, falling back to the primary version.
+func (g *Gateway) publishReply(subject string, req *nats.Msg, reply CmdReply) error {
+	version := g.schemaVersions[0]
+	if v, err := strconv.Atoi(req.Header.Get(SchemaVersionHeader)); err == nil && slices.Contains(g.schemaVersions, v) {
+		version = v
+	}
+
+	g.record(RecordPub, subject, "reply", reply)
+	ts := time.Now().UTC()
+	data, err := g.encode(version, "reply", 0, ts, reply)
+	if err != nil {
+		return err
+	}
+	msg := g.newMsg(subject, version, 0, ts)
+	msg.Data = data
+	return g.publishLocal(msg)
+}
+
+func (g *Gateway) newMsg(subject string, version int, seq uint64, ts time.Time) *nats.Msg {
+	msg := newMsg(subject, version, seq, ts)
+	msg.Header.Set(InstanceHeader, g.instance)
+	return msg
+}
+
+func newMsg(subject string, version int, seq uint64, ts time.Time) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Header.Set(SchemaVersionHeader, strconv.Itoa(version))
+	msg.Header.Set(TimestampHeader, ts.Format(time.RFC3339Nano))
+	if seq > 0 {
+		msg.Header.Set(SeqHeader, strconv.FormatUint(seq, 10))
+	}
+	return msg
+}
+
+func (g *Gateway) versionedSubject(subject string, i, version int) string {
+	if i == 0 {
+		return subject
+	}
+	return g.subjectPrefix + "v" + strconv.Itoa(version) + "." + strings.TrimPrefix(subject, g.subjectPrefix)
+}
+
+// decodePayload decodes data published in the given schema version into v.
+func decodePayload(version int, data []byte, v any) error {
+	if version == SchemaV1 {
+		return json.Unmarshal(data, v)
+	}
+	return json.Unmarshal(data, &Envelope{Payload: v})
+}
+
+// msgSchemaVersion returns the schema version of a message published by the
+// gateway.
+func msgSchemaVersion(msg *nats.Msg) int {
+	if v, err := strconv.Atoi(msg.Header.Get(SchemaVersionHeader)); err == nil {
+		return v
+	}
+	return SchemaV1
+}
+
+// parseSchemaVersions parses a comma separated list of schema versions, the
+// first one being the primary.
+func parseSchemaVersions(s string) ([]int, error) {
+	var versions []int
+	for _, f := range strings.Split(s, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || v < SchemaV1 || v > SchemaV2 {
+			return nil, fmt.Errorf("invalid schema version %q", f)
+		}
+		if !slices.Contains(versions, v) {
+			versions = append(versions, v)
+		}
+	}
+	return versions, nil
+}
@@ -0,0 +1,72 @@
+package gateway
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// renamedPayload has a schema version 2 representation of its own.
+type renamedPayload struct {
+	Addr uint16 `json:"Addr"`
+}
+
+func (p renamedPayload) v2() any {
+	return map[string]uint16{"address": p.Addr}
+}
+
+func TestEncodeSchemaVersions(t *testing.T) {
+	g := &Gateway{name: "main"}
+	ts := time.Date(2025, 11, 7, 21, 22, 3, 500000000, time.UTC)
+	for _, tt := range []struct {
+		name    string
+		version int
+		seq     uint64
+		payload any
+		want    string
+	}{
+		{"v1 is the bare payload", SchemaV1, 7, map[string]int{"Port": 2}, `{"Port":2}`},
+		{"v1 ignores the v2 representation", SchemaV1, 7, renamedPayload{Addr: 3}, `{"Addr":3}`},
+		{"v2 wraps the payload", SchemaV2, 7, map[string]int{"Port": 2},
+			`{"schema_version":2,"device":"main","kind":"event.can","seq":7,"ts":"2025-11-07T21:22:03.5Z","payload":{"Port":2}}`},
+		{"v2 omits a zero seq", SchemaV2, 0, map[string]int{"Port": 2},
+			`{"schema_version":2,"device":"main","kind":"event.can","ts":"2025-11-07T21:22:03.5Z","payload":{"Port":2}}`},
+		{"v2 uses the v2 representation", SchemaV2, 7, renamedPayload{Addr: 3},
+			`{"schema_version":2,"device":"main","kind":"event.can","seq":7,"ts":"2025-11-07T21:22:03.5Z","payload":{"address":3}}`},
+	} {
+		data, err := g.encode(tt.version, "event.can", tt.seq, ts, tt.payload)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, data, tt.want)
+		}
+	}
+}
+
+func TestParseSchemaVersions(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want []int
+	}{
+		{"1", []int{1}},
+		{"2,1", []int{2, 1}},
+		{" 1 , 2 ", []int{1, 2}},
+		{"1,1,2", []int{1, 2}},
+		{"", nil},
+		{"0", nil},
+		{"3", nil},
+		{"1,v2", nil},
+	} {
+		got, err := parseSchemaVersions(tt.s)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseSchemaVersions(%q) = %v, want an error", tt.s, got)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("parseSchemaVersions(%q) = %v, %v, want %v", tt.s, got, err, tt.want)
+		}
+	}
+}
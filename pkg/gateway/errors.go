@@ -0,0 +1,66 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrorCode is the machine-readable reason carried in CmdReply.ErrorCode
+// when Ok is false. Values are part of the public reply format and must not
+// be renamed.
+type ErrorCode string
+
+const (
+	ErrCodeTimeout        ErrorCode = "timeout"
+	ErrCodeZ21Offline     ErrorCode = "z21_offline"
+	ErrCodeInvalidRequest ErrorCode = "invalid_request"
+	ErrCodeUnknownCommand ErrorCode = "unknown_command"
+	ErrCodeUnsupported    ErrorCode = "unsupported"
+	// ErrCodeUnsupportedByDevice is returned instead of waiting for a
+	// timeout when the hardware or firmware of the Z21 lacks a feature.
+	ErrCodeUnsupportedByDevice ErrorCode = "unsupported_by_device"
+	ErrCodeBusy                ErrorCode = "busy"
+	ErrCodeLocked              ErrorCode = "locked"
+	ErrCodeValidationFailed    ErrorCode = "validation_failed"
+	ErrCodeForbidden           ErrorCode = "forbidden"
+	ErrCodeCanceled            ErrorCode = "canceled"
+	ErrCodeInternal            ErrorCode = "internal"
+	// ErrCodeGatewayOffline is returned when a command for the z21 of
+	// another gateway, e.g. the step of a route, finds no gateway serving it.
+	ErrCodeGatewayOffline ErrorCode = "gateway_offline"
+	// ErrCodeReplyRequired rejects a command sent without a reply inbox
+	// with --replies required.
+	ErrCodeReplyRequired ErrorCode = "reply_required"
+	// ErrCodeProgNack is returned when the decoder on the programming track
+	// did not acknowledge a read or write.
+	ErrCodeProgNack ErrorCode = "prog_nack"
+	// ErrCodeShortCircuit is returned when the programming track shorted.
+	ErrCodeShortCircuit ErrorCode = "short_circuit"
+	// ErrCodeRailComRequired is returned when a loco did not answer a read
+	// on the main track, which needs a decoder with RailCom.
+	ErrCodeRailComRequired ErrorCode = "railcom_required"
+)
+
+// codedError is an error with the error code reported for it, e.g. in the
+// status of a failed job.
+type codedError struct {
+	code ErrorCode
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+// errorCode classifies an error returned while talking to the Z21.
+func (g *Gateway) errorCode(err error) ErrorCode {
+	switch {
+	case !g.isOnline.Load():
+		return ErrCodeZ21Offline
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrCodeTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrCodeCanceled
+	default:
+		return ErrCodeInternal
+	}
+}
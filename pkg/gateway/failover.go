@@ -0,0 +1,172 @@
+package gateway
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+// FailoverAfter is the default time the active Z21 must be unreachable for
+// before the gateway switches to the other one.
+const FailoverAfter = 30 * time.Second
+
+const (
+	CentralPrimary = "primary"
+	CentralBackup  = "backup"
+)
+
+// FailoverEvent is published on z21.<name>.event.failover when the gateway
+// switches between the primary and the backup Z21.
+type FailoverEvent struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Addr    string `json:"addr"`
+	DownFor string `json:"down_for"`
+	// TrackPower is the track power before the failover, replayed on the
+	// Z21 switched to once it is reachable.
+	TrackPower string `json:"track_power,omitempty"`
+	TS         string `json:"ts"`
+}
+
+// z21Failover holds the primary and the backup Z21. Without a backup the
+// primary is always active.
+type z21Failover struct {
+	addrs   [2]string
+	serials [2]uint32
+	after   time.Duration
+	// active is the index of the Z21 in use, 1 for the backup.
+	active atomic.Int32
+	// switched wakes the events loop to read the events of the new
+	// connection.
+	switched chan struct{}
+	// downSince is only used by the heartbeat.
+	downSince time.Time
+	// replayPower is the track power to replay once the Z21 switched to
+	// is reachable, set by the heartbeat and taken by reestablishState.
+	replayPower atomic.Pointer[string]
+}
+
+func newZ21Failover(cfg Config) *z21Failover {
+	return &z21Failover{
+		addrs:    [2]string{cfg.Z21Addr, cfg.Z21BackupAddr},
+		serials:  [2]uint32{cfg.Z21Serial, cfg.Z21BackupSerial},
+		after:    cfg.FailoverAfter,
+		switched: make(chan struct{}, 1),
+	}
+}
+
+func (f *z21Failover) enabled() bool {
+	return f.addrs[1] != ""
+}
+
+func (f *z21Failover) addr() string {
+	return f.addrs[f.active.Load()]
+}
+
+// serial returns the serial number the active Z21 is pinned to, 0 if any.
+func (f *z21Failover) serial() uint32 {
+	return f.serials[f.active.Load()]
+}
+
+func (f *z21Failover) central() string {
+	if f.active.Load() == 1 {
+		return CentralBackup
+	}
+	return CentralPrimary
+}
+
+// checkFailover switches to the other Z21 once the active one has been
+// unreachable for --failover_after. The Z21s take turns while both are
+// down. It is only called from the heartbeat.
+func (g *Gateway) checkFailover(reachable bool) {
+	f := g.failover
+	if !f.enabled() {
+		return
+	}
+	if reachable {
+		f.downSince = time.Time{}
+		return
+	}
+	if f.downSince.IsZero() {
+		f.downSince = time.Now()
+		return
+	}
+	down := time.Since(f.downSince)
+	if down < f.after {
+		return
+	}
+
+	from := f.central()
+	next := 1 - f.active.Load()
+	zc, relay, err := g.connectZ21(f.addrs[next])
+	if err != nil {
+		g.logger.Error().
+			Err(err).
+			Str("addr", f.addrs[next]).
+			Msg("failover failed to connect")
+		f.downSince = time.Now()
+		return
+	}
+	f.active.Store(next)
+	old, oldRelay := g.zc.Swap(zc), g.relay.Swap(relay)
+	old.Close()
+	oldRelay.close()
+	select {
+	case f.switched <- struct{}{}:
+	default:
+	}
+	f.downSince = time.Now()
+	// the serial number of the other Z21 is not a change of the central
+	g.lastSerial, g.serialMismatch = 0, false
+
+	ev := FailoverEvent{
+		From:    from,
+		To:      f.central(),
+		Addr:    f.addr(),
+		DownFor: down.Truncate(time.Second).String(),
+		TS:      time.Now().UTC().Format(time.RFC3339),
+	}
+	if state := g.trackPowerState.Load(); state != nil {
+		ev.TrackPower = *state
+		f.replayPower.Store(state)
+	}
+	g.logger.Warn().
+		Str("from", ev.From).
+		Str("to", ev.To).
+		Str("addr", ev.Addr).
+		Str("down_for", ev.DownFor).
+		Msg("Z21 failover")
+	g.publishDerivedEvent("failover", "event.failover", &ev)
+}
+
+// replayFailover restores the track power of the Z21 failed over from on
+// the one now in use. Power that was off, stopped or shorted is switched
+// off; power on is not replayed as the gateway has no power on request.
+func (g *Gateway) replayFailover(ctx context.Context) {
+	state := g.failover.replayPower.Swap(nil)
+	if state == nil {
+		return
+	}
+	switch *state {
+	case TrackPowerOff, TrackPowerEmergencyStop, TrackPowerShortCircuit:
+	default:
+		if current := g.trackPowerState.Load(); current != nil && *current != *state {
+			g.logger.Warn().
+				Str("track_power", *current).
+				Str("before", *state).
+				Msg("track power differs after failover")
+		}
+		return
+	}
+	if _, err := g.z21SendRcv(ctx, &z21.TrackPowerOff{}); err != nil {
+		g.logger.Error().
+			Err(err).
+			Msg("failed to replay track power after failover")
+		return
+	}
+	g.logger.Info().
+		Str("before", *state).
+		Msg("track power switched off after failover")
+}
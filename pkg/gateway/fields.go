@@ -0,0 +1,9 @@
+package gateway
+
+import (
+	"reflect"
+)
+
+func eventTypeName(ev any) string {
+	return reflect.Indirect(reflect.ValueOf(ev)).Type().Name()
+}
@@ -0,0 +1,160 @@
+package gateway
+
+import (
+	"context"
+	"encoding/binary"
+)
+
+const (
+	lanX              = 0x40
+	lanGetTurnoutMode = 0x70
+	lanSetTurnoutMode = 0x71
+
+	lanCANDeviceGetDescription = 0xc8
+
+	// X-Bus headers of LAN_X frames
+	xSetTurnout      = 0x53
+	xSetExtAccessory = 0x54
+	xSetLocoEStop    = 0x92
+	xSetLoco         = 0xe4 // LAN_X_SET_LOCO_DRIVE and _FUNCTION
+)
+
+// lanFrame returns a frame of the Z21 LAN protocol with header and data.
+func lanFrame(header uint16, data ...byte) []byte {
+	frame := make([]byte, z21FrameHeaderSize, z21FrameHeaderSize+len(data))
+	binary.LittleEndian.PutUint16(frame, uint16(z21FrameHeaderSize+len(data)))
+	binary.LittleEndian.PutUint16(frame[2:], header)
+	return append(frame, data...)
+}
+
+// xFrame returns a LAN_X frame with the X-Bus bytes in data and their
+// checksum.
+func xFrame(data ...byte) []byte {
+	var xor byte
+	for _, b := range data {
+		xor ^= b
+	}
+	return lanFrame(lanX, append(data, xor)...)
+}
+
+// locoAddrBytes returns the address bytes of a loco in LAN_X frames, the
+// two highest bits set for long addresses.
+func locoAddrBytes(addr uint16) (msb, lsb byte) {
+	msb, lsb = byte(addr>>8), byte(addr)
+	if addr >= 128 {
+		msb |= 0xc0
+	}
+	return msb, lsb
+}
+
+// sendZ21Frames sends LAN frames built by the gateway, rather than z21.go
+// messages, in one datagram from a socket of its own like a TCP bridge
+// client, so the Z21 handles them together. It logs off afterwards so that
+// the Z21 frees the slot of the socket. The frames are not answered.
+func (g *Gateway) sendZ21Frames(frames ...[]byte) error {
+	udp, err := g.dialZ21()
+	if err != nil {
+		return err
+	}
+	defer udp.Close()
+	var datagram []byte
+	for _, frame := range frames {
+		if isActivityFrame(frame) {
+			g.markActivity()
+		}
+		datagram = append(datagram, frame...)
+	}
+	g.publishRaw(RawTx, datagram)
+	if _, err := udp.Write(datagram); err != nil {
+		return err
+	}
+	_, err = udp.Write(z21LogoffFrame)
+	return err
+}
+
+// requestXFrame sends a LAN_X frame built by the gateway from a socket of
+// its own and returns the X-Bus bytes, without the checksum, of the first
+// LAN_X answer accepted by match.
+func (g *Gateway) requestXFrame(ctx context.Context, frame []byte, match func(x []byte) bool) ([]byte, error) {
+	x, err := g.requestFrame(ctx, frame, func(header uint16, data []byte) bool {
+		if header != lanX || len(data) < 2 {
+			return false
+		}
+		var xor byte
+		for _, b := range data {
+			xor ^= b
+		}
+		return xor == 0 && match(data[:len(data)-1])
+	})
+	if err != nil {
+		return nil, err
+	}
+	return x[:len(x)-1], nil
+}
+
+// requestFrame sends a frame built by the gateway from a socket of its own
+// and returns the data of the first answer accepted by match.
+func (g *Gateway) requestFrame(ctx context.Context, frame []byte, match func(header uint16, data []byte) bool) ([]byte, error) {
+	var answer []byte
+	err := g.exchangeFrames(ctx, [][]byte{frame}, func(header uint16, data []byte) bool {
+		if !match(header, data) {
+			return false
+		}
+		answer = append([]byte(nil), data...)
+		return true
+	})
+	return answer, err
+}
+
+// exchangeFrames sends frames built by the gateway in one datagram from a
+// socket of its own and passes every answer to handle until it reports
+// that it got all it waited for. The Z21 answers the socket that asked, so
+// the answers to the gateway's own requests are not mixed in.
+func (g *Gateway) exchangeFrames(ctx context.Context, frames [][]byte, handle func(header uint16, data []byte) (done bool)) error {
+	return g.roundTripFrames(ctx, frames, handle)
+}
+
+// roundTripFrames is exchangeFrames for the heartbeat, which does not count
+// as layout activity.
+func (g *Gateway) roundTripFrames(ctx context.Context, frames [][]byte, handle func(header uint16, data []byte) (done bool)) error {
+	udp, err := g.dialZ21()
+	if err != nil {
+		return err
+	}
+	defer udp.Close()
+	stop := context.AfterFunc(ctx, func() { udp.Close() })
+	defer stop()
+	defer udp.Write(z21LogoffFrame)
+
+	var datagram []byte
+	for _, frame := range frames {
+		datagram = append(datagram, frame...)
+	}
+	g.publishRaw(RawTx, datagram)
+	if _, err := udp.Write(datagram); err != nil {
+		return err
+	}
+	buf := make([]byte, z21MaxDatagram)
+	for {
+		n, err := udp.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		g.publishRaw(RawRx, buf[:n])
+		for datagram := buf[:n]; len(datagram) >= z21FrameHeaderSize; {
+			size := int(binary.LittleEndian.Uint16(datagram))
+			if size < z21FrameHeaderSize || size > len(datagram) {
+				break
+			}
+			header := binary.LittleEndian.Uint16(datagram[2:])
+			data := datagram[z21FrameHeaderSize:size]
+			datagram = datagram[size:]
+			if handle(header, data) {
+				return nil
+			}
+		}
+	}
+}
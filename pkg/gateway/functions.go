@@ -0,0 +1,88 @@
+package gateway
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// MaxLocoFunction is the highest function loco.functions sets.
+	MaxLocoFunction = 31
+	// DefaultFunctionMask selects F0 to F12, the functions of the classic
+	// function groups, when loco.functions is sent without a mask.
+	DefaultFunctionMask = 0x1fff
+)
+
+// FunctionsRequest is the payload of loco.functions. Bit n of Functions is
+// the state of function Fn, set for the functions selected by Mask.
+type FunctionsRequest struct {
+	Address uint16 `json:"address"`
+	// Name is resolved to Address through the configured loco names.
+	Name      string `json:"name,omitempty"`
+	Functions uint32 `json:"functions" payload:"required"`
+	Mask      uint32 `json:"mask,omitempty"`
+}
+
+// FunctionsResult is the reply to loco.functions.
+type FunctionsResult struct {
+	Address   uint16          `json:"address"`
+	Functions map[string]bool `json:"functions"`
+}
+
+// setLocoFunctionFrame returns LAN_X_SET_LOCO_FUNCTION switching function n
+// of a loco on or off.
+func setLocoFunctionFrame(addr uint16, n uint8, on bool) []byte {
+	msb, lsb := locoAddrBytes(addr)
+	tt := byte(0x00)
+	if on {
+		tt = 0x40
+	}
+	return xFrame(xSetLoco, 0xf8, msb, lsb, tt|n&0x3f)
+}
+
+// handleFunctions sets the functions of a loco with one
+// LAN_X_SET_LOCO_FUNCTION per function, all in one datagram, so that the
+// Z21 receives them together rather than as separate requests.
+func (g *Gateway) handleFunctions(cr *cmdRequest, req *FunctionsRequest) CmdReply {
+	addr, err := g.names.resolveLoco(req.Name, req.Address)
+	if err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	req.Address = addr
+	if req.Address == 0 || req.Address > MaxLocoAddress {
+		return g.handleValidationError(cr, fmt.Errorf("address must be between 1 and %d", MaxLocoAddress))
+	}
+	mask := req.Mask
+	if mask == 0 {
+		mask = DefaultFunctionMask
+	}
+
+	res := &FunctionsResult{Address: req.Address, Functions: make(map[string]bool)}
+	var frames [][]byte
+	for n := range uint8(MaxLocoFunction + 1) {
+		if mask&(1<<n) == 0 {
+			continue
+		}
+		on := req.Functions&(1<<n) != 0
+		res.Functions[fmt.Sprintf("f%d", n)] = on
+		frames = append(frames, setLocoFunctionFrame(req.Address, n, on))
+	}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, Data: res, TS: time.Now().Format(time.RFC3339)}
+	}
+	if !g.isOnline.Load() {
+		return CmdReply{Ok: false, Error: "z21 is offline", ErrorCode: ErrCodeZ21Offline, TS: time.Now().Format(time.RFC3339)}
+	}
+
+	sent := time.Now()
+	err = g.sendZ21Frames(frames...)
+	cr.timing.z21 += time.Since(sent)
+	if err != nil {
+		cr.logger.Error().
+			Err(err).
+			Uint16("address", req.Address).
+			Msg("failed to set loco functions")
+		return CmdReply{Ok: false, Error: err.Error(), ErrorCode: ErrCodeZ21Offline, TS: time.Now().Format(time.RFC3339)}
+	}
+	return CmdReply{Ok: true, Data: res, TS: time.Now().Format(time.RFC3339)}
+}
@@ -0,0 +1,1047 @@
+// Package gateway bridges a z21 to NATS. It is the z21-gateway binary as a
+// library: build a Config with DefaultConfig or ParseConfig, create the
+// gateway with New on an existing NATS connection, then Start it and
+// Shutdown and Stop it when done.
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/trains-io/z21.go"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	HeartbeatInterval     = 5 * time.Second
+	StatusInterval        = 20 * time.Second
+	RequestTimeout        = 500 * time.Millisecond
+	MaxConcurrentCommands = 4
+	RequestIDHeader       = "Request-Id"
+	SeqHeader             = "Z21-Seq"
+	TimestampHeader       = "Z21-Timestamp"
+)
+
+type Gateway struct {
+	name string
+	// subjectPrefix and eventPrefix are z21.<name>. and
+	// z21.<name>.event., precomputed for the event path.
+	subjectPrefix string
+	eventPrefix   string
+	// zc is the connection to the active Z21, replaced on failover, and
+	// relay the relay it is connected through.
+	zc    atomic.Pointer[z21.Conn]
+	relay atomic.Pointer[z21Relay]
+	// bind is the --bind address or interface of the Z21 sockets.
+	bind       string
+	udpOptions udpOptions
+	failover   *z21Failover
+	nc         *nats.Conn
+	ctx        context.Context
+	cancel     context.CancelFunc
+	stopReason atomic.Pointer[shutdownReason]
+	wg         sync.WaitGroup
+	logger     zerolog.Logger
+	// pools hold the command slots per command class.
+	pools map[string]chan struct{}
+	// queues hold the commands per command class waiting for a worker.
+	queues map[string]chan queuedCommand
+	// publishQueue holds the events waiting for the publisher.
+	publishQueue chan publishJob
+	// batches collects the events of the batched kinds while
+	// --batch_window is set.
+	batches     map[string]*eventBatch
+	batchWindow time.Duration
+	// maxGoroutines and maxHeapMB are the guardrail limits, zero
+	// disables one.
+	maxGoroutines int
+	maxHeapMB     int
+	guardRestart  bool
+	onlineStatus  chan bool
+	isOnline      atomic.Bool
+	link          linkQuality
+	// onlineSince is when the Z21 last became reachable, zero while it
+	// is not.
+	onlineSince     atomic.Int64
+	trackPowerState atomic.Pointer[string]
+	eventSeq        atomic.Uint64
+	startedAt       time.Time
+	stats           gatewayStats
+	state           *stateCache
+
+	lastBroadcast atomic.Int64
+	lastActivity  atomic.Int64
+
+	legacySubjects bool
+	schemaVersions []int
+	nodeRED        bool
+	// homie is the Homie device, nil unless --homie is set.
+	homie             *homieDevice
+	homieInterval     time.Duration
+	dccPackets        bool
+	heartbeatInterval time.Duration
+	statusInterval    time.Duration
+	broadcastTimeout  time.Duration
+	broadcastRefresh  time.Duration
+	// broadcastFlags is the broadcast subscription of --broadcast_flags,
+	// 0 for the default one.
+	broadcastFlags    z21.Mask32
+	webhookURL        string
+	currentRules      []CurrentRule
+	currentStates     []currentRuleState
+	tempWarning       float64
+	tempCritical      float64
+	tempSeverity      map[string]string
+	tempUnmonitored   map[uint16]bool
+	occupancy         map[string]any
+	selfTest          bool
+	selfTestMandatory []string
+	selfTestTurnout   uint16
+	idlePowerOff      time.Duration
+	powerOffAt        time.Duration
+	powerOffWarning   time.Duration
+	profiles          map[string]Profile
+	clients           map[string]string
+	defaultProfile    string
+	accessoryOffset   int
+	names             *nameIndex
+	speedSteps        *speedStepTable
+	signals           map[string]SignalConfig
+	routes            map[string]RouteConfig
+	templates         map[string]CVTemplate
+	tracker           *blockTracker
+	taps              *eventTaps
+	jobs              *jobManager
+	seen              *seenLocos
+	canDevices        *canDevices
+	counters          *eventCounters
+	// rawUntil is when the raw stream enabled by debug.raw ends, in unix
+	// nanoseconds; zero while it is disabled.
+	rawUntil        atomic.Int64
+	backupDir       string
+	tlsConfig       *tls.Config
+	jsStream        string
+	jsMaxDeliver    int
+	idempotency     *idempotencyCache
+	recordingBucket string
+	pcapDir         string
+	// pcap is the running capture, guarded by pcapMu.
+	pcapMu          sync.Mutex
+	pcap            *pcapCapture
+	recordOnStart   bool
+	metricsInterval time.Duration
+	metricsAddr     string
+	dashboardAddr   string
+	srcpAddr        string
+	purgeOnRelease  bool
+	tcpBridgeAddr   string
+	// tcpBridgeSlots holds a token per connected TCP bridge client.
+	tcpBridgeSlots chan struct{}
+	// lcc is the OpenLCB link, nil unless --lcc_addr is set.
+	lcc            *lccLink
+	latencies      *latencies
+	logSampler     *eventLogSampler
+	slowCommand    time.Duration
+	replies        string
+	service        *serviceStats
+	loops          loopHealth
+	plugins        map[string]PluginConfig
+	filters        []FilterConfig
+	pluginCommands map[string]*plugin
+	transforms     []eventTransform
+	chaos          ChaosConfig
+	synthetic      SyntheticConfig
+	capabilities   *CapabilityReport
+	device         atomic.Pointer[DeviceInfo]
+	// locked holds the capability bits a locked z21start cleared.
+	locked atomic.Uint32
+	// ratedCurrentMA is --rated_current, 0 for the rating of the model.
+	ratedCurrentMA float64
+	probe          string
+	probeTimeout   time.Duration
+	// lastSerial and serialMismatch are only used by the heartbeat.
+	lastSerial     uint32
+	serialMismatch bool
+	// unsupported are the commands the capability report marks as not
+	// supported by the device.
+	unsupported map[string]bool
+	recMu       sync.Mutex
+	rec         *recording
+	progLock    sync.Mutex
+	subsMu      sync.Mutex
+	subs        []*nats.Subscription
+	// mirror is the connection of --mirror_url, nil without.
+	mirror *natsMirror
+	// instance is the ID of the gateway process, shared by the gateways
+	// attached to it.
+	instance  string
+	instances instanceWatch
+	// shared writes blocks and trains to --layout_bucket, nil without.
+	shared *sharedState
+	// host runs the gateways attached to the process with device.attach,
+	// it is shared by all of them.
+	host *deviceHost
+}
+
+type StatusMsg struct {
+	Reachable bool `json:"reachable"`
+	// Serial keeps its malformed schema version 1 key for existing
+	// consumers, schema version 2 publishes it as serial.
+	Serial string       `json:"serial:omitempty"`
+	Link   *LinkQuality `json:"link,omitempty"`
+	// Instance is the instance ID of the gateway process.
+	Instance string `json:"instance"`
+	// The following fields are only set while the Z21 is reachable. Uptime
+	// is the time it has been reachable without interruption.
+	HardwareType  string `json:"hardware_type,omitempty"`
+	Model         string `json:"model,omitempty"`
+	Firmware      string `json:"firmware,omitempty"`
+	Uptime        string `json:"uptime,omitempty"`
+	TrackPower    string `json:"track_power,omitempty"`
+	LastBroadcast string `json:"last_broadcast,omitempty"`
+	TS            string `json:"ts"`
+}
+
+// StatusMsgV2 is the schema version 2 status payload.
+type StatusMsgV2 struct {
+	Reachable     bool         `json:"reachable"`
+	Serial        string       `json:"serial,omitempty"`
+	Link          *LinkQuality `json:"link,omitempty"`
+	Instance      string       `json:"instance"`
+	HardwareType  string       `json:"hardware_type,omitempty"`
+	Model         string       `json:"model,omitempty"`
+	Firmware      string       `json:"firmware,omitempty"`
+	Uptime        string       `json:"uptime,omitempty"`
+	TrackPower    string       `json:"track_power,omitempty"`
+	LastBroadcast string       `json:"last_broadcast,omitempty"`
+	TS            string       `json:"ts"`
+}
+
+func (s *StatusMsg) v2() any {
+	return &StatusMsgV2{
+		Reachable:     s.Reachable,
+		Serial:        s.Serial,
+		Link:          s.Link,
+		Instance:      s.Instance,
+		HardwareType:  s.HardwareType,
+		Model:         s.Model,
+		Firmware:      s.Firmware,
+		Uptime:        s.Uptime,
+		TrackPower:    s.TrackPower,
+		LastBroadcast: s.LastBroadcast,
+		TS:            s.TS,
+	}
+}
+
+type CmdRequest struct {
+	Type string           `json:"type"`
+	Data z21.Serializable `json:"request,omitempty"`
+}
+
+type CmdReply struct {
+	Type      string `json:"type"`
+	RequestID string `json:"request_id"`
+	Device    string `json:"device"`
+	Instance  string `json:"instance,omitempty"`
+	// Subject is the subject of the command, set on replies published on
+	// z21.<name>.reply for commands sent without a reply inbox.
+	Subject   string    `json:"subject,omitempty"`
+	Ok        bool      `json:"ok"`
+	Data      any       `json:"reply,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	ErrorCode ErrorCode `json:"error_code,omitempty"`
+	Commands  []string  `json:"commands,omitempty"`
+	DryRun    bool      `json:"dry_run,omitempty"`
+	TS        string    `json:"ts"`
+}
+
+// New connects to the Z21 of cfg and returns a gateway bridging it to nc.
+// The gateway runs from Start until ctx is done or Shutdown is called, after
+// which Stop waits for it to finish.
+func New(ctx context.Context, nc *nats.Conn, cfg Config) (*Gateway, error) {
+	unsupported := make(map[string]bool)
+	if cfg.Capabilities != nil {
+		for _, name := range cfg.Capabilities.Unsupported {
+			unsupported[name] = true
+		}
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	g := &Gateway{
+		name:              cfg.Z21Name,
+		subjectPrefix:     "z21." + cfg.Z21Name + ".",
+		eventPrefix:       "z21." + cfg.Z21Name + ".event.",
+		failover:          newZ21Failover(cfg),
+		bind:              cfg.Bind,
+		udpOptions:        udpOptions{readBuffer: cfg.UDPReadBuffer, writeBuffer: cfg.UDPWriteBuffer, readers: cfg.UDPReaders},
+		nc:                nc,
+		ctx:               cctx,
+		cancel:            cancel,
+		logger:            cfg.Logger,
+		pools:             newCommandPools(cfg.CommandPools),
+		queues:            newCommandQueues(cfg.CommandPools, cfg.CommandQueue),
+		publishQueue:      make(chan publishJob, PublishQueue),
+		batches:           newEventBatches(cfg.BatchWindow, cfg.BatchKinds),
+		batchWindow:       cfg.BatchWindow,
+		maxGoroutines:     cfg.MaxGoroutines,
+		maxHeapMB:         cfg.MaxHeapMB,
+		guardRestart:      cfg.GuardRestart,
+		onlineStatus:      make(chan bool, 1),
+		startedAt:         time.Now(),
+		legacySubjects:    cfg.LegacySubjects,
+		schemaVersions:    cfg.SchemaVersions,
+		nodeRED:           cfg.NodeRED,
+		homie:             newHomieDevice(cfg),
+		homieInterval:     cfg.HomieInterval,
+		dccPackets:        cfg.DCCPackets,
+		heartbeatInterval: cfg.HeartbeatInterval,
+		statusInterval:    cfg.StatusInterval,
+		broadcastTimeout:  cfg.BroadcastTimeout,
+		broadcastRefresh:  cfg.BroadcastRefresh,
+		broadcastFlags:    cfg.BroadcastFlags,
+		webhookURL:        cfg.WebhookURL,
+		currentRules:      cfg.CurrentRules,
+		ratedCurrentMA:    cfg.RatedCurrent,
+		currentStates:     make([]currentRuleState, len(cfg.CurrentRules)),
+		tempWarning:       cfg.TemperatureWarning,
+		tempCritical:      cfg.TemperatureCritical,
+		tempSeverity:      make(map[string]string),
+		tempUnmonitored:   make(map[uint16]bool),
+		occupancy:         make(map[string]any),
+		selfTest:          cfg.SelfTest,
+		selfTestMandatory: cfg.SelfTestMandatory,
+		selfTestTurnout:   cfg.SelfTestTurnout,
+		idlePowerOff:      cfg.IdlePowerOff,
+		powerOffAt:        cfg.PowerOffAt,
+		powerOffWarning:   cfg.PowerOffWarning,
+		profiles:          cfg.Profiles,
+		clients:           cfg.File.Clients,
+		defaultProfile:    cfg.File.DefaultProfile,
+		accessoryOffset:   cfg.AccessoryOffset,
+		names:             cfg.Names,
+		speedSteps:        newSpeedStepTable(cfg.SpeedSteps),
+		signals:           cfg.File.Signals,
+		routes:            cfg.File.Routes,
+		templates:         cfg.File.Templates,
+		tracker:           newBlockTracker(cfg.Blocks),
+		taps:              newEventTaps(),
+		jobs:              newJobManager(),
+		seen:              newSeenLocos(),
+		canDevices:        newCANDevices(),
+		counters:          newEventCounters(),
+		state:             newStateCache(cfg.StateLimit),
+		backupDir:         cfg.BackupDir,
+		tlsConfig:         cfg.TLSConfig,
+		jsStream:          cfg.JetStreamStream,
+		jsMaxDeliver:      cfg.JetStreamMaxDeliver,
+		idempotency:       newIdempotencyCache(cfg.IdempotencyWindow),
+		recordingBucket:   cfg.RecordingBucket,
+		pcapDir:           cfg.PcapDir,
+		recordOnStart:     cfg.Record,
+		metricsInterval:   cfg.MetricsInterval,
+		metricsAddr:       cfg.MetricsAddr,
+		dashboardAddr:     cfg.DashboardAddr,
+		srcpAddr:          cfg.SRCPAddr,
+		purgeOnRelease:    cfg.PurgeOnRelease,
+		tcpBridgeAddr:     cfg.TCPBridgeAddr,
+		tcpBridgeSlots:    make(chan struct{}, cfg.TCPBridgeClients),
+		lcc:               newLCCLink(cfg.LCCAddr, cfg.LCCNodeID, cfg.File.LCC),
+		latencies:         newLatencies(),
+		logSampler:        newEventLogSampler(cfg.LogSample),
+		slowCommand:       cfg.SlowCommand,
+		replies:           cfg.Replies,
+		service:           newServiceStats(),
+		plugins:           cfg.File.Plugins,
+		filters:           cfg.File.Filters,
+		chaos:             cfg.Chaos,
+		synthetic:         cfg.Synthetic,
+		capabilities:      cfg.Capabilities,
+		unsupported:       unsupported,
+		probe:             cfg.Probe,
+		probeTimeout:      cfg.ProbeTimeout,
+		pluginCommands:    make(map[string]*plugin),
+		mirror:            newNATSMirror(cfg),
+		shared:            newSharedState(cfg.LayoutBucket),
+		instance:          cfg.InstanceID,
+		instances:         instanceWatch{seen: make(map[string]bool)},
+	}
+	zc, relay, err := g.connectZ21(cfg.Z21Addr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	g.zc.Store(zc)
+	g.relay.Store(relay)
+	g.host = newDeviceHost(ctx, nc, cfg, g)
+	return g, nil
+}
+
+func (g *Gateway) Start() error {
+	if g.mirror != nil {
+		if err := g.mirror.start("z21gw-mirror-" + g.name); err != nil {
+			return err
+		}
+	}
+	if g.recordOnStart {
+		if _, err := g.startRecording(""); err != nil {
+			return err
+		}
+	}
+	if err := g.startPlugins(g.plugins); err != nil {
+		return err
+	}
+	if err := g.startFilters(g.filters); err != nil {
+		return err
+	}
+	if g.chaos.enabled() {
+		g.logger.Warn().
+			Float64("timeout", g.chaos.Timeout).
+			Float64("delay_rate", g.chaos.DelayRate).
+			Dur("delay", g.chaos.Delay).
+			Float64("drop", g.chaos.Drop).
+			Dur("disconnect", g.chaos.Disconnect).
+			Msg("chaos mode enabled, injecting faults")
+		if g.chaos.Disconnect > 0 {
+			g.wg.Add(1)
+			go g.chaosDisconnectLoop()
+		}
+	}
+	if g.synthetic.enabled() {
+		g.wg.Add(1)
+		go g.syntheticLoop()
+	}
+	if g.shared != nil {
+		if err := g.startSharedState(); err != nil {
+			return err
+		}
+	}
+
+	g.logger.Debug().
+		Msg("starting Z21 heartbeat loop")
+	g.wg.Add(1)
+	go g.heartbeatLoop()
+
+	g.logger.Debug().
+		Msg("starting Z21 online status monitor")
+	g.wg.Add(1)
+	go g.monitorOnlineStatus()
+
+	g.logger.Debug().
+		Msg("starting Z21 events loop")
+	g.wg.Add(1)
+	go g.publishLoop()
+	g.wg.Add(1)
+	go g.z21EventsLoop()
+
+	g.wg.Add(1)
+	go g.guardLoop()
+
+	if g.logSampler.n > 1 {
+		g.wg.Add(1)
+		go g.logSummaryLoop()
+	}
+
+	if g.broadcastTimeout > 0 {
+		g.logger.Debug().
+			Msg("starting Z21 broadcast health loop")
+		g.wg.Add(1)
+		go g.broadcastHealthLoop()
+	}
+
+	if g.idlePowerOff > 0 || g.powerOffAt >= 0 {
+		g.logger.Debug().
+			Msg("starting track power-off loop")
+		g.wg.Add(1)
+		go g.powerOffLoop()
+	}
+
+	g.logger.Debug().
+		Msg("starting gateway status loop")
+	g.wg.Add(1)
+	go g.gatewayStatusLoop()
+
+	g.logger.Debug().
+		Msg("starting registry loop")
+	g.wg.Add(1)
+	go g.registryLoop()
+
+	if g.metricsInterval > 0 {
+		g.logger.Debug().
+			Msg("starting metrics loop")
+		g.wg.Add(1)
+		go g.metricsLoop()
+	}
+
+	if err := g.startHTTP(); err != nil {
+		return err
+	}
+	if g.srcpAddr != "" {
+		if err := g.startSRCP(); err != nil {
+			return err
+		}
+	}
+	if g.tcpBridgeAddr != "" {
+		if err := g.startTCPBridge(); err != nil {
+			return err
+		}
+	}
+	if g.lcc != nil {
+		if err := g.startLCC(); err != nil {
+			return err
+		}
+	}
+	if g.homie != nil {
+		if err := g.startHomie(); err != nil {
+			return err
+		}
+	}
+
+	if g.selfTest {
+		g.logger.Info().
+			Msg("running self-test")
+		if err := g.runSelfTest(); err != nil {
+			return err
+		}
+	}
+
+	g.logger.Debug().
+		Msg("starting NATS commands loop")
+	if err := g.natsCommandsLoop(); err != nil {
+		return err
+	}
+	if err := g.subscribeService(); err != nil {
+		return err
+	}
+	if err := g.subscribeRegistry(); err != nil {
+		return err
+	}
+	if err := g.subscribeInstances(); err != nil {
+		return err
+	}
+	if g.jsStream != "" {
+		g.logger.Debug().
+			Msg("starting JetStream commands loop")
+		if err := g.jetStreamCommandsLoop(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (g *Gateway) Stop() {
+	g.cancel()
+	g.unsubscribeAll()
+	if g.host.main == g {
+		g.host.detachAll(g.StopReason())
+	}
+	g.closeZ21()
+	g.wg.Wait()
+	if _, err := g.stopRecording(); err != nil && !errors.Is(err, errNoRecording) {
+		g.logger.Error().
+			Err(err).
+			Msg("failed to store recording")
+	}
+	g.publishGatewayStatus(GatewayStopped)
+	g.publishRegistryEntry(GatewayStopped)
+	if g.homie != nil {
+		g.homie.setState(g, HomieDisconnected)
+	}
+	if g.mirror != nil {
+		g.mirror.close()
+	}
+	g.nc.Flush()
+}
+
+func (g *Gateway) heartbeatLoop() {
+	defer g.wg.Done()
+	ticker := time.NewTicker(g.heartbeatInterval)
+	defer ticker.Stop()
+
+	var lastPublished time.Time
+	if g.doHeartbeatCheck(true) {
+		lastPublished = time.Now()
+	}
+	g.loops.heartbeat.beat()
+
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-ticker.C:
+			keepalive := time.Since(lastPublished) >= g.statusInterval
+			if g.doHeartbeatCheck(keepalive) {
+				lastPublished = time.Now()
+			}
+			g.loops.heartbeat.beat()
+		}
+	}
+}
+
+// doHeartbeatCheck probes the Z21 and publishes its status if the
+// reachability changed or force is set. It reports whether it published.
+func (g *Gateway) doHeartbeatCheck(force bool) bool {
+	status := g.checkReachability()
+	g.checkLinkQuality(status.Link)
+	g.checkFailover(status.Reachable)
+	wasOnline := g.isOnline.Load()
+
+	changed := status.Reachable != wasOnline
+	if changed {
+		g.isOnline.Store(status.Reachable)
+		if status.Reachable {
+			g.onlineSince.Store(time.Now().UnixNano())
+		} else {
+			g.onlineSince.Store(0)
+		}
+
+		select {
+		case g.onlineStatus <- status.Reachable:
+		default:
+		}
+	}
+
+	if !changed && !force {
+		return false
+	}
+	g.completeStatus(status)
+
+	subject := fmt.Sprintf("z21.%s.status", g.name)
+	if err := g.publish(subject, "status", 0, status); err != nil {
+		g.logger.Error().
+			Err(err).
+			Msg("failed to publish heartbeat status")
+		return false
+	}
+	g.logger.Info().
+		Str("subject", subject).
+		Bool("reachable", status.Reachable).
+		Str("serial", status.Serial).
+		Bool("changed", changed).
+		Msg("NATS pub")
+	return true
+}
+
+func (g *Gateway) checkReachability() *StatusMsg {
+	ctx, cancel := context.WithTimeout(g.ctx, g.probeTimeout)
+	defer cancel()
+
+	reachable := false
+	serial := ""
+
+	g.logger.Debug().
+		Str("probe", g.probe).
+		Msg("sending hearbeat")
+
+	start := time.Now()
+	if g.probe == ProbeStatus {
+		centralState, err := g.probeStatus(ctx)
+		g.link.record(time.Since(start), err)
+		if err == nil {
+			g.stats.z21RTT.Store(int64(time.Since(start)))
+			reachable = true
+			state := trackPowerState(centralState)
+			g.trackPowerState.Store(&state)
+		}
+	} else {
+		req := probes[g.probe]()
+		msg, err := g.z21SendRcv(ctx, req)
+		g.link.record(time.Since(start), err)
+		if err == nil {
+			if sn, ok := msg.(*z21.SerialNumber); ok {
+				g.stats.z21RTT.Store(int64(time.Since(start)))
+				reachable = g.checkSerial(sn.SerialNumber)
+				serial = fmt.Sprintf("%d", sn.SerialNumber)
+			} else if eventTypeName(msg) == eventTypeName(req) {
+				g.stats.z21RTT.Store(int64(time.Since(start)))
+				reachable = true
+				// the richer probes double as events, e.g. the system state
+				g.publishEvent(msg, time.Now())
+				g.trackPower(msg)
+				g.trackLock(msg)
+			}
+		}
+	}
+
+	return &StatusMsg{
+		Reachable: reachable,
+		Serial:    serial,
+		Link:      g.link.snapshot(),
+		TS:        time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+func (g *Gateway) monitorOnlineStatus() {
+	defer g.wg.Done()
+
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case isOnline := <-g.onlineStatus:
+			if isOnline {
+				g.logger.Info().
+					Msg("Z21 is ONLINE — re-establishing state")
+				g.reestablishState()
+			} else {
+				g.logger.Warn().
+					Msg("Z21 is OFFLINE")
+				g.state.markStale()
+			}
+		}
+	}
+}
+
+func (g *Gateway) z21EventsLoop() {
+	defer g.wg.Done()
+	events := g.zc.Load().Events()
+	beat := time.NewTicker(LoopBeatInterval)
+	defer beat.Stop()
+	g.loops.events.beat()
+
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-beat.C:
+			g.loops.events.beat()
+		case <-g.failover.switched:
+			events = g.zc.Load().Events()
+		case ev, ok := <-events:
+			if !ok {
+				// the connection was closed on failover
+				events = nil
+				continue
+			}
+			if g.chaosDropEvent() {
+				continue
+			}
+			received := time.Now()
+			g.lastBroadcast.Store(received.UnixNano())
+			g.applyAccessoryOffset(ev)
+			g.record(RecordRx, "", eventTypeName(ev), ev)
+			g.publishEvent(ev, received)
+			g.countEvent(ev)
+			g.checkCurrent(ev)
+			g.checkTemperature(ev)
+			g.trackActivity(ev)
+			g.trackPower(ev)
+			g.trackLock(ev)
+			g.trackBlocks(ev)
+			g.exportDCC(ev)
+			g.recordSeenLocos(ev)
+			g.recordCANDevice(ev)
+			g.detectSpeedSteps(ev)
+			g.taps.send(ev)
+		}
+	}
+}
+
+// publishEvent queues ev, received at ts, for publishing on its event
+// subject. The envelope and Z21-Timestamp carry ts, however long the event
+// waits in the queue.
+func (g *Gateway) publishEvent(ev z21.Serializable, ts time.Time) {
+	g.enqueuePublish(func() error { return g.publishEventNow(ev, ts) }, g.onEventPublishError)
+}
+
+func (g *Gateway) publishEventNow(ev z21.Serializable, ts time.Time) error {
+	seq := g.eventSeq.Add(1)
+	subject := g.eventSubject(ev)
+	token := eventKind(ev)
+	kind := "event." + token
+	var header nats.Header
+	name, hasName := g.names.eventName(ev)
+	if hasName {
+		header = nats.Header{NameHeader: []string{name}}
+	}
+	var payload any = ev
+	if len(g.transforms) > 0 {
+		te, ok := g.transformEvent(ev, token, subject)
+		if !ok {
+			return nil
+		}
+		subject, payload = te.Subject, te.Payload
+	}
+	if g.batchEvent(token, subject, seq, ts, payload, header) {
+		return nil
+	}
+	if err := g.publishWithHeader(subject, kind, seq, ts, payload, header); err != nil {
+		return fmt.Errorf("%s: %w", subject, err)
+	}
+	g.stats.events.Add(1)
+	g.state.put(subject, payload)
+
+	if hasName && !g.legacySubjects {
+		if named, ok := g.namedSubject(token, name); ok {
+			if err := g.publishWithHeader(named, kind, seq, ts, payload, header); err != nil {
+				return fmt.Errorf("%s: %w", named, err)
+			}
+		}
+	}
+
+	g.logPublished(subject, seq)
+	return nil
+}
+
+// publishDerivedEvent publishes an event computed by the gateway, rather than
+// received from the Z21, on z21.<name>.event.<tokens>.
+func (g *Gateway) publishDerivedEvent(tokens, kind string, payload any) {
+	ts := time.Now()
+	g.enqueuePublish(func() error {
+		seq := g.eventSeq.Add(1)
+		subject := g.eventSubjectPrefix() + tokens
+		if err := g.publishWithHeader(subject, kind, seq, ts, payload, nil); err != nil {
+			return fmt.Errorf("%s: %w", subject, err)
+		}
+		g.stats.events.Add(1)
+		g.state.put(subject, payload)
+
+		g.logPublished(subject, seq)
+		return nil
+	}, g.onEventPublishError)
+}
+
+func (g *Gateway) subscribeBroadcast() {
+	// the subscription counts as a broadcast so that the health check
+	// gives the Z21 a full window to start sending
+	g.lastBroadcast.Store(time.Now().UnixNano())
+
+	ctx := context.Background()
+	_, err := g.z21SendRcv(ctx, &z21.BroadcastFlags{Flags: g.subscriptionFlags()})
+	if err != nil {
+		g.logger.Error().
+			Err(err).
+			Msg("failed to subscribe to broadcasts")
+	}
+}
+
+func (g *Gateway) natsCommandsLoop() error {
+	subject := fmt.Sprintf("z21.%s.cmd.>", g.name)
+	g.logger.Info().
+		Str("subject", subject).
+		Msg("NATS sub")
+	g.startCommandWorkers()
+	_, err := g.subscribe(subject, g.enqueueCommand)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// subscribe subscribes handler to subject until Stop, which unsubscribes
+// it: gateways attached with device.attach share the NATS connection and
+// must not leave handlers behind when detached.
+func (g *Gateway) subscribe(subject string, handler nats.MsgHandler) (*nats.Subscription, error) {
+	sub, err := g.nc.Subscribe(subject, handler)
+	if err != nil {
+		return nil, err
+	}
+	g.subsMu.Lock()
+	g.subs = append(g.subs, sub)
+	g.subsMu.Unlock()
+	return sub, nil
+}
+
+func (g *Gateway) unsubscribeAll() {
+	g.subsMu.Lock()
+	defer g.subsMu.Unlock()
+	for _, sub := range g.subs {
+		sub.Unsubscribe()
+	}
+	g.subs = nil
+}
+
+func (g *Gateway) handleCmdMessage(msg *nats.Msg, received time.Time) {
+	reply, ok := g.execCmdMessage(msg, received)
+	if !ok {
+		return
+	}
+	g.sendCmdReply(msg, reply)
+}
+
+// execCmdMessage runs a command received at the given time once a command
+// slot is free. It returns false if the gateway stopped first.
+func (g *Gateway) execCmdMessage(msg *nats.Msg, received time.Time) (CmdReply, bool) {
+	pool := g.pools[commandClass(g.commandName(msg.Subject))]
+	select {
+	case pool <- struct{}{}:
+		defer func() { <-pool }()
+	case <-g.ctx.Done():
+		return CmdReply{}, false
+	}
+
+	g.record(RecordCmd, msg.Subject, "", rawData(msg.Data))
+	name := g.commandName(msg.Subject)
+	id := requestID(msg)
+	start := time.Now()
+	var timing cmdTiming
+	reply := g.doCmdRequest(msg, g.commandLogger(name, id), &timing)
+	reply.Type = name
+	reply.RequestID = id
+	reply.Device = g.name
+	elapsed := time.Since(start)
+	g.latencies.observe(g.metricCommand(name), commandOutcome(reply), elapsed)
+	g.service.record(g.metricCommand(name), elapsed, reply)
+	timing.queued = start.Sub(received)
+	timing.executed = elapsed
+	g.checkSlowCommand(reply, &timing)
+	g.stats.commands.Add(1)
+	if !reply.Ok {
+		g.stats.commandErrors.Add(1)
+	}
+	return reply, true
+}
+
+func (g *Gateway) sendCmdReply(msg *nats.Msg, reply CmdReply) {
+	var subject string
+	// publish to NATS internal request-reply topic
+	if msg.Reply != "" {
+		subject = msg.Reply
+	} else {
+		// fallback to generic topic, with the command subject to tell the
+		// replies of the commands of one request ID apart
+		subject = g.fallbackReplySubject()
+		reply.Subject = msg.Subject
+	}
+	reply.Instance = g.instance
+	logger := g.commandLogger(reply.Type, reply.RequestID)
+	if err := g.publishReply(subject, msg, reply); err != nil {
+		logger.Error().
+			Err(err).
+			Msg("NATS msg")
+	}
+
+	logger.Info().
+		Str("subject", subject).
+		Msg("NATS pub")
+}
+
+func (g *Gateway) doCmdRequest(msg *nats.Msg, logger zerolog.Logger, timing *cmdTiming) CmdReply {
+	logger.Debug().
+		Str("subject", msg.Subject).
+		Msg("NATS msg")
+	name := g.commandName(msg.Subject)
+	cmd, ok := commands[name]
+	if p, isPlugin := g.pluginCommands[name]; !ok && isPlugin {
+		cmd, ok = command{local: func(g *Gateway, cr *cmdRequest) CmdReply { return p.handleCommand(cr) }}, true
+	}
+	if !ok {
+		logger.Warn().
+			Str("subject", msg.Subject).
+			Msg("unknown subject")
+		return g.handleUnknownCommand(name)
+	}
+	cr := newCmdRequest(g, name, msg, logger, timing)
+	if cr.profile != nil && !cr.profile.allows(name) {
+		return g.handleForbidden(cr)
+	}
+	if g.unsupportedByDevice(name) {
+		return g.handleUnsupportedByDevice(name)
+	}
+	if g.lockedByDevice(name) {
+		return g.handleLockedByDevice(name)
+	}
+	return g.runCommand(cr, cmd)
+}
+
+// runCommand runs the handler of a command, turning a panic on a payload
+// nobody thought of into an internal error reply.
+func (g *Gateway) runCommand(cr *cmdRequest, cmd command) (reply CmdReply) {
+	defer func() {
+		if r := recover(); r != nil {
+			cr.logger.Error().
+				Interface("panic", r).
+				Bytes("payload", cr.msg.Data).
+				Msg("command handler panic")
+			reply = CmdReply{
+				Ok:        false,
+				Error:     "internal error",
+				ErrorCode: ErrCodeInternal,
+				TS:        time.Now().Format(time.RFC3339),
+			}
+		}
+	}()
+	return cmd.local(g, cr)
+}
+
+func (g *Gateway) commandName(subject string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(subject, g.subjectPrefix), "cmd.")
+}
+
+// requestID returns the caller supplied request ID, or generates one so that
+// every reply can be correlated.
+func requestID(msg *nats.Msg) string {
+	if id := msg.Header.Get(RequestIDHeader); id != "" {
+		return id
+	}
+	if id := msg.Header.Get(nats.MsgIdHdr); id != "" {
+		return id
+	}
+	return nuid.Next()
+}
+
+func (g *Gateway) handleUnknownCommand(name string) CmdReply {
+	return CmdReply{
+		Ok:        false,
+		Error:     fmt.Sprintf("unknown command: %s", name),
+		ErrorCode: ErrCodeUnknownCommand,
+		Commands:  g.supportedCommands(),
+		TS:        time.Now().Format(time.RFC3339),
+	}
+}
+
+func (g *Gateway) handleError(cr *cmdRequest, err error) CmdReply {
+	cr.logger.Error().
+		Err(err).
+		Msg("NATS msg")
+	return CmdReply{
+		Ok:        false,
+		Error:     fmt.Sprintf("invalid message: %s", err),
+		ErrorCode: ErrCodeInvalidRequest,
+		TS:        time.Now().Format(time.RFC3339),
+	}
+}
+
+func (g *Gateway) handleRequest(cr *cmdRequest, req z21.Serializable) CmdReply {
+	if cr.dryRun {
+		return g.handleDryRun(cr, req)
+	}
+
+	cr.logger.Debug().Msgf("Z21 tx")
+	if isActivityRequest(req) {
+		g.markActivity()
+	}
+	g.record(RecordTx, "", eventTypeName(req), req)
+
+	ctx, cancel := context.WithTimeout(g.ctx, RequestTimeout)
+	defer cancel()
+
+	sent := time.Now()
+	resp, err := g.z21SendRcv(ctx, req)
+	cr.timing.z21 += time.Since(sent)
+	reply := CmdReply{
+		TS: time.Now().Format(time.RFC3339),
+	}
+	if err != nil {
+		cr.logger.Error().
+			Err(err).
+			Msg("Z21 rx")
+		reply.Ok = false
+		reply.Error = fmt.Sprintf("%s", err)
+		reply.ErrorCode = g.errorCode(err)
+	} else {
+		cr.logger.Debug().Msg("Z21 rx")
+		reply.Ok = true
+		reply.Data = resp
+	}
+	return reply
+}
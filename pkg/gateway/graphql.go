@@ -0,0 +1,469 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/nats-io/nats.go"
+)
+
+// GraphQLMaxDepth bounds the nesting of GraphQL queries.
+const GraphQLMaxDepth = 8
+
+const graphQLSchema = `
+"""Any JSON value, e.g. the payload of a z21 event."""
+scalar JSON
+
+schema {
+	query: Query
+	mutation: Mutation
+	subscription: Subscription
+}
+
+type Query {
+	"""The z21 status as last probed."""
+	status: Status!
+	"""The locos in the state cache, by address."""
+	locos: [Loco!]!
+	"""A loco by address or configured name, null if it is not in the state cache."""
+	loco(address: Int, name: String): Loco
+	"""The turnouts in the state cache, by address."""
+	turnouts: [Turnout!]!
+	"""The configured blocks, by name."""
+	blocks: [Block!]!
+	"""The cached events whose subject after z21.<name>.event. starts with prefix."""
+	state(prefix: String): [State!]!
+}
+
+type Mutation {
+	"""Sets the speed, in percent of full speed, and direction of a loco."""
+	driveLoco(address: Int, name: String, speed: Float!, forward: Boolean!, dryRun: Boolean): CommandReply!
+	"""Switches a turnout to output 0 or 1."""
+	setTurnout(address: Int, name: String, output: Int!, dryRun: Boolean): CommandReply!
+	"""Shows an aspect on a configured signal."""
+	setSignal(name: String!, aspect: String!, dryRun: Boolean): CommandReply!
+	"""Switches the track power off."""
+	powerOff(dryRun: Boolean): CommandReply!
+	"""Sends any command, name being the subject suffix after z21.<name>.cmd."""
+	command(name: String!, payload: JSON): CommandReply!
+}
+
+type Subscription {
+	"""The events whose subject after z21.<name>.event. matches one of the patterns, all by default."""
+	events(filter: [String!]): Event!
+}
+
+type Status {
+	reachable: Boolean!
+	hardwareType: String
+	model: String
+	firmware: String
+	uptime: String
+	trackPower: String
+	lastBroadcast: String
+	ts: String!
+}
+
+type Loco {
+	address: Int!
+	name: String
+	"""The last loco info event."""
+	state: JSON!
+	updatedAt: String!
+	stale: Boolean!
+}
+
+type Turnout {
+	address: Int!
+	name: String
+	"""The last turnout info event."""
+	state: JSON!
+	updatedAt: String!
+	stale: Boolean!
+}
+
+type Block {
+	name: String!
+	occupied: Boolean!
+	trains: [String!]!
+}
+
+type State {
+	subject: String!
+	event: JSON!
+	updatedAt: String!
+	stale: Boolean!
+}
+
+type Event {
+	subject: String!
+	payload: JSON!
+}
+
+type CommandReply {
+	ok: Boolean!
+	requestId: String!
+	error: String
+	errorCode: String
+	dryRun: Boolean!
+	reply: JSON
+}
+`
+
+// graphQLJSON is the JSON scalar of the GraphQL schema.
+type graphQLJSON struct {
+	value any
+}
+
+func (graphQLJSON) ImplementsGraphQLType(name string) bool {
+	return name == "JSON"
+}
+
+func (j *graphQLJSON) UnmarshalGraphQL(input any) error {
+	j.value = input
+	return nil
+}
+
+func (j graphQLJSON) MarshalJSON() ([]byte, error) {
+	if raw, ok := j.value.(json.RawMessage); ok {
+		return raw, nil
+	}
+	return json.Marshal(j.value)
+}
+
+// newGraphQLSchema returns the GraphQL schema over the state cache and
+// commands of the gateway.
+func (g *Gateway) newGraphQLSchema() *graphql.Schema {
+	return graphql.MustParseSchema(graphQLSchema, &graphQLResolver{g: g},
+		graphql.UseFieldResolvers(),
+		graphql.MaxDepth(GraphQLMaxDepth),
+	)
+}
+
+type graphQLResolver struct {
+	g *Gateway
+}
+
+type graphQLStatus struct {
+	Reachable     bool
+	HardwareType  *string
+	Model         *string
+	Firmware      *string
+	Uptime        *string
+	TrackPower    *string
+	LastBroadcast *string
+	TS            string
+}
+
+func (r *graphQLResolver) Status() *graphQLStatus {
+	s := r.g.currentStatus()
+	optional := func(v string) *string {
+		if v == "" {
+			return nil
+		}
+		return &v
+	}
+	return &graphQLStatus{
+		Reachable:     s.Reachable,
+		HardwareType:  optional(s.HardwareType),
+		Model:         optional(s.Model),
+		Firmware:      optional(s.Firmware),
+		Uptime:        optional(s.Uptime),
+		TrackPower:    optional(s.TrackPower),
+		LastBroadcast: optional(s.LastBroadcast),
+		TS:            s.TS,
+	}
+}
+
+type graphQLAccessory struct {
+	Address   int32
+	Name      *string
+	State     graphQLJSON
+	UpdatedAt string
+	Stale     bool
+}
+
+// accessories returns the cached events of a kind with an address as their
+// only source token, e.g. loco.3.
+func (r *graphQLResolver) accessories(kind string) []*graphQLAccessory {
+	var list []*graphQLAccessory
+	for _, s := range r.g.state.snapshot(r.g.eventPrefix + kind + ".") {
+		source := strings.TrimPrefix(s.Subject, r.g.eventPrefix)
+		addr, err := strconv.ParseUint(strings.TrimPrefix(source, kind+"."), 10, 16)
+		if err != nil {
+			continue
+		}
+		a := &graphQLAccessory{
+			Address:   int32(addr),
+			State:     graphQLJSON{s.Event},
+			UpdatedAt: s.TS,
+			Stale:     s.Stale,
+		}
+		if name, ok := r.g.names.sources[source]; ok {
+			a.Name = &name
+		}
+		list = append(list, a)
+	}
+	slices.SortFunc(list, func(a, b *graphQLAccessory) int { return int(a.Address - b.Address) })
+	return list
+}
+
+func (r *graphQLResolver) Locos() []*graphQLAccessory {
+	return r.accessories("loco")
+}
+
+func (r *graphQLResolver) Loco(args struct {
+	Address *int32
+	Name    *string
+}) (*graphQLAccessory, error) {
+	if args.Address == nil && args.Name == nil {
+		return nil, errors.New("address or name required")
+	}
+	addr, err := r.g.names.resolveLoco(deref(args.Name), uint16(deref(args.Address)))
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range r.accessories("loco") {
+		if l.Address == int32(addr) {
+			return l, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *graphQLResolver) Turnouts() []*graphQLAccessory {
+	return r.accessories("turnout")
+}
+
+type graphQLBlock struct {
+	Name     string
+	Occupied bool
+	Trains   []string
+}
+
+func (r *graphQLResolver) Blocks() []*graphQLBlock {
+	t := r.g.tracker
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	blocks := make([]*graphQLBlock, 0, len(t.blocks))
+	for name, block := range t.blocks {
+		trains := make([]string, 0, len(block.trains))
+		for addr := range block.trains {
+			trains = append(trains, r.g.trainName(addr))
+		}
+		slices.Sort(trains)
+		blocks = append(blocks, &graphQLBlock{Name: name, Occupied: block.isOccupied(), Trains: trains})
+	}
+	slices.SortFunc(blocks, func(a, b *graphQLBlock) int { return strings.Compare(a.Name, b.Name) })
+	return blocks
+}
+
+type graphQLState struct {
+	Subject   string
+	Event     graphQLJSON
+	UpdatedAt string
+	Stale     bool
+}
+
+func (r *graphQLResolver) State(args struct{ Prefix *string }) []*graphQLState {
+	var states []*graphQLState
+	for _, s := range r.g.state.snapshot(r.g.eventPrefix + deref(args.Prefix)) {
+		states = append(states, &graphQLState{
+			Subject:   strings.TrimPrefix(s.Subject, r.g.eventPrefix),
+			Event:     graphQLJSON{s.Event},
+			UpdatedAt: s.TS,
+			Stale:     s.Stale,
+		})
+	}
+	return states
+}
+
+type graphQLCommandReply struct {
+	Ok        bool
+	RequestID string
+	Error     *string
+	ErrorCode *string
+	DryRun    bool
+	Reply     *graphQLJSON
+}
+
+// command sends a command and returns its reply; a failed command is a
+// reply with ok false, only a command without reply is a GraphQL error.
+func (r *graphQLResolver) command(ctx context.Context, name string, payload any) (*graphQLCommandReply, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := r.g.requestCommand(ctx, name, data)
+	if err != nil {
+		return nil, err
+	}
+	var reply struct {
+		Ok        bool            `json:"ok"`
+		RequestID string          `json:"request_id"`
+		Error     string          `json:"error"`
+		ErrorCode string          `json:"error_code"`
+		DryRun    bool            `json:"dry_run"`
+		Data      json.RawMessage `json:"reply"`
+	}
+	if err := json.Unmarshal(raw, &reply); err != nil {
+		return nil, fmt.Errorf("invalid reply: %w", err)
+	}
+	cr := &graphQLCommandReply{Ok: reply.Ok, RequestID: reply.RequestID, DryRun: reply.DryRun}
+	if reply.Error != "" {
+		cr.Error = &reply.Error
+	}
+	if reply.ErrorCode != "" {
+		cr.ErrorCode = &reply.ErrorCode
+	}
+	if len(reply.Data) > 0 {
+		cr.Reply = &graphQLJSON{reply.Data}
+	}
+	return cr, nil
+}
+
+// commandPayload is the payload of a mutation, dry_run only if requested.
+type commandPayload map[string]any
+
+func (p commandPayload) dryRun(dryRun *bool) commandPayload {
+	if deref(dryRun) {
+		p["dry_run"] = true
+	}
+	return p
+}
+
+// target adds the address or name of a loco or turnout.
+func (p commandPayload) target(address *int32, name *string) commandPayload {
+	if address != nil {
+		p["address"] = *address
+	}
+	if name != nil {
+		p["name"] = *name
+	}
+	return p
+}
+
+func (r *graphQLResolver) DriveLoco(ctx context.Context, args struct {
+	Address *int32
+	Name    *string
+	Speed   float64
+	Forward bool
+	DryRun  *bool
+}) (*graphQLCommandReply, error) {
+	p := commandPayload{"speed": args.Speed, "forward": args.Forward}
+	return r.command(ctx, "loco.drive", p.target(args.Address, args.Name).dryRun(args.DryRun))
+}
+
+func (r *graphQLResolver) SetTurnout(ctx context.Context, args struct {
+	Address *int32
+	Name    *string
+	Output  int32
+	DryRun  *bool
+}) (*graphQLCommandReply, error) {
+	p := commandPayload{"output": args.Output}
+	return r.command(ctx, "turnout.set", p.target(args.Address, args.Name).dryRun(args.DryRun))
+}
+
+func (r *graphQLResolver) SetSignal(ctx context.Context, args struct {
+	Name   string
+	Aspect string
+	DryRun *bool
+}) (*graphQLCommandReply, error) {
+	p := commandPayload{"name": args.Name, "aspect": args.Aspect}
+	return r.command(ctx, "signal.set", p.dryRun(args.DryRun))
+}
+
+func (r *graphQLResolver) PowerOff(ctx context.Context, args struct{ DryRun *bool }) (*graphQLCommandReply, error) {
+	return r.command(ctx, "power.off", commandPayload{}.dryRun(args.DryRun))
+}
+
+func (r *graphQLResolver) Command(ctx context.Context, args struct {
+	Name    string
+	Payload *graphQLJSON
+}) (*graphQLCommandReply, error) {
+	var payload any = commandPayload{}
+	if args.Payload != nil {
+		payload = args.Payload.value
+	}
+	return r.command(ctx, args.Name, payload)
+}
+
+type graphQLEvent struct {
+	Subject string
+	Payload graphQLJSON
+}
+
+// Events subscribes to the events matching the filters until ctx is done.
+// A subscriber falling dashboardStreamBuffer events behind is ended.
+func (r *graphQLResolver) Events(ctx context.Context, args struct{ Filter *[]string }) (<-chan *graphQLEvent, error) {
+	filters := []string{">"}
+	if args.Filter != nil && len(*args.Filter) > 0 {
+		filters = *args.Filter
+	}
+
+	ch := make(chan *graphQLEvent, dashboardStreamBuffer)
+	var (
+		mu     sync.Mutex
+		closed bool
+	)
+	closeCh := func() {
+		if !closed {
+			closed = true
+			close(ch)
+		}
+	}
+	handler := func(msg *nats.Msg) {
+		m, ok := r.g.streamEvent(msg)
+		if !ok {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case ch <- &graphQLEvent{Subject: m.Subject, Payload: graphQLJSON{m.Payload}}:
+		default:
+			closeCh()
+		}
+	}
+
+	var subs []*nats.Subscription
+	unsubscribe := func() {
+		for _, sub := range subs {
+			sub.Unsubscribe()
+		}
+	}
+	for _, filter := range filters {
+		sub, err := r.g.nc.Subscribe(r.g.eventPrefix+filter, handler)
+		if err != nil {
+			unsubscribe()
+			return nil, fmt.Errorf("invalid filter %q: %w", filter, err)
+		}
+		subs = append(subs, sub)
+	}
+	go func() {
+		<-ctx.Done()
+		unsubscribe()
+		mu.Lock()
+		closeCh()
+		mu.Unlock()
+	}()
+	return ch, nil
+}
+
+func deref[T any](p *T) T {
+	var zero T
+	if p == nil {
+		return zero
+	}
+	return *p
+}
@@ -0,0 +1,202 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+const (
+	// graphQLWSProtocol is the WebSocket subprotocol of GraphQL subscriptions,
+	// https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md.
+	graphQLWSProtocol = "graphql-transport-ws"
+	// graphQLInitTimeout is the time a WebSocket client has to send
+	// connection_init.
+	graphQLInitTimeout = 10 * time.Second
+)
+
+// graphQLRequest is a GraphQL request, the body of a POST request or the
+// payload of a subscribe message.
+type graphQLRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// graphQLHandler serves queries and mutations as POST requests and all
+// operations, including subscriptions, over WebSocket with the
+// graphql-transport-ws protocol.
+func (g *Gateway) graphQLHandler() http.HandlerFunc {
+	schema := g.newGraphQLSchema()
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.EqualFold(r.Header.Get("Upgrade"), "websocket"):
+			g.serveGraphQLWS(w, r, schema)
+		case r.Method == http.MethodPost:
+			// unlike form posts, JSON requires a CORS preflight from other
+			// origins, which the gateway does not answer
+			if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+				http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+			var req graphQLRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxPayloadSize)).Decode(&req); err != nil {
+				http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			resp := schema.Exec(r.Context(), req.Query, req.OperationName, req.Variables)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+		default:
+			http.Error(w, "POST queries and mutations, subscribe over WebSocket", http.StatusBadRequest)
+		}
+	}
+}
+
+// graphQLWSMessage is a message of the graphql-transport-ws protocol.
+type graphQLWSMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// serveGraphQLWS runs a graphql-transport-ws connection: after
+// connection_init, each subscribe message runs one operation until it ends
+// or the client completes it.
+func (g *Gateway) serveGraphQLWS(w http.ResponseWriter, r *http.Request, schema *graphql.Schema) {
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{graphQLWSProtocol}})
+	if err != nil {
+		return
+	}
+	defer conn.CloseNow()
+	if conn.Subprotocol() != graphQLWSProtocol {
+		conn.Close(4406, "subprotocol not acceptable")
+		return
+	}
+	conn.SetReadLimit(dashboardReadLimit)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stop := context.AfterFunc(g.ctx, cancel)
+	defer stop()
+
+	var writeMu sync.Mutex
+	write := func(m graphQLWSMessage) error {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.Write(ctx, websocket.MessageText, data)
+	}
+
+	initCtx, initCancel := context.WithTimeout(ctx, graphQLInitTimeout)
+	defer initCancel()
+	var init graphQLWSMessage
+	if _, data, err := conn.Read(initCtx); err != nil || json.Unmarshal(data, &init) != nil || init.Type != "connection_init" {
+		conn.Close(4408, "connection initialisation timeout")
+		return
+	}
+	if err := write(graphQLWSMessage{Type: "connection_ack"}); err != nil {
+		return
+	}
+
+	var mu sync.Mutex
+	operations := make(map[string]context.CancelFunc)
+	defer func() {
+		mu.Lock()
+		for _, cancel := range operations {
+			cancel()
+		}
+		mu.Unlock()
+	}()
+
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			if g.ctx.Err() != nil {
+				conn.Close(websocket.StatusGoingAway, "gateway stopped")
+			}
+			return
+		}
+		var m graphQLWSMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			conn.Close(4400, "invalid message")
+			return
+		}
+		switch m.Type {
+		case "ping":
+			write(graphQLWSMessage{Type: "pong"})
+		case "pong":
+		case "connection_init":
+			conn.Close(4429, "too many initialisation requests")
+			return
+		case "subscribe":
+			var req graphQLRequest
+			if m.ID == "" || json.Unmarshal(m.Payload, &req) != nil {
+				conn.Close(4400, "invalid subscribe message")
+				return
+			}
+			mu.Lock()
+			if _, ok := operations[m.ID]; ok {
+				mu.Unlock()
+				conn.Close(4409, fmt.Sprintf("subscriber for %s already exists", m.ID))
+				return
+			}
+			opCtx, opCancel := context.WithCancel(ctx)
+			operations[m.ID] = opCancel
+			mu.Unlock()
+
+			go func(id string) {
+				defer func() {
+					mu.Lock()
+					delete(operations, id)
+					mu.Unlock()
+					opCancel()
+				}()
+				g.runGraphQLOperation(opCtx, schema, id, req, write)
+			}(m.ID)
+		case "complete":
+			mu.Lock()
+			if cancel, ok := operations[m.ID]; ok {
+				cancel()
+			}
+			mu.Unlock()
+		default:
+			conn.Close(4400, "unknown message type "+m.Type)
+			return
+		}
+	}
+}
+
+// runGraphQLOperation sends the results of an operation as next messages
+// and completes it, unless the client completed it first.
+func (g *Gateway) runGraphQLOperation(ctx context.Context, schema *graphql.Schema, id string, req graphQLRequest, write func(graphQLWSMessage) error) {
+	responses, err := schema.Subscribe(ctx, req.Query, req.OperationName, req.Variables)
+	if err != nil {
+		payload, _ := json.Marshal([]map[string]string{{"message": err.Error()}})
+		write(graphQLWSMessage{ID: id, Type: "error", Payload: payload})
+		return
+	}
+	for resp := range responses {
+		payload, err := json.Marshal(resp)
+		if err != nil {
+			continue
+		}
+		if err := write(graphQLWSMessage{ID: id, Type: "next", Payload: payload}); err != nil {
+			return
+		}
+	}
+	if ctx.Err() == nil {
+		write(graphQLWSMessage{ID: id, Type: "complete"})
+	}
+}
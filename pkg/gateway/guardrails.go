@@ -0,0 +1,112 @@
+package gateway
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+const (
+	GuardInterval = 30 * time.Second
+	MaxGoroutines = 1000
+	MaxHeapMB     = 256
+
+	// guardQueueFill is the share of a queue above which it is reported.
+	guardQueueFill = 0.8
+	// guardRestartChecks is the number of checks in a row a limit has to
+	// be exceeded before --guard_restart restarts the gateway, so that
+	// a short burst does not.
+	guardRestartChecks = 3
+)
+
+// guardrails holds the state of the self-monitoring checks. It is only
+// touched from the guard loop.
+type guardrails struct {
+	warned   map[string]bool
+	exceeded int
+}
+
+// guardLoop watches the goroutines, heap and queues of the gateway for
+// leaks, warning once per exceeded limit and, with --guard_restart,
+// stopping the gateway for its supervisor to restart it.
+func (g *Gateway) guardLoop() {
+	defer g.wg.Done()
+	ticker := time.NewTicker(GuardInterval)
+	defer ticker.Stop()
+
+	gr := &guardrails{warned: make(map[string]bool)}
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-ticker.C:
+			g.guardCheck(gr)
+		}
+	}
+}
+
+func (g *Gateway) guardCheck(gr *guardrails) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	goroutines := runtime.NumGoroutine()
+	heapMB := int(mem.HeapAlloc >> 20)
+
+	exceeded := false
+	if g.maxGoroutines > 0 && goroutines > g.maxGoroutines {
+		exceeded = true
+		g.guardWarn(gr, "goroutines", "goroutines_high", fmt.Sprintf("%d goroutines exceed --max_goroutines %d", goroutines, g.maxGoroutines),
+			map[string]any{"goroutines": goroutines, "limit": g.maxGoroutines})
+	} else {
+		gr.warned["goroutines"] = false
+	}
+	if g.maxHeapMB > 0 && heapMB > g.maxHeapMB {
+		exceeded = true
+		g.guardWarn(gr, "heap", "heap_high", fmt.Sprintf("%d MiB heap exceed --max_heap_mb %d", heapMB, g.maxHeapMB),
+			map[string]any{"heap_mb": heapMB, "limit": g.maxHeapMB})
+	} else {
+		gr.warned["heap"] = false
+	}
+	for name, depth := range g.queueDepths() {
+		key := "queue." + name
+		if float64(depth[0]) <= guardQueueFill*float64(depth[1]) {
+			gr.warned[key] = false
+			continue
+		}
+		g.guardWarn(gr, key, "queue_high", fmt.Sprintf("the %s queue is %d of %d full", name, depth[0], depth[1]),
+			map[string]any{"queue": name, "depth": depth[0], "capacity": depth[1]})
+	}
+
+	if !exceeded {
+		gr.exceeded = 0
+		return
+	}
+	gr.exceeded++
+	if g.guardRestart && gr.exceeded >= guardRestartChecks {
+		g.logger.Error().
+			Int("goroutines", goroutines).
+			Int("heap_mb", heapMB).
+			Msg("guardrail exceeded, restarting")
+		g.Shutdown(ShutdownGuardrail, fmt.Sprintf("%d goroutines, %d MiB heap", goroutines, heapMB))
+	}
+}
+
+// guardWarn publishes a warning once until the condition identified by key
+// clears.
+func (g *Gateway) guardWarn(gr *guardrails, key, code, message string, details map[string]any) {
+	if gr.warned[key] {
+		return
+	}
+	gr.warned[key] = true
+	g.publishWarning(code, message, details)
+}
+
+// queueDepths returns the length and capacity of the internal queues.
+func (g *Gateway) queueDepths() map[string][2]int {
+	depths := map[string][2]int{
+		"publish": {len(g.publishQueue), cap(g.publishQueue)},
+	}
+	for class, queue := range g.queues {
+		depths["command."+class] = [2]int{len(queue), cap(queue)}
+	}
+	return depths
+}
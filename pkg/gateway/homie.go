@@ -0,0 +1,464 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// HomieVersion is the version of the Homie convention the device
+	// follows, https://homieiot.github.io/specification/spec-core-v4_0_0/.
+	HomieVersion = "4.0.0"
+	// HomieInterval is the default interval the device is announced at.
+	// Messages published over NATS are not retained for MQTT clients, so
+	// controllers that start later discover the device with the next
+	// announcement.
+	HomieInterval = time.Minute
+
+	homieRoot = "homie"
+	// homiePoll is how often the track node follows the gateway state.
+	homiePoll = time.Second
+)
+
+// Homie device states.
+const (
+	HomieInit         = "init"
+	HomieReady        = "ready"
+	HomieAlert        = "alert"
+	HomieDisconnected = "disconnected"
+)
+
+// homieProperty is a property of a Homie node; settable properties have a
+// set func.
+type homieProperty struct {
+	id, name, datatype, format, unit string
+	set                              func(g *Gateway, n *homieNode, value string) error
+}
+
+// homieNode is a Homie node following the events on source, the event
+// subject below event., with update.
+type homieNode struct {
+	id, name, typ string
+	// target is the name payload field of the commands of the node.
+	target     string
+	source     string
+	update     func(payload map[string]any) map[string]string
+	properties []homieProperty
+}
+
+// homieDevice is the Homie device of the gateway, z21-<name>, with a node
+// for the track and one per named loco, turnout and detector and per
+// block.
+type homieDevice struct {
+	id    string
+	name  string
+	nodes []*homieNode
+
+	mu    sync.Mutex
+	state string
+	// values holds the last value of each property, by node/property.
+	values map[string]string
+}
+
+// newHomieDevice returns the Homie device of cfg, nil unless --homie is
+// set.
+func newHomieDevice(cfg Config) *homieDevice {
+	if !cfg.Homie {
+		return nil
+	}
+	d := &homieDevice{
+		id:     "z21-" + homieID(cfg.Z21Name),
+		name:   "z21 " + cfg.Z21Name,
+		state:  HomieInit,
+		values: make(map[string]string),
+	}
+	d.nodes = append(d.nodes, &homieNode{
+		id: "track", name: "Track", typ: "z21",
+		properties: []homieProperty{
+			{id: "power", name: "Track power", datatype: "enum",
+				format: strings.Join([]string{TrackPowerOn, TrackPowerOff, TrackPowerEmergencyStop,
+					TrackPowerShortCircuit, TrackPowerProgramming}, ","),
+				set: homieSetPower},
+			{id: "reachable", name: "Reachable", datatype: "boolean"},
+		},
+	})
+	for _, name := range sortedKeys(cfg.Names.locos) {
+		addr := cfg.Names.locos[name]
+		d.nodes = append(d.nodes, &homieNode{
+			id: "loco-" + homieID(name), name: name, typ: "loco", target: name,
+			source: fmt.Sprintf("loco.%d", addr),
+			update: homieLocoUpdate,
+			properties: []homieProperty{
+				{id: "speed", name: "Speed", datatype: "float", format: "0:100", unit: "%", set: homieSetSpeed},
+				{id: "forward", name: "Forward", datatype: "boolean", set: homieSetForward},
+				{id: "address", name: "Address", datatype: "integer"},
+			},
+		})
+		d.values["loco-"+homieID(name)+"/address"] = strconv.Itoa(int(addr))
+	}
+	for _, name := range sortedKeys(cfg.Names.turnouts) {
+		addr := cfg.Names.turnouts[name]
+		d.nodes = append(d.nodes, &homieNode{
+			id: "turnout-" + homieID(name), name: name, typ: "turnout", target: name,
+			source: fmt.Sprintf("turnout.%d", addr),
+			update: homieTurnoutUpdate,
+			properties: []homieProperty{
+				{id: "output", name: "Output", datatype: "integer", format: "0:1", set: homieSetOutput},
+				{id: "address", name: "Address", datatype: "integer"},
+			},
+		})
+		d.values["turnout-"+homieID(name)+"/address"] = strconv.Itoa(int(addr))
+	}
+	for _, name := range sortedKeys(cfg.Names.detectors) {
+		d.nodes = append(d.nodes, &homieNode{
+			id: "detector-" + homieID(name), name: name, typ: "detector",
+			source:     cfg.Names.detectors[name],
+			update:     homieDetectorUpdate,
+			properties: []homieProperty{{id: "occupied", name: "Occupied", datatype: "boolean"}},
+		})
+	}
+	for _, name := range cfg.Blocks.names() {
+		d.nodes = append(d.nodes, &homieNode{
+			id: "block-" + homieID(name), name: name, typ: "block",
+			source:     "block." + name,
+			update:     homieBlockUpdate,
+			properties: []homieProperty{{id: "occupied", name: "Occupied", datatype: "boolean"}},
+		})
+	}
+	return d
+}
+
+// homieID converts a name to a Homie topic ID of lowercase letters, digits
+// and hyphens.
+func homieID(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('-')
+		}
+	}
+	id := strings.Trim(b.String(), "-")
+	if id == "" {
+		return "x"
+	}
+	return id
+}
+
+// startHomie announces the device, subscribes to the events of its nodes
+// and to the set topics, and keeps the device up to date.
+func (g *Gateway) startHomie() error {
+	d := g.homie
+	d.announce(g)
+	for _, n := range d.nodes {
+		if n.source == "" {
+			continue
+		}
+		_, err := g.subscribe(g.eventPrefix+n.source, func(msg *nats.Msg) {
+			var payload map[string]any
+			if decodePayload(msgSchemaVersion(msg), msg.Data, &payload) != nil {
+				return
+			}
+			for prop, value := range n.update(payload) {
+				d.setValue(g, n.id+"/"+prop, value)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err := g.subscribe(d.subject("*/*/set"), func(msg *nats.Msg) {
+		tokens := strings.Split(msg.Subject, ".")
+		node, prop := tokens[len(tokens)-3], tokens[len(tokens)-2]
+		// commands may wait for the Z21, which must not hold up other sets
+		go func() {
+			if err := d.set(g, node, prop, string(msg.Data)); err != nil {
+				g.logger.Warn().
+					Err(err).
+					Str("node", node).
+					Str("property", prop).
+					Str("value", string(msg.Data)).
+					Msg("Homie set failed")
+			}
+		}()
+	})
+	if err != nil {
+		return err
+	}
+
+	g.wg.Add(1)
+	go g.homieLoop()
+	return nil
+}
+
+// homieLoop follows the track state and announces the device every
+// homieInterval.
+func (g *Gateway) homieLoop() {
+	defer g.wg.Done()
+	poll := time.NewTicker(homiePoll)
+	defer poll.Stop()
+	announce := time.NewTicker(g.homieInterval)
+	defer announce.Stop()
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-announce.C:
+			g.homie.announce(g)
+		case <-poll.C:
+			g.homie.pollTrack(g)
+		}
+	}
+}
+
+// pollTrack updates the track node and the device state, alert while the
+// Z21 is unreachable.
+func (d *homieDevice) pollTrack(g *Gateway) {
+	reachable := g.isOnline.Load()
+	d.setValue(g, "track/reachable", strconv.FormatBool(reachable))
+	if state := g.trackPowerState.Load(); state != nil {
+		d.setValue(g, "track/power", *state)
+	}
+	if reachable {
+		d.setState(g, HomieReady)
+	} else {
+		d.setState(g, HomieAlert)
+	}
+}
+
+func (d *homieDevice) subject(topic string) string {
+	return homieRoot + "." + d.id + "." + strings.ReplaceAll(topic, "/", ".")
+}
+
+func (d *homieDevice) publish(g *Gateway, topic, value string) {
+	msg := nats.NewMsg(d.subject(topic))
+	msg.Data = []byte(value)
+	if err := g.publishMsg(msg); err != nil {
+		g.onEventPublishError(fmt.Errorf("%s: %w", msg.Subject, err))
+	}
+}
+
+// announce publishes the device, node and property attributes and the
+// property values, between the init and the current state as the
+// convention requires.
+func (d *homieDevice) announce(g *Gateway) {
+	d.mu.Lock()
+	values := make(map[string]string, len(d.values))
+	for k, v := range d.values {
+		values[k] = v
+	}
+	d.mu.Unlock()
+
+	d.publish(g, "$state", HomieInit)
+	d.publish(g, "$homie", HomieVersion)
+	d.publish(g, "$name", d.name)
+	d.publish(g, "$extensions", "")
+	nodes := make([]string, len(d.nodes))
+	for i, n := range d.nodes {
+		nodes[i] = n.id
+	}
+	d.publish(g, "$nodes", strings.Join(nodes, ","))
+	for _, n := range d.nodes {
+		d.publish(g, n.id+"/$name", n.name)
+		d.publish(g, n.id+"/$type", n.typ)
+		props := make([]string, len(n.properties))
+		for i, p := range n.properties {
+			props[i] = p.id
+			topic := n.id + "/" + p.id
+			d.publish(g, topic+"/$name", p.name)
+			d.publish(g, topic+"/$datatype", p.datatype)
+			if p.format != "" {
+				d.publish(g, topic+"/$format", p.format)
+			}
+			if p.unit != "" {
+				d.publish(g, topic+"/$unit", p.unit)
+			}
+			d.publish(g, topic+"/$settable", strconv.FormatBool(p.set != nil))
+			if v, ok := values[topic]; ok {
+				d.publish(g, topic, v)
+			}
+		}
+		d.publish(g, n.id+"/$properties", strings.Join(props, ","))
+	}
+	d.mu.Lock()
+	if d.state == HomieInit {
+		d.state = HomieReady
+	}
+	state := d.state
+	d.mu.Unlock()
+	d.publish(g, "$state", state)
+}
+
+// setState publishes the device state when it changed.
+func (d *homieDevice) setState(g *Gateway, state string) {
+	d.mu.Lock()
+	changed := d.state != state
+	d.state = state
+	d.mu.Unlock()
+	if changed {
+		d.publish(g, "$state", state)
+	}
+}
+
+// setValue publishes a property value when it changed.
+func (d *homieDevice) setValue(g *Gateway, topic, value string) {
+	d.mu.Lock()
+	changed := d.values[topic] != value
+	d.values[topic] = value
+	d.mu.Unlock()
+	if changed {
+		d.publish(g, topic, value)
+	}
+}
+
+func (d *homieDevice) value(topic string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v, ok := d.values[topic]
+	return v, ok
+}
+
+// set handles a value published on the set topic of a property. The new
+// value is published once the event confirming it arrives.
+func (d *homieDevice) set(g *Gateway, nodeID, propID, value string) error {
+	for _, n := range d.nodes {
+		if n.id != nodeID {
+			continue
+		}
+		for _, p := range n.properties {
+			if p.id != propID {
+				continue
+			}
+			if p.set == nil {
+				return errors.New("property is not settable")
+			}
+			return p.set(g, n, value)
+		}
+	}
+	return errors.New("unknown property")
+}
+
+// homieCommand sends a command for a set topic, over NATS like the
+// commands of the dashboard.
+func (g *Gateway) homieCommand(command string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	raw, err := g.requestCommand(g.ctx, command, data)
+	if err != nil {
+		return err
+	}
+	var reply CmdReply
+	if err := json.Unmarshal(raw, &reply); err != nil {
+		return err
+	}
+	if !reply.Ok {
+		return errors.New(reply.Error)
+	}
+	return nil
+}
+
+// homieSetPower only switches the track power off, the gateway has no power
+// on command.
+func homieSetPower(g *Gateway, _ *homieNode, value string) error {
+	if value != TrackPowerOff {
+		return fmt.Errorf("track power can only be set to %s", TrackPowerOff)
+	}
+	return g.homieCommand("power.off", struct{}{})
+}
+
+func homieSetSpeed(g *Gateway, n *homieNode, value string) error {
+	speed, err := strconv.ParseFloat(value, 64)
+	if err != nil || speed < 0 || speed > 100 {
+		return fmt.Errorf("invalid speed %q", value)
+	}
+	forward := true
+	if v, ok := g.homie.value(n.id + "/forward"); ok {
+		forward = v == "true"
+	}
+	return g.homieCommand("loco.drive", DriveRequest{Name: n.target, Speed: speed, Forward: forward})
+}
+
+func homieSetForward(g *Gateway, n *homieNode, value string) error {
+	forward, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid boolean %q", value)
+	}
+	var speed float64
+	if v, ok := g.homie.value(n.id + "/speed"); ok {
+		speed, _ = strconv.ParseFloat(v, 64)
+	}
+	return g.homieCommand("loco.drive", DriveRequest{Name: n.target, Speed: speed, Forward: forward})
+}
+
+func homieSetOutput(g *Gateway, n *homieNode, value string) error {
+	output, err := strconv.ParseUint(value, 10, 8)
+	if err != nil || output > 1 {
+		return fmt.Errorf("invalid output %q", value)
+	}
+	return g.homieCommand("turnout.set", TurnoutRequest{Name: n.target, Output: uint8(output)})
+}
+
+// payloadNumber returns the first numeric payload field of names.
+func payloadNumber(payload map[string]any, names ...string) (float64, bool) {
+	for _, name := range names {
+		if v, ok := payload[name].(float64); ok {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// homieLocoUpdate reads the speed, in percent like loco.drive, and the
+// direction from a loco info event.
+func homieLocoUpdate(payload map[string]any) map[string]string {
+	values := make(map[string]string)
+	if step, ok := payloadNumber(payload, "Speed", "SpeedStep"); ok {
+		speed := 0.0
+		if step > 1 {
+			speed = math.Round((step-1)/MaxSpeedStep*1000) / 10
+		}
+		values["speed"] = strconv.FormatFloat(speed, 'f', -1, 64)
+	}
+	if forward, ok := payload["Forward"].(bool); ok {
+		values["forward"] = strconv.FormatBool(forward)
+	}
+	return values
+}
+
+// homieTurnoutUpdate reads the output from a turnout info event, which
+// reports output 1 as 1 and output 2 as 2.
+func homieTurnoutUpdate(payload map[string]any) map[string]string {
+	pos, ok := payloadNumber(payload, "Position", "State")
+	if !ok || pos < 1 || pos > 2 {
+		return nil
+	}
+	return map[string]string{"output": strconv.Itoa(int(pos) - 1)}
+}
+
+func homieDetectorUpdate(payload map[string]any) map[string]string {
+	typ, ok := payloadNumber(payload, "Type")
+	if !ok || typ != canDetectorOccupancy {
+		return nil
+	}
+	v1, _ := payloadNumber(payload, "Value1")
+	return map[string]string{"occupied": strconv.FormatBool(v1 != 0)}
+}
+
+func homieBlockUpdate(payload map[string]any) map[string]string {
+	occupied, ok := payload["occupied"].(bool)
+	if !ok {
+		return nil
+	}
+	return map[string]string{"occupied": strconv.FormatBool(occupied)}
+}
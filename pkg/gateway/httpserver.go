@@ -0,0 +1,122 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+const httpShutdownTimeout = 5 * time.Second
+
+// loadTLSConfig returns the TLS config of the HTTP listeners, or nil if no
+// certificate is configured. With a client CA, clients must present a
+// certificate signed by it.
+func loadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, fmt.Errorf("--tls_client_ca requires --tls_cert and --tls_key")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("--tls_cert and --tls_key must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// startHTTP starts the metrics and dashboard listeners that are enabled,
+// sharing one listener if both have the same address.
+func (g *Gateway) startHTTP() error {
+	var metrics, dashboard *http.ServeMux
+	if g.metricsAddr != "" {
+		metrics = http.NewServeMux()
+		metrics.HandleFunc("GET /metrics", g.handleMetricsHTTP)
+	}
+	if g.dashboardAddr != "" {
+		dashboard = g.dashboardMux()
+		if g.dashboardAddr == g.metricsAddr {
+			dashboard.HandleFunc("GET /metrics", g.handleMetricsHTTP)
+			metrics = nil
+		}
+	}
+	if metrics != nil {
+		if err := g.serveHTTP("metrics", g.metricsAddr, metrics); err != nil {
+			return err
+		}
+	}
+	if dashboard != nil {
+		if err := g.serveHTTP("dashboard", g.dashboardAddr, dashboard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveHTTP runs an HTTP listener until the gateway stops, with TLS if
+// configured.
+func (g *Gateway) serveHTTP(name, addr string, handler http.Handler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if g.tlsConfig != nil {
+		ln = tls.NewListener(ln, g.tlsConfig)
+	}
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	g.logger.Info().
+		Str("listener", name).
+		Str("addr", ln.Addr().String()).
+		Bool("tls", g.tlsConfig != nil).
+		Msg("HTTP listener started")
+
+	g.loops.http.beat()
+	g.wg.Add(2)
+	go func() {
+		defer g.wg.Done()
+		<-g.ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}()
+	go func() {
+		defer g.wg.Done()
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			g.loops.http.failed.Store(true)
+			g.logger.Error().
+				Err(err).
+				Str("listener", name).
+				Msg("HTTP listener failed")
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,70 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// IdempotencyWindow is how long executed queued commands are remembered by
+// their message ID.
+const IdempotencyWindow = 2 * time.Minute
+
+// idempotencyCache remembers the replies of executed commands by message ID,
+// so a redelivered command, e.g. after its ack got lost, is answered again
+// instead of being executed twice.
+type idempotencyCache struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	replies map[string]idempotentReply
+}
+
+type idempotentReply struct {
+	reply CmdReply
+	at    time.Time
+}
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		window:  window,
+		replies: make(map[string]idempotentReply),
+	}
+}
+
+// idempotencyKey returns the Nats-Msg-Id or Request-Id header of a command.
+func idempotencyKey(msg *nats.Msg) string {
+	if id := msg.Header.Get(nats.MsgIdHdr); id != "" {
+		return id
+	}
+	return msg.Header.Get(RequestIDHeader)
+}
+
+func (c *idempotencyCache) get(key string) (CmdReply, bool) {
+	if key == "" {
+		return CmdReply{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.replies[key]
+	if !ok || time.Since(r.at) > c.window {
+		return CmdReply{}, false
+	}
+	return r.reply, true
+}
+
+func (c *idempotencyCache) put(key string, reply CmdReply) {
+	if key == "" {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, r := range c.replies {
+		if now.Sub(r.at) > c.window {
+			delete(c.replies, k)
+		}
+	}
+	c.replies[key] = idempotentReply{reply: reply, at: now}
+}
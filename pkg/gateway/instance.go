@@ -0,0 +1,83 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// InstanceHeader carries the instance ID of the gateway process on every
+// message it publishes.
+const InstanceHeader = "Z21-Instance"
+
+// newInstanceID returns the host name with a random suffix, so that
+// replicas on one host differ as well.
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "z21-gateway"
+	}
+	b := make([]byte, 3)
+	_, _ = rand.Read(b)
+	return subjectToken(host) + "-" + hex.EncodeToString(b)
+}
+
+func validateInstanceID(id string) error {
+	if subjectToken(id) != id {
+		return fmt.Errorf("invalid --instance_id %q", id)
+	}
+	return nil
+}
+
+// instanceWatch tells the other instances serving the name of the gateway
+// from their registry entries, two replicas run against the same device.
+type instanceWatch struct {
+	mu sync.Mutex
+	// seen holds the other instances warned about.
+	seen map[string]bool
+}
+
+// subscribeInstances follows the registry for other instances of the
+// gateway and asks the running gateways to announce themselves, so a
+// replica started second is told at once.
+func (g *Gateway) subscribeInstances() error {
+	if _, err := g.subscribe(RegistrySubject, g.handleRegistryEntry); err != nil {
+		return err
+	}
+	return g.nc.Publish(RegistryDiscoverSubject, nil)
+}
+
+func (g *Gateway) handleRegistryEntry(msg *nats.Msg) {
+	var entry RegistryEntry
+	if err := json.Unmarshal(msg.Data, &entry); err != nil {
+		return
+	}
+	if entry.Name != g.name || entry.Instance == "" || entry.Instance == g.instance {
+		return
+	}
+	w := &g.instances
+	w.mu.Lock()
+	if entry.State == GatewayStopped {
+		delete(w.seen, entry.Instance)
+		w.mu.Unlock()
+		return
+	}
+	if w.seen[entry.Instance] {
+		w.mu.Unlock()
+		return
+	}
+	w.seen[entry.Instance] = true
+	w.mu.Unlock()
+
+	g.logger.Error().
+		Str("instance", g.instance).
+		Str("other", entry.Instance).
+		Msg("another gateway instance serves the device")
+	g.publishWarning("duplicate_instance", "another gateway instance serves the device, both send commands to the z21 and publish its events",
+		map[string]any{"instance": g.instance, "other": entry.Instance, "other_started_at": entry.StartedAt})
+}
@@ -0,0 +1,167 @@
+package gateway
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	JetStreamMaxDeliver = 5
+	JetStreamAckWait    = 30 * time.Second
+	// JetStreamMaxAge drops queued commands that were not consumed in time,
+	// e.g. drive commands queued while the gateway was down for long.
+	JetStreamMaxAge = 5 * time.Minute
+	// jetStreamRetryDelay is the redelivery delay of commands that failed
+	// for a transient reason.
+	jetStreamRetryDelay = 5 * time.Second
+	// jetStreamProgressInterval is how often a running command is reported
+	// in progress, so that a slow one does not run out of its ack wait.
+	jetStreamProgressInterval = JetStreamAckWait / 3
+)
+
+// retryableCodes are the error codes of failures that may succeed later.
+var retryableCodes = map[ErrorCode]bool{
+	ErrCodeTimeout:    true,
+	ErrCodeZ21Offline: true,
+	ErrCodeBusy:       true,
+}
+
+func (g *Gateway) jetStreamSubject() string {
+	return fmt.Sprintf("z21.%s.queue.>", g.name)
+}
+
+// jetStreamCommandsLoop consumes commands published on
+// z21.<name>.queue.<command> from the work-queue stream g.jsStream. Commands
+// are acknowledged once they are answered; commands failing for a transient
+// reason are redelivered up to g.jsMaxDeliver times.
+func (g *Gateway) jetStreamCommandsLoop() error {
+	js, err := jetstream.New(g.nc)
+	if err != nil {
+		return err
+	}
+	stream, err := js.CreateOrUpdateStream(g.ctx, jetstream.StreamConfig{
+		Name:      g.jsStream,
+		Subjects:  []string{g.jetStreamSubject()},
+		Retention: jetstream.WorkQueuePolicy,
+		MaxAge:    JetStreamMaxAge,
+		// the server drops republished commands with a known Nats-Msg-Id
+		Duplicates: g.idempotency.window,
+	})
+	if err != nil {
+		return fmt.Errorf("create stream %s: %w", g.jsStream, err)
+	}
+	consumer, err := stream.CreateOrUpdateConsumer(g.ctx, jetstream.ConsumerConfig{
+		Durable:       "z21-gateway-" + g.name,
+		FilterSubject: g.jetStreamSubject(),
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       JetStreamAckWait,
+		MaxDeliver:    g.jsMaxDeliver,
+	})
+	if err != nil {
+		return fmt.Errorf("create consumer: %w", err)
+	}
+
+	g.logger.Info().
+		Str("stream", g.jsStream).
+		Str("subject", g.jetStreamSubject()).
+		Msg("JetStream consume")
+	// the commands are handled one at a time, so a buffered command would
+	// use up its ack wait behind a slow one
+	cc, err := consumer.Consume(g.handleJetStreamCommand, jetstream.PullMaxMessages(1))
+	if err != nil {
+		return err
+	}
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		<-g.ctx.Done()
+		cc.Stop()
+	}()
+	return nil
+}
+
+// handleJetStreamCommand runs a queued command. Commands are handled one at
+// a time in stream order.
+func (g *Gateway) handleJetStreamCommand(m jetstream.Msg) {
+	name := strings.TrimPrefix(m.Subject(), fmt.Sprintf("z21.%s.queue.", g.name))
+	msg := &nats.Msg{
+		Subject: fmt.Sprintf("z21.%s.cmd.%s", g.name, name),
+		Data:    m.Data(),
+		Header:  m.Headers(),
+	}
+
+	key := idempotencyKey(msg)
+	if key == "" {
+		// a redelivery keeps its stream sequence, so it still finds the
+		// reply of the first delivery
+		if md, err := m.Metadata(); err == nil {
+			key = fmt.Sprintf("%s.%d", g.jsStream, md.Sequence.Stream)
+		}
+	}
+	if reply, ok := g.idempotency.get(key); ok {
+		g.logger.Warn().
+			Str("command", name).
+			Str("id", key).
+			Msg("JetStream duplicate command")
+		g.sendCmdReply(msg, reply)
+		_ = m.Ack()
+		return
+	}
+
+	stop := keepInProgress(m)
+	reply, ok := g.execCmdMessage(msg, time.Now())
+	stop()
+	if !ok {
+		_ = m.Nak()
+		return
+	}
+
+	if !reply.Ok && retryableCodes[reply.ErrorCode] {
+		if md, err := m.Metadata(); err == nil && int(md.NumDelivered) < g.jsMaxDeliver {
+			g.logger.Warn().
+				Str("command", name).
+				Str("error_code", string(reply.ErrorCode)).
+				Uint64("delivered", md.NumDelivered).
+				Msg("JetStream command redelivery")
+			_ = m.NakWithDelay(jetStreamRetryDelay)
+			return
+		}
+	}
+
+	g.idempotency.put(key, reply)
+	g.sendCmdReply(msg, reply)
+	if err := m.Ack(); err != nil {
+		g.logger.Error().
+			Err(err).
+			Msg("JetStream ack")
+	}
+}
+
+// keepInProgress reports m in progress every jetStreamProgressInterval until
+// stop is called, e.g. while a programming track command runs.
+func keepInProgress(m jetstream.Msg) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(jetStreamProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_ = m.InProgress()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,210 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+const (
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+
+	// JobRetention is how long finished jobs stay queryable.
+	JobRetention = time.Hour
+)
+
+// JobStatus describes a long-running command. It is returned when the job is
+// started and by job.get, and published on z21.<name>.job.<id>.progress
+// while running and z21.<name>.job.<id>.done when finished.
+type JobStatus struct {
+	ID         string    `json:"id"`
+	Kind       string    `json:"kind"`
+	State      string    `json:"state"`
+	Progress   float64   `json:"progress"`
+	Message    string    `json:"message,omitempty"`
+	Details    any       `json:"details,omitempty"`
+	Result     any       `json:"result,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	ErrorCode  ErrorCode `json:"error_code,omitempty"`
+	StartedAt  string    `json:"started_at"`
+	FinishedAt string    `json:"finished_at,omitempty"`
+}
+
+type job struct {
+	g      *Gateway
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	status   JobStatus
+	finished time.Time
+}
+
+type jobManager struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+func newJobManager() *jobManager {
+	return &jobManager{jobs: make(map[string]*job)}
+}
+
+// startJob runs fn in the background as a job of the given kind and returns
+// its initial status.
+func (g *Gateway) startJob(kind string, fn func(ctx context.Context, j *job) (any, error)) JobStatus {
+	ctx, cancel := context.WithCancel(g.ctx)
+	j := &job{
+		g:      g,
+		cancel: cancel,
+		status: JobStatus{
+			ID:        nuid.Next(),
+			Kind:      kind,
+			State:     JobRunning,
+			StartedAt: time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+
+	g.jobs.mu.Lock()
+	g.jobs.expire()
+	g.jobs.jobs[j.status.ID] = j
+	g.jobs.mu.Unlock()
+
+	g.logger.Info().
+		Str("job", j.status.ID).
+		Str("kind", kind).
+		Msg("job started")
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer cancel()
+		result, err := fn(ctx, j)
+		j.finish(result, err)
+	}()
+
+	return j.snapshot()
+}
+
+func (j *job) snapshot() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// progress records and publishes the progress (0..1) of the job.
+func (j *job) progress(p float64, message string, details any) {
+	j.mu.Lock()
+	j.status.Progress = p
+	j.status.Message = message
+	j.status.Details = details
+	status := j.status
+	j.mu.Unlock()
+
+	j.publish("progress", &status)
+}
+
+func (j *job) finish(result any, err error) {
+	j.mu.Lock()
+	switch {
+	case errors.Is(err, context.Canceled):
+		j.status.State = JobCanceled
+		j.status.Error = err.Error()
+	case err != nil:
+		j.status.State = JobFailed
+		j.status.Error = err.Error()
+		var ce *codedError
+		if errors.As(err, &ce) {
+			j.status.ErrorCode = ce.code
+		}
+	default:
+		j.status.State = JobDone
+		j.status.Progress = 1
+	}
+	j.status.Result = result
+	j.status.Details = nil
+	j.finished = time.Now()
+	j.status.FinishedAt = j.finished.UTC().Format(time.RFC3339)
+	status := j.status
+	j.mu.Unlock()
+
+	j.g.logger.Info().
+		Str("job", status.ID).
+		Str("kind", status.Kind).
+		Str("state", status.State).
+		Str("error", status.Error).
+		Msg("job finished")
+	j.publish("done", &status)
+}
+
+func (j *job) publish(what string, status *JobStatus) {
+	subject := fmt.Sprintf("z21.%s.job.%s.%s", j.g.name, status.ID, what)
+	if err := j.g.publish(subject, "job."+what, 0, status); err != nil {
+		j.g.logger.Error().
+			Err(err).
+			Msg("failed to publish job status")
+	}
+}
+
+// expire drops jobs finished more than JobRetention ago. The caller holds
+// m.mu.
+func (m *jobManager) expire() {
+	for id, j := range m.jobs {
+		j.mu.Lock()
+		expired := !j.finished.IsZero() && time.Since(j.finished) > JobRetention
+		j.mu.Unlock()
+		if expired {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+type jobRequest struct {
+	ID string `json:"id"`
+}
+
+func (g *Gateway) handleJobGet(cr *cmdRequest, req *jobRequest) CmdReply {
+	g.jobs.mu.Lock()
+	defer g.jobs.mu.Unlock()
+	g.jobs.expire()
+
+	if req.ID == "" {
+		statuses := make([]JobStatus, 0, len(g.jobs.jobs))
+		for _, j := range g.jobs.jobs {
+			statuses = append(statuses, j.snapshot())
+		}
+		sort.Slice(statuses, func(i, k int) bool { return statuses[i].StartedAt < statuses[k].StartedAt })
+		return CmdReply{Ok: true, Data: statuses, TS: time.Now().Format(time.RFC3339)}
+	}
+
+	j, ok := g.jobs.jobs[req.ID]
+	if !ok {
+		return g.handleValidationError(cr, fmt.Errorf("unknown job %q", req.ID))
+	}
+	return CmdReply{Ok: true, Data: j.snapshot(), TS: time.Now().Format(time.RFC3339)}
+}
+
+func (g *Gateway) handleJobCancel(cr *cmdRequest, req *jobRequest) CmdReply {
+	g.jobs.mu.Lock()
+	j, ok := g.jobs.jobs[req.ID]
+	g.jobs.mu.Unlock()
+	if !ok {
+		return g.handleValidationError(cr, fmt.Errorf("unknown job %q", req.ID))
+	}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, Data: j.snapshot(), TS: time.Now().Format(time.RFC3339)}
+	}
+	j.cancel()
+	return CmdReply{Ok: true, Data: j.snapshot(), TS: time.Now().Format(time.RFC3339)}
+}
+
+// jobStarted is the reply of commands starting a job.
+func jobStarted(status JobStatus) CmdReply {
+	return CmdReply{Ok: true, Data: status, TS: time.Now().Format(time.RFC3339)}
+}
@@ -0,0 +1,36 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestJobCancelDryRun(t *testing.T) {
+	g := newTestGateway(t)
+	cancelled := make(chan struct{})
+	status := g.startJob("test", func(ctx context.Context, j *job) (any, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	})
+
+	reply := g.handleJobCancel(testCmdRequest("job.cancel", true), &jobRequest{ID: status.ID})
+	if !reply.Ok || !reply.DryRun {
+		t.Fatalf("dry run of job.cancel replied %+v", reply)
+	}
+	select {
+	case <-cancelled:
+		t.Fatal("dry run of job.cancel cancelled the job")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if reply := g.handleJobCancel(testCmdRequest("job.cancel", false), &jobRequest{ID: status.ID}); !reply.Ok || reply.DryRun {
+		t.Fatalf("job.cancel replied %+v", reply)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("job.cancel did not cancel the job")
+	}
+}
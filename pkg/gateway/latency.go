@@ -0,0 +1,147 @@
+package gateway
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the command latency
+// histograms, from a fast loco.drive to slow programming track reads.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// MetricBucket is a cumulative histogram bucket.
+type MetricBucket struct {
+	LE    float64 `json:"le"`
+	Count uint64  `json:"count"`
+}
+
+type latencyKey struct {
+	command string
+	outcome string
+}
+
+type histogram struct {
+	// counts holds one count per bucket plus the +Inf one, not cumulative.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// latencies records the command latency histograms by command and
+// outcome, "ok" or the error code.
+type latencies struct {
+	mu    sync.Mutex
+	hists map[latencyKey]*histogram
+}
+
+func newLatencies() *latencies {
+	return &latencies{hists: make(map[latencyKey]*histogram)}
+}
+
+func (l *latencies) observe(command, outcome string, d time.Duration) {
+	s := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, s)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := latencyKey{command: command, outcome: outcome}
+	h, ok := l.hists[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		l.hists[key] = h
+	}
+	h.counts[i]++
+	h.sum += s
+	h.count++
+}
+
+// metrics returns one histogram metric per command and outcome.
+func (l *latencies) metrics() []Metric {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	metrics := make([]Metric, 0, len(l.hists))
+	for key, h := range l.hists {
+		buckets := make([]MetricBucket, len(latencyBuckets))
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			buckets[i] = MetricBucket{LE: le, Count: cumulative}
+		}
+		metrics = append(metrics, Metric{
+			Name:    "z21_gateway_command_duration_seconds",
+			Type:    MetricHistogram,
+			Labels:  map[string]string{"command": key.command, "outcome": key.outcome},
+			Value:   float64(h.count),
+			Sum:     h.sum,
+			Buckets: buckets,
+		})
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		a, b := metrics[i].Labels, metrics[j].Labels
+		if a["command"] != b["command"] {
+			return a["command"] < b["command"]
+		}
+		return a["outcome"] < b["outcome"]
+	})
+	return metrics
+}
+
+func commandOutcome(reply CmdReply) string {
+	switch {
+	case reply.Ok:
+		return "ok"
+	case reply.ErrorCode != "":
+		return string(reply.ErrorCode)
+	}
+	return string(ErrCodeInternal)
+}
+
+// handleMetricsHTTP serves the metrics in the Prometheus text format.
+func (g *Gateway) handleMetricsHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writePrometheus(w, g.metrics())
+}
+
+func writePrometheus(w io.Writer, metrics []Metric) {
+	typed := make(map[string]bool)
+	for _, m := range metrics {
+		if !typed[m.Name] {
+			fmt.Fprintf(w, "# TYPE %s %s\n", m.Name, m.Type)
+			typed[m.Name] = true
+		}
+		if m.Type != MetricHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", m.Name, promLabels(m.Labels, ""), promFloat(m.Value))
+			continue
+		}
+		for _, b := range m.Buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.Name, promLabels(m.Labels, promFloat(b.LE)), b.Count)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %s\n", m.Name, promLabels(m.Labels, "+Inf"), promFloat(m.Value))
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.Name, promLabels(m.Labels, ""), promFloat(m.Sum))
+		fmt.Fprintf(w, "%s_count%s %s\n", m.Name, promLabels(m.Labels, ""), promFloat(m.Value))
+	}
+}
+
+func promLabels(labels map[string]string, le string) string {
+	if len(labels) == 0 && le == "" {
+		return ""
+	}
+	var pairs []string
+	for _, k := range sortedKeys(labels) {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, labels[k]))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=%q", le))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func promFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
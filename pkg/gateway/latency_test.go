@@ -0,0 +1,24 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestLatenciesCollapseUnknownCommands(t *testing.T) {
+	g := newTestGateway(t)
+	for _, name := range []string{"no.such", "made.up.1", "made.up.2", "capabilities.get"} {
+		if _, ok := g.execCmdMessage(&nats.Msg{Subject: "z21.bench.cmd." + name, Header: nats.Header{}}, time.Now()); !ok {
+			t.Fatal("gateway stopped")
+		}
+	}
+	commands := make(map[string]uint64)
+	for key, h := range g.latencies.hists {
+		commands[key.command] += h.count
+	}
+	if len(commands) != 2 || commands[unknownCommand] != 3 || commands["capabilities.get"] != 1 {
+		t.Errorf("histograms per command %v, want capabilities.get once and %s thrice", commands, unknownCommand)
+	}
+}
@@ -0,0 +1,583 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// LCCReconnect is the delay before the OpenLCB link is reopened after it
+	// failed.
+	LCCReconnect = 5 * time.Second
+	// lccAliasWait is how long an alias must be unanswered after its check
+	// ID frames before it is reserved.
+	lccAliasWait = 200 * time.Millisecond
+	// lccQueue bounds the events waiting to be produced.
+	lccQueue = 256
+	// lccMaxFrame bounds a GridConnect frame, the longest one is 28 bytes.
+	lccMaxFrame = 64
+)
+
+// OpenLCB CAN frame types and MTIs, see the OpenLCB CAN frame transfer and
+// message network standards.
+const (
+	lccFrameMessage = 0x19000000
+
+	lccCID7 = 0x17000000
+	lccCID4 = 0x14000000
+	lccRID  = 0x10700000
+	lccAMD  = 0x10701000
+	lccAME  = 0x10702000
+	lccAMR  = 0x10703000
+
+	mtiInitComplete          = 0x100
+	mtiVerifyNodeAddressed   = 0x488
+	mtiVerifyNodeGlobal      = 0x490
+	mtiVerifiedNode          = 0x170
+	mtiProtocolSupport       = 0x828
+	mtiProtocolSupportReply  = 0x668
+	mtiIdentifyConsumer      = 0x8F4
+	mtiConsumerIdentified    = 0x4C7
+	mtiIdentifyProducer      = 0x914
+	mtiProducerIdentified    = 0x547
+	mtiIdentifyEventsAddrd   = 0x968
+	mtiIdentifyEventsGlobal  = 0x970
+	mtiEventReport           = 0x5B4
+	mtiAddressed             = 0x008
+	lccProtocolEventExchange = 0x04
+)
+
+var (
+	errLCCDisabled = errors.New("OpenLCB is not enabled, see --lcc_addr")
+	errLCCDown     = errors.New("the OpenLCB link is down")
+	errLCCConflict = errors.New("alias conflict")
+)
+
+// LCCConfig maps between gateway events and commands and OpenLCB events.
+type LCCConfig struct {
+	Produce []LCCProduce `yaml:"produce"`
+	Consume []LCCConsume `yaml:"consume"`
+}
+
+// LCCProduce produces an OpenLCB event for each gateway event on Subject,
+// a subject pattern below z21.<name>.event., whose payload has the Match
+// fields.
+type LCCProduce struct {
+	Subject string         `yaml:"subject"`
+	Match   map[string]any `yaml:"match"`
+	Event   string         `yaml:"event"`
+}
+
+// LCCConsume sends Command with Payload when the OpenLCB event Event is
+// reported.
+type LCCConsume struct {
+	Event   string         `yaml:"event"`
+	Command string         `yaml:"command"`
+	Payload map[string]any `yaml:"payload"`
+}
+
+// LCCEvent is the payload of the gateway events published for the OpenLCB
+// events reported by other nodes, on z21.<name>.event.lcc.<event id>.
+type LCCEvent struct {
+	Event  string `json:"event"`
+	Source string `json:"source"`
+	TS     string `json:"ts"`
+}
+
+type lccSendRequest struct {
+	Event string `json:"event" payload:"required"`
+}
+
+// lccLink is the connection of the gateway, an OpenLCB node, to an
+// OpenLCB CAN segment through a GridConnect TCP hub or CAN-USB adapter.
+type lccLink struct {
+	addr    string
+	nodeID  uint64
+	produce []LCCProduce
+	consume map[uint64]LCCConsume
+	out     chan uint64
+	up      atomic.Bool
+}
+
+// parseLCCID parses a dotted hex OpenLCB ID of n bytes, e.g. the event ID
+// 05.01.01.01.22.00.00.01 or the node ID 05.01.01.01.22.01.
+func parseLCCID(s string, n int) (uint64, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ".", ""))
+	if err != nil || len(b) != n {
+		return 0, fmt.Errorf("invalid OpenLCB ID %q: want %d dotted hex bytes", s, n)
+	}
+	var id uint64
+	for _, c := range b {
+		id = id<<8 | uint64(c)
+	}
+	return id, nil
+}
+
+// formatLCCEvent formats an event ID as dotted hex.
+func formatLCCEvent(event uint64) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], event)
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = fmt.Sprintf("%02X", c)
+	}
+	return strings.Join(parts, ".")
+}
+
+// validateLCC checks the event IDs, subjects and commands of the OpenLCB
+// mappings.
+func validateLCC(cfg LCCConfig) error {
+	for i, p := range cfg.Produce {
+		if _, err := parseLCCID(p.Event, 8); err != nil {
+			return fmt.Errorf("lcc produce %d: %w", i+1, err)
+		}
+		if p.Subject == "" || strings.HasPrefix(p.Subject, "lcc.") {
+			return fmt.Errorf("lcc produce %d: subject must be set and not below lcc.", i+1)
+		}
+	}
+	seen := make(map[uint64]bool)
+	for i, c := range cfg.Consume {
+		event, err := parseLCCID(c.Event, 8)
+		if err != nil {
+			return fmt.Errorf("lcc consume %d: %w", i+1, err)
+		}
+		if seen[event] {
+			return fmt.Errorf("lcc consume %d: event %s is mapped twice", i+1, c.Event)
+		}
+		seen[event] = true
+		if _, ok := commands[c.Command]; !ok {
+			return fmt.Errorf("lcc consume %d: unknown command %q", i+1, c.Command)
+		}
+	}
+	return nil
+}
+
+// newLCCLink returns the OpenLCB link, nil without an address.
+func newLCCLink(addr string, nodeID uint64, cfg LCCConfig) *lccLink {
+	if addr == "" {
+		return nil
+	}
+	l := &lccLink{
+		addr:    addr,
+		nodeID:  nodeID,
+		produce: cfg.Produce,
+		consume: make(map[uint64]LCCConsume),
+		out:     make(chan uint64, lccQueue),
+	}
+	for _, c := range cfg.Consume {
+		event, _ := parseLCCID(c.Event, 8)
+		l.consume[event] = c
+	}
+	return l
+}
+
+// startLCC subscribes to the events of the produce mappings and runs the
+// OpenLCB link, reopening it after failures until the gateway stops.
+func (g *Gateway) startLCC() error {
+	for _, p := range g.lcc.produce {
+		event, _ := parseLCCID(p.Event, 8)
+		match := make(map[string]any, len(p.Match))
+		for k, v := range p.Match {
+			// compare YAML values like decoded JSON
+			data, err := json.Marshal(v)
+			if err != nil {
+				return fmt.Errorf("lcc produce %s: %w", p.Event, err)
+			}
+			var jv any
+			json.Unmarshal(data, &jv)
+			match[k] = jv
+		}
+		_, err := g.subscribe(g.eventPrefix+p.Subject, func(msg *nats.Msg) {
+			var payload map[string]any
+			if decodePayload(msgSchemaVersion(msg), msg.Data, &payload) != nil {
+				return
+			}
+			for k, v := range match {
+				if !reflect.DeepEqual(payload[k], v) {
+					return
+				}
+			}
+			select {
+			case g.lcc.out <- event:
+			default:
+				g.logger.Warn().
+					Str("event", p.Event).
+					Msg("OpenLCB queue full, event dropped")
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("lcc produce %s: %w", p.Event, err)
+		}
+	}
+
+	g.wg.Add(1)
+	go g.lccLoop()
+	return nil
+}
+
+func (g *Gateway) lccLoop() {
+	defer g.wg.Done()
+	for {
+		err := g.runLCC()
+		g.lcc.up.Store(false)
+		if g.ctx.Err() != nil {
+			return
+		}
+		g.logger.Error().
+			Err(err).
+			Str("addr", g.lcc.addr).
+			Dur("retry", LCCReconnect).
+			Msg("OpenLCB link failed")
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-time.After(LCCReconnect):
+		}
+	}
+}
+
+// openLCC opens the GridConnect link, a serial CAN-USB adapter for device
+// paths and a TCP hub otherwise.
+func openLCC(addr string) (io.ReadWriteCloser, error) {
+	if strings.HasPrefix(addr, "/") {
+		return openLCCSerial(addr)
+	}
+	return net.DialTimeout("tcp", addr, 10*time.Second)
+}
+
+// lccFrame is a CAN frame with an extended ID.
+type lccFrame struct {
+	id   uint32
+	data []byte
+}
+
+func (f lccFrame) alias() uint16 {
+	return uint16(f.id & 0xFFF)
+}
+
+// lccSession is an open OpenLCB link with the alias of the gateway node.
+type lccSession struct {
+	g     *Gateway
+	w     io.Writer
+	alias uint16
+}
+
+// runLCC opens the link, logs the node in and runs it until it fails.
+func (g *Gateway) runLCC() error {
+	rw, err := openLCC(g.lcc.addr)
+	if err != nil {
+		return err
+	}
+	defer rw.Close()
+	stop := context.AfterFunc(g.ctx, func() { rw.Close() })
+	defer stop()
+
+	frames := make(chan lccFrame, 64)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		readErr <- readGridConnect(rw, frames, done)
+	}()
+
+	s := &lccSession{g: g, w: rw}
+	if err := s.login(frames, readErr); err != nil {
+		return err
+	}
+	g.lcc.up.Store(true)
+	g.logger.Info().
+		Str("addr", g.lcc.addr).
+		Str("alias", fmt.Sprintf("%03X", s.alias)).
+		Msg("OpenLCB node initialized")
+
+	for {
+		select {
+		case <-g.ctx.Done():
+			return g.ctx.Err()
+		case err := <-readErr:
+			return err
+		case event := <-g.lcc.out:
+			if err := s.send(s.message(mtiEventReport), binary.BigEndian.AppendUint64(nil, event)); err != nil {
+				return err
+			}
+		case f := <-frames:
+			if err := s.handle(f); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// login reserves an alias derived from the node ID and announces the node
+// and its events.
+func (s *lccSession) login(frames <-chan lccFrame, readErr <-chan error) error {
+	nodeID := s.g.lcc.nodeID
+	seed := lccSeed(nodeID)
+reserve:
+	for {
+		s.alias = seed.next()
+		for i := 0; i < 4; i++ {
+			part := uint32(nodeID>>(36-12*i)) & 0xFFF
+			if err := s.send(uint32(lccCID7-i*0x01000000)|part<<12|uint32(s.alias), nil); err != nil {
+				return err
+			}
+		}
+		wait := time.After(lccAliasWait)
+		for {
+			select {
+			case <-s.g.ctx.Done():
+				return s.g.ctx.Err()
+			case err := <-readErr:
+				return err
+			case f := <-frames:
+				if f.alias() == s.alias {
+					continue reserve
+				}
+			case <-wait:
+				break reserve
+			}
+		}
+	}
+
+	id := binary.BigEndian.AppendUint64(nil, nodeID)[2:]
+	if err := s.send(lccRID|uint32(s.alias), nil); err != nil {
+		return err
+	}
+	if err := s.send(lccAMD|uint32(s.alias), id); err != nil {
+		return err
+	}
+	if err := s.send(s.message(mtiInitComplete), id); err != nil {
+		return err
+	}
+	return s.identifyEvents()
+}
+
+// identifyEvents announces the produced and consumed events, with an
+// unknown state.
+func (s *lccSession) identifyEvents() error {
+	for _, p := range s.g.lcc.produce {
+		event, _ := parseLCCID(p.Event, 8)
+		if err := s.send(s.message(mtiProducerIdentified), binary.BigEndian.AppendUint64(nil, event)); err != nil {
+			return err
+		}
+	}
+	for event := range s.g.lcc.consume {
+		if err := s.send(s.message(mtiConsumerIdentified), binary.BigEndian.AppendUint64(nil, event)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handle answers the frames of other nodes addressed to or concerning the
+// gateway node and reports their events.
+func (s *lccSession) handle(f lccFrame) error {
+	nodeID := binary.BigEndian.AppendUint64(nil, s.g.lcc.nodeID)[2:]
+	if f.alias() == s.alias {
+		if f.id>>24 >= lccCID4>>24 && f.id>>24 <= lccCID7>>24 {
+			return s.send(lccRID|uint32(s.alias), nil)
+		}
+		// another node uses the alias, release it and log in again
+		s.send(lccAMR|uint32(s.alias), nodeID)
+		return errLCCConflict
+	}
+	if f.id&^0xFFF == lccAME {
+		if len(f.data) == 0 || bytes.Equal(f.data, nodeID) {
+			return s.send(lccAMD|uint32(s.alias), nodeID)
+		}
+		return nil
+	}
+	if f.id&0xFF000000 != lccFrameMessage {
+		return nil
+	}
+
+	mti := uint16(f.id>>12) & 0xFFF
+	data := f.data
+	if mti&mtiAddressed != 0 {
+		if len(data) < 2 || uint16(data[0]&0x0F)<<8|uint16(data[1]) != s.alias {
+			return nil
+		}
+		data = data[2:]
+	}
+	switch mti {
+	case mtiVerifyNodeGlobal:
+		if len(data) != 0 && !bytes.Equal(data, nodeID) {
+			return nil
+		}
+		return s.send(s.message(mtiVerifiedNode), nodeID)
+	case mtiVerifyNodeAddressed:
+		return s.send(s.message(mtiVerifiedNode), nodeID)
+	case mtiProtocolSupport:
+		return s.send(s.message(mtiProtocolSupportReply),
+			[]byte{byte(f.alias() >> 8), byte(f.alias()), lccProtocolEventExchange, 0, 0})
+	case mtiIdentifyEventsGlobal, mtiIdentifyEventsAddrd:
+		return s.identifyEvents()
+	case mtiIdentifyProducer, mtiIdentifyConsumer:
+		if len(data) != 8 {
+			return nil
+		}
+		event := binary.BigEndian.Uint64(data)
+		if mti == mtiIdentifyConsumer {
+			if _, ok := s.g.lcc.consume[event]; ok {
+				return s.send(s.message(mtiConsumerIdentified), data)
+			}
+			return nil
+		}
+		for _, p := range s.g.lcc.produce {
+			if id, _ := parseLCCID(p.Event, 8); id == event {
+				return s.send(s.message(mtiProducerIdentified), data)
+			}
+		}
+	case mtiEventReport:
+		if len(data) == 8 {
+			s.g.handleLCCEvent(binary.BigEndian.Uint64(data), f.alias())
+		}
+	}
+	return nil
+}
+
+// handleLCCEvent publishes an event reported by another node and sends the
+// command it is mapped to.
+func (g *Gateway) handleLCCEvent(event uint64, alias uint16) {
+	id := formatLCCEvent(event)
+	g.publishDerivedEvent(fmt.Sprintf("lcc.%016x", event), "event.lcc", LCCEvent{
+		Event:  id,
+		Source: fmt.Sprintf("%03X", alias),
+		TS:     time.Now().UTC().Format(time.RFC3339Nano),
+	})
+
+	c, ok := g.lcc.consume[event]
+	if !ok {
+		return
+	}
+	payload, err := json.Marshal(c.Payload)
+	if err != nil {
+		return
+	}
+	// commands may wait for the Z21, which must not hold up the link
+	go func() {
+		raw, err := g.requestCommand(g.ctx, c.Command, payload)
+		var reply CmdReply
+		if err == nil {
+			err = json.Unmarshal(raw, &reply)
+		}
+		if err == nil && !reply.Ok {
+			err = errors.New(reply.Error)
+		}
+		if err != nil {
+			g.logger.Warn().
+				Err(err).
+				Str("event", id).
+				Str("command", c.Command).
+				Msg("OpenLCB event command failed")
+		}
+	}()
+}
+
+func (g *Gateway) handleLCCSend(cr *cmdRequest, req *lccSendRequest) CmdReply {
+	if g.lcc == nil {
+		return CmdReply{Ok: false, Error: errLCCDisabled.Error(), ErrorCode: ErrCodeUnsupported, TS: time.Now().Format(time.RFC3339)}
+	}
+	event, err := parseLCCID(req.Event, 8)
+	if err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, TS: time.Now().Format(time.RFC3339)}
+	}
+	if !g.lcc.up.Load() {
+		return CmdReply{Ok: false, Error: errLCCDown.Error(), ErrorCode: ErrCodeInternal, TS: time.Now().Format(time.RFC3339)}
+	}
+	select {
+	case g.lcc.out <- event:
+		return CmdReply{Ok: true, TS: time.Now().Format(time.RFC3339)}
+	default:
+		return CmdReply{Ok: false, Error: "the OpenLCB queue is full", ErrorCode: ErrCodeBusy, TS: time.Now().Format(time.RFC3339)}
+	}
+}
+
+// message returns the CAN ID of a global or addressed message of the
+// gateway node.
+func (s *lccSession) message(mti uint16) uint32 {
+	return lccFrameMessage | uint32(mti)<<12 | uint32(s.alias)
+}
+
+func (s *lccSession) send(id uint32, data []byte) error {
+	_, err := fmt.Fprintf(s.w, ":X%08XN%s;\n", id, strings.ToUpper(hex.EncodeToString(data)))
+	return err
+}
+
+// readGridConnect reads GridConnect frames, :X<id>N<data>;, until the link
+// fails or done is closed. Standard frames and malformed frames are
+// skipped.
+func readGridConnect(r io.Reader, frames chan<- lccFrame, done <-chan struct{}) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString(';')
+		if err != nil {
+			return err
+		}
+		start := strings.LastIndex(line, ":X")
+		if start < 0 || len(line)-start > lccMaxFrame {
+			continue
+		}
+		idHex, dataHex, ok := strings.Cut(strings.TrimSuffix(line[start+2:], ";"), "N")
+		if !ok {
+			continue
+		}
+		id, err := strconv.ParseUint(idHex, 16, 29)
+		if err != nil {
+			continue
+		}
+		data, err := hex.DecodeString(dataHex)
+		if err != nil || len(data) > 8 {
+			continue
+		}
+		select {
+		case frames <- lccFrame{id: uint32(id), data: data}:
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// lccAliasSeed generates the alias candidates of a node, following the
+// pseudo random generator of the OpenLCB CAN frame transfer standard.
+type lccAliasSeed struct {
+	lfsr1, lfsr2 uint32
+}
+
+func lccSeed(nodeID uint64) *lccAliasSeed {
+	return &lccAliasSeed{lfsr1: uint32(nodeID>>24) & 0xFFFFFF, lfsr2: uint32(nodeID) & 0xFFFFFF}
+}
+
+// next returns the next alias candidate, never zero.
+func (s *lccAliasSeed) next() uint16 {
+	for {
+		alias := uint16((s.lfsr1 ^ s.lfsr2 ^ s.lfsr1>>12 ^ s.lfsr2>>12) & 0xFFF)
+		temp1 := (s.lfsr1<<9 | s.lfsr2>>15&0x1FF) & 0xFFFFFF
+		temp2 := s.lfsr2 << 9 & 0xFFFFFF
+		s.lfsr2 += temp2 + 0x7A4BA9
+		s.lfsr1 += temp1 + 0x1B0CA3
+		s.lfsr1 = s.lfsr1&0xFFFFFF + (s.lfsr2&0xFF000000)>>24
+		s.lfsr2 &= 0xFFFFFF
+		if alias != 0 {
+			return alias
+		}
+	}
+}
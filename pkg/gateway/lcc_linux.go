@@ -0,0 +1,53 @@
+package gateway
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// openLCCSerial opens a GridConnect CAN-USB adapter in raw mode, so that
+// the tty neither echoes nor rewrites frames. USB adapters ignore the baud
+// rate, it is left as is.
+func openLCCSerial(path string) (io.ReadWriteCloser, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	var t syscall.Termios
+	if err := termiosIoctl(f, syscall.TCGETS, &t); err != nil {
+		f.Close()
+		return nil, err
+	}
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8 | syscall.CLOCAL | syscall.CREAD
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	if err := termiosIoctl(f, syscall.TCSETS, &t); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func termiosIoctl(f *os.File, req uintptr, t *syscall.Termios) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(t)))
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
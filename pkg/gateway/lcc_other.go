@@ -0,0 +1,12 @@
+//go:build !linux
+
+package gateway
+
+import (
+	"errors"
+	"io"
+)
+
+func openLCCSerial(path string) (io.ReadWriteCloser, error) {
+	return nil, errors.New("serial CAN-USB adapters are only supported on Linux, use a GridConnect TCP hub")
+}
@@ -0,0 +1,88 @@
+package gateway
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLCCIDs(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		n    int
+		want uint64
+		ok   bool
+	}{
+		{"05.01.01.01.22.00.00.01", 8, 0x0501010122000001, true},
+		{"05.01.01.01.22.01", 6, 0x050101012201, true},
+		{"0501010122000001", 8, 0x0501010122000001, true},
+		{"05.01.01.01.22.01", 8, 0, false},
+		{"05.01.01.01.22.00.00.0G", 8, 0, false},
+		{"", 8, 0, false},
+	} {
+		got, err := parseLCCID(tt.s, tt.n)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseLCCID(%q, %d) = %#x, %v, want %#x", tt.s, tt.n, got, err, tt.want)
+		}
+	}
+	if got := formatLCCEvent(0x0501010122000001); got != "05.01.01.01.22.00.00.01" {
+		t.Errorf("formatLCCEvent = %s", got)
+	}
+}
+
+// TestLCCSessionReplies feeds frames of another node, alias 0x456, to the
+// session of the gateway node, alias 0x123, and checks the GridConnect
+// frames it answers with.
+func TestLCCSessionReplies(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		f    lccFrame
+		want string
+	}{
+		{"verify node global", lccFrame{id: 0x19490456}, ":X19170123N050101012201;\n"},
+		{"verify node global of our ID", lccFrame{id: 0x19490456, data: []byte{0x05, 0x01, 0x01, 0x01, 0x22, 0x01}}, ":X19170123N050101012201;\n"},
+		{"verify node global of another ID", lccFrame{id: 0x19490456, data: []byte{0x05, 0x01, 0x01, 0x01, 0x22, 0x02}}, ""},
+		{"verify node addressed", lccFrame{id: 0x19488456, data: []byte{0x01, 0x23}}, ":X19170123N050101012201;\n"},
+		{"verify node addressed to another node", lccFrame{id: 0x19488456, data: []byte{0x07, 0x89}}, ""},
+		{"protocol support inquiry", lccFrame{id: 0x19828456, data: []byte{0x01, 0x23}}, ":X19668123N0456040000;\n"},
+		{"alias map enquiry", lccFrame{id: 0x10702456}, ":X10701123N050101012201;\n"},
+		{"check ID of our alias", lccFrame{id: 0x17050123}, ":X10700123N;\n"},
+	} {
+		var out bytes.Buffer
+		s := &lccSession{
+			g:     &Gateway{lcc: &lccLink{nodeID: 0x050101012201}},
+			w:     &out,
+			alias: 0x123,
+		}
+		if err := s.handle(tt.f); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if out.String() != tt.want {
+			t.Errorf("%s: sent %q, want %q", tt.name, out.String(), tt.want)
+		}
+	}
+}
+
+func TestReadGridConnect(t *testing.T) {
+	in := ":X195B4456N0501010122000001;\n:S123N00;garbage;:X19170456N050101012201;:X1917045N0102030405060708090A;"
+	frames := make(chan lccFrame, 4)
+	done := make(chan struct{})
+	err := readGridConnect(strings.NewReader(in), frames, done)
+	if err == nil {
+		t.Fatal("readGridConnect returned without the end of the input")
+	}
+	close(frames)
+	var got []lccFrame
+	for f := range frames {
+		got = append(got, f)
+	}
+	if len(got) != 2 {
+		t.Fatalf("read %d frames, want the 2 extended frames with at most 8 bytes: %+v", len(got), got)
+	}
+	if got[0].id != 0x195B4456 || !bytes.Equal(got[0].data, []byte{0x05, 0x01, 0x01, 0x01, 0x22, 0x00, 0x00, 0x01}) {
+		t.Errorf("first frame %+v", got[0])
+	}
+	if got[1].id != 0x19170456 || got[1].alias() != 0x456 {
+		t.Errorf("second frame %+v", got[1])
+	}
+}
@@ -0,0 +1,131 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// LinkWindow is the number of reachability probes the link quality is
+	// computed over, 100s at the default heartbeat interval.
+	LinkWindow = 20
+	// LinkLossWarning is the estimated loss above which a link_degraded
+	// warning is published.
+	LinkLossWarning = 0.1
+)
+
+// LinkQuality describes the network path to the Z21 over the last
+// reachability probes.
+type LinkQuality struct {
+	Probes       int     `json:"probes"`
+	RTTMillis    float64 `json:"rtt_ms"`
+	RTTMaxMillis float64 `json:"rtt_max_ms"`
+	// JitterMillis is the mean difference between consecutive round trip
+	// times.
+	JitterMillis float64 `json:"jitter_ms"`
+	TimeoutRate  float64 `json:"timeout_rate"`
+	// Loss estimates the packet loss as the share of unanswered probes.
+	// Each probe is one datagram each way, so it does not tell which
+	// direction lost it.
+	Loss float64 `json:"loss"`
+}
+
+type linkSample struct {
+	rtt      time.Duration
+	answered bool
+	timeout  bool
+}
+
+// linkQuality keeps the outcome of the last LinkWindow probes.
+type linkQuality struct {
+	mu      sync.Mutex
+	samples [LinkWindow]linkSample
+	next    int
+	n       int
+	warned  bool
+}
+
+func (l *linkQuality) record(rtt time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.samples[l.next] = linkSample{
+		rtt:      rtt,
+		answered: err == nil,
+		timeout:  errors.Is(err, context.DeadlineExceeded),
+	}
+	l.next = (l.next + 1) % LinkWindow
+	l.n = min(l.n+1, LinkWindow)
+}
+
+func (l *linkQuality) snapshot() *LinkQuality {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.n == 0 {
+		return nil
+	}
+
+	q := &LinkQuality{Probes: l.n}
+	var answered, timeouts int
+	var sum, jitter time.Duration
+	var prev time.Duration
+	var havePrev bool
+	// oldest first, so that the jitter follows the probe order
+	for i := range l.n {
+		s := l.samples[(l.next-l.n+i+LinkWindow)%LinkWindow]
+		if s.timeout {
+			timeouts++
+		}
+		if !s.answered {
+			continue
+		}
+		answered++
+		sum += s.rtt
+		q.RTTMaxMillis = math.Max(q.RTTMaxMillis, millis(s.rtt))
+		if havePrev {
+			jitter += (s.rtt - prev).Abs()
+		}
+		prev, havePrev = s.rtt, true
+	}
+	if answered > 0 {
+		q.RTTMillis = millis(sum / time.Duration(answered))
+	}
+	if answered > 1 {
+		q.JitterMillis = millis(jitter / time.Duration(answered-1))
+	}
+	q.TimeoutRate = float64(timeouts) / float64(l.n)
+	q.Loss = float64(l.n-answered) / float64(l.n)
+	return q
+}
+
+// checkLinkQuality warns once when the estimated loss over a full window
+// exceeds LinkLossWarning, and re-arms when it recovers.
+func (g *Gateway) checkLinkQuality(q *LinkQuality) {
+	if q == nil || q.Probes < LinkWindow {
+		return
+	}
+	g.link.mu.Lock()
+	degraded := q.Loss > LinkLossWarning
+	warn := degraded && !g.link.warned
+	g.link.warned = degraded
+	g.link.mu.Unlock()
+
+	if warn {
+		g.publishWarning("link_degraded", "the network path to the z21 loses probes",
+			map[string]any{"loss": q.Loss, "timeout_rate": q.TimeoutRate, "rtt_ms": q.RTTMillis})
+	}
+}
+
+func (g *Gateway) linkMetrics() []Metric {
+	q := g.link.snapshot()
+	if q == nil {
+		return nil
+	}
+	return []Metric{
+		gauge("z21_gateway_z21_loss_ratio", q.Loss),
+		gauge("z21_gateway_z21_timeout_ratio", q.TimeoutRate),
+		gauge("z21_gateway_z21_jitter_seconds", q.JitterMillis/1000),
+	}
+}
@@ -0,0 +1,138 @@
+package gateway
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+)
+
+// LogBackend formats the log records the gateway writes to stderr.
+type LogBackend interface {
+	// Writer returns the writer for out. It receives zerolog JSON records,
+	// one per write, and may reformat them.
+	Writer(out io.Writer) io.Writer
+}
+
+// LogBackendFunc adapts a function to a LogBackend.
+type LogBackendFunc func(out io.Writer) io.Writer
+
+func (f LogBackendFunc) Writer(out io.Writer) io.Writer { return f(out) }
+
+// LogHook receives the log records in addition to the backend, e.g. to
+// forward them to a collector. Hooks filter the levels they want.
+type LogHook interface {
+	zerolog.LevelWriter
+	// Attach passes the NATS connection of the gateway once it is connected;
+	// records logged before may be dropped.
+	Attach(nc *nats.Conn)
+}
+
+var (
+	logMu       sync.Mutex
+	logBackends = map[string]LogBackend{
+		"console": LogBackendFunc(func(out io.Writer) io.Writer { return zerolog.ConsoleWriter{Out: out} }),
+		"json":    LogBackendFunc(func(out io.Writer) io.Writer { return out }),
+	}
+	logHooks []LogHook
+)
+
+// RegisterLogBackend makes backend available as --log_format name. It
+// panics if name is already registered.
+func RegisterLogBackend(name string, backend LogBackend) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	if _, ok := logBackends[name]; ok {
+		panic("gateway: log backend " + name + " registered twice")
+	}
+	logBackends[name] = backend
+}
+
+// RegisterLogHook adds hook to the loggers of the configs parsed afterwards.
+func RegisterLogHook(hook LogHook) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	logHooks = append(logHooks, hook)
+}
+
+func logFormats() string {
+	formats := make([]string, 0, len(logBackends))
+	for f := range logBackends {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+	return strings.Join(formats, ", ")
+}
+
+// natsLogHook publishes log records at or above its level as JSON on
+// z21.<name>.gateway.log, once a NATS connection is attached.
+type natsLogHook struct {
+	subject string
+	level   zerolog.Level
+	nc      atomic.Pointer[nats.Conn]
+}
+
+// Attach starts forwarding log entries to nc; entries logged before are
+// dropped.
+func (h *natsLogHook) Attach(nc *nats.Conn) {
+	h.nc.Store(nc)
+}
+
+func (h *natsLogHook) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (h *natsLogHook) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	nc := h.nc.Load()
+	if level < h.level || nc == nil {
+		return len(p), nil
+	}
+	// zerolog reuses p after the write returns
+	data := bytes.Clone(bytes.TrimRight(p, "\n"))
+	// the hook must not log, errors would recurse
+	_ = nc.Publish(h.subject, data)
+	return len(p), nil
+}
+
+// newLogger returns the logger writing to stderr in the given format and
+// to the registered hooks plus, if natsLevel is set, the NATS log hook.
+func newLogger(name, format, natsLevel string) (zerolog.Logger, []LogHook, error) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	backend, ok := logBackends[format]
+	if !ok {
+		return zerolog.Logger{}, nil, fmt.Errorf("unknown log format %q, supported: %s", format, logFormats())
+	}
+
+	hooks := slices.Clone(logHooks)
+	if natsLevel != "" {
+		level, err := zerolog.ParseLevel(natsLevel)
+		if err != nil || level == zerolog.NoLevel {
+			return zerolog.Logger{}, nil, fmt.Errorf("invalid NATS log level %q", natsLevel)
+		}
+		hooks = append(hooks, &natsLogHook{
+			subject: fmt.Sprintf("z21.%s.gateway.log", name),
+			level:   level,
+		})
+	}
+	writers := []io.Writer{backend.Writer(os.Stderr)}
+	for _, hook := range hooks {
+		writers = append(writers, hook)
+	}
+
+	logger := zerolog.New(zerolog.MultiLevelWriter(writers...)).
+		Level(zerolog.DebugLevel).
+		With().
+		Str("component", "z21gw").
+		Timestamp().
+		Logger()
+	return logger, hooks, nil
+}
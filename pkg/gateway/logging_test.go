@@ -0,0 +1,60 @@
+package gateway
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+)
+
+// recordingHook keeps the records of level warn and above.
+type recordingHook struct {
+	bytes.Buffer
+}
+
+func (h *recordingHook) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	if level < zerolog.WarnLevel {
+		return len(p), nil
+	}
+	return h.Write(p)
+}
+
+func (h *recordingHook) Attach(*nats.Conn) {}
+
+func TestRegisterLogBackendAndHook(t *testing.T) {
+	RegisterLogBackend("discard", LogBackendFunc(func(io.Writer) io.Writer { return io.Discard }))
+	hook := &recordingHook{}
+	RegisterLogHook(hook)
+	t.Cleanup(func() {
+		logMu.Lock()
+		delete(logBackends, "discard")
+		logHooks = nil
+		logMu.Unlock()
+	})
+
+	if _, _, err := newLogger("bench", "logfmt", ""); err == nil || !strings.Contains(err.Error(), "console, discard, json") {
+		t.Errorf("unknown format: %v, want the list of registered formats", err)
+	}
+	logger, hooks, err := newLogger("bench", "discard", "warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 2 || hooks[0] != hook {
+		t.Fatalf("hooks %v, want the registered hook and the NATS hook", hooks)
+	}
+	logger.Info().Msg("quiet")
+	logger.Warn().Msg("loud")
+	if got := hook.String(); strings.Contains(got, "quiet") || !strings.Contains(got, `"message":"loud"`) {
+		t.Errorf("hook received %q, want only the warning", got)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a backend twice did not panic")
+		}
+	}()
+	RegisterLogBackend("json", LogBackendFunc(func(out io.Writer) io.Writer { return out }))
+}
@@ -0,0 +1,107 @@
+package gateway
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// LogSummaryInterval is how often the number of event log lines skipped
+// by --log_sample is logged.
+const LogSummaryInterval = time.Minute
+
+// eventLogSampler logs the first and then every n-th published event of
+// each kind.
+type eventLogSampler struct {
+	n       uint64
+	mu      sync.Mutex
+	seen    map[string]uint64
+	skipped map[string]uint64
+}
+
+func newEventLogSampler(n int) *eventLogSampler {
+	return &eventLogSampler{
+		n:       uint64(max(n, 1)),
+		seen:    make(map[string]uint64),
+		skipped: make(map[string]uint64),
+	}
+}
+
+// sample reports whether the event of kind published on subject is
+// logged.
+func (s *eventLogSampler) sample(subject string) bool {
+	if s.n == 1 {
+		return true
+	}
+	kind := eventSubjectKind(subject)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.seen[kind]
+	s.seen[kind] = i + 1
+	if i%s.n == 0 {
+		return true
+	}
+	s.skipped[kind]++
+	return false
+}
+
+// takeSkipped returns and resets the skipped log lines per kind.
+func (s *eventLogSampler) takeSkipped() map[string]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	skipped := s.skipped
+	s.skipped = make(map[string]uint64)
+	return skipped
+}
+
+// eventSubjectKind returns the token after "event." of an event subject,
+// or the subject if it is none.
+func eventSubjectKind(subject string) string {
+	_, rest, ok := strings.Cut(subject, ".event.")
+	if !ok {
+		return subject
+	}
+	kind, _, _ := strings.Cut(rest, ".")
+	return kind
+}
+
+// logPublished logs a published event, subject to --log_sample.
+func (g *Gateway) logPublished(subject string, seq uint64) {
+	if !g.logSampler.sample(subject) {
+		return
+	}
+	g.logger.Info().
+		Str("subject", subject).
+		Uint64("seq", seq).
+		Msg("NATS pub")
+}
+
+// logSummaryLoop periodically logs how many event log lines were skipped,
+// so a quiet log does not hide an occupancy storm.
+func (g *Gateway) logSummaryLoop() {
+	defer g.wg.Done()
+	ticker := time.NewTicker(LogSummaryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-ticker.C:
+			skipped := g.logSampler.takeSkipped()
+			if len(skipped) == 0 {
+				continue
+			}
+			dict := zerolog.Dict()
+			for _, kind := range sortedKeys(skipped) {
+				dict = dict.Uint64(kind, skipped[kind])
+			}
+			g.logger.Info().
+				Dict("skipped", dict).
+				Dur("interval", LogSummaryInterval).
+				Msg("NATS pub summary")
+		}
+	}
+}
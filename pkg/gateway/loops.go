@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Internal loops whose health is reported in the gateway status.
+const (
+	LoopEvents    = "events"
+	LoopHeartbeat = "heartbeat"
+	LoopCommands  = "commands"
+	LoopHTTP      = "http"
+)
+
+const (
+	LoopOK      = "ok"
+	LoopStalled = "stalled"
+	LoopFailed  = "failed"
+
+	// LoopBeatInterval is how often an idle events loop reports that it
+	// still runs. A loop is stalled after missing three beats.
+	LoopBeatInterval = 10 * time.Second
+)
+
+// loopBeat is the last sign of life of a loop, zero while it did not start.
+type loopBeat struct {
+	last   atomic.Int64
+	failed atomic.Bool
+}
+
+func (b *loopBeat) beat() {
+	b.last.Store(time.Now().UnixNano())
+}
+
+func (b *loopBeat) age() time.Duration {
+	return time.Since(time.Unix(0, b.last.Load()))
+}
+
+type loopHealth struct {
+	events    loopBeat
+	heartbeat loopBeat
+	// commands beats whenever a worker takes a command from a queue.
+	commands loopBeat
+	// http beats when the first HTTP listener starts and fails when any
+	// stops serving.
+	http loopBeat
+}
+
+// loopStates returns the state of every started loop, so that a partially
+// wedged gateway, e.g. with a dead events loop but working commands, is
+// told apart from a healthy one.
+func (g *Gateway) loopStates() map[string]string {
+	stall := 3 * LoopBeatInterval
+	states := make(map[string]string)
+	if g.loops.events.last.Load() != 0 {
+		states[LoopEvents] = loopState(g.loops.events.age() > stall)
+	}
+	if g.loops.heartbeat.last.Load() != 0 {
+		// a probe may take up to the probe timeout on top of the interval
+		states[LoopHeartbeat] = loopState(g.loops.heartbeat.age() > 3*g.heartbeatInterval+g.probeTimeout)
+	}
+	if g.loops.commands.last.Load() != 0 {
+		// idle workers do not beat, they only stall with commands waiting
+		states[LoopCommands] = loopState(g.commandsQueued() > 0 && g.loops.commands.age() > stall)
+	}
+	if g.loops.http.last.Load() != 0 {
+		states[LoopHTTP] = LoopOK
+		if g.loops.http.failed.Load() {
+			states[LoopHTTP] = LoopFailed
+		}
+	}
+	return states
+}
+
+func loopState(stalled bool) string {
+	if stalled {
+		return LoopStalled
+	}
+	return LoopOK
+}
+
+func (g *Gateway) loopMetrics() []Metric {
+	states := g.loopStates()
+	metrics := make([]Metric, 0, len(states))
+	for _, loop := range sortedKeys(states) {
+		m := boolGauge("z21_gateway_loop_healthy", states[loop] == LoopOK)
+		m.Labels = map[string]string{"loop": loop}
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
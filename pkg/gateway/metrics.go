@@ -0,0 +1,128 @@
+package gateway
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+const (
+	MetricsInterval = 15 * time.Second
+
+	MetricCounter   = "counter"
+	MetricGauge     = "gauge"
+	MetricHistogram = "histogram"
+)
+
+// Metric is a single named value of a metrics snapshot, modelled after
+// Prometheus samples.
+type Metric struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Value is the sample count of a histogram.
+	Value   float64        `json:"value"`
+	Sum     float64        `json:"sum,omitempty"`
+	Buckets []MetricBucket `json:"buckets,omitempty"`
+}
+
+// MetricsMsg is published on z21.<name>.metrics.
+type MetricsMsg struct {
+	Device   string   `json:"device"`
+	Instance string   `json:"instance"`
+	Metrics  []Metric `json:"metrics"`
+	TS       string   `json:"ts"`
+}
+
+func counter(name string, v uint64) Metric {
+	return Metric{Name: name, Type: MetricCounter, Value: float64(v)}
+}
+
+func gauge(name string, v float64) Metric {
+	return Metric{Name: name, Type: MetricGauge, Value: v}
+}
+
+func boolGauge(name string, v bool) Metric {
+	if v {
+		return gauge(name, 1)
+	}
+	return gauge(name, 0)
+}
+
+// metrics returns a snapshot of the gateway's internal metrics.
+func (g *Gateway) metrics() []Metric {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	var natsRTT time.Duration
+	if rtt, err := g.nc.RTT(); err == nil {
+		natsRTT = rtt
+	}
+
+	g.jobs.mu.Lock()
+	var jobsRunning int
+	for _, j := range g.jobs.jobs {
+		if j.snapshot().State == JobRunning {
+			jobsRunning++
+		}
+	}
+	g.jobs.mu.Unlock()
+
+	metrics := []Metric{
+		gauge("z21_gateway_uptime_seconds", time.Since(g.startedAt).Seconds()),
+		gauge("z21_gateway_goroutines", float64(runtime.NumGoroutine())),
+		gauge("z21_gateway_heap_bytes", float64(mem.HeapAlloc)),
+		counter("z21_gateway_commands_total", g.stats.commands.Load()),
+		counter("z21_gateway_command_errors_total", g.stats.commandErrors.Load()),
+		counter("z21_gateway_commands_rejected_total", g.stats.commandsRejected.Load()),
+		counter("z21_gateway_slow_commands_total", g.stats.slowCommands.Load()),
+		gauge("z21_gateway_commands_in_flight", float64(g.commandsInFlight())),
+		counter("z21_gateway_events_total", g.stats.events.Load()),
+		counter("z21_gateway_event_batches_total", g.stats.batches.Load()),
+		counter("z21_gateway_publish_errors_total", g.stats.publishErrors.Load()),
+		counter("z21_gateway_events_dropped_total", g.stats.eventsDropped.Load()),
+		gauge("z21_gateway_publish_queue_depth", float64(len(g.publishQueue))),
+		gauge("z21_gateway_state_entries", float64(g.state.len())),
+		counter("z21_gateway_state_evictions_total", g.state.evictions.Load()),
+		gauge("z21_gateway_jobs_running", float64(jobsRunning)),
+		gauge("z21_gateway_nats_rtt_seconds", natsRTT.Seconds()),
+		gauge("z21_gateway_z21_rtt_seconds", time.Duration(g.stats.z21RTT.Load()).Seconds()),
+		boolGauge("z21_gateway_z21_online", g.isOnline.Load()),
+		counter("z21_gateway_z21_foreign_datagrams_total", g.stats.foreignDatagrams.Load()),
+	}
+	info := gauge("z21_gateway_instance_info", 1)
+	info.Labels = map[string]string{"instance_id": g.instance}
+	metrics = append(metrics, info)
+	if n, ok := udpRcvbufErrors(); ok {
+		metrics = append(metrics, counter("z21_gateway_udp_rcvbuf_errors_total", n))
+	}
+	metrics = append(metrics, g.linkMetrics()...)
+	metrics = append(metrics, g.poolMetrics()...)
+	metrics = append(metrics, g.loopMetrics()...)
+	return append(metrics, g.latencies.metrics()...)
+}
+
+func (g *Gateway) metricsLoop() {
+	defer g.wg.Done()
+	ticker := time.NewTicker(g.metricsInterval)
+	defer ticker.Stop()
+
+	subject := fmt.Sprintf("z21.%s.metrics", g.name)
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-ticker.C:
+			msg := &MetricsMsg{
+				Device:   g.name,
+				Instance: g.instance,
+				Metrics:  g.metrics(),
+				TS:       time.Now().UTC().Format(time.RFC3339),
+			}
+			if err := g.publish(subject, "metrics", 0, msg); err != nil {
+				g.logger.Error().
+					Err(err).
+					Msg("failed to publish metrics")
+			}
+		}
+	}
+}
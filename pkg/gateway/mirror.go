@@ -0,0 +1,164 @@
+package gateway
+
+import (
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// MirrorQueue is the number of messages waiting for the mirror before
+	// further ones are dropped.
+	MirrorQueue = 4096
+	// MirrorBuffer is the default size in MiB of the buffer the mirror
+	// connection keeps messages in while reconnecting.
+	MirrorBuffer = 8
+	// MirrorDrainTimeout bounds how long Stop waits for the mirror to take
+	// the messages left in the queue.
+	MirrorDrainTimeout = 5 * time.Second
+)
+
+// MirrorStatus is the state of the mirror connection in the gateway status.
+type MirrorStatus struct {
+	Connected bool   `json:"connected"`
+	Published uint64 `json:"published"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+// natsMirror publishes copies of the messages of the gateway to a second
+// NATS server, e.g. a cloud cluster for remote dashboards. It has its own
+// connection and queue, so a slow or unreachable mirror never holds up the
+// local publishing.
+type natsMirror struct {
+	url    string
+	creds  string
+	buffer int
+	logger zerolog.Logger
+
+	nc        *nats.Conn
+	queue     chan *nats.Msg
+	published atomic.Uint64
+	dropped   atomic.Uint64
+	done      chan struct{}
+	// mu guards closed, publishes may race with close.
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newNATSMirror(cfg Config) *natsMirror {
+	if cfg.MirrorURL == "" {
+		return nil
+	}
+	return &natsMirror{
+		url:    cfg.MirrorURL,
+		creds:  cfg.MirrorCreds,
+		buffer: cfg.MirrorBuffer,
+		logger: cfg.Logger.With().Str("mirror", RedactURLs(cfg.MirrorURL)).Logger(),
+		queue:  make(chan *nats.Msg, MirrorQueue),
+		done:   make(chan struct{}),
+	}
+}
+
+// start connects to the mirror. A mirror that cannot be reached does not
+// fail the start, the connection keeps retrying in the background.
+func (m *natsMirror) start(name string) error {
+	opts := []nats.Option{
+		nats.Name(name),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectBufSize(m.buffer << 20),
+		nats.DisconnectErrHandler(func(c *nats.Conn, err error) {
+			m.logger.Warn().
+				Err(err).
+				Str("status", "disconnected").
+				Msg("NATS mirror conn")
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			m.logger.Info().
+				Str("status", "reconnected").
+				Msg("NATS mirror conn")
+		}),
+	}
+	// the credentials of the local server are not sent to the mirror, it
+	// authenticates with a credentials file or the user info of its URL
+	if m.creds != "" {
+		opts = append(opts, nats.UserCredentials(m.creds))
+	}
+	nc, err := nats.Connect(m.url, opts...)
+	if err != nil {
+		return err
+	}
+	m.nc = nc
+	m.logger.Info().
+		Bool("connected", nc.IsConnected()).
+		Msg("NATS mirror conn")
+	go m.loop()
+	return nil
+}
+
+// publish queues a copy of msg for the mirror, dropping it if the queue is
+// full.
+func (m *natsMirror) publish(msg *nats.Msg) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return
+	}
+	cp := &nats.Msg{Subject: msg.Subject, Header: maps.Clone(msg.Header), Data: append([]byte(nil), msg.Data...)}
+	select {
+	case m.queue <- cp:
+	default:
+		if m.dropped.Add(1) == 1 {
+			m.logger.Warn().
+				Msg("NATS mirror queue full, dropping messages")
+		}
+	}
+}
+
+func (m *natsMirror) loop() {
+	defer close(m.done)
+	for msg := range m.queue {
+		// errors other than a full reconnect buffer end the connection,
+		// which is retried by the client
+		if err := m.nc.PublishMsg(msg); err != nil {
+			m.dropped.Add(1)
+			continue
+		}
+		m.published.Add(1)
+	}
+}
+
+// close publishes what is left in the queue and closes the connection.
+func (m *natsMirror) close() {
+	m.mu.Lock()
+	if m.closed || m.nc == nil {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	close(m.queue)
+	m.mu.Unlock()
+
+	select {
+	case <-m.done:
+	case <-time.After(MirrorDrainTimeout):
+	}
+	if err := m.nc.FlushTimeout(MirrorDrainTimeout); err != nil {
+		m.logger.Warn().
+			Err(err).
+			Msg("failed to flush NATS mirror")
+	}
+	m.nc.Close()
+}
+
+func (m *natsMirror) status() *MirrorStatus {
+	return &MirrorStatus{
+		Connected: m.nc != nil && m.nc.IsConnected(),
+		Published: m.published.Load(),
+		Dropped:   m.dropped.Load(),
+	}
+}
@@ -0,0 +1,116 @@
+package gateway
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+// Capability bits of LAN_SYSTEMSTATE_DATAFRAME, reported from firmware
+// 1.42; older firmware reports none.
+const (
+	capLocoCmds      = 0x10
+	capAccessoryCmds = 0x20
+)
+
+// deviceModel adapts the gateway to a Z21 model.
+type deviceModel struct {
+	// lockable models refuse to drive and switch until unlocked with an
+	// activation code. The lock is read from the capabilities of the
+	// system state.
+	lockable bool
+	// ratedCurrentMA is the nominal main track current that current rules
+	// in percent refer to, 0 if not known.
+	ratedCurrentMA float64
+}
+
+var deviceModels = map[uint32]deviceModel{
+	HWTypeZ21Old:   {ratedCurrentMA: 3200},
+	HWTypeZ21New:   {ratedCurrentMA: 3200},
+	HWTypeZ21Start: {lockable: true},
+	HWTypeXL:       {ratedCurrentMA: 6000},
+}
+
+// lockedCommands maps the capability bits a locked Z21 clears to the
+// commands it then ignores.
+var lockedCommands = map[uint8][]string{
+	capLocoCmds:      {"loco.drive", "loco.functions", "loco.purge"},
+	capAccessoryCmds: {"turnout.set", "signal.set"},
+}
+
+// model returns the model of the detected Z21, the zero model until it is
+// detected.
+func (g *Gateway) model() deviceModel {
+	if info := g.device.Load(); info != nil {
+		return deviceModels[info.hwType]
+	}
+	return deviceModel{}
+}
+
+// ratedCurrent returns the nominal main track current in mA, set with
+// --rated_current or by the model, 0 if not known.
+func (g *Gateway) ratedCurrent() float64 {
+	if g.ratedCurrentMA > 0 {
+		return g.ratedCurrentMA
+	}
+	return g.model().ratedCurrentMA
+}
+
+// trackLock follows the lock of a lockable Z21 from system state events.
+// It is only called from the events loop and for the system state probe.
+func (g *Gateway) trackLock(ev z21.Serializable) {
+	ss, ok := ev.(*z21.SystemState)
+	if !ok || !g.model().lockable || ss.Capabilities == 0 {
+		return
+	}
+	caps := ss.Capabilities
+	var locked uint32
+	for bit := range lockedCommands {
+		if uint8(caps)&bit == 0 {
+			locked |= uint32(bit)
+		}
+	}
+	if g.locked.Swap(locked) == locked {
+		return
+	}
+	if locked == 0 {
+		g.logger.Info().
+			Msg("Z21 unlocked")
+		return
+	}
+	names := g.lockedCommands()
+	g.logger.Warn().
+		Strs("commands", names).
+		Msg("Z21 locked")
+	g.publishWarning("z21_locked", "the z21 is locked and ignores driving and switching until unlocked with its activation code",
+		map[string]any{"commands": names})
+}
+
+// lockedCommands returns the commands the Z21 ignores while locked.
+func (g *Gateway) lockedCommands() []string {
+	locked := g.locked.Load()
+	var names []string
+	for bit, cmds := range lockedCommands {
+		if locked&uint32(bit) != 0 {
+			names = append(names, cmds...)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// lockedByDevice reports whether a locked Z21 ignores the command.
+func (g *Gateway) lockedByDevice(name string) bool {
+	return slices.Contains(g.lockedCommands(), name)
+}
+
+func (g *Gateway) handleLockedByDevice(name string) CmdReply {
+	return CmdReply{
+		Ok:        false,
+		Error:     fmt.Sprintf("z21 is locked, unlock it with its activation code: %s", name),
+		ErrorCode: ErrCodeLocked,
+		TS:        time.Now().Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,135 @@
+package gateway
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/trains-io/z21.go"
+)
+
+const (
+	NameHeader = "Z21-Name"
+)
+
+// NameConfig maps symbolic names to locos, turnouts and detectors.
+// Detectors are identified by their event subject below event., e.g.
+// "can.1234.2" for port 2 of CAN detector 1234.
+type NameConfig struct {
+	Locos     map[string]uint16 `yaml:"locos"`
+	Turnouts  map[string]uint16 `yaml:"turnouts"`
+	Detectors map[string]string `yaml:"detectors"`
+}
+
+// nameIndex resolves names to addresses and event sources back to names.
+type nameIndex struct {
+	locos    map[string]uint16
+	turnouts map[string]uint16
+	// detectors maps names to detector sources.
+	detectors map[string]string
+	// sources maps event subject tokens below event., e.g. "loco.3", to a
+	// name.
+	sources map[string]string
+}
+
+func newNameIndex(nc NameConfig, signals map[string]SignalConfig) (*nameIndex, error) {
+	idx := &nameIndex{
+		locos:     nc.Locos,
+		turnouts:  nc.Turnouts,
+		detectors: nc.Detectors,
+		sources:   make(map[string]string),
+	}
+
+	add := func(source, name string) error {
+		// names must not look like addresses, they share subjects with them
+		if name == "" || strings.ContainsAny(name, ".*> \t") || strings.Trim(name, "0123456789") == "" {
+			return fmt.Errorf("invalid name %q", name)
+		}
+		if other, ok := idx.sources[source]; ok {
+			return fmt.Errorf("%s is named both %q and %q", source, other, name)
+		}
+		idx.sources[source] = name
+		return nil
+	}
+	for name, addr := range nc.Locos {
+		if err := add(fmt.Sprintf("loco.%d", addr), name); err != nil {
+			return nil, err
+		}
+	}
+	for name, addr := range nc.Turnouts {
+		if err := add(fmt.Sprintf("turnout.%d", addr), name); err != nil {
+			return nil, err
+		}
+	}
+	for name, sig := range signals {
+		if err := add(fmt.Sprintf("accessory.%d", sig.Address), name); err != nil {
+			return nil, err
+		}
+	}
+	for name, source := range nc.Detectors {
+		if err := add(source, name); err != nil {
+			return nil, err
+		}
+	}
+	return idx, nil
+}
+
+// resolve returns addr, or the address of name if set.
+func resolve(kind string, names map[string]uint16, name string, addr uint16) (uint16, error) {
+	if name == "" {
+		return addr, nil
+	}
+	a, ok := names[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown %s name %q", kind, name)
+	}
+	if addr != 0 && addr != a {
+		return 0, fmt.Errorf("%s name %q does not match address %d", kind, name, addr)
+	}
+	return a, nil
+}
+
+func (idx *nameIndex) resolveLoco(name string, addr uint16) (uint16, error) {
+	return resolve("loco", idx.locos, name, addr)
+}
+
+func (idx *nameIndex) resolveTurnout(name string, addr uint16) (uint16, error) {
+	return resolve("turnout", idx.turnouts, name, addr)
+}
+
+// resolveDetector returns the source of a detector given by name or
+// source, e.g. "can.1234.2".
+func (idx *nameIndex) resolveDetector(s string) (string, error) {
+	if source, ok := idx.detectors[s]; ok {
+		return source, nil
+	}
+	if kind, _, ok := strings.Cut(s, "."); ok && detectorKinds[kind] {
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown detector %q", s)
+}
+
+// namedAccessoryKinds are the event kinds additionally published under
+// event.<kind>.<name>.
+var namedAccessoryKinds = map[string]bool{
+	"turnout":   true,
+	"accessory": true,
+}
+
+// namedSubject returns the name based subject of an accessory event of
+// kind whose source is called name.
+func (g *Gateway) namedSubject(kind, name string) (string, bool) {
+	if !namedAccessoryKinds[kind] {
+		return "", false
+	}
+	return g.eventSubjectPrefix() + kind + "." + name, true
+}
+
+// eventName returns the configured name of the source of ev, if any.
+// Without names, the event path skips building the source tokens.
+func (idx *nameIndex) eventName(ev z21.Serializable) (string, bool) {
+	if len(idx.sources) == 0 {
+		return "", false
+	}
+	name, ok := idx.sources[strings.Join(eventTokens(ev), ".")]
+	return name, ok
+}
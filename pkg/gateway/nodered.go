@@ -0,0 +1,140 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/nats-io/nats.go"
+)
+
+// noderedToken is the subject token Node-RED payloads are published under,
+// z21.<name>.nodered.<subject>.
+const noderedToken = "nodered"
+
+// noderedMeta are the keys every Node-RED payload starts with; payload
+// fields of the same name are prefixed with payload_.
+var noderedMeta = map[string]bool{
+	"topic":  true,
+	"device": true,
+	"kind":   true,
+	"seq":    true,
+	"ts":     true,
+}
+
+// noderedSubject returns the subject the Node-RED copy of a message on
+// subject is published on.
+func (g *Gateway) noderedSubject(subject string) string {
+	return g.subjectPrefix + noderedToken + "." + strings.TrimPrefix(subject, g.subjectPrefix)
+}
+
+// publishNodeRED publishes the Node-RED copy of a message published on
+// subject.
+func (g *Gateway) publishNodeRED(subject, kind string, seq uint64, ts time.Time, payload any, header nats.Header) error {
+	data, err := encodeNodeRED(subject, g.name, kind, seq, ts, payload)
+	if err != nil {
+		return err
+	}
+	msg := nats.NewMsg(g.noderedSubject(subject))
+	for k, v := range header {
+		msg.Header[k] = v
+	}
+	msg.Data = data
+	return g.publishMsg(msg)
+}
+
+// encodeNodeRED encodes payload as a flat JSON object with lowercase
+// snake_case keys, led by the topic, the subject with slashes, and the
+// envelope fields. Nested objects are flattened with _ separated keys,
+// payloads that are not objects are the value field.
+func encodeNodeRED(subject, device, kind string, seq uint64, ts time.Time, payload any) ([]byte, error) {
+	if p, ok := payload.(v2Payload); ok {
+		payload = p.v2()
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	flat := map[string]any{
+		"topic":  strings.ReplaceAll(subject, ".", "/"),
+		"device": device,
+		"kind":   kind,
+		"ts":     ts.Format(time.RFC3339Nano),
+	}
+	if seq > 0 {
+		flat["seq"] = seq
+	}
+	obj, ok := v.(map[string]any)
+	if !ok {
+		flat["value"] = noderedValue(v)
+		return json.Marshal(flat)
+	}
+	fields := make(map[string]any)
+	flattenNodeRED(fields, "", obj)
+	for k, v := range fields {
+		if noderedMeta[k] {
+			k = "payload_" + k
+		}
+		flat[k] = v
+	}
+	return json.Marshal(flat)
+}
+
+// flattenNodeRED adds the fields of obj to flat, nested object fields with
+// their parent keys as prefix.
+func flattenNodeRED(flat map[string]any, prefix string, obj map[string]any) {
+	for k, v := range obj {
+		key := prefix + snakeCase(k)
+		if nested, ok := v.(map[string]any); ok {
+			flattenNodeRED(flat, key+"_", nested)
+			continue
+		}
+		flat[key] = noderedValue(v)
+	}
+}
+
+// noderedValue lowercases the keys of objects within arrays, which stay
+// nested.
+func noderedValue(v any) any {
+	switch v := v.(type) {
+	case []any:
+		for i, e := range v {
+			v[i] = noderedValue(e)
+		}
+		return v
+	case map[string]any:
+		flat := make(map[string]any)
+		flattenNodeRED(flat, "", v)
+		return flat
+	}
+	return v
+}
+
+// snakeCase converts Go field names like MainCurrent or NetworkID to
+// main_current and network_id; JSON keys that are snake_case already stay
+// as they are.
+func snakeCase(s string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && runes[i-1] != '_' &&
+				(unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+					i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,146 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// MaxPayloadSize bounds command payloads; the largest legitimate ones are
+// prog.restore with a full CV set.
+const MaxPayloadSize = 64 * 1024
+
+// decodeCommand strictly decodes a command payload into v, a pointer to a
+// payload struct. The payload must be a single JSON object of at most
+// MaxPayloadSize bytes with only fields of v, besides dry_run, and all its
+// fields tagged payload:"required", those of embedded structs included. An
+// empty payload decodes to the zero value and skips the required fields.
+func decodeCommand(data []byte, v any) error {
+	if len(data) > MaxPayloadSize {
+		return fmt.Errorf("payload of %d bytes exceeds %d bytes", len(data), MaxPayloadSize)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := decodeStrict(data, &fields); err != nil {
+		return err
+	}
+	if fields == nil {
+		return errors.New("payload must be a JSON object")
+	}
+	if raw, ok := fields["dry_run"]; ok {
+		var dryRun bool
+		if err := json.Unmarshal(raw, &dryRun); err != nil {
+			return errors.New("dry_run must be a boolean")
+		}
+		delete(fields, "dry_run")
+	}
+	for _, name := range requiredFields(v) {
+		if _, ok := fields[name]; !ok {
+			return fmt.Errorf("missing field %q", name)
+		}
+	}
+
+	// re-encoding drops dry_run, which no payload struct declares
+	stripped, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return decodeStrict(stripped, v)
+}
+
+// decodeStrict decodes exactly one JSON value into v, rejecting unknown
+// fields and trailing data.
+func decodeStrict(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return payloadError(err)
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return errors.New("trailing data after the payload")
+	}
+	return nil
+}
+
+// payloadError rewords the decoding errors of encoding/json, which name Go
+// types and struct fields, in terms of the payload.
+func payloadError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		if typeErr.Field == "" {
+			return errors.New("payload must be a JSON object")
+		}
+		kind := jsonKind(typeErr.Type)
+		if value, ok := strings.CutPrefix(typeErr.Value, "number "); ok && kind == "number" {
+			if strings.ContainsAny(value, ".eE") {
+				return fmt.Errorf("%s %s is not an integer", typeErr.Field, value)
+			}
+			return fmt.Errorf("%s %s out of range", typeErr.Field, value)
+		}
+		return fmt.Errorf("%s must be a %s", typeErr.Field, kind)
+	}
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return fmt.Errorf("unknown field %s", field)
+	}
+	return err
+}
+
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	}
+	return "object"
+}
+
+// requiredFields returns the JSON names of the fields of the struct v
+// points to tagged payload:"required", including the fields of embedded
+// structs, which encoding/json decodes as fields of v.
+func requiredFields(v any) []string {
+	t := reflect.TypeOf(v)
+	if t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	return structRequiredFields(t.Elem())
+}
+
+func structRequiredFields(t reflect.Type) []string {
+	var names []string
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				names = append(names, structRequiredFields(ft)...)
+				continue
+			}
+		}
+		if f.Tag.Get("payload") != "required" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,170 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+)
+
+// FuzzDecodeCommand decodes arbitrary payloads of loco.drive, whose address
+// is an integer and whose speed and forward fields are required.
+func FuzzDecodeCommand(f *testing.F) {
+	for _, seed := range []string{
+		``,
+		` `,
+		`{}`,
+		`null`,
+		`[]`,
+		`"speed"`,
+		`{"address": 3, "speed": 40, "forward": true}`,
+		`{"name": "br218", "speed": 0, "forward": false, "dry_run": true}`,
+		`{"address": 3, "speed": 40, "forward": true, "dry_run": "yes"}`,
+		`{"address": 3, "speed": 40, "forward": true}{}`,
+		`{"address": 3, "speed": 40, "forward": true} x`,
+		`{"address": 3, "speed": 40, "forward": true, "direction": "forward"}`,
+		`{"address": 65536, "speed": 40, "forward": true}`,
+		`{"address": -1, "speed": 40, "forward": true}`,
+		`{"address": 1.5, "speed": 40, "forward": true}`,
+		`{"address": "3", "speed": 40, "forward": true}`,
+		`{"address": 3, "forward": true}`,
+		`{"address": 3, "speed": 40}`,
+		`{"Address": 3, "SPEED": 40, "forward": true}`,
+		`{"address": 3, "speed": 40, "forward": true, "name": "` + strings.Repeat("x", MaxPayloadSize) + `"}`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var req DriveRequest
+		err := decodeCommand(data, &req)
+		if len(data) > MaxPayloadSize {
+			if err == nil {
+				t.Fatalf("accepted a payload of %d bytes", len(data))
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			if req != (DriveRequest{}) {
+				t.Fatalf("empty payload decoded to %+v", req)
+			}
+			return
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(data))
+		var fields map[string]json.RawMessage
+		if err := dec.Decode(&fields); err != nil || fields == nil {
+			t.Fatalf("accepted %q, which is not a JSON object", data)
+		}
+		if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+			t.Fatalf("accepted trailing data in %q", data)
+		}
+
+		// encoding/json matches field names case insensitively
+		var addresses []json.RawMessage
+		for name, raw := range fields {
+			switch {
+			case strings.EqualFold(name, "address"):
+				addresses = append(addresses, raw)
+			case strings.EqualFold(name, "name"), strings.EqualFold(name, "speed"), strings.EqualFold(name, "forward"):
+			case name == "dry_run":
+				if string(raw) != "true" && string(raw) != "false" {
+					t.Fatalf("accepted dry_run %s", raw)
+				}
+			default:
+				t.Fatalf("accepted unknown field %q", name)
+			}
+		}
+		for _, name := range []string{"speed", "forward"} {
+			if _, ok := fields[name]; !ok {
+				t.Fatalf("accepted %q without the required field %s", data, name)
+			}
+		}
+		if len(addresses) == 1 && string(addresses[0]) != "null" {
+			addr, err := strconv.ParseUint(string(addresses[0]), 10, 16)
+			if err != nil {
+				t.Fatalf("accepted address %s: %v", addresses[0], err)
+			}
+			if uint16(addr) != req.Address {
+				t.Fatalf("address %s decoded to %d", addresses[0], req.Address)
+			}
+		}
+	})
+}
+
+func TestRequiredFieldsOfEmbeddedStructs(t *testing.T) {
+	for _, tt := range []struct {
+		payload any
+		want    []string
+	}{
+		{&AccessoryCVRequest{}, []string{"cv"}},
+		{&AccessoryCVWriteRequest{}, []string{"cv", "value"}},
+		{&TurnoutModeSetRequest{}, []string{"mode"}},
+		{&DriveRequest{}, []string{"speed", "forward"}},
+		{&SignalRequest{}, []string{"name", "aspect"}},
+	} {
+		if got := requiredFields(tt.payload); !slices.Equal(got, tt.want) {
+			t.Errorf("requiredFields(%T) = %v, want %v", tt.payload, got, tt.want)
+		}
+	}
+
+	var req AccessoryCVWriteRequest
+	if err := decodeCommand([]byte(`{"address": 12, "value": 3}`), &req); err == nil || err.Error() != `missing field "cv"` {
+		t.Errorf("accessory.cv.write without cv: %v, want the missing field", err)
+	}
+}
+
+// TestRunCommandRecoversPanics runs every command on a gateway without any
+// of its state, so that handlers touching it panic, and checks that
+// runCommand turns the panics into internal errors.
+func TestRunCommandRecoversPanics(t *testing.T) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	recovered := 0
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			g := &Gateway{logger: zerolog.Nop()}
+			cr := &cmdRequest{
+				name:   name,
+				msg:    &nats.Msg{Subject: "z21.test.cmd." + name, Data: []byte(`{}`)},
+				logger: zerolog.Nop(),
+				timing: &cmdTiming{},
+			}
+			var reply CmdReply
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("panic escaped runCommand: %v", r)
+					}
+				}()
+				reply = g.runCommand(cr, commands[name])
+			}()
+			if reply.TS == "" {
+				t.Errorf("reply %+v without a timestamp", reply)
+			}
+			if reply.Error == "internal error" {
+				if reply.Ok || reply.ErrorCode != ErrCodeInternal {
+					t.Errorf("recovered panic replied %+v, want an %s error", reply, ErrCodeInternal)
+				}
+				recovered++
+			}
+		})
+	}
+	if recovered == 0 {
+		t.Error("no command panicked, the recovery was not exercised")
+	}
+}
@@ -0,0 +1,343 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// PcapDuration is how long a capture runs unless the request gives a
+	// duration; captures run at most PcapMaxDuration.
+	PcapDuration    = 5 * time.Minute
+	PcapMaxDuration = time.Hour
+	// PcapMaxSize bounds the size of a capture file, the capture stops when
+	// it is reached.
+	PcapMaxSize = 64 << 20
+
+	pcapSnapLen = 65535
+	// linkTypeRaw is the pcap link type of packets starting with the IP
+	// header.
+	linkTypeRaw = 101
+)
+
+var (
+	errPcapRunning     = errors.New("a capture is already running")
+	errNoPcap          = errors.New("no capture is running")
+	errPcapDuration    = errors.New("invalid duration")
+	errPcapStopped     = errors.New("capture stopped")
+	errPcapSizeLimit   = errors.New("capture reached its maximum size")
+	errPcapUnresolved  = errors.New("the z21 address does not resolve to an IP address")
+	errPcapUnsupported = errors.New("pcap capture is only supported on Linux")
+)
+
+// packetSource reads the IP packets of all interfaces. read returns zero
+// bytes when it timed out without a packet, so that the capture can stop.
+type packetSource interface {
+	read(buf []byte) (int, error)
+	close() error
+}
+
+// PcapCapture describes a capture of the Z21 UDP traffic.
+type PcapCapture struct {
+	File    string `json:"file"`
+	Started string `json:"started"`
+	Until   string `json:"until"`
+	Packets int    `json:"packets"`
+	Bytes   int64  `json:"bytes"`
+	// Reason tells why a finished capture stopped.
+	Reason string `json:"reason,omitempty"`
+}
+
+type pcapCapture struct {
+	mu       sync.Mutex
+	info     PcapCapture
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	z21      netip.AddrPort
+	src      packetSource
+	f        *os.File
+	writer   *pcapWriter
+}
+
+type pcapRequest struct {
+	Duration string `json:"duration,omitempty"`
+}
+
+// pcapWriter writes packets in the classic pcap format.
+type pcapWriter struct {
+	w    io.Writer
+	size int64
+}
+
+func newPcapWriter(w io.Writer) (*pcapWriter, error) {
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], linkTypeRaw)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &pcapWriter{w: w, size: int64(len(hdr))}, nil
+}
+
+func (p *pcapWriter) write(ts time.Time, packet []byte) error {
+	var hdr [16]byte
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(len(packet)))
+	if _, err := p.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := p.w.Write(packet); err != nil {
+		return err
+	}
+	p.size += int64(len(hdr) + len(packet))
+	return nil
+}
+
+// z21Packet reports whether an IP packet is a UDP datagram from or to the
+// Z21.
+func z21Packet(packet []byte, z21 netip.AddrPort) bool {
+	var src, dst netip.Addr
+	var udp []byte
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		ihl := int(packet[0]&0x0f) * 4
+		if packet[9] != 17 || ihl < 20 || len(packet) < ihl+8 {
+			return false
+		}
+		src = netip.AddrFrom4([4]byte(packet[12:16]))
+		dst = netip.AddrFrom4([4]byte(packet[16:20]))
+		udp = packet[ihl:]
+	case len(packet) >= 48 && packet[0]>>4 == 6:
+		// extension headers are not followed, the Z21 sends none
+		if packet[6] != 17 {
+			return false
+		}
+		src = netip.AddrFrom16([16]byte(packet[8:24]))
+		dst = netip.AddrFrom16([16]byte(packet[24:40]))
+		udp = packet[40:]
+	default:
+		return false
+	}
+	srcPort := binary.BigEndian.Uint16(udp[0:])
+	dstPort := binary.BigEndian.Uint16(udp[2:])
+	addr, port := z21.Addr().Unmap(), z21.Port()
+	return (src.Unmap() == addr && srcPort == port) || (dst.Unmap() == addr && dstPort == port)
+}
+
+// resolveZ21 returns the IP address and port the Z21 is reached at.
+func resolveZ21(addr string) (netip.AddrPort, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	ap := udpAddr.AddrPort()
+	if !ap.Addr().IsValid() {
+		return netip.AddrPort{}, errPcapUnresolved
+	}
+	return ap, nil
+}
+
+// startPcap starts capturing the Z21 UDP traffic into a file in the
+// capture directory.
+func (g *Gateway) startPcap(duration time.Duration) (PcapCapture, error) {
+	g.pcapMu.Lock()
+	defer g.pcapMu.Unlock()
+	if g.pcap != nil {
+		return PcapCapture{}, errPcapRunning
+	}
+
+	z21, err := resolveZ21(g.failover.addr())
+	if err != nil {
+		return PcapCapture{}, err
+	}
+	src, err := openPacketSource()
+	if err != nil {
+		return PcapCapture{}, err
+	}
+	now := time.Now()
+	name := filepath.Join(g.pcapDir, fmt.Sprintf("z21-%s-%s.pcap", g.name, now.UTC().Format("20060102T150405Z")))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		src.close()
+		return PcapCapture{}, err
+	}
+	w, err := newPcapWriter(f)
+	if err != nil {
+		src.close()
+		f.Close()
+		return PcapCapture{}, err
+	}
+
+	c := &pcapCapture{
+		info: PcapCapture{
+			File:    name,
+			Started: now.UTC().Format(time.RFC3339),
+			Until:   now.Add(duration).UTC().Format(time.RFC3339),
+		},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		z21:    z21,
+		src:    src,
+		f:      f,
+		writer: w,
+	}
+	g.pcap = c
+	g.wg.Add(1)
+	go g.pcapLoop(c, duration)
+	g.logger.Info().
+		Str("file", name).
+		Str("z21", z21.String()).
+		Dur("duration", duration).
+		Msg("pcap capture started")
+	return c.snapshot(), nil
+}
+
+// stopPcap stops the running capture and returns it once its file is
+// closed.
+func (g *Gateway) stopPcap() (PcapCapture, error) {
+	g.pcapMu.Lock()
+	c := g.pcap
+	g.pcapMu.Unlock()
+	if c == nil {
+		return PcapCapture{}, errNoPcap
+	}
+	c.stopOnce.Do(func() { close(c.stop) })
+	<-c.done
+	return c.snapshot(), nil
+}
+
+func (c *pcapCapture) snapshot() PcapCapture {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info
+}
+
+// pcapLoop writes the Z21 packets until the capture is stopped, its
+// duration passed, the file is full or the gateway stops.
+func (g *Gateway) pcapLoop(c *pcapCapture, duration time.Duration) {
+	defer g.wg.Done()
+	reason := c.run(g.ctx.Done(), duration)
+
+	c.src.close()
+	if err := c.f.Close(); err != nil && reason == errPcapStopped {
+		reason = err
+	}
+	c.mu.Lock()
+	c.info.Reason = reason.Error()
+	info := c.info
+	c.mu.Unlock()
+
+	g.pcapMu.Lock()
+	g.pcap = nil
+	g.pcapMu.Unlock()
+	close(c.done)
+
+	g.logger.Info().
+		Str("file", info.File).
+		Int("packets", info.Packets).
+		Int64("bytes", info.Bytes).
+		Str("reason", info.Reason).
+		Msg("pcap capture stopped")
+}
+
+// run writes packets until the capture ends and returns why it ended.
+func (c *pcapCapture) run(done <-chan struct{}, duration time.Duration) error {
+	deadline := time.Now().Add(duration)
+	buf := make([]byte, pcapSnapLen)
+	for {
+		select {
+		case <-done:
+			return errPcapStopped
+		case <-c.stop:
+			return errPcapStopped
+		default:
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("capture ran for %s", duration)
+		}
+		n, err := c.src.read(buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 || !z21Packet(buf[:n], c.z21) {
+			continue
+		}
+		if err := c.writer.write(time.Now(), buf[:n]); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.info.Packets++
+		c.info.Bytes = c.writer.size
+		c.mu.Unlock()
+		if c.writer.size >= PcapMaxSize {
+			return errPcapSizeLimit
+		}
+	}
+}
+
+func (g *Gateway) handlePcapStart(cr *cmdRequest, req *pcapRequest) CmdReply {
+	duration := PcapDuration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 || d > PcapMaxDuration {
+			return g.handleValidationError(cr, fmt.Errorf("%w %q, at most %s", errPcapDuration, req.Duration, PcapMaxDuration))
+		}
+		duration = d
+	}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, TS: time.Now().Format(time.RFC3339)}
+	}
+	capture, err := g.startPcap(duration)
+	if err != nil {
+		return g.handlePcapError(cr, err)
+	}
+	return CmdReply{Ok: true, Data: capture, TS: time.Now().Format(time.RFC3339)}
+}
+
+func (g *Gateway) handlePcapStop(cr *cmdRequest, req *struct{}) CmdReply {
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, TS: time.Now().Format(time.RFC3339)}
+	}
+	capture, err := g.stopPcap()
+	if err != nil {
+		return g.handlePcapError(cr, err)
+	}
+	return CmdReply{Ok: true, Data: capture, TS: time.Now().Format(time.RFC3339)}
+}
+
+func (g *Gateway) handlePcapError(cr *cmdRequest, err error) CmdReply {
+	code := ErrCodeInternal
+	switch {
+	case errors.Is(err, errPcapRunning):
+		code = ErrCodeBusy
+	case errors.Is(err, errNoPcap):
+		code = ErrCodeInvalidRequest
+	case errors.Is(err, errPcapUnsupported):
+		code = ErrCodeUnsupported
+	case errors.Is(err, os.ErrPermission):
+		err = fmt.Errorf("%w: capturing needs CAP_NET_RAW", err)
+	}
+	cr.logger.Error().
+		Err(err).
+		Msg("pcap capture")
+	return CmdReply{
+		Ok:        false,
+		Error:     err.Error(),
+		ErrorCode: code,
+		TS:        time.Now().Format(time.RFC3339),
+	}
+}
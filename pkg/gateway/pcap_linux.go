@@ -0,0 +1,66 @@
+package gateway
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// pcapReadTimeout bounds how long a read blocks, so a stopped capture
+// ends while the layout is quiet.
+const pcapReadTimeout = 200 * time.Millisecond
+
+// packetSocket is an AF_PACKET socket of all interfaces. SOCK_DGRAM strips
+// the link layer header, so packets start with the IP header whatever the
+// interface.
+type packetSocket struct {
+	fd       int
+	loopback map[int]bool
+}
+
+func openPacketSource() (packetSource, error) {
+	proto := int(htons(syscall.ETH_P_ALL))
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, err
+	}
+	tv := syscall.NsecToTimeval(int64(pcapReadTimeout))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	s := &packetSocket{fd: fd, loopback: make(map[int]bool)}
+	if ifaces, err := net.Interfaces(); err == nil {
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagLoopback != 0 {
+				s.loopback[iface.Index] = true
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *packetSocket) read(buf []byte) (int, error) {
+	n, from, err := syscall.Recvfrom(s.fd, buf, 0)
+	switch {
+	case errors.Is(err, syscall.EAGAIN), errors.Is(err, syscall.EINTR):
+		return 0, nil
+	case err != nil:
+		return 0, err
+	}
+	// a packet over the loopback interface is seen going out and coming in
+	if ll, ok := from.(*syscall.SockaddrLinklayer); ok &&
+		ll.Pkttype == syscall.PACKET_OUTGOING && s.loopback[ll.Ifindex] {
+		return 0, nil
+	}
+	return n, nil
+}
+
+func (s *packetSocket) close() error {
+	return syscall.Close(s.fd)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
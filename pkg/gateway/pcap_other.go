@@ -0,0 +1,7 @@
+//go:build !linux
+
+package gateway
+
+func openPacketSource() (packetSource, error) {
+	return nil, errPcapUnsupported
+}
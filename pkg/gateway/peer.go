@@ -0,0 +1,175 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	Z21Port = "21105"
+)
+
+// normalizeZ21Addr returns addr as host:port, adding the default port. IPv6
+// addresses may be given with or without brackets, link-local ones need a
+// zone, e.g. fe80::1%eth0.
+func normalizeZ21Addr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), Z21Port
+	}
+	if host == "" {
+		return "", fmt.Errorf("invalid z21 address %q", addr)
+	}
+	ip, zone, _ := strings.Cut(host, "%")
+	if parsed := net.ParseIP(ip); parsed != nil {
+		if parsed.To4() == nil && parsed.IsLinkLocalUnicast() && zone == "" {
+			return "", fmt.Errorf("link-local z21 address %s needs a zone, e.g. %s%%eth0", ip, ip)
+		}
+	} else if zone != "" || strings.Contains(host, ":") {
+		return "", fmt.Errorf("invalid z21 address %q", addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// validateZ21Addr rejects addresses that could be answered by more than one
+// central: broadcast and multicast addresses, including the broadcast
+// address of a local subnet. Host names are checked once resolved.
+func validateZ21Addr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip, _, _ := strings.Cut(host, "%")
+	ips := []net.IP{net.ParseIP(ip)}
+	if ips[0] == nil {
+		// unresolvable names fail on connect with a better error
+		if ips, err = net.LookupIP(host); err != nil {
+			return nil
+		}
+	}
+	for _, ip := range ips {
+		if ip.IsUnspecified() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) || isLocalBroadcast(ip) {
+			return fmt.Errorf("z21 address %s must be the unicast address of a single z21", addr)
+		}
+	}
+	return nil
+}
+
+// isLocalBroadcast reports whether ip is the broadcast address of a subnet
+// of a local interface.
+func isLocalBroadcast(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil || len(ipNet.Mask) != net.IPv4len {
+			continue
+		}
+		bcast := make(net.IP, net.IPv4len)
+		for i := range bcast {
+			bcast[i] = ipNet.IP.To4()[i] | ^ipNet.Mask[i]
+		}
+		// /31 and /32 have no broadcast address
+		if ones, _ := ipNet.Mask.Size(); ones < 31 && bcast.Equal(ip4) {
+			return true
+		}
+	}
+	return false
+}
+
+// bindAddr returns the local address of the sockets talking to the Z21 at
+// z21Addr for --bind, nil without it. bind is an IP address or the name of
+// an interface, whose first address of the family of the Z21 is used; the
+// zone of link-local addresses is the interface.
+func bindAddr(bind, z21Addr string) (*net.UDPAddr, error) {
+	if bind == "" {
+		return nil, nil
+	}
+	host, _, err := net.SplitHostPort(z21Addr)
+	if err != nil {
+		host = z21Addr
+	}
+	ip, _, _ := strings.Cut(host, "%")
+	z21IP := net.ParseIP(ip)
+	if z21IP == nil {
+		// names resolve to IPv4 for the relay unless they only have IPv6
+		z21IP = net.IPv4zero
+		if ips, err := net.LookupIP(host); err == nil && len(ips) > 0 {
+			z21IP = ips[0]
+		}
+	}
+	want4 := z21IP.To4() != nil
+
+	addr, zone, _ := strings.Cut(bind, "%")
+	if local := net.ParseIP(addr); local != nil {
+		if (local.To4() != nil) != want4 {
+			return nil, fmt.Errorf("--bind %s is not of the address family of z21 %s", bind, z21Addr)
+		}
+		return &net.UDPAddr{IP: local, Zone: zone}, nil
+	}
+	ifi, err := net.InterfaceByName(bind)
+	if err != nil {
+		return nil, fmt.Errorf("--bind %s is neither an IP address nor an interface", bind)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() != nil) != want4 {
+			continue
+		}
+		local := &net.UDPAddr{IP: ipNet.IP}
+		if ipNet.IP.IsLinkLocalUnicast() {
+			local.Zone = ifi.Name
+		}
+		return local, nil
+	}
+	return nil, fmt.Errorf("interface %s has no address of the family of z21 %s", bind, z21Addr)
+}
+
+// dialZ21 returns a UDP socket connected to the active Z21 and bound to
+// --bind. Connected sockets only receive the datagrams of the Z21.
+func (g *Gateway) dialZ21() (net.Conn, error) {
+	addr := g.failover.addr()
+	laddr, err := bindAddr(g.bind, addr)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{}
+	if laddr != nil {
+		d.LocalAddr = laddr
+	}
+	return d.Dial("udp", addr)
+}
+
+// checkSerial guards against a second central answering in place of the
+// configured one. With --z21_serial, or --z21_backup_serial while the backup
+// is active, answers of another serial number do not count as reachable;
+// without it, a changing serial number is warned about.
+func (g *Gateway) checkSerial(serial uint32) bool {
+	if expected := g.failover.serial(); expected != 0 && serial != expected {
+		if !g.serialMismatch {
+			g.publishWarning("z21_serial_mismatch", "a z21 of another serial number answers on the z21 address",
+				map[string]any{"expected": expected, "serial": serial})
+			g.serialMismatch = true
+		}
+		return false
+	}
+	g.serialMismatch = false
+
+	if g.lastSerial != 0 && serial != g.lastSerial {
+		g.publishWarning("z21_serial_changed", "the serial number of the z21 changed, the z21 was replaced or another central answers",
+			map[string]any{"previous": g.lastSerial, "serial": serial})
+	}
+	g.lastSerial = serial
+	return true
+}
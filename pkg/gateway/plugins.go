@@ -0,0 +1,329 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// PluginTimeout bounds a plugin command call.
+	PluginTimeout = 5 * time.Second
+	// PluginEventTimeout bounds a plugin event transform, which delays the
+	// event.
+	PluginEventTimeout = 200 * time.Millisecond
+	pluginStartTimeout = 5 * time.Second
+	pluginMaxLine      = 1 << 20
+)
+
+// PluginConfig starts an external plugin process.
+type PluginConfig struct {
+	Command []string          `yaml:"command"`
+	Env     map[string]string `yaml:"env"`
+}
+
+// PluginMsg is a line of the plugin stdio protocol, one JSON object per line
+// in both directions.
+//
+// The plugin starts with a register message naming its commands and the
+// event kinds it transforms. The gateway sends command and event messages;
+// the plugin answers each with a reply or event message of the same id.
+type PluginMsg struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+
+	// register
+	Commands []string `json:"commands,omitempty"`
+	Events   []string `json:"events,omitempty"`
+
+	// command
+	Command  string `json:"command,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+
+	// command, event
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// event
+	Kind    string `json:"kind,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	Drop    bool   `json:"drop,omitempty"`
+
+	// reply
+	Ok        bool            `json:"ok,omitempty"`
+	Reply     json.RawMessage `json:"reply,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	ErrorCode ErrorCode       `json:"error_code,omitempty"`
+}
+
+type plugin struct {
+	g      *Gateway
+	name   string
+	events map[string]bool
+
+	encMu sync.Mutex
+	stdin *os.File
+	enc   *json.Encoder
+
+	nextID  atomic.Uint64
+	mu      sync.Mutex
+	pending map[string]chan *PluginMsg
+	exited  bool
+}
+
+// startPlugins starts the configured plugins and registers their commands
+// and event transforms.
+func (g *Gateway) startPlugins(configs map[string]PluginConfig) error {
+	for _, name := range sortedKeys(configs) {
+		p, names, err := g.startPlugin(name, configs[name])
+		if err != nil {
+			return fmt.Errorf("plugin %s: %w", name, err)
+		}
+		for _, cmd := range names {
+			if _, ok := commands[cmd]; ok {
+				return fmt.Errorf("plugin %s: command %s is already registered", name, cmd)
+			}
+			if other, ok := g.pluginCommands[cmd]; ok {
+				return fmt.Errorf("plugin %s: command %s is already registered by %s", name, cmd, other.name)
+			}
+			g.pluginCommands[cmd] = p
+		}
+		if len(p.events) > 0 {
+			g.transforms = append(g.transforms, p)
+		}
+		g.logger.Info().
+			Str("plugin", name).
+			Strs("commands", names).
+			Msg("plugin started")
+	}
+	return nil
+}
+
+func (g *Gateway) startPlugin(name string, cfg PluginConfig) (*plugin, []string, error) {
+	if len(cfg.Command) == 0 {
+		return nil, nil, fmt.Errorf("no command")
+	}
+	cmd := exec.CommandContext(g.ctx, cfg.Command[0], cfg.Command[1:]...)
+	cmd.Env = os.Environ()
+	for k, v := range cfg.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	// a pipe of its own rather than cmd.StdinPipe, whose writer does not
+	// expose the write deadline that bounds a call to a stuck plugin
+	stdinR, stdin, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd.Stdin = stdinR
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		stdinR.Close()
+		stdin.Close()
+		return nil, nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		stdinR.Close()
+		stdin.Close()
+		return nil, nil, err
+	}
+	err = cmd.Start()
+	stdinR.Close()
+	if err != nil {
+		stdin.Close()
+		return nil, nil, err
+	}
+
+	p := &plugin{
+		g:       g,
+		name:    name,
+		events:  make(map[string]bool),
+		stdin:   stdin,
+		enc:     json.NewEncoder(stdin),
+		pending: make(map[string]chan *PluginMsg),
+	}
+	registered := make(chan *PluginMsg, 1)
+
+	g.wg.Add(2)
+	go func() {
+		defer g.wg.Done()
+		p.logStderr(stderr)
+	}()
+	go func() {
+		defer g.wg.Done()
+		p.readLoop(stdout, registered)
+		err := cmd.Wait()
+		stdin.Close()
+		if g.ctx.Err() == nil {
+			g.logger.Error().
+				Err(err).
+				Str("plugin", name).
+				Msg("plugin exited")
+		}
+	}()
+
+	select {
+	case reg := <-registered:
+		for _, kind := range reg.Events {
+			p.events[kind] = true
+		}
+		return p, reg.Commands, nil
+	case <-time.After(pluginStartTimeout):
+		_ = cmd.Process.Kill()
+		return nil, nil, fmt.Errorf("no register message within %s", pluginStartTimeout)
+	}
+}
+
+func (p *plugin) readLoop(r io.Reader, registered chan<- *PluginMsg) {
+	defer func() {
+		p.mu.Lock()
+		p.exited = true
+		for id, ch := range p.pending {
+			close(ch)
+			delete(p.pending, id)
+		}
+		p.mu.Unlock()
+	}()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), pluginMaxLine)
+	for scanner.Scan() {
+		msg := &PluginMsg{}
+		if err := json.Unmarshal(scanner.Bytes(), msg); err != nil {
+			p.g.logger.Warn().
+				Err(err).
+				Str("plugin", p.name).
+				Msg("invalid plugin message")
+			continue
+		}
+		if msg.Type == "register" {
+			select {
+			case registered <- msg:
+			default:
+			}
+			continue
+		}
+		p.mu.Lock()
+		ch, ok := p.pending[msg.ID]
+		delete(p.pending, msg.ID)
+		p.mu.Unlock()
+		if ok {
+			ch <- msg
+		}
+	}
+}
+
+func (p *plugin) logStderr(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		p.g.logger.Info().
+			Str("plugin", p.name).
+			Msg(scanner.Text())
+	}
+}
+
+// call sends msg to the plugin and waits for its answer, both within
+// timeout.
+func (p *plugin) call(msg *PluginMsg, timeout time.Duration) (*PluginMsg, error) {
+	deadline := time.Now().Add(timeout)
+	msg.ID = strconv.FormatUint(p.nextID.Add(1), 10)
+	ch := make(chan *PluginMsg, 1)
+	p.mu.Lock()
+	if p.exited {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("plugin %s exited", p.name)
+	}
+	p.pending[msg.ID] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, msg.ID)
+		p.mu.Unlock()
+	}()
+
+	p.encMu.Lock()
+	err := p.stdin.SetWriteDeadline(deadline)
+	if err == nil {
+		err = p.enc.Encode(msg)
+	}
+	if err != nil {
+		// a message cut off by the deadline leaves the protocol out of
+		// step, so the plugin gets no further messages and sees EOF
+		p.stdin.Close()
+	}
+	p.encMu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", p.name, err)
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("plugin %s exited", p.name)
+		}
+		return resp, nil
+	case <-time.After(time.Until(deadline)):
+		return nil, fmt.Errorf("plugin %s did not answer within %s", p.name, timeout)
+	}
+}
+
+func (p *plugin) handleCommand(cr *cmdRequest) CmdReply {
+	resp, err := p.call(&PluginMsg{
+		Type:     "command",
+		Command:  cr.name,
+		ClientID: cr.msg.Header.Get(ClientIDHeader),
+		Payload:  rawPayload(cr.msg.Data),
+	}, PluginTimeout)
+	if err != nil {
+		return CmdReply{Ok: false, Error: err.Error(), ErrorCode: ErrCodeInternal, TS: time.Now().Format(time.RFC3339)}
+	}
+	reply := CmdReply{Ok: resp.Ok, Error: resp.Error, ErrorCode: resp.ErrorCode, TS: time.Now().Format(time.RFC3339)}
+	if len(resp.Reply) > 0 {
+		reply.Data = resp.Reply
+	}
+	if !reply.Ok && reply.ErrorCode == "" {
+		reply.ErrorCode = ErrCodeInternal
+	}
+	return reply
+}
+
+func (p *plugin) transformEvent(ev *TransformedEvent) (bool, error) {
+	if !p.events[ev.Kind] {
+		return true, nil
+	}
+	resp, err := p.call(&PluginMsg{
+		Type:    "event",
+		Kind:    ev.Kind,
+		Subject: ev.Subject,
+		Payload: ev.Payload,
+	}, PluginEventTimeout)
+	if err != nil {
+		return true, err
+	}
+	if resp.Drop {
+		return false, nil
+	}
+	if resp.Subject != "" {
+		ev.Subject = resp.Subject
+	}
+	if len(resp.Payload) > 0 {
+		ev.Payload = resp.Payload
+	}
+	return true, nil
+}
+
+// rawPayload passes JSON command payloads on as is and others as JSON
+// strings. An empty payload is omitted.
+func rawPayload(data []byte) json.RawMessage {
+	if len(data) == 0 || json.Valid(data) {
+		return data
+	}
+	s, _ := json.Marshal(string(data))
+	return s
+}
@@ -0,0 +1,35 @@
+package gateway
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPluginCallStuckStdin calls a plugin that registers and then never
+// reads its stdin, so that the write of a large event fills the pipe.
+func TestPluginCallStuckStdin(t *testing.T) {
+	g := newTestGateway(t)
+	p, _, err := g.startPlugin("stuck", PluginConfig{
+		Command: []string{"sh", "-c", `echo '{"type": "register", "events": ["can"]}'; exec sleep 60`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := &TransformedEvent{
+		Kind:    "can",
+		Subject: "z21.bench.event.can.1.1",
+		Payload: []byte(`"` + strings.Repeat("x", 1<<20) + `"`),
+	}
+
+	start := time.Now()
+	if _, err := p.transformEvent(ev); err == nil {
+		t.Fatal("transform through a plugin not reading its stdin succeeded")
+	}
+	if took := time.Since(start); took > 2*PluginEventTimeout {
+		t.Errorf("transform failed after %s, want about %s", took, PluginEventTimeout)
+	}
+	if _, err := p.transformEvent(ev); err == nil {
+		t.Error("transform succeeded after the plugin was cut off")
+	}
+}
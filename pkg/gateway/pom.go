@@ -0,0 +1,84 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+// POMReadTimeout bounds cv.pom.read. The decoder answers a POM read by
+// RailCom right away, so it is answered well before a programming track
+// read and within the command timeout of clients.
+const POMReadTimeout = 2 * time.Second
+
+// POMReadRequest is the payload of cv.pom.read.
+type POMReadRequest struct {
+	Address uint16 `json:"address"`
+	// Name is resolved to Address through the configured loco names.
+	Name string `json:"name,omitempty"`
+	CV   uint16 `json:"cv" payload:"required"`
+}
+
+// POMReadResult is the reply to cv.pom.read.
+type POMReadResult struct {
+	Address uint16 `json:"address"`
+	CV      uint16 `json:"cv"`
+	Value   uint8  `json:"value"`
+}
+
+// handlePOMRead reads a CV of a loco on the main track with
+// LAN_X_CV_POM_READ_BYTE. The value comes back by RailCom, so both the Z21
+// and the decoder need it.
+func (g *Gateway) handlePOMRead(cr *cmdRequest, req *POMReadRequest) CmdReply {
+	addr, err := g.names.resolveLoco(req.Name, req.Address)
+	if err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	req.Address = addr
+	if req.Address == 0 || req.Address > MaxLocoAddress {
+		return g.handleValidationError(cr, fmt.Errorf("address must be between 1 and %d", MaxLocoAddress))
+	}
+	if req.CV == 0 || req.CV > MaxCV {
+		return g.handleValidationError(cr, fmt.Errorf("cv must be between 1 and %d", MaxCV))
+	}
+	if !g.hasFeature("railcom") || !g.hasFeature("pom_read") {
+		return CmdReply{
+			Ok:        false,
+			Error:     fmt.Sprintf("%s requires RailCom, which the firmware of this z21 does not support", cr.name),
+			ErrorCode: ErrCodeUnsupportedByDevice,
+			TS:        time.Now().Format(time.RFC3339),
+		}
+	}
+	pom := &z21.CVPOMRead{Address: req.Address, CV: req.CV}
+	if cr.dryRun {
+		return g.handleDryRun(cr, pom)
+	}
+	if !g.isOnline.Load() {
+		return CmdReply{Ok: false, Error: "z21 is offline", ErrorCode: ErrCodeZ21Offline, TS: time.Now().Format(time.RFC3339)}
+	}
+
+	ctx, cancel := context.WithTimeout(g.ctx, POMReadTimeout)
+	defer cancel()
+	sent := time.Now()
+	value, err := g.cvRequest(ctx, pom, 0)
+	cr.timing.z21 += time.Since(sent)
+	if err != nil {
+		code := g.errorCode(err)
+		msg := err.Error()
+		// the Z21 answers LAN_X_CV_NACK, or nothing, when no RailCom answer
+		// came back from the decoder
+		if code == ErrCodeTimeout || code == ErrCodeInternal {
+			code = ErrCodeRailComRequired
+			msg = fmt.Sprintf("no RailCom answer from loco %d, %s requires a decoder with RailCom enabled", req.Address, cr.name)
+		}
+		cr.logger.Warn().
+			Err(err).
+			Uint16("address", req.Address).
+			Uint16("cv", req.CV).
+			Msg("POM read failed")
+		return CmdReply{Ok: false, Error: msg, ErrorCode: code, TS: time.Now().Format(time.RFC3339)}
+	}
+	return CmdReply{Ok: true, Data: &POMReadResult{Address: req.Address, CV: req.CV, Value: value}, TS: time.Now().Format(time.RFC3339)}
+}
@@ -0,0 +1,189 @@
+package gateway
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// CommandQueue is the number of commands per class waiting for a
+	// worker before further ones are rejected as busy.
+	CommandQueue = 64
+)
+
+// Command classes, each executed from its own pool of command slots so
+// that slow commands of one class cannot starve the others.
+const (
+	ClassDrive     = "drive"
+	ClassAccessory = "accessory"
+	ClassProg      = "prog"
+	ClassOther     = "other"
+)
+
+// DefaultCommandPools runs drive commands in parallel for throttle
+// responsiveness, switches accessories one after the other so that their
+// pulses do not overlap and serializes programming.
+var DefaultCommandPools = map[string]int{
+	ClassDrive:     8,
+	ClassAccessory: 1,
+	ClassProg:      1,
+	ClassOther:     MaxConcurrentCommands,
+}
+
+// commandClasses maps the first token of a command name to its class.
+var commandClasses = map[string]string{
+	"loco":      ClassDrive,
+	"turnout":   ClassAccessory,
+	"signal":    ClassAccessory,
+	"accessory": ClassAccessory,
+	"prog":      ClassProg,
+	"cv":        ClassProg,
+}
+
+func commandClass(name string) string {
+	prefix, _, _ := strings.Cut(name, ".")
+	if class, ok := commandClasses[prefix]; ok {
+		return class
+	}
+	return ClassOther
+}
+
+// parseCommandPools parses a comma separated list of <class>=<size>
+// overriding the default pool sizes, e.g. "drive=16,prog=1".
+func parseCommandPools(s string) (map[string]int, error) {
+	pools := make(map[string]int, len(DefaultCommandPools))
+	for class, size := range DefaultCommandPools {
+		pools[class] = size
+	}
+	if s == "" {
+		return pools, nil
+	}
+	for entry := range strings.SplitSeq(s, ",") {
+		class, size, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if _, known := pools[class]; !ok || !known {
+			return nil, fmt.Errorf("invalid command pool %q, classes are %v", entry, sortedKeys(DefaultCommandPools))
+		}
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid command pool size %q", size)
+		}
+		pools[class] = n
+	}
+	return pools, nil
+}
+
+func newCommandPools(sizes map[string]int) map[string]chan struct{} {
+	pools := make(map[string]chan struct{}, len(sizes))
+	for class, size := range sizes {
+		pools[class] = make(chan struct{}, size)
+	}
+	return pools
+}
+
+// queuedCommand is a command waiting for a worker.
+type queuedCommand struct {
+	msg      *nats.Msg
+	received time.Time
+}
+
+func newCommandQueues(sizes map[string]int, length int) map[string]chan queuedCommand {
+	queues := make(map[string]chan queuedCommand, len(sizes))
+	for class := range sizes {
+		queues[class] = make(chan queuedCommand, length)
+	}
+	return queues
+}
+
+// startCommandWorkers starts one worker per command slot. Workers take
+// commands from the queue of their class, which the NATS subscription
+// fills without blocking.
+func (g *Gateway) startCommandWorkers() {
+	g.loops.commands.beat()
+	for class, pool := range g.pools {
+		for range cap(pool) {
+			g.wg.Add(1)
+			go g.commandWorker(g.queues[class])
+		}
+	}
+}
+
+func (g *Gateway) commandWorker(queue <-chan queuedCommand) {
+	defer g.wg.Done()
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case qc := <-queue:
+			g.loops.commands.beat()
+			g.handleCmdMessage(qc.msg, qc.received)
+		}
+	}
+}
+
+// enqueueCommand queues msg for a worker of its class, or rejects it as
+// busy if the queue is full.
+func (g *Gateway) enqueueCommand(msg *nats.Msg) {
+	if g.rejectWithoutReply(msg) {
+		return
+	}
+	name := g.commandName(msg.Subject)
+	class := commandClass(name)
+	select {
+	case g.queues[class] <- queuedCommand{msg: msg, received: time.Now()}:
+		return
+	default:
+	}
+
+	g.stats.commandsRejected.Add(1)
+	g.logger.Warn().
+		Str("command", name).
+		Str("class", class).
+		Int("queue", cap(g.queues[class])).
+		Msg("command queue full, rejecting command")
+	g.sendCmdReply(msg, CmdReply{
+		Type:      name,
+		RequestID: requestID(msg),
+		Device:    g.name,
+		Ok:        false,
+		Error:     fmt.Sprintf("too many %s commands queued", class),
+		ErrorCode: ErrCodeBusy,
+		TS:        time.Now().Format(time.RFC3339),
+	})
+}
+
+// commandsQueued returns the number of commands waiting in all queues.
+func (g *Gateway) commandsQueued() int {
+	n := 0
+	for _, queue := range g.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// commandsInFlight returns the number of commands executed in all pools.
+func (g *Gateway) commandsInFlight() int {
+	n := 0
+	for _, pool := range g.pools {
+		n += len(pool)
+	}
+	return n
+}
+
+func (g *Gateway) poolMetrics() []Metric {
+	var metrics []Metric
+	for _, class := range sortedKeys(g.pools) {
+		labels := map[string]string{"class": class}
+		inFlight := gauge("z21_gateway_command_pool_in_flight", float64(len(g.pools[class])))
+		inFlight.Labels = labels
+		size := gauge("z21_gateway_command_pool_size", float64(cap(g.pools[class])))
+		size.Labels = labels
+		queued := gauge("z21_gateway_command_queue_depth", float64(len(g.queues[class])))
+		queued.Labels = labels
+		metrics = append(metrics, inFlight, size, queued)
+	}
+	return metrics
+}
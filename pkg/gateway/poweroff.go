@@ -0,0 +1,154 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+const (
+	PowerOffWarning = time.Minute
+)
+
+type powerRequest struct{}
+
+// handlePowerOff switches the track power off. There is no power.on, z21.go
+// only provides the power off request.
+func (g *Gateway) handlePowerOff(cr *cmdRequest, req *powerRequest) CmdReply {
+	if !cr.dryRun {
+		cr.logger.Warn().Msg("switching track power off")
+	}
+	return g.handleRequest(cr, &z21.TrackPowerOff{})
+}
+
+// markActivity records a drive or accessory command or an occupancy
+// change, which resets the idle power-off timer.
+func (g *Gateway) markActivity() {
+	g.lastActivity.Store(time.Now().UnixNano())
+}
+
+// isActivityRequest reports whether req drives a loco or switches an
+// accessory.
+func isActivityRequest(req z21.Serializable) bool {
+	switch req.(type) {
+	case *z21.LocoDrive, *z21.ExtAccessory:
+		return true
+	}
+	return false
+}
+
+// isActivityFrame reports whether a LAN frame drives a loco or switches an
+// accessory, for the frames the gateway relays or builds itself.
+func isActivityFrame(frame []byte) bool {
+	if len(frame) <= z21FrameHeaderSize || binary.LittleEndian.Uint16(frame[2:]) != lanX {
+		return false
+	}
+	switch frame[z21FrameHeaderSize] {
+	case xSetTurnout, xSetExtAccessory, xSetLocoEStop, xSetLoco:
+		return true
+	}
+	return false
+}
+
+// trackActivity marks the occupancy changes reported by CAN detectors and
+// R-BUS feedback modules as activity; repeated reports of the same state are
+// not. It is only called from the events loop.
+func (g *Gateway) trackActivity(ev z21.Serializable) {
+	var state any
+	switch ev := ev.(type) {
+	case *z21.CanDetector:
+		occupied, _, ok := detectorReading(ev)
+		if !ok || occupied == nil {
+			return
+		}
+		state = *occupied
+	case *z21.RBusData:
+		state = ev.Feedback
+	default:
+		return
+	}
+	source := strings.Join(eventTokens(ev), ".")
+	if prev, ok := g.occupancy[source]; ok && prev == state {
+		return
+	}
+	g.occupancy[source] = state
+	g.markActivity()
+}
+
+// parseClock parses a HH:MM time of day.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: want HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// nextClock returns the next point in time at the given time of day.
+func nextClock(now time.Time, clock time.Duration) time.Time {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	next := midnight.Add(clock)
+	if !next.After(now) {
+		next = midnight.AddDate(0, 0, 1).Add(clock)
+	}
+	return next
+}
+
+// powerOffLoop switches the track power off after idlePowerOff without
+// activity and, if configured, every night at powerOffAt. A warning is
+// published powerOffWarning beforehand.
+func (g *Gateway) powerOffLoop() {
+	defer g.wg.Done()
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	g.markActivity()
+	var (
+		idleWarned, idleOff bool
+		nightly             time.Time
+		nightlyWarned       bool
+	)
+	if g.powerOffAt >= 0 {
+		nightly = nextClock(time.Now(), g.powerOffAt)
+	}
+
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case now := <-ticker.C:
+			if g.idlePowerOff > 0 {
+				idle := now.Sub(time.Unix(0, g.lastActivity.Load()))
+				switch {
+				case idle < g.idlePowerOff-g.powerOffWarning:
+					idleWarned, idleOff = false, false
+				case idle < g.idlePowerOff:
+					if !idleWarned {
+						g.publishWarning("idle_poweroff", "track power will be switched off due to inactivity",
+							map[string]any{"in": (g.idlePowerOff - idle).Truncate(time.Second).String()})
+						idleWarned = true
+					}
+				case !idleOff:
+					g.trackPowerOff(fmt.Sprintf("idle for %s", idle.Truncate(time.Second)))
+					idleOff = true
+				}
+			}
+
+			if !nightly.IsZero() {
+				switch {
+				case !now.Before(nightly):
+					g.trackPowerOff("scheduled power-off")
+					nightly = nextClock(now, g.powerOffAt)
+					nightlyWarned = false
+				case !nightlyWarned && !now.Before(nightly.Add(-g.powerOffWarning)):
+					g.publishWarning("scheduled_poweroff", "track power will be switched off as scheduled",
+						map[string]any{"at": nightly.Format(time.RFC3339)})
+					nightlyWarned = true
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package gateway
+
+import (
+	"testing"
+
+	"github.com/trains-io/z21.go"
+)
+
+func TestIsActivityFrame(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		frame []byte
+		want  bool
+	}{
+		{"loco function", setLocoFunctionFrame(3, 0, true), true},
+		{"loco drive", xFrame(xSetLoco, 0x13, 0x00, 0x03, 0x80), true},
+		{"loco e-stop", xFrame(xSetLocoEStop, 0x00, 0x03), true},
+		{"turnout", xFrame(xSetTurnout, 0x00, 0x05, 0xa9), true},
+		{"extended accessory", xFrame(xSetExtAccessory, 0x00, 0x05, 0x11, 0x00), true},
+		{"loco info request", xFrame(0xe3, 0xf0, 0x00, 0x03), false},
+		{"turnout mode", lanFrame(lanSetTurnoutMode, 0x00, 0x05, 0x01), false},
+		{"logoff", z21LogoffFrame, false},
+		{"header only", lanFrame(lanX), false},
+	} {
+		if got := isActivityFrame(tt.frame); got != tt.want {
+			t.Errorf("%s % x: activity %v, want %v", tt.name, tt.frame, got, tt.want)
+		}
+	}
+}
+
+func TestTrackActivityOccupancyChanges(t *testing.T) {
+	g := &Gateway{occupancy: make(map[string]any)}
+	for _, tt := range []struct {
+		ev   z21.Serializable
+		want bool
+	}{
+		{&z21.CanDetector{NetworkID: 0x1234, Port: 1, Type: canDetectorOccupancy, Value1: 1}, true},
+		{&z21.CanDetector{NetworkID: 0x1234, Port: 1, Type: canDetectorOccupancy, Value1: 1}, false},
+		{&z21.CanDetector{NetworkID: 0x1234, Port: 1, Type: canDetectorRailComFirst, Value1: 3}, false},
+		{&z21.CanDetector{NetworkID: 0x1234, Port: 1, Type: canDetectorOccupancy, Value1: 0}, true},
+		{&z21.CanDetector{NetworkID: 0x1234, Port: 2, Type: canDetectorOccupancy, Value1: 0}, true},
+		{&z21.RBusData{GroupIndex: 0, Feedback: [10]byte{0x01}}, true},
+		{&z21.RBusData{GroupIndex: 0, Feedback: [10]byte{0x01}}, false},
+		{&z21.RBusData{GroupIndex: 0, Feedback: [10]byte{0x03}}, true},
+		{&z21.LocoInfo{Address: 3, Speed: 40}, false},
+	} {
+		g.lastActivity.Store(0)
+		g.trackActivity(tt.ev)
+		if got := g.lastActivity.Load() != 0; got != tt.want {
+			t.Errorf("%+v: activity %v, want %v", tt.ev, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/trains-io/z21.go"
+)
+
+const (
+	ProbeSerial      = "serial"
+	ProbeStatus      = "status"
+	ProbeHWInfo      = "hwinfo"
+	ProbeSystemState = "systemstate"
+)
+
+// probes maps the --probe names to the Z21 request of the heartbeat.
+// z21.go has no LAN_X_GET_STATUS request, the status probe is sent as a
+// frame of the gateway by probeStatus.
+var probes = map[string]func() z21.Serializable{
+	ProbeSerial:      func() z21.Serializable { return &z21.SerialNumber{} },
+	ProbeStatus:      nil,
+	ProbeHWInfo:      func() z21.Serializable { return &z21.HWInfo{} },
+	ProbeSystemState: func() z21.Serializable { return &z21.SystemState{} },
+}
+
+// probeStatus sends LAN_X_GET_STATUS and returns the central state of the
+// LAN_X_STATUS_CHANGED answer.
+func (g *Gateway) probeStatus(ctx context.Context) (uint8, error) {
+	var centralState uint8
+	err := g.roundTripFrames(ctx, [][]byte{xFrame(0x21, 0x24)}, func(header uint16, data []byte) bool {
+		if header != lanX || len(data) != 4 || data[0] != 0x62 || data[1] != 0x22 || data[0]^data[1]^data[2] != data[3] {
+			return false
+		}
+		centralState = data[2]
+		return true
+	})
+	return centralState, err
+}
+
+func validateProbe(name string) error {
+	if _, ok := probes[name]; !ok {
+		return fmt.Errorf("unknown probe %q, must be one of %v", name, sortedKeys(probes))
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package gateway
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	ClientIDHeader = "Client-Id"
+)
+
+// Profile restricts what a client may do. Commands are matched by name or
+// by dot separated prefix, e.g. "prog" matches "prog.cv.read".
+type Profile struct {
+	// MaxSpeed caps drive commands in percent of full speed; 0 means no cap.
+	MaxSpeed int `yaml:"max_speed"`
+	// Allow, if not empty, lists the only commands the client may send.
+	Allow []string `yaml:"allow"`
+	// Deny lists commands the client may not send.
+	Deny []string `yaml:"deny"`
+}
+
+// builtinProfiles can be overridden by profiles of the same name in the
+// config file.
+var builtinProfiles = map[string]Profile{
+	// guest lists the commands it may send rather than the ones it may not,
+	// so that new commands are denied until they are added here.
+	"guest": {MaxSpeed: 50, Allow: []string{
+		"loco.drive",
+		"loco.functions",
+		"loco.seen",
+		"turnout.set",
+		"turnout.mode.get",
+		"signal.set",
+		"route.set",
+		"state.get",
+		"stats.events",
+		"capabilities.get",
+		"can.devices",
+		"device.list",
+		"job.get",
+	}},
+}
+
+func matchCommand(patterns []string, name string) bool {
+	return slices.ContainsFunc(patterns, func(p string) bool {
+		return name == p || strings.HasPrefix(name, p+".")
+	})
+}
+
+func (p *Profile) allows(name string) bool {
+	if len(p.Allow) > 0 && !matchCommand(p.Allow, name) {
+		return false
+	}
+	return !matchCommand(p.Deny, name)
+}
+
+// capSpeed applies MaxSpeed to a speed in percent.
+func (p *Profile) capSpeed(percent float64) float64 {
+	if p.MaxSpeed > 0 && percent > float64(p.MaxSpeed) {
+		return float64(p.MaxSpeed)
+	}
+	return percent
+}
+
+// resolveProfiles merges the builtin profiles with the configured ones and
+// checks that every client and the default refer to an existing profile.
+func resolveProfiles(fc *FileConfig) (map[string]Profile, error) {
+	profiles := make(map[string]Profile)
+	for name, p := range builtinProfiles {
+		profiles[name] = p
+	}
+	for name, p := range fc.Profiles {
+		if p.MaxSpeed < 0 || p.MaxSpeed > 100 {
+			return nil, fmt.Errorf("profile %q: max_speed must be between 0 and 100", name)
+		}
+		profiles[name] = p
+	}
+	for client, name := range fc.Clients {
+		if _, ok := profiles[name]; !ok {
+			return nil, fmt.Errorf("client %q: unknown profile %q", client, name)
+		}
+	}
+	if _, ok := profiles[fc.DefaultProfile]; fc.DefaultProfile != "" && !ok {
+		return nil, fmt.Errorf("unknown default profile %q", fc.DefaultProfile)
+	}
+	return profiles, nil
+}
+
+// clientProfile returns the profile of the client that sent msg, identified
+// by the Client-Id header, or nil if the client is unrestricted.
+func (g *Gateway) clientProfile(msg *nats.Msg) *Profile {
+	name, ok := g.clients[msg.Header.Get(ClientIDHeader)]
+	if !ok {
+		name = g.defaultProfile
+	}
+	if p, ok := g.profiles[name]; ok {
+		return &p
+	}
+	return nil
+}
+
+func (g *Gateway) handleForbidden(cr *cmdRequest) CmdReply {
+	cr.logger.Warn().
+		Str("command", cr.name).
+		Str("client", cr.msg.Header.Get(ClientIDHeader)).
+		Msg("command not allowed by profile")
+	return CmdReply{
+		Ok:        false,
+		Error:     fmt.Sprintf("command not allowed: %s", cr.name),
+		ErrorCode: ErrCodeForbidden,
+		TS:        time.Now().Format(time.RFC3339),
+	}
+}
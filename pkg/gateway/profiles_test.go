@@ -0,0 +1,76 @@
+package gateway
+
+import (
+	"sort"
+	"testing"
+)
+
+// guestAllowed lists for every command whether the builtin guest profile
+// allows it. A new command fails the test until it is decided here.
+var guestAllowed = map[string]bool{
+	"accessory.cv.read":   false,
+	"accessory.cv.write":  false,
+	"can.devices":         true,
+	"can.discover":        false,
+	"capabilities.get":    true,
+	"cv.pom.read":         false,
+	"cv.speedmatch":       false,
+	"cv.template.apply":   false,
+	"cv.template.list":    false,
+	"debug.pcap.start":    false,
+	"debug.pcap.stop":     false,
+	"debug.raw":           false,
+	"device.attach":       false,
+	"device.detach":       false,
+	"device.list":         true,
+	"gateway.stop":        false,
+	"job.cancel":          false,
+	"job.get":             true,
+	"lcc.send":            false,
+	"loco.drive":          true,
+	"loco.functions":      true,
+	"loco.purge":          false,
+	"loco.seen":           true,
+	"power.off":           false,
+	"prog.backup":         false,
+	"prog.mm.write":       false,
+	"prog.register.read":  false,
+	"prog.register.write": false,
+	"prog.restore":        false,
+	"record.start":        false,
+	"record.stop":         false,
+	"route.set":           true,
+	"signal.set":          true,
+	"state.get":           true,
+	"stats.events":        true,
+	"turnout.mode.get":    true,
+	"turnout.mode.set":    false,
+	"turnout.set":         true,
+}
+
+func TestGuestProfileCommands(t *testing.T) {
+	guest := builtinProfiles["guest"]
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		want, ok := guestAllowed[name]
+		if !ok {
+			t.Errorf("command %s is not in guestAllowed, decide whether guests may run it", name)
+			continue
+		}
+		if got := guest.allows(name); got != want {
+			t.Errorf("guest allows %s = %v, want %v", name, got, want)
+		}
+	}
+	for name := range guestAllowed {
+		if _, ok := commands[name]; !ok {
+			t.Errorf("guestAllowed lists %s, which is not a command", name)
+		}
+	}
+	if guest.allows("plugin.example") {
+		t.Error("guest allows an unlisted plugin command")
+	}
+}
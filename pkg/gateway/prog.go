@@ -0,0 +1,293 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+const (
+	// ProgTimeout bounds a single programming track read or write, which
+	// takes far longer than other requests.
+	ProgTimeout = 5 * time.Second
+	ProgRetries = 2
+
+	MaxCV = 1024
+	// DefaultBackupCVs is the CV range backed up if none is given.
+	DefaultBackupCVs = "1-256"
+)
+
+// readOnlyCVs are skipped on restore: CV7 and CV8 hold the version and
+// manufacturer, and writing CV8 resets most decoders.
+var readOnlyCVs = map[uint16]bool{7: true, 8: true}
+
+// BackupRequest is the payload of prog.backup.
+type BackupRequest struct {
+	// Name stores the backup as <name>.json in the backup directory.
+	Name string `json:"name,omitempty"`
+	// CVs is a CV range like "1-256,512".
+	CVs     string `json:"cvs,omitempty"`
+	Retries *int   `json:"retries,omitempty"`
+}
+
+// CVBackup is the result of prog.backup and the stored backup.
+type CVBackup struct {
+	Name   string           `json:"name,omitempty"`
+	CVs    map[uint16]uint8 `json:"cvs"`
+	Failed []uint16         `json:"failed,omitempty"`
+	TS     string           `json:"ts"`
+}
+
+// RestoreRequest is the payload of prog.restore, restoring either the stored
+// backup Name or the given CVs.
+type RestoreRequest struct {
+	Name string           `json:"name,omitempty"`
+	CVs  map[uint16]uint8 `json:"cvs,omitempty"`
+	// Only restricts the restored CVs to a CV range.
+	Only    string `json:"only,omitempty"`
+	Retries *int   `json:"retries,omitempty"`
+}
+
+// RestoreResult is the result of prog.restore.
+type RestoreResult struct {
+	Written []uint16 `json:"written"`
+	Skipped []uint16 `json:"skipped,omitempty"`
+	Failed  []uint16 `json:"failed,omitempty"`
+}
+
+// parseCVRange parses a comma separated list of CVs and CV ranges.
+func parseCVRange(s string) ([]uint16, error) {
+	var cvs []uint16
+	seen := make(map[uint16]bool)
+	for part := range strings.SplitSeq(s, ",") {
+		part = strings.TrimSpace(part)
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CV range %q", part)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.ParseUint(hi, 10, 16); err != nil {
+				return nil, fmt.Errorf("invalid CV range %q", part)
+			}
+		}
+		if first < 1 || last > MaxCV || first > last {
+			return nil, fmt.Errorf("CV range %q must be within 1-%d", part, MaxCV)
+		}
+		for cv := uint16(first); cv <= uint16(last); cv++ {
+			if !seen[cv] {
+				seen[cv] = true
+				cvs = append(cvs, cv)
+			}
+		}
+	}
+	return cvs, nil
+}
+
+func retries(n *int) (int, error) {
+	if n == nil {
+		return ProgRetries, nil
+	}
+	if *n < 0 {
+		return 0, fmt.Errorf("retries must not be negative")
+	}
+	return *n, nil
+}
+
+func (g *Gateway) backupPath(name string) (string, error) {
+	if g.backupDir == "" {
+		return "", fmt.Errorf("named backups need --backup_dir")
+	}
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid backup name %q", name)
+	}
+	return filepath.Join(g.backupDir, name+".json"), nil
+}
+
+// lockProg reserves the programming track for a job; the returned reply is
+// set if it is in use.
+func (g *Gateway) lockProg() (CmdReply, bool) {
+	if g.progLock.TryLock() {
+		return CmdReply{}, true
+	}
+	return CmdReply{
+		Ok:        false,
+		Error:     "programming track is in use",
+		ErrorCode: ErrCodeLocked,
+		TS:        time.Now().Format(time.RFC3339),
+	}, false
+}
+
+func (g *Gateway) handleBackup(cr *cmdRequest, req *BackupRequest) CmdReply {
+	if req.CVs == "" {
+		req.CVs = DefaultBackupCVs
+	}
+	cvs, err := parseCVRange(req.CVs)
+	if err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	n, err := retries(req.Retries)
+	if err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	var path string
+	if req.Name != "" {
+		if path, err = g.backupPath(req.Name); err != nil {
+			return g.handleValidationError(cr, err)
+		}
+	}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, Data: cvs, TS: time.Now().Format(time.RFC3339)}
+	}
+	if reply, ok := g.lockProg(); !ok {
+		return reply
+	}
+
+	return jobStarted(g.startJob(cr.name, func(ctx context.Context, j *job) (any, error) {
+		defer g.progLock.Unlock()
+
+		backup := &CVBackup{Name: req.Name, CVs: make(map[uint16]uint8)}
+		for i, cv := range cvs {
+			j.progress(float64(i)/float64(len(cvs)), fmt.Sprintf("reading CV%d", cv), nil)
+			value, err := g.cvRequest(ctx, &z21.CVRead{CV: cv}, n)
+			if errors.Is(err, context.Canceled) {
+				return backup, err
+			}
+			if err != nil {
+				// unimplemented CVs are not acknowledged by most decoders
+				backup.Failed = append(backup.Failed, cv)
+				continue
+			}
+			backup.CVs[cv] = value
+		}
+		backup.TS = time.Now().UTC().Format(time.RFC3339)
+
+		if path != "" {
+			data, err := json.MarshalIndent(backup, "", "  ")
+			if err != nil {
+				return backup, err
+			}
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				return backup, fmt.Errorf("store backup: %w", err)
+			}
+		}
+		return backup, nil
+	}))
+}
+
+func (g *Gateway) handleRestore(cr *cmdRequest, req *RestoreRequest) CmdReply {
+	cvs := req.CVs
+	switch {
+	case req.Name != "" && cvs != nil:
+		return g.handleValidationError(cr, fmt.Errorf("name and cvs are mutually exclusive"))
+	case req.Name != "":
+		path, err := g.backupPath(req.Name)
+		if err != nil {
+			return g.handleValidationError(cr, err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return g.handleValidationError(cr, fmt.Errorf("load backup: %w", err))
+		}
+		var backup CVBackup
+		if err := json.Unmarshal(data, &backup); err != nil {
+			return g.handleValidationError(cr, fmt.Errorf("load backup: %w", err))
+		}
+		cvs = backup.CVs
+	case len(cvs) == 0:
+		return g.handleValidationError(cr, fmt.Errorf("name or cvs is required"))
+	}
+	n, err := retries(req.Retries)
+	if err != nil {
+		return g.handleValidationError(cr, err)
+	}
+
+	res := &RestoreResult{}
+	var only map[uint16]bool
+	if req.Only != "" {
+		filter, err := parseCVRange(req.Only)
+		if err != nil {
+			return g.handleValidationError(cr, err)
+		}
+		only = make(map[uint16]bool)
+		for _, cv := range filter {
+			only[cv] = true
+		}
+	}
+	var write []uint16
+	for _, cv := range sortedKeys(cvs) {
+		if cv < 1 || cv > MaxCV {
+			return g.handleValidationError(cr, fmt.Errorf("CV%d must be within 1-%d", cv, MaxCV))
+		}
+		switch {
+		case only != nil && !only[cv]:
+		case readOnlyCVs[cv]:
+			res.Skipped = append(res.Skipped, cv)
+		default:
+			write = append(write, cv)
+		}
+	}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, Data: write, TS: time.Now().Format(time.RFC3339)}
+	}
+	if reply, ok := g.lockProg(); !ok {
+		return reply
+	}
+
+	return jobStarted(g.startJob(cr.name, func(ctx context.Context, j *job) (any, error) {
+		defer g.progLock.Unlock()
+
+		for i, cv := range write {
+			j.progress(float64(i)/float64(len(write)), fmt.Sprintf("writing CV%d", cv), nil)
+			value, err := g.cvRequest(ctx, &z21.CVWrite{CV: cv, Value: cvs[cv]}, n)
+			if errors.Is(err, context.Canceled) {
+				return res, err
+			}
+			if err != nil || value != cvs[cv] {
+				res.Failed = append(res.Failed, cv)
+				continue
+			}
+			res.Written = append(res.Written, cv)
+		}
+		if len(res.Failed) > 0 {
+			return res, fmt.Errorf("%d CVs failed to restore", len(res.Failed))
+		}
+		return res, nil
+	}))
+}
+
+// cvRequest sends a CV read or write, retrying up to retries times, and
+// returns the CV value reported by the decoder.
+func (g *Gateway) cvRequest(ctx context.Context, req z21.Serializable, retries int) (uint8, error) {
+	var err error
+	for range retries + 1 {
+		g.record(RecordTx, "", eventTypeName(req), req)
+		var resp z21.Serializable
+		rctx, cancel := context.WithTimeout(ctx, ProgTimeout)
+		resp, err = g.z21SendRcv(rctx, req)
+		cancel()
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if err != nil {
+			continue
+		}
+		res, ok := resp.(*z21.CVResult)
+		if !ok {
+			// LAN_X_CV_NACK or a short circuit on the programming track
+			err = fmt.Errorf("no CV result: %s", eventTypeName(resp))
+			continue
+		}
+		return res.Value, nil
+	}
+	return 0, err
+}
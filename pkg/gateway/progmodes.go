@@ -0,0 +1,192 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// ProgRegisterTimeout bounds a register mode read or write. Register
+	// mode reads verify the values one after the other, which takes far
+	// longer than a direct mode read.
+	ProgRegisterTimeout = 20 * time.Second
+	// ProgMMTimeout is how long a Motorola write waits for the Z21 to
+	// report an error. Motorola decoders do not acknowledge, so a write not
+	// answered by then is reported as unconfirmed.
+	ProgMMTimeout = 5 * time.Second
+
+	MaxRegister   = 8
+	MaxMMRegister = 256
+)
+
+const (
+	ProgModeRegister = "register"
+	ProgModeMM       = "mm"
+)
+
+// RegisterRequest is the payload of prog.register.read.
+type RegisterRequest struct {
+	Register uint16 `json:"register" payload:"required"`
+}
+
+// RegisterWriteRequest is the payload of prog.register.write and
+// prog.mm.write.
+type RegisterWriteRequest struct {
+	Register uint16 `json:"register" payload:"required"`
+	Value    uint8  `json:"value" payload:"required"`
+}
+
+// RegisterResult is the result of the register mode and Motorola
+// programming jobs.
+type RegisterResult struct {
+	Mode     string `json:"mode"`
+	Register uint16 `json:"register"`
+	Value    uint8  `json:"value"`
+	// Unconfirmed is set for a Motorola write the Z21 did not answer.
+	Unconfirmed bool `json:"unconfirmed,omitempty"`
+}
+
+// progAnswer matches the answers of the Z21 to a programming request:
+// LAN_X_CV_RESULT, LAN_X_CV_NACK_SC, LAN_X_CV_NACK and LAN_X_UNKNOWN_COMMAND.
+func progAnswer(x []byte) bool {
+	switch {
+	case len(x) == 5 && x[0] == 0x64 && x[1] == 0x14:
+		return true
+	case len(x) == 2 && x[0] == 0x61:
+		return x[1] == 0x12 || x[1] == 0x13 || x[1] == 0x82
+	}
+	return false
+}
+
+// registerReadFrame returns LAN_X_DCC_READ_REGISTER for register reg.
+func registerReadFrame(reg uint16) []byte {
+	return xFrame(0x22, 0x11, byte(reg))
+}
+
+// registerWriteFrame returns LAN_X_DCC_WRITE_REGISTER writing value to
+// register reg.
+func registerWriteFrame(reg uint16, value uint8) []byte {
+	return xFrame(0x23, 0x12, byte(reg), value)
+}
+
+// mmWriteFrame returns LAN_X_MM_WRITE_BYTE writing value to Motorola
+// register reg, which is sent as reg-1.
+func mmWriteFrame(reg uint16, value uint8) []byte {
+	return xFrame(0x24, 0xff, 0x00, byte(reg-1), value)
+}
+
+// progFrameRequest sends a programming request the gateway builds itself
+// and returns the value of the CV result, or an error carrying the error
+// code of the answer.
+func (g *Gateway) progFrameRequest(ctx context.Context, frame []byte, timeout time.Duration) (uint8, error) {
+	rctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	x, err := g.requestXFrame(rctx, frame, progAnswer)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil:
+		return 0, &codedError{ErrCodeTimeout, fmt.Errorf("no answer from the programming track within %s", timeout)}
+	case err != nil:
+		return 0, err
+	}
+	if x[0] == 0x64 {
+		return x[4], nil
+	}
+	switch x[1] {
+	case 0x12:
+		return 0, &codedError{ErrCodeShortCircuit, errors.New("short circuit on the programming track")}
+	case 0x13:
+		return 0, &codedError{ErrCodeProgNack, errors.New("the decoder did not acknowledge")}
+	}
+	return 0, &codedError{ErrCodeUnsupportedByDevice, errors.New("the z21 does not support the programming mode")}
+}
+
+// startProgJob starts a job running a single programming request on the
+// programming track.
+func (g *Gateway) startProgJob(cr *cmdRequest, what string, run func(ctx context.Context) (*RegisterResult, error)) CmdReply {
+	if !g.isOnline.Load() {
+		return CmdReply{Ok: false, Error: "z21 is offline", ErrorCode: ErrCodeZ21Offline, TS: time.Now().Format(time.RFC3339)}
+	}
+	if reply, ok := g.lockProg(); !ok {
+		return reply
+	}
+	return jobStarted(g.startJob(cr.name, func(ctx context.Context, j *job) (any, error) {
+		defer g.progLock.Unlock()
+		j.progress(0, what, nil)
+		res, err := run(ctx)
+		if err != nil {
+			cr.logger.Warn().
+				Err(err).
+				Msg(what + " failed")
+		}
+		return res, err
+	}))
+}
+
+func validateRegister(reg, max uint16) error {
+	if reg == 0 || reg > max {
+		return fmt.Errorf("register must be between 1 and %d", max)
+	}
+	return nil
+}
+
+func (g *Gateway) handleRegisterRead(cr *cmdRequest, req *RegisterRequest) CmdReply {
+	if err := validateRegister(req.Register, MaxRegister); err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, Data: req, TS: time.Now().Format(time.RFC3339)}
+	}
+	frame := registerReadFrame(req.Register)
+	return g.startProgJob(cr, fmt.Sprintf("reading register %d", req.Register), func(ctx context.Context) (*RegisterResult, error) {
+		value, err := g.progFrameRequest(ctx, frame, ProgRegisterTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return &RegisterResult{Mode: ProgModeRegister, Register: req.Register, Value: value}, nil
+	})
+}
+
+func (g *Gateway) handleRegisterWrite(cr *cmdRequest, req *RegisterWriteRequest) CmdReply {
+	if err := validateRegister(req.Register, MaxRegister); err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, Data: req, TS: time.Now().Format(time.RFC3339)}
+	}
+	frame := registerWriteFrame(req.Register, req.Value)
+	return g.startProgJob(cr, fmt.Sprintf("writing register %d", req.Register), func(ctx context.Context) (*RegisterResult, error) {
+		value, err := g.progFrameRequest(ctx, frame, ProgRegisterTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if value != req.Value {
+			return nil, &codedError{ErrCodeProgNack, fmt.Errorf("register %d reads %d after writing %d", req.Register, value, req.Value)}
+		}
+		return &RegisterResult{Mode: ProgModeRegister, Register: req.Register, Value: value}, nil
+	})
+}
+
+func (g *Gateway) handleMMWrite(cr *cmdRequest, req *RegisterWriteRequest) CmdReply {
+	if err := validateRegister(req.Register, MaxMMRegister); err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, Data: req, TS: time.Now().Format(time.RFC3339)}
+	}
+	frame := mmWriteFrame(req.Register, req.Value)
+	return g.startProgJob(cr, fmt.Sprintf("writing Motorola register %d", req.Register), func(ctx context.Context) (*RegisterResult, error) {
+		res := &RegisterResult{Mode: ProgModeMM, Register: req.Register, Value: req.Value}
+		_, err := g.progFrameRequest(ctx, frame, ProgMMTimeout)
+		var ce *codedError
+		if errors.As(err, &ce) && ce.code == ErrCodeTimeout {
+			res.Unconfirmed = true
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	})
+}
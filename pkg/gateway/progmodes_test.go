@@ -0,0 +1,43 @@
+package gateway
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestProgModeFrames(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		frame []byte
+		want  []byte
+	}{
+		{"read register 1", registerReadFrame(1), []byte{0x08, 0x00, 0x40, 0x00, 0x22, 0x11, 0x01, 0x32}},
+		{"read register 8", registerReadFrame(8), []byte{0x08, 0x00, 0x40, 0x00, 0x22, 0x11, 0x08, 0x3b}},
+		{"write register 5", registerWriteFrame(5, 7), []byte{0x09, 0x00, 0x40, 0x00, 0x23, 0x12, 0x05, 0x07, 0x33}},
+		{"write Motorola register 1", mmWriteFrame(1, 10), []byte{0x0a, 0x00, 0x40, 0x00, 0x24, 0xff, 0x00, 0x00, 0x0a, 0xd1}},
+		{"write Motorola register 80", mmWriteFrame(80, 255), []byte{0x0a, 0x00, 0x40, 0x00, 0x24, 0xff, 0x00, 0x4f, 0xff, 0x6b}},
+	} {
+		if !bytes.Equal(tt.frame, tt.want) {
+			t.Errorf("%s: % x, want % x", tt.name, tt.frame, tt.want)
+		}
+	}
+}
+
+func TestProgAnswer(t *testing.T) {
+	for _, tt := range []struct {
+		x    []byte
+		want bool
+	}{
+		{[]byte{0x64, 0x14, 0x00, 0x04, 0x03}, true}, // LAN_X_CV_RESULT
+		{[]byte{0x61, 0x12}, true},                   // LAN_X_CV_NACK_SC
+		{[]byte{0x61, 0x13}, true},                   // LAN_X_CV_NACK
+		{[]byte{0x61, 0x82}, true},                   // LAN_X_UNKNOWN_COMMAND
+		{[]byte{0x61, 0x01}, false},                  // LAN_X_BC_TRACK_POWER_ON
+		{[]byte{0x64, 0x14, 0x00, 0x04}, false},
+		{[]byte{0xef, 0x00, 0x03}, false},
+	} {
+		if got := progAnswer(tt.x); got != tt.want {
+			t.Errorf("progAnswer(% x) = %v, want %v", tt.x, got, tt.want)
+		}
+	}
+}
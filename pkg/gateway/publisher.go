@@ -0,0 +1,116 @@
+package gateway
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	PublishQueue      = 4096
+	PublishRetries    = 3
+	PublishRetryDelay = 50 * time.Millisecond
+)
+
+var errPublishQueueFull = errors.New("publish queue full")
+
+// publishJob is an event publish queued for the publisher.
+type publishJob struct {
+	publish func() error
+	// onError is called if the publish failed for good.
+	onError func(error)
+}
+
+// enqueuePublish hands publish to the publisher, so that a slow publish
+// does not delay decoding the following Z21 frames. Events are published
+// in the order they are queued, which keeps their sequence numbers in
+// order. With a full queue the publish is dropped and counted rather than
+// blocking the events loop.
+func (g *Gateway) enqueuePublish(publish func() error, onError func(error)) {
+	select {
+	case g.publishQueue <- publishJob{publish: publish, onError: onError}:
+	default:
+		g.stats.eventsDropped.Add(1)
+		onError(errPublishQueueFull)
+	}
+}
+
+// enqueuePublishWait is enqueuePublish for publishes that must not be
+// dropped, e.g. the flush of a batch holding many events. It waits for room
+// in the queue and only gives up on shutdown, when the publisher flushes the
+// batches itself.
+func (g *Gateway) enqueuePublishWait(publish func() error, onError func(error)) {
+	select {
+	case g.publishQueue <- publishJob{publish: publish, onError: onError}:
+	case <-g.ctx.Done():
+	}
+}
+
+// publishLoop publishes the queued events. On shutdown it publishes what
+// is left in the queue before returning.
+func (g *Gateway) publishLoop() {
+	defer g.wg.Done()
+	for {
+		select {
+		case <-g.ctx.Done():
+			for {
+				select {
+				case job := <-g.publishQueue:
+					g.runPublishJob(job)
+				default:
+					g.flushBatches()
+					return
+				}
+			}
+		case job := <-g.publishQueue:
+			g.runPublishJob(job)
+		}
+	}
+}
+
+func (g *Gateway) runPublishJob(job publishJob) {
+	if err := job.publish(); err != nil && job.onError != nil {
+		job.onError(err)
+	}
+}
+
+// publishMsg publishes msg, retrying errors that pass once NATS has
+// reconnected, and mirrors it with --mirror_url.
+func (g *Gateway) publishMsg(msg *nats.Msg) error {
+	if g.mirror != nil {
+		g.mirror.publish(msg)
+	}
+	return g.publishLocal(msg)
+}
+
+// publishLocal publishes msg on the local NATS server only, e.g. a reply to
+// a local inbox.
+func (g *Gateway) publishLocal(msg *nats.Msg) error {
+	var err error
+	for attempt := range PublishRetries + 1 {
+		if attempt > 0 {
+			select {
+			case <-g.ctx.Done():
+				return err
+			case <-time.After(PublishRetryDelay << (attempt - 1)):
+			}
+		}
+		if err = g.nc.PublishMsg(msg); !transientPublishError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func transientPublishError(err error) bool {
+	return errors.Is(err, nats.ErrReconnectBufExceeded) || errors.Is(err, nats.ErrConnectionReconnecting)
+}
+
+// onEventPublishError is the error callback of event publishes.
+func (g *Gateway) onEventPublishError(err error) {
+	g.stats.publishErrors.Add(1)
+	g.logger.Error().
+		Err(err).
+		Msg("failed to publish")
+}
@@ -0,0 +1,59 @@
+package gateway
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+// PurgeRequest is the payload of loco.purge.
+type PurgeRequest struct {
+	Address uint16 `json:"address"`
+	// Name is resolved to Address through the configured loco names.
+	Name string `json:"name,omitempty"`
+	// Forward is the direction the loco is stopped in, so that stopping
+	// does not reverse it.
+	Forward bool `json:"forward"`
+}
+
+// purgeLocoFrame returns LAN_X_PURGE_LOCO for a loco, which removes it from
+// the locos the Z21 keeps refreshing on the track.
+func purgeLocoFrame(addr uint16) []byte {
+	msb, lsb := locoAddrBytes(addr)
+	return xFrame(0xe3, 0x44, msb, lsb)
+}
+
+func (g *Gateway) handlePurge(cr *cmdRequest, req *PurgeRequest) CmdReply {
+	addr, err := g.names.resolveLoco(req.Name, req.Address)
+	if err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	req.Address = addr
+	if req.Address == 0 || req.Address > MaxLocoAddress {
+		return g.handleValidationError(cr, fmt.Errorf("address must be between 1 and %d", MaxLocoAddress))
+	}
+
+	// stop the loco first, the Z21 does not stop a loco it purges and the
+	// decoder would keep its last speed
+	stop := g.handleRequest(cr, &z21.LocoDrive{
+		Address:    req.Address,
+		Speed:      0,
+		Forward:    req.Forward,
+		SpeedSteps: g.speedSteps.mode(req.Address),
+	})
+	if !stop.Ok || cr.dryRun {
+		return stop
+	}
+	if err := g.sendZ21Frames(purgeLocoFrame(req.Address)); err != nil {
+		cr.logger.Error().
+			Err(err).
+			Uint16("address", req.Address).
+			Msg("failed to purge loco")
+		return CmdReply{Ok: false, Error: err.Error(), ErrorCode: ErrCodeZ21Offline, TS: time.Now().Format(time.RFC3339)}
+	}
+	cr.logger.Info().
+		Uint16("address", req.Address).
+		Msg("loco purged")
+	return CmdReply{Ok: true, TS: time.Now().Format(time.RFC3339)}
+}
@@ -0,0 +1,90 @@
+package gateway
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+const (
+	RawRx = "rx"
+	RawTx = "tx"
+
+	// RawDebugDuration is how long debug.raw enables the raw stream unless
+	// the request gives a duration, so that it is not left on by mistake.
+	RawDebugDuration = 15 * time.Minute
+)
+
+// RawMessage is a UDP datagram exchanged with the Z21, published on
+// z21.<name>.raw.rx and z21.<name>.raw.tx while the raw stream is enabled.
+type RawMessage struct {
+	TS string `json:"ts"`
+	// Data is the datagram, hex encoded. A datagram may hold several LAN
+	// frames.
+	Data string `json:"data"`
+}
+
+type rawDebugRequest struct {
+	Enabled  bool   `json:"enabled"`
+	Duration string `json:"duration,omitempty"`
+}
+
+type rawDebugReply struct {
+	Enabled bool   `json:"enabled"`
+	Until   string `json:"until,omitempty"`
+}
+
+// rawEnabled reports whether the raw stream is enabled.
+func (g *Gateway) rawEnabled() bool {
+	until := g.rawUntil.Load()
+	return until != 0 && time.Now().UnixNano() < until
+}
+
+// publishRaw publishes a datagram sent to or received from the Z21 while
+// the raw stream is enabled. The datagram is encoded right away, so the
+// caller may reuse it.
+func (g *Gateway) publishRaw(dir string, datagram []byte) {
+	if !g.rawEnabled() {
+		return
+	}
+	raw := &RawMessage{
+		TS:   time.Now().UTC().Format(time.RFC3339Nano),
+		Data: hex.EncodeToString(datagram),
+	}
+	subject := g.subjectPrefix + "raw." + dir
+	g.enqueuePublish(func() error {
+		if err := g.publish(subject, "raw."+dir, 0, raw); err != nil {
+			return fmt.Errorf("%s: %w", subject, err)
+		}
+		return nil
+	}, g.onEventPublishError)
+}
+
+func (g *Gateway) handleDebugRaw(cr *cmdRequest, req *rawDebugRequest) CmdReply {
+	duration := RawDebugDuration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			return g.handleValidationError(cr, fmt.Errorf("invalid duration %q", req.Duration))
+		}
+		duration = d
+	}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, TS: time.Now().Format(time.RFC3339)}
+	}
+
+	reply := rawDebugReply{Enabled: req.Enabled}
+	if req.Enabled {
+		until := time.Now().Add(duration)
+		g.rawUntil.Store(until.UnixNano())
+		reply.Until = until.UTC().Format(time.RFC3339)
+	} else {
+		g.rawUntil.Store(0)
+	}
+	cr.logger.Warn().
+		Str("client", cr.msg.Header.Get(ClientIDHeader)).
+		Bool("enabled", reply.Enabled).
+		Str("until", reply.Until).
+		Msg("raw stream toggled")
+	return CmdReply{Ok: true, Data: reply, TS: time.Now().Format(time.RFC3339)}
+}
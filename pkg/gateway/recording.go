@@ -0,0 +1,252 @@
+package gateway
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	RecordingBucket = "z21-recordings"
+	// MaxRecordingSize caps the uncompressed size of a recording; later
+	// records are dropped.
+	MaxRecordingSize    = 256 << 20
+	recordingPutTimeout = 30 * time.Second
+)
+
+// Record directions.
+const (
+	RecordRx  = "rx"  // event received from the Z21
+	RecordTx  = "tx"  // request sent to the Z21
+	RecordCmd = "cmd" // command received from NATS
+	RecordPub = "pub" // message published on NATS
+)
+
+// Record is a line of a recording.
+type Record struct {
+	TS      string `json:"ts"`
+	Dir     string `json:"dir"`
+	Subject string `json:"subject,omitempty"`
+	Kind    string `json:"kind,omitempty"`
+	Data    any    `json:"data"`
+}
+
+// recording captures Z21 traffic and published messages of a session into a
+// gzipped JSON lines temp file, which is put into the NATS Object Store when
+// the session stops.
+type recording struct {
+	name    string
+	started time.Time
+
+	mu        sync.Mutex
+	file      *os.File
+	gz        *gzip.Writer
+	enc       *json.Encoder
+	size      int64
+	truncated bool
+}
+
+var (
+	errRecordingRunning = errors.New("a recording is running")
+	errNoRecording      = errors.New("no recording is running")
+)
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+func newRecording(name string) (*recording, error) {
+	f, err := os.CreateTemp("", "z21-recording-*.jsonl.gz")
+	if err != nil {
+		return nil, err
+	}
+	r := &recording{name: name, started: time.Now(), file: f, gz: gzip.NewWriter(f)}
+	r.enc = json.NewEncoder(countingWriter{w: r.gz, n: &r.size})
+	return r, nil
+}
+
+// record appends a record to the running recording, if any.
+func (g *Gateway) record(dir, subject, kind string, data any) {
+	g.recMu.Lock()
+	r := g.rec
+	g.recMu.Unlock()
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	if r.truncated || r.enc == nil {
+		r.mu.Unlock()
+		return
+	}
+	_ = r.enc.Encode(&Record{
+		TS:      time.Now().UTC().Format(time.RFC3339Nano),
+		Dir:     dir,
+		Subject: subject,
+		Kind:    kind,
+		Data:    data,
+	})
+	truncated := r.size > MaxRecordingSize
+	r.truncated = truncated
+	r.mu.Unlock()
+
+	if truncated {
+		g.publishWarning("recording_truncated",
+			"recording reached its maximum size, later records are dropped",
+			map[string]any{"recording": r.name, "max_bytes": MaxRecordingSize})
+	}
+}
+
+// rawData records JSON payloads as is and others as strings.
+func rawData(data []byte) any {
+	if json.Valid(data) {
+		return json.RawMessage(data)
+	}
+	return string(data)
+}
+
+// RecordingRequest is the payload of record.start.
+type RecordingRequest struct {
+	Name string `json:"name,omitempty"`
+}
+
+// recordingName returns name, or a name of the device and the current time
+// if it is empty.
+func (g *Gateway) recordingName(name string) string {
+	if name == "" {
+		return fmt.Sprintf("%s-%s", g.name, time.Now().UTC().Format("20060102T150405Z"))
+	}
+	return name
+}
+
+// runningRecording returns the running recording, nil if there is none.
+func (g *Gateway) runningRecording() *recording {
+	g.recMu.Lock()
+	defer g.recMu.Unlock()
+	return g.rec
+}
+
+func (g *Gateway) startRecording(name string) (*recording, error) {
+	name = g.recordingName(name)
+	g.recMu.Lock()
+	defer g.recMu.Unlock()
+	if g.rec != nil {
+		return nil, fmt.Errorf("%w: %s", errRecordingRunning, g.rec.name)
+	}
+	r, err := newRecording(name)
+	if err != nil {
+		return nil, err
+	}
+	g.rec = r
+	g.logger.Info().
+		Str("recording", name).
+		Msg("recording started")
+	return r, nil
+}
+
+// stopRecording ends the running recording and puts it into the Object
+// Store bucket as <name>.jsonl.gz.
+func (g *Gateway) stopRecording() (*jetstream.ObjectInfo, error) {
+	g.recMu.Lock()
+	r := g.rec
+	g.rec = nil
+	g.recMu.Unlock()
+	if r == nil {
+		return nil, errNoRecording
+	}
+
+	r.mu.Lock()
+	err := r.gz.Close()
+	r.enc = nil
+	r.mu.Unlock()
+	defer os.Remove(r.file.Name())
+	defer r.file.Close()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), recordingPutTimeout)
+	defer cancel()
+	js, err := jetstream.New(g.nc)
+	if err != nil {
+		return nil, err
+	}
+	store, err := js.CreateOrUpdateObjectStore(ctx, jetstream.ObjectStoreConfig{
+		Bucket:      g.recordingBucket,
+		Description: "z21-gateway session recordings",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("object store %s: %w", g.recordingBucket, err)
+	}
+	info, err := store.Put(ctx, jetstream.ObjectMeta{
+		Name:        r.name + ".jsonl.gz",
+		Description: fmt.Sprintf("z21 %s session %s to %s", g.name, r.started.UTC().Format(time.RFC3339), time.Now().UTC().Format(time.RFC3339)),
+		Headers: map[string][]string{
+			"Z21-Device":    {g.name},
+			"Z21-Truncated": {fmt.Sprintf("%t", r.truncated)},
+		},
+	}, r.file)
+	if err != nil {
+		return nil, fmt.Errorf("store recording: %w", err)
+	}
+	g.logger.Info().
+		Str("recording", r.name).
+		Str("bucket", g.recordingBucket).
+		Uint64("bytes", info.Size).
+		Msg("recording stored")
+	return info, nil
+}
+
+func (g *Gateway) handleRecordStart(cr *cmdRequest, req *RecordingRequest) CmdReply {
+	if cr.dryRun {
+		if r := g.runningRecording(); r != nil {
+			err := fmt.Errorf("%w: %s", errRecordingRunning, r.name)
+			return CmdReply{Ok: false, Error: err.Error(), ErrorCode: ErrCodeLocked, TS: time.Now().Format(time.RFC3339)}
+		}
+		return CmdReply{Ok: true, DryRun: true, Data: map[string]string{"name": g.recordingName(req.Name)}, TS: time.Now().Format(time.RFC3339)}
+	}
+	r, err := g.startRecording(req.Name)
+	if errors.Is(err, errRecordingRunning) {
+		return CmdReply{Ok: false, Error: err.Error(), ErrorCode: ErrCodeLocked, TS: time.Now().Format(time.RFC3339)}
+	}
+	if err != nil {
+		return CmdReply{Ok: false, Error: err.Error(), ErrorCode: ErrCodeInternal, TS: time.Now().Format(time.RFC3339)}
+	}
+	return CmdReply{Ok: true, Data: map[string]string{"name": r.name}, TS: time.Now().Format(time.RFC3339)}
+}
+
+func (g *Gateway) handleRecordStop(cr *cmdRequest, req *struct{}) CmdReply {
+	if cr.dryRun {
+		r := g.runningRecording()
+		if r == nil {
+			return g.handleValidationError(cr, errNoRecording)
+		}
+		return CmdReply{Ok: true, DryRun: true, Data: map[string]string{"name": r.name}, TS: time.Now().Format(time.RFC3339)}
+	}
+	info, err := g.stopRecording()
+	if errors.Is(err, errNoRecording) {
+		return g.handleValidationError(cr, err)
+	}
+	if err != nil {
+		return CmdReply{Ok: false, Error: err.Error(), ErrorCode: ErrCodeInternal, TS: time.Now().Format(time.RFC3339)}
+	}
+	return CmdReply{Ok: true, Data: info, TS: time.Now().Format(time.RFC3339)}
+}
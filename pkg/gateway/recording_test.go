@@ -0,0 +1,32 @@
+package gateway
+
+import "testing"
+
+func TestRecordDryRun(t *testing.T) {
+	g := newTestGateway(t)
+
+	reply := g.handleRecordStop(testCmdRequest("record.stop", true), &struct{}{})
+	if reply.Ok || reply.ErrorCode != ErrCodeValidationFailed {
+		t.Errorf("dry run of record.stop without a recording replied %+v", reply)
+	}
+	reply = g.handleRecordStart(testCmdRequest("record.start", true), &RecordingRequest{Name: "expo"})
+	if !reply.Ok || !reply.DryRun {
+		t.Errorf("dry run of record.start replied %+v", reply)
+	}
+	if g.runningRecording() != nil {
+		t.Fatal("dry run of record.start started a recording")
+	}
+
+	if reply := g.handleRecordStart(testCmdRequest("record.start", false), &RecordingRequest{Name: "expo"}); !reply.Ok {
+		t.Fatalf("record.start replied %+v", reply)
+	}
+	t.Cleanup(func() { g.stopRecording() })
+	reply = g.handleRecordStop(testCmdRequest("record.stop", true), &struct{}{})
+	if !reply.Ok || !reply.DryRun || g.runningRecording() == nil {
+		t.Errorf("dry run of record.stop replied %+v and stopped the recording", reply)
+	}
+	reply = g.handleRecordStart(testCmdRequest("record.start", true), &RecordingRequest{})
+	if reply.Ok || reply.ErrorCode != ErrCodeLocked {
+		t.Errorf("dry run of record.start during a recording replied %+v", reply)
+	}
+}
@@ -0,0 +1,116 @@
+package gateway
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// RegistryInterval is the interval gateways announce themselves on
+	// RegistrySubject at. Entries not refreshed for three intervals are
+	// stale.
+	RegistryInterval = 30 * time.Second
+
+	// RegistrySubject is shared by all gateways on the bus, entries are
+	// plain JSON so that gateways with different schema versions can be
+	// listed together.
+	RegistrySubject = "z21.registry"
+	// RegistryDiscoverSubject is answered by every gateway with its
+	// registry entry.
+	RegistryDiscoverSubject = RegistrySubject + ".discover"
+)
+
+// RegistryEntry announces a gateway on RegistrySubject.
+type RegistryEntry struct {
+	Name string `json:"name"`
+	// ID is the NATS micro service ID of the gateway process.
+	ID string `json:"id"`
+	// Instance is the instance ID of the gateway process, see
+	// --instance_id.
+	Instance string `json:"instance"`
+	Version  string `json:"version"`
+	// State is online, or stopped when the gateway leaves.
+	State string `json:"state"`
+	// Subjects is the prefix of the subjects of the gateway.
+	Subjects       string        `json:"subjects"`
+	SchemaVersions []int         `json:"schema_versions"`
+	Z21Online      bool          `json:"z21_online"`
+	Capabilities   *Capabilities `json:"capabilities"`
+	StartedAt      string        `json:"started_at"`
+	Interval       string        `json:"interval"`
+	TS             string        `json:"ts"`
+}
+
+func (g *Gateway) registryEntry(state string) *RegistryEntry {
+	return &RegistryEntry{
+		Name:           g.name,
+		ID:             g.service.id,
+		Instance:       g.instance,
+		Version:        Version,
+		State:          state,
+		Subjects:       "z21." + g.name,
+		SchemaVersions: g.schemaVersions,
+		Z21Online:      g.isOnline.Load(),
+		Capabilities:   g.currentCapabilities(),
+		StartedAt:      g.startedAt.UTC().Format(time.RFC3339),
+		Interval:       RegistryInterval.String(),
+		TS:             time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// publishRegistryEntry announces the gateway on RegistrySubject.
+func (g *Gateway) publishRegistryEntry(state string) {
+	data, err := json.Marshal(g.registryEntry(state))
+	if err != nil {
+		return
+	}
+	msg := nats.NewMsg(RegistrySubject)
+	msg.Header.Set(TimestampHeader, time.Now().UTC().Format(time.RFC3339Nano))
+	msg.Data = data
+	if err := g.publishMsg(msg); err != nil {
+		g.logger.Error().
+			Err(err).
+			Msg("failed to publish registry entry")
+	}
+}
+
+func (g *Gateway) registryLoop() {
+	defer g.wg.Done()
+	ticker := time.NewTicker(RegistryInterval)
+	defer ticker.Stop()
+
+	g.publishRegistryEntry(GatewayOnline)
+
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-ticker.C:
+			g.publishRegistryEntry(GatewayOnline)
+		}
+	}
+}
+
+// subscribeRegistry answers discovery requests on RegistryDiscoverSubject.
+// The requests are not load balanced, every gateway answers, so callers
+// collect replies until a timeout.
+func (g *Gateway) subscribeRegistry() error {
+	_, err := g.subscribe(RegistryDiscoverSubject, func(msg *nats.Msg) {
+		if msg.Reply == "" {
+			g.publishRegistryEntry(GatewayOnline)
+			return
+		}
+		data, err := json.Marshal(g.registryEntry(GatewayOnline))
+		if err != nil {
+			return
+		}
+		if err := msg.Respond(data); err != nil {
+			g.logger.Error().
+				Err(err).
+				Msg("failed to answer registry discovery")
+		}
+	})
+	return err
+}
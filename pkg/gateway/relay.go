@@ -0,0 +1,189 @@
+package gateway
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/trains-io/z21.go"
+)
+
+// relayBufferSize fits the largest UDP datagram, so that the relay never
+// truncates one.
+const relayBufferSize = 65535
+
+// udpOptions tunes the relay sockets, see --udp_read_buffer,
+// --udp_write_buffer and --udp_readers.
+type udpOptions struct {
+	readBuffer  int
+	writeBuffer int
+	readers     int
+}
+
+// apply sets the buffer sizes of conn, keeping the OS default for 0.
+func (o udpOptions) apply(conn *net.UDPConn) error {
+	if o.readBuffer > 0 {
+		if err := conn.SetReadBuffer(o.readBuffer); err != nil {
+			return err
+		}
+	}
+	if o.writeBuffer > 0 {
+		if err := conn.SetWriteBuffer(o.writeBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// z21Relay forwards datagrams between z21.go and the Z21. z21.go creates
+// its UDP socket itself and offers no hook into it, so the gateway connects
+// z21.go to the loopback end of a relay and talks to the Z21 from a socket
+// of its own. The Z21 sees that socket as its client.
+type z21Relay struct {
+	g   *Gateway
+	z21 netip.AddrPort
+	// local is the loopback socket z21.go is connected to, upstream the
+	// socket exchanging datagrams with the Z21.
+	local    *net.UDPConn
+	upstream *net.UDPConn
+	// client is the address of the z21.go socket, learned from its first
+	// datagram.
+	client atomic.Pointer[netip.AddrPort]
+	// warned is set once a datagram of another source was warned about.
+	warned atomic.Bool
+	wg     sync.WaitGroup
+}
+
+// newZ21Relay starts a relay to the Z21 at addr.
+func (g *Gateway) newZ21Relay(addr string) (*z21Relay, error) {
+	ua, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	r := &z21Relay{g: g, z21: unmapAddrPort(ua.AddrPort())}
+	network := "udp4"
+	if r.z21.Addr().Is6() {
+		network = "udp6"
+	}
+	laddr, err := bindAddr(g.bind, addr)
+	if err != nil {
+		return nil, err
+	}
+	if r.upstream, err = net.ListenUDP(network, laddr); err != nil {
+		return nil, err
+	}
+	if r.local, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		r.upstream.Close()
+		return nil, err
+	}
+	for _, conn := range []*net.UDPConn{r.upstream, r.local} {
+		if err := g.udpOptions.apply(conn); err != nil {
+			r.upstream.Close()
+			r.local.Close()
+			return nil, err
+		}
+	}
+	readers := max(g.udpOptions.readers, 1)
+	r.wg.Add(1 + readers)
+	go r.forwardRequests()
+	for range readers {
+		go r.forwardAnswers()
+	}
+	return r, nil
+}
+
+// connectZ21 connects z21.go to the Z21 at addr through a new relay.
+func (g *Gateway) connectZ21(addr string) (*z21.Conn, *z21Relay, error) {
+	r, err := g.newZ21Relay(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	zc, err := z21.Connect(r.addr(), z21.Verbose(true))
+	if err != nil {
+		r.close()
+		return nil, nil, err
+	}
+	return zc, r, nil
+}
+
+// closeZ21 closes the connection to the active Z21 and its relay.
+func (g *Gateway) closeZ21() {
+	g.zc.Load().Close()
+	g.relay.Load().close()
+}
+
+// addr returns the address z21.go is connected to.
+func (r *z21Relay) addr() string {
+	return r.local.LocalAddr().String()
+}
+
+func (r *z21Relay) close() {
+	r.local.Close()
+	r.upstream.Close()
+	r.wg.Wait()
+}
+
+// forwardRequests sends the datagrams of z21.go to the Z21. Only the first
+// socket sending to the loopback end is relayed.
+func (r *z21Relay) forwardRequests() {
+	defer r.wg.Done()
+	buf := make([]byte, relayBufferSize)
+	for {
+		n, src, err := r.local.ReadFromUDPAddrPort(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			continue
+		}
+		if client := r.client.Load(); client == nil {
+			r.client.Store(&src)
+		} else if *client != src {
+			continue
+		}
+		r.g.publishRaw(RawTx, buf[:n])
+		r.upstream.WriteToUDPAddrPort(buf[:n], r.z21)
+	}
+}
+
+// forwardAnswers passes the datagrams of the Z21 on to z21.go. Datagrams of
+// any other source, e.g. a second central answering a broadcast, are
+// dropped. With --udp_readers above 1 several of them read the socket, and
+// datagrams arriving at once may be passed on out of order.
+func (r *z21Relay) forwardAnswers() {
+	defer r.wg.Done()
+	buf := make([]byte, relayBufferSize)
+	for {
+		n, src, err := r.upstream.ReadFromUDPAddrPort(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			continue
+		}
+		if src = unmapAddrPort(src); src.Addr().WithZone("") != r.z21.Addr().WithZone("") || src.Port() != r.z21.Port() {
+			r.g.foreignDatagram(r, src)
+			continue
+		}
+		r.g.publishRaw(RawRx, buf[:n])
+		if client := r.client.Load(); client != nil {
+			r.local.WriteToUDPAddrPort(buf[:n], *client)
+		}
+	}
+}
+
+// unmapAddrPort returns ap with IPv4-mapped IPv6 addresses as IPv4.
+func unmapAddrPort(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// foreignDatagram counts a datagram dropped by a relay for not coming from
+// the Z21 and warns about the first one of each connection.
+func (g *Gateway) foreignDatagram(r *z21Relay, src netip.AddrPort) {
+	g.stats.foreignDatagrams.Add(1)
+	if r.warned.Swap(true) {
+		return
+	}
+	g.publishWarning("z21_foreign_datagram", "a datagram not sent by the z21 was dropped",
+		map[string]any{"source": src.String(), "z21": r.z21.String()})
+}
@@ -0,0 +1,170 @@
+package gateway
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rs/zerolog"
+)
+
+const (
+	ReplaySpeed = 1.0
+
+	ReplayHeader = "Z21-Replay"
+
+	// maxRecordLine bounds a line of a recording, e.g. a state.get reply
+	// of a large layout.
+	maxRecordLine = 16 << 20
+)
+
+// ReplayOptions are the settings of the replay subcommand.
+type ReplayOptions struct {
+	// Recording is a local file or the name of an object in the recording
+	// bucket.
+	Recording string
+	Bucket    string
+	// Speed scales the recorded timing, 2 replays twice as fast.
+	Speed float64
+}
+
+// replayer publishes the messages of a recording again, with their
+// recorded timing, as device <name>.
+type replayer struct {
+	nc       *nats.Conn
+	device   string
+	versions []int
+	opts     ReplayOptions
+	logger   zerolog.Logger
+	seq      uint64
+}
+
+type replayRecord struct {
+	TS      string          `json:"ts"`
+	Dir     string          `json:"dir"`
+	Subject string          `json:"subject"`
+	Kind    string          `json:"kind"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// openRecording opens a local recording file or fetches the recording from
+// the Object Store.
+func openRecording(ctx context.Context, nc *nats.Conn, opts ReplayOptions) (io.ReadCloser, error) {
+	if f, err := os.Open(opts.Recording); err == nil {
+		return f, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+	store, err := js.ObjectStore(ctx, opts.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("object store %s: %w", opts.Bucket, err)
+	}
+	obj, err := store.Get(ctx, opts.Recording)
+	if err != nil {
+		return nil, fmt.Errorf("recording %s: %w", opts.Recording, err)
+	}
+	return obj, nil
+}
+
+func (r *replayer) Run(ctx context.Context) error {
+	rc, err := openRecording(ctx, r.nc, r.opts)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	gz, err := gzip.NewReader(rc)
+	if err != nil {
+		return fmt.Errorf("recording %s: %w", r.opts.Recording, err)
+	}
+	defer gz.Close()
+
+	r.logger.Info().
+		Str("recording", r.opts.Recording).
+		Str("device", r.device).
+		Float64("speed", r.opts.Speed).
+		Msg("replay started")
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64<<10), maxRecordLine)
+	var first time.Time
+	start := time.Now()
+	var published int
+	for scanner.Scan() {
+		var rec replayRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("recording %s: %w", r.opts.Recording, err)
+		}
+		// replies went to inboxes of the recorded session
+		if rec.Dir != RecordPub || rec.Kind == "reply" {
+			continue
+		}
+		ts, err := time.Parse(time.RFC3339Nano, rec.TS)
+		if err != nil {
+			return fmt.Errorf("recording %s: %w", r.opts.Recording, err)
+		}
+		if first.IsZero() {
+			first = ts
+		}
+		due := start.Add(time.Duration(float64(ts.Sub(first)) / r.opts.Speed))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Until(due)):
+		}
+		if err := r.publish(rec); err != nil {
+			return err
+		}
+		published++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("recording %s: %w", r.opts.Recording, err)
+	}
+	r.logger.Info().
+		Str("recording", r.opts.Recording).
+		Int("messages", published).
+		Dur("duration", time.Since(start)).
+		Msg("replay finished")
+	return nil
+}
+
+// publish publishes a recorded message on the subjects of the replay
+// device, once per schema version like the gateway does.
+func (r *replayer) publish(rec replayRecord) error {
+	// z21.<recorded device>.<rest>
+	parts := strings.SplitN(rec.Subject, ".", 3)
+	if len(parts) < 3 || parts[0] != "z21" {
+		return nil
+	}
+	r.seq++
+	ts := time.Now().UTC()
+	for i, version := range r.versions {
+		data, err := encodePayload(version, r.device, rec.Kind, r.seq, ts, rec.Data)
+		if err != nil {
+			return err
+		}
+		subject := fmt.Sprintf("z21.%s.%s", r.device, parts[2])
+		if i > 0 {
+			subject = fmt.Sprintf("z21.%s.v%d.%s", r.device, version, parts[2])
+		}
+		msg := newMsg(subject, version, r.seq, ts)
+		msg.Header.Set(ReplayHeader, "true")
+		msg.Data = data
+		if err := r.nc.PublishMsg(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// --replies modes, how commands published without a reply inbox are
+// answered.
+const (
+	// RepliesFallback answers them on z21.<name>.reply, with the subject of
+	// the command, so fire-and-forget publishers can match the outcome by
+	// their Request-Id.
+	RepliesFallback = "fallback"
+	// RepliesRequired rejects them unexecuted, a command nobody waits for
+	// is not sent to the z21.
+	RepliesRequired = "required"
+)
+
+func validateReplies(mode string) error {
+	switch mode {
+	case RepliesFallback, RepliesRequired:
+		return nil
+	}
+	return fmt.Errorf("unknown --replies %q, must be one of [%s %s]", mode, RepliesFallback, RepliesRequired)
+}
+
+// fallbackReplySubject returns the subject commands without a reply inbox
+// are answered on.
+func (g *Gateway) fallbackReplySubject() string {
+	return fmt.Sprintf("z21.%s.reply", g.name)
+}
+
+// rejectWithoutReply answers a command received without a reply inbox with
+// reply_required when --replies is required, reporting whether it did. The
+// rejection is published on the fallback subject, the only place a sender
+// without an inbox can learn about it. Queued commands are never rejected,
+// JetStream messages have no inbox.
+func (g *Gateway) rejectWithoutReply(msg *nats.Msg) bool {
+	if msg.Reply != "" || g.replies != RepliesRequired {
+		return false
+	}
+	name := g.commandName(msg.Subject)
+	id := requestID(msg)
+	logger := g.commandLogger(name, id)
+	logger.Warn().
+		Str("subject", msg.Subject).
+		Msg("command without reply inbox rejected")
+	g.sendCmdReply(msg, CmdReply{
+		Type:      name,
+		RequestID: id,
+		Device:    g.name,
+		Ok:        false,
+		Error:     fmt.Sprintf("%s sent without a reply inbox, send it as a request", name),
+		ErrorCode: ErrCodeReplyRequired,
+		TS:        time.Now().Format(time.RFC3339),
+	})
+	return true
+}
@@ -0,0 +1,166 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// RouteStepTimeout bounds the wait for the reply of a step set by the
+// gateway of another device.
+const RouteStepTimeout = 5 * time.Second
+
+// RouteConfig is a named route, the turnouts switched one after the other
+// to clear a path. Its steps may be on the z21s of other gateways, so a
+// route can span the command stations of a large layout.
+type RouteConfig struct {
+	Description string      `yaml:"description" json:"description,omitempty"`
+	Steps       []RouteStep `yaml:"steps" json:"steps"`
+}
+
+// RouteStep switches a turnout. Device is the z21 name of the gateway the
+// turnout is on, the gateway setting the route if empty. Name is resolved
+// through the turnout names of that gateway.
+type RouteStep struct {
+	Device  string `yaml:"device" json:"device,omitempty"`
+	Address uint16 `yaml:"address" json:"address,omitempty"`
+	Name    string `yaml:"name" json:"name,omitempty"`
+	Output  uint8  `yaml:"output" json:"output"`
+}
+
+// RouteRequest is the payload of route.set.
+type RouteRequest struct {
+	Route string `json:"route"`
+}
+
+// RouteResult is the result of route.set.
+type RouteResult struct {
+	Route string            `json:"route"`
+	Steps []RouteStepResult `json:"steps"`
+}
+
+// RouteStepResult is the reply to one step of a route.
+type RouteStepResult struct {
+	RouteStep
+	Ok        bool      `json:"ok"`
+	Error     string    `json:"error,omitempty"`
+	ErrorCode ErrorCode `json:"error_code,omitempty"`
+}
+
+func validateRoutes(routes map[string]RouteConfig) error {
+	for name, r := range routes {
+		if len(r.Steps) == 0 {
+			return fmt.Errorf("route %q: no steps", name)
+		}
+		for i, step := range r.Steps {
+			switch {
+			case step.Device != "" && subjectToken(step.Device) != step.Device:
+				return fmt.Errorf("route %q: step %d: invalid device %q", name, i+1, step.Device)
+			case step.Address == 0 && step.Name == "":
+				return fmt.Errorf("route %q: step %d: address or name required", name, i+1)
+			case step.Address > MaxAccessoryAddress:
+				return fmt.Errorf("route %q: step %d: address must be between 1 and %d", name, i+1, MaxAccessoryAddress)
+			case step.Output > 1:
+				return fmt.Errorf("route %q: step %d: output must be 0 or 1", name, i+1)
+			}
+		}
+	}
+	return nil
+}
+
+func (g *Gateway) handleRouteSet(cr *cmdRequest, req *RouteRequest) CmdReply {
+	route, ok := g.routes[req.Route]
+	if !ok {
+		return g.handleValidationError(cr, fmt.Errorf("unknown route %q", req.Route))
+	}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, Data: route, TS: time.Now().Format(time.RFC3339)}
+	}
+
+	return jobStarted(g.startJob(cr.name, func(ctx context.Context, j *job) (any, error) {
+		res := &RouteResult{Route: req.Route}
+		failed := 0
+		for i, step := range route.Steps {
+			if step.Device == "" {
+				step.Device = g.name
+			}
+			j.progress(float64(i)/float64(len(route.Steps)), fmt.Sprintf("setting step %d on %s", i+1, step.Device), nil)
+			reply := g.setRouteStep(ctx, cr, fmt.Sprintf("%s-%d", j.status.ID, i+1), step)
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return res, ctx.Err()
+			}
+			res.Steps = append(res.Steps, RouteStepResult{
+				RouteStep: step,
+				Ok:        reply.Ok,
+				Error:     reply.Error,
+				ErrorCode: reply.ErrorCode,
+			})
+			if !reply.Ok {
+				cr.logger.Warn().
+					Str("route", req.Route).
+					Int("step", i+1).
+					Str("device", step.Device).
+					Str("error", reply.Error).
+					Msg("route step failed")
+				failed++
+			}
+		}
+		if failed > 0 {
+			return res, fmt.Errorf("%d of %d steps failed", failed, len(route.Steps))
+		}
+		return res, nil
+	}))
+}
+
+// setRouteStep sends turnout.set for a step to the gateway of its device.
+// Steps of the gateway itself run like a command it received; the others are
+// requested over NATS with the client ID of the route request, so they are
+// subject to the same profile.
+func (g *Gateway) setRouteStep(ctx context.Context, cr *cmdRequest, id string, step RouteStep) CmdReply {
+	data, err := json.Marshal(TurnoutRequest{Address: step.Address, Name: step.Name, Output: step.Output})
+	if err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	msg := nats.NewMsg("z21." + step.Device + ".cmd.turnout.set")
+	msg.Header.Set(RequestIDHeader, id)
+	msg.Header.Set(SchemaVersionHeader, strconv.Itoa(SchemaV1))
+	if client := cr.msg.Header.Get(ClientIDHeader); client != "" {
+		msg.Header.Set(ClientIDHeader, client)
+	}
+	msg.Data = data
+
+	if step.Device == g.name {
+		reply, ok := g.execCmdMessage(msg, time.Now())
+		if !ok {
+			return CmdReply{Ok: false, Error: errHostStopped.Error(), ErrorCode: ErrCodeCanceled, TS: time.Now().Format(time.RFC3339)}
+		}
+		return reply
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, RouteStepTimeout)
+	defer cancel()
+	resp, err := g.nc.RequestMsgWithContext(ctx, msg)
+	if err != nil {
+		code := ErrCodeGatewayOffline
+		switch {
+		case errors.Is(err, nats.ErrNoResponders):
+			err = fmt.Errorf("no gateway serves device %s", step.Device)
+		case errors.Is(err, context.DeadlineExceeded):
+			err = fmt.Errorf("no reply from the gateway of device %s", step.Device)
+			code = ErrCodeTimeout
+		case errors.Is(err, context.Canceled):
+			code = ErrCodeCanceled
+		}
+		return CmdReply{Ok: false, Error: err.Error(), ErrorCode: code, TS: time.Now().Format(time.RFC3339)}
+	}
+	var reply CmdReply
+	if err := decodePayload(msgSchemaVersion(resp), resp.Data, &reply); err != nil {
+		return CmdReply{Ok: false, Error: fmt.Sprintf("invalid reply from device %s: %s", step.Device, err), ErrorCode: ErrCodeInternal, TS: time.Now().Format(time.RFC3339)}
+	}
+	return reply
+}
@@ -0,0 +1,132 @@
+package gateway
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+)
+
+// NATSAuth holds where the NATS credentials come from. Secrets are read on
+// every connect, so rotated files and helper output are picked up on
+// reconnect, and never appear in flags or logs.
+type NATSAuth struct {
+	User         string
+	PasswordFile string
+	TokenFile    string
+	CredsFile    string
+	NkeyFile     string
+	// CredsCmd is run with sh -c; its output is the password if User is
+	// set, the token otherwise.
+	CredsCmd string
+}
+
+func (a *NATSAuth) validate() error {
+	secrets := 0
+	for _, s := range []string{a.PasswordFile, a.TokenFile, a.CredsCmd} {
+		if s != "" {
+			secrets++
+		}
+	}
+	switch {
+	case secrets > 1:
+		return fmt.Errorf("--nats_password_file, --nats_token_file and --nats_creds_cmd are mutually exclusive")
+	case a.PasswordFile != "" && a.User == "":
+		return fmt.Errorf("--nats_password_file requires --nats_user")
+	case a.TokenFile != "" && a.User != "":
+		return fmt.Errorf("--nats_token_file and --nats_user are mutually exclusive")
+	case a.CredsFile != "" && a.NkeyFile != "":
+		return fmt.Errorf("--nats_creds and --nats_nkey are mutually exclusive")
+	}
+	return nil
+}
+
+// Options returns the NATS connect options authenticating with the
+// configured credentials.
+func (a *NATSAuth) Options(logger zerolog.Logger) ([]nats.Option, error) {
+	var opts []nats.Option
+	if a.CredsFile != "" {
+		opts = append(opts, nats.UserCredentials(a.CredsFile))
+	}
+	if a.NkeyFile != "" {
+		opt, err := nats.NkeyOptionFromSeed(a.NkeyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+
+	secret := func(file, env string) func() string {
+		return func() string {
+			var v string
+			var err error
+			switch {
+			case file != "":
+				v, err = readSecretFile(file)
+			case a.CredsCmd != "":
+				v, err = runSecretCmd(a.CredsCmd)
+			default:
+				v = os.Getenv(env)
+			}
+			if err != nil {
+				logger.Error().
+					Err(err).
+					Msg("NATS credentials")
+			}
+			return v
+		}
+	}
+	if a.User != "" {
+		password := secret(a.PasswordFile, "Z21_NATS_PASSWORD")
+		opts = append(opts, nats.UserInfoHandler(func() (string, string) {
+			return a.User, password()
+		}))
+	} else if a.TokenFile != "" || a.CredsCmd != "" || os.Getenv("Z21_NATS_TOKEN") != "" {
+		opts = append(opts, nats.TokenHandler(secret(a.TokenFile, "Z21_NATS_TOKEN")))
+	}
+	return opts, nil
+}
+
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func runSecretCmd(cmd string) (string, error) {
+	var stderr bytes.Buffer
+	c := exec.Command("sh", "-c", cmd)
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("--nats_creds_cmd: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// RedactURLs hides passwords and tokens embedded in a comma separated list
+// of NATS URLs.
+func RedactURLs(urls string) string {
+	parts := strings.Split(urls, ",")
+	for i, p := range parts {
+		u, err := url.Parse(strings.TrimSpace(p))
+		if err != nil {
+			continue
+		}
+		if u.User != nil {
+			if _, ok := u.User.Password(); !ok {
+				// nats://<token>@host
+				u.User = url.User("xxxxx")
+			}
+		}
+		parts[i] = u.Redacted()
+	}
+	return strings.Join(parts, ",")
+}
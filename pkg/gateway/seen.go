@@ -0,0 +1,109 @@
+package gateway
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+// SeenLoco is an entry of the seen locos registry.
+type SeenLoco struct {
+	Address   uint16 `json:"address"`
+	Name      string `json:"name,omitempty"`
+	FirstSeen string `json:"first_seen"`
+	LastSeen  string `json:"last_seen"`
+	// Source is the event the loco was last seen in: railcom or loco_info.
+	Source string `json:"source"`
+	// Detector is the detector that last reported the loco by RailCom.
+	Detector string `json:"detector,omitempty"`
+
+	lastSeen time.Time
+}
+
+// seenLocos records the locos reported by RailCom and LOCO_INFO broadcasts,
+// i.e. the locos currently on the track.
+type seenLocos struct {
+	mu    sync.Mutex
+	locos map[uint16]*SeenLoco
+}
+
+func newSeenLocos() *seenLocos {
+	return &seenLocos{locos: make(map[uint16]*SeenLoco)}
+}
+
+func (s *seenLocos) see(addr uint16, source, detector string, now time.Time) {
+	if addr == 0 || addr > MaxLocoAddress {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.locos[addr]
+	if !ok {
+		l = &SeenLoco{Address: addr, FirstSeen: now.UTC().Format(time.RFC3339)}
+		s.locos[addr] = l
+	}
+	l.lastSeen = now
+	l.LastSeen = now.UTC().Format(time.RFC3339)
+	l.Source = source
+	if detector != "" {
+		l.Detector = detector
+	}
+}
+
+// recordSeenLocos updates the seen locos registry from an event. It is only
+// called from the events loop.
+func (g *Gateway) recordSeenLocos(ev z21.Serializable) {
+	now := time.Now()
+	switch ev := ev.(type) {
+	case *z21.LocoInfo:
+		g.seen.see(ev.Address, "loco_info", "", now)
+	case *z21.RailComData:
+		g.seen.see(ev.Address, "railcom", "", now)
+	case *z21.CanDetector:
+		_, railcom, ok := detectorReading(ev)
+		if !ok {
+			return
+		}
+		detector := strings.Join(eventTokens(ev), ".")
+		for _, addr := range railcom {
+			g.seen.see(addr, "railcom", detector, now)
+		}
+	}
+}
+
+type seenRequest struct {
+	// Within restricts the result to locos seen within this duration.
+	Within string `json:"within,omitempty"`
+}
+
+func (g *Gateway) handleLocoSeen(cr *cmdRequest, req *seenRequest) CmdReply {
+	var within time.Duration
+	if req.Within != "" {
+		var err error
+		if within, err = time.ParseDuration(req.Within); err != nil || within <= 0 {
+			return g.handleValidationError(cr, fmt.Errorf("invalid within %q", req.Within))
+		}
+	}
+
+	g.seen.mu.Lock()
+	locos := make([]SeenLoco, 0, len(g.seen.locos))
+	for _, l := range g.seen.locos {
+		if within > 0 && time.Since(l.lastSeen) > within {
+			continue
+		}
+		entry := *l
+		entry.Name = g.names.sources[fmt.Sprintf("loco.%d", l.Address)]
+		if name, ok := g.names.sources[entry.Detector]; ok {
+			entry.Detector = name
+		}
+		locos = append(locos, entry)
+	}
+	g.seen.mu.Unlock()
+
+	slices.SortFunc(locos, func(a, b SeenLoco) int { return int(a.Address) - int(b.Address) })
+	return CmdReply{Ok: true, Data: locos, TS: time.Now().Format(time.RFC3339)}
+}
@@ -0,0 +1,157 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+const (
+	SelfTestBroadcastWait = 3 * time.Second
+)
+
+var selfTestSteps = []string{"serial", "hwinfo", "systemstate", "broadcast", "turnout"}
+
+// SelfTestStep is the outcome of a single self-test step.
+type SelfTestStep struct {
+	Name      string `json:"name"`
+	Mandatory bool   `json:"mandatory"`
+	Ok        bool   `json:"ok"`
+	Skipped   bool   `json:"skipped,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Duration  string `json:"duration"`
+	Result    any    `json:"result,omitempty"`
+}
+
+// SelfTestReport is published on z21.<name>.gateway.selftest.
+type SelfTestReport struct {
+	Ok    bool           `json:"ok"`
+	Steps []SelfTestStep `json:"steps"`
+	TS    string         `json:"ts"`
+}
+
+// parseSelfTestSteps parses a comma separated list of self-test step names.
+func parseSelfTestSteps(s string) ([]string, error) {
+	var steps []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(selfTestSteps, name) {
+			return nil, fmt.Errorf("unknown self-test step %q", name)
+		}
+		steps = append(steps, name)
+	}
+	return steps, nil
+}
+
+// runSelfTest runs all self-test steps, publishes the report and returns an
+// error if a mandatory step failed.
+func (g *Gateway) runSelfTest() error {
+	report := &SelfTestReport{Ok: true}
+	for _, name := range selfTestSteps {
+		step := g.runSelfTestStep(name)
+		step.Mandatory = slices.Contains(g.selfTestMandatory, name)
+		if !step.Ok && !step.Skipped && step.Mandatory {
+			report.Ok = false
+		}
+		report.Steps = append(report.Steps, step)
+
+		g.logger.Info().
+			Str("step", step.Name).
+			Bool("ok", step.Ok).
+			Bool("skipped", step.Skipped).
+			Str("error", step.Error).
+			Msg("self-test")
+	}
+	report.TS = time.Now().UTC().Format(time.RFC3339)
+
+	subject := fmt.Sprintf("z21.%s.gateway.selftest", g.name)
+	if err := g.publish(subject, "gateway.selftest", 0, report); err != nil {
+		g.logger.Error().
+			Err(err).
+			Msg("failed to publish self-test report")
+	}
+
+	if !report.Ok {
+		return fmt.Errorf("self-test failed")
+	}
+	return nil
+}
+
+func (g *Gateway) runSelfTestStep(name string) SelfTestStep {
+	step := SelfTestStep{Name: name}
+	start := time.Now()
+
+	var (
+		result any
+		err    error
+	)
+	switch name {
+	case "serial":
+		result, err = g.sendRcv(&z21.SerialNumber{})
+	case "hwinfo":
+		result, err = g.sendRcv(&z21.HWInfo{})
+	case "systemstate":
+		result, err = g.sendRcv(&z21.SystemState{})
+	case "broadcast":
+		err = g.selfTestBroadcast()
+	case "turnout":
+		if g.selfTestTurnout == 0 {
+			step.Skipped = true
+			break
+		}
+		err = g.selfTestToggleTurnout()
+	}
+
+	step.Duration = time.Since(start).Truncate(time.Millisecond).String()
+	if err != nil {
+		step.Error = err.Error()
+		return step
+	}
+	step.Ok = !step.Skipped
+	step.Result = result
+	return step
+}
+
+func (g *Gateway) sendRcv(req z21.Serializable) (z21.Serializable, error) {
+	g.record(RecordTx, "", eventTypeName(req), req)
+	ctx, cancel := context.WithTimeout(g.ctx, RequestTimeout)
+	defer cancel()
+	return g.z21SendRcv(ctx, req)
+}
+
+// selfTestBroadcast subscribes to broadcasts and waits for the first one.
+func (g *Gateway) selfTestBroadcast() error {
+	seen := g.stats.events.Load()
+	g.subscribeBroadcast()
+
+	deadline := time.After(SelfTestBroadcastWait)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.ctx.Done():
+			return g.ctx.Err()
+		case <-deadline:
+			return fmt.Errorf("no broadcast within %s", SelfTestBroadcastWait)
+		case <-ticker.C:
+			if g.stats.events.Load() > seen {
+				return nil
+			}
+		}
+	}
+}
+
+// selfTestToggleTurnout switches the test turnout to output 1 and back.
+func (g *Gateway) selfTestToggleTurnout() error {
+	if err := g.switchTurnout(g.selfTestTurnout, 1); err != nil {
+		return err
+	}
+	return g.switchTurnout(g.selfTestTurnout, 0)
+}
@@ -0,0 +1,185 @@
+package gateway
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// ServiceName is the name the gateway answers the NATS micro service
+// discovery under, so `nats micro ls`, `info` and `stats` list it.
+const ServiceName = "z21-gateway"
+
+const (
+	servicePingType  = "io.nats.micro.v1.ping_response"
+	serviceInfoType  = "io.nats.micro.v1.info_response"
+	serviceStatsType = "io.nats.micro.v1.stats_response"
+)
+
+// ServiceIdentity is the part common to all NATS micro discovery
+// responses.
+type ServiceIdentity struct {
+	Name     string            `json:"name"`
+	ID       string            `json:"id"`
+	Version  string            `json:"version"`
+	Metadata map[string]string `json:"metadata"`
+	Type     string            `json:"type"`
+}
+
+type ServiceEndpointInfo struct {
+	Name       string            `json:"name"`
+	Subject    string            `json:"subject"`
+	QueueGroup string            `json:"queue_group,omitempty"`
+	Metadata   map[string]string `json:"metadata"`
+}
+
+type ServiceInfo struct {
+	ServiceIdentity
+	Description string                `json:"description"`
+	Endpoints   []ServiceEndpointInfo `json:"endpoints"`
+}
+
+// ServiceEndpointStats has the shape of the NATS micro endpoint stats,
+// durations are in nanoseconds.
+type ServiceEndpointStats struct {
+	Name                  string `json:"name"`
+	Subject               string `json:"subject"`
+	QueueGroup            string `json:"queue_group,omitempty"`
+	NumRequests           int    `json:"num_requests"`
+	NumErrors             int    `json:"num_errors"`
+	LastError             string `json:"last_error"`
+	ProcessingTime        int64  `json:"processing_time"`
+	AverageProcessingTime int64  `json:"average_processing_time"`
+}
+
+type ServiceStats struct {
+	ServiceIdentity
+	Started   string                 `json:"started"`
+	Endpoints []ServiceEndpointStats `json:"endpoints"`
+}
+
+type endpointStats struct {
+	requests  int
+	errors    int
+	lastError string
+	total     time.Duration
+}
+
+// serviceStats counts requests, errors and processing time per command.
+type serviceStats struct {
+	id        string
+	mu        sync.Mutex
+	endpoints map[string]*endpointStats
+}
+
+func newServiceStats() *serviceStats {
+	return &serviceStats{id: nuid.Next(), endpoints: make(map[string]*endpointStats)}
+}
+
+func (s *serviceStats) record(command string, d time.Duration, reply CmdReply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.endpoints[command]
+	if !ok {
+		e = &endpointStats{}
+		s.endpoints[command] = e
+	}
+	e.requests++
+	e.total += d
+	if !reply.Ok {
+		e.errors++
+		e.lastError = reply.Error
+	}
+}
+
+func (g *Gateway) serviceIdentity(typ string) ServiceIdentity {
+	return ServiceIdentity{
+		Name:     ServiceName,
+		ID:       g.service.id,
+		Version:  Version,
+		Metadata: map[string]string{"device": g.name},
+		Type:     typ,
+	}
+}
+
+func (g *Gateway) serviceInfo() ServiceInfo {
+	info := ServiceInfo{
+		ServiceIdentity: g.serviceIdentity(serviceInfoType),
+		Description:     "z21 gateway " + g.name,
+	}
+	for _, name := range g.supportedCommands() {
+		info.Endpoints = append(info.Endpoints, ServiceEndpointInfo{
+			Name:     name,
+			Subject:  g.subjectPrefix + "cmd." + name,
+			Metadata: map[string]string{"class": commandClass(name)},
+		})
+	}
+	return info
+}
+
+func (g *Gateway) serviceStats() ServiceStats {
+	stats := ServiceStats{
+		ServiceIdentity: g.serviceIdentity(serviceStatsType),
+		Started:         g.startedAt.UTC().Format(time.RFC3339Nano),
+	}
+	g.service.mu.Lock()
+	defer g.service.mu.Unlock()
+	for _, name := range g.supportedCommands() {
+		es := ServiceEndpointStats{Name: name, Subject: g.subjectPrefix + "cmd." + name}
+		if e, ok := g.service.endpoints[name]; ok {
+			es.setStats(e)
+		}
+		stats.Endpoints = append(stats.Endpoints, es)
+	}
+	if e, ok := g.service.endpoints[unknownCommand]; ok {
+		es := ServiceEndpointStats{Name: unknownCommand, Subject: g.subjectPrefix + "cmd.>"}
+		es.setStats(e)
+		stats.Endpoints = append(stats.Endpoints, es)
+	}
+	return stats
+}
+
+func (es *ServiceEndpointStats) setStats(e *endpointStats) {
+	es.NumRequests = e.requests
+	es.NumErrors = e.errors
+	es.LastError = e.lastError
+	es.ProcessingTime = int64(e.total)
+	es.AverageProcessingTime = int64(e.total / time.Duration(e.requests))
+}
+
+// subscribeService answers the NATS micro discovery requests on
+// $SRV.<verb>, $SRV.<verb>.z21-gateway and $SRV.<verb>.z21-gateway.<id>.
+func (g *Gateway) subscribeService() error {
+	verbs := map[string]func() any{
+		"PING":  func() any { return g.serviceIdentity(servicePingType) },
+		"INFO":  func() any { return g.serviceInfo() },
+		"STATS": func() any { return g.serviceStats() },
+	}
+	for verb, response := range verbs {
+		handler := func(msg *nats.Msg) {
+			data, err := json.Marshal(response())
+			if err != nil {
+				return
+			}
+			if err := msg.Respond(data); err != nil {
+				g.logger.Error().
+					Err(err).
+					Str("subject", msg.Subject).
+					Msg("failed to answer service request")
+			}
+		}
+		for _, subject := range []string{
+			"$SRV." + verb,
+			"$SRV." + verb + "." + ServiceName,
+			"$SRV." + verb + "." + ServiceName + "." + g.service.id,
+		} {
+			if _, err := g.subscribe(subject, handler); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
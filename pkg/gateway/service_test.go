@@ -0,0 +1,25 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestServiceStatsCollapseUnknownCommands(t *testing.T) {
+	g := newTestGateway(t)
+	for _, name := range []string{"no.such", "made.up.1", "capabilities.get"} {
+		if _, ok := g.execCmdMessage(&nats.Msg{Subject: "z21.bench.cmd." + name, Header: nats.Header{}}, time.Now()); !ok {
+			t.Fatal("gateway stopped")
+		}
+	}
+	if len(g.service.endpoints) != 2 {
+		t.Errorf("%d endpoints recorded, want capabilities.get and %s", len(g.service.endpoints), unknownCommand)
+	}
+	stats := g.serviceStats()
+	last := stats.Endpoints[len(stats.Endpoints)-1]
+	if last.Name != unknownCommand || last.Subject != "z21.bench.cmd.>" || last.NumRequests != 2 || last.NumErrors != 2 {
+		t.Errorf("last endpoint %+v, want 2 failed requests of %s", last, unknownCommand)
+	}
+}
@@ -0,0 +1,270 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// SharedStateQueue is the number of writes waiting for the layout
+	// bucket before further ones are dropped.
+	SharedStateQueue = 1024
+	// sharedStateTimeout bounds a single read or write of the bucket.
+	sharedStateTimeout = 5 * time.Second
+)
+
+var bucketNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// SharedBlock is the value of block.<block> in the layout bucket.
+type SharedBlock struct {
+	Block    string   `json:"block"`
+	Occupied bool     `json:"occupied"`
+	Trains   []string `json:"trains"`
+	// Owner is the z21 name of the gateway whose detectors report the
+	// block. Only the owner writes the entry.
+	Owner string `json:"owner"`
+	TS    string `json:"ts"`
+}
+
+// SharedTrain is the value of train.<train> in the layout bucket, the
+// block a train was last reported in.
+type SharedTrain struct {
+	Train   string `json:"train"`
+	Address uint16 `json:"address"`
+	Block   string `json:"block"`
+	// Owner is the z21 name of the gateway that reported the train last.
+	// The entry passes to another gateway when the train enters one of its
+	// blocks, and only the owner removes it.
+	Owner     string `json:"owner"`
+	EnteredAt string `json:"entered_at"`
+	TS        string `json:"ts"`
+}
+
+// sharedState writes the blocks and trains of the gateway to a JetStream
+// KV bucket shared by the gateways of one layout. Writes are queued, so the
+// events loop is never held up by JetStream.
+type sharedState struct {
+	bucket string
+	kv     jetstream.KeyValue
+	queue  chan func(ctx context.Context) error
+	// revisions of the block entries owned by the gateway, so that a write
+	// fails instead of overwriting an entry another gateway took. It and
+	// conflicts are only touched from the shared state loop.
+	revisions map[string]uint64
+	// conflicts holds the blocks owned by another gateway, warned once.
+	conflicts map[string]bool
+}
+
+func newSharedState(bucket string) *sharedState {
+	if bucket == "" {
+		return nil
+	}
+	return &sharedState{
+		bucket:    bucket,
+		queue:     make(chan func(ctx context.Context) error, SharedStateQueue),
+		revisions: make(map[string]uint64),
+		conflicts: make(map[string]bool),
+	}
+}
+
+func validateBucketName(flag, name string) error {
+	if name != "" && !bucketNameRe.MatchString(name) {
+		return fmt.Errorf("--%s %q may only contain letters, digits, - and _", flag, name)
+	}
+	return nil
+}
+
+// sharedKey returns a KV key token for a block or train name.
+func sharedKey(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '=':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// startSharedState binds the layout bucket, creating it if no gateway did
+// yet, and starts the loop writing to it.
+func (g *Gateway) startSharedState() error {
+	js, err := jetstream.New(g.nc)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(g.ctx, sharedStateTimeout)
+	defer cancel()
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      g.shared.bucket,
+		Description: "z21-gateway layout state",
+	})
+	if err != nil {
+		return fmt.Errorf("create bucket %s: %w", g.shared.bucket, err)
+	}
+	g.shared.kv = kv
+	g.logger.Info().
+		Str("bucket", g.shared.bucket).
+		Msg("sharing layout state")
+	g.wg.Add(1)
+	go g.sharedStateLoop()
+	return nil
+}
+
+func (g *Gateway) sharedStateLoop() {
+	defer g.wg.Done()
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case write := <-g.shared.queue:
+			ctx, cancel := context.WithTimeout(g.ctx, sharedStateTimeout)
+			err := write(ctx)
+			cancel()
+			if err != nil && !errors.Is(err, context.Canceled) {
+				g.logger.Error().
+					Err(err).
+					Str("bucket", g.shared.bucket).
+					Msg("failed to write layout state")
+			}
+		}
+	}
+}
+
+// shareWrite queues a write to the layout bucket, dropping it if the queue
+// is full.
+func (g *Gateway) shareWrite(write func(ctx context.Context) error) {
+	select {
+	case g.shared.queue <- write:
+	default:
+		g.logger.Warn().
+			Str("bucket", g.shared.bucket).
+			Msg("layout state queue full, dropping write")
+	}
+}
+
+// shareBlock writes the state of a block of the gateway.
+func (g *Gateway) shareBlock(ev *BlockEvent) {
+	if g.shared == nil {
+		return
+	}
+	data, err := json.Marshal(&SharedBlock{
+		Block:    ev.Block,
+		Occupied: ev.Occupied,
+		Trains:   ev.Trains,
+		Owner:    g.name,
+		TS:       ev.TS,
+	})
+	if err != nil {
+		return
+	}
+	key, block := "block."+sharedKey(ev.Block), ev.Block
+	g.shareWrite(func(ctx context.Context) error {
+		return g.putOwnedBlock(ctx, key, block, data)
+	})
+}
+
+// putOwnedBlock writes a block entry the gateway owns. An entry created by
+// another gateway is left alone and warned about: two gateways configure a
+// block of the same name.
+func (g *Gateway) putOwnedBlock(ctx context.Context, key, block string, data []byte) error {
+	s := g.shared
+	if s.conflicts[key] {
+		return nil
+	}
+	if rev, ok := s.revisions[key]; ok {
+		rev, err := s.kv.Update(ctx, key, data, rev)
+		if err == nil {
+			s.revisions[key] = rev
+			return nil
+		}
+		if !errors.Is(err, jetstream.ErrKeyExists) {
+			return err
+		}
+		delete(s.revisions, key)
+	}
+	rev, err := s.kv.Create(ctx, key, data)
+	if err == nil {
+		s.revisions[key] = rev
+		return nil
+	}
+	if !errors.Is(err, jetstream.ErrKeyExists) {
+		return err
+	}
+
+	entry, err := s.kv.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	var current SharedBlock
+	if err := json.Unmarshal(entry.Value(), &current); err == nil && current.Owner != g.name {
+		s.conflicts[key] = true
+		g.publishWarning("shared_block_conflict", "another gateway owns a block of the same name in the layout bucket, it is not shared",
+			map[string]any{"block": block, "owner": current.Owner, "bucket": s.bucket})
+		return nil
+	}
+	// written by this gateway before it restarted
+	if rev, err = s.kv.Update(ctx, key, data, entry.Revision()); err != nil {
+		return err
+	}
+	s.revisions[key] = rev
+	return nil
+}
+
+// shareTrainEntered takes over the entry of a train entering a block of the
+// gateway.
+func (g *Gateway) shareTrainEntered(te *TrainEvent) {
+	if g.shared == nil {
+		return
+	}
+	data, err := json.Marshal(&SharedTrain{
+		Train:     te.Train,
+		Address:   te.Address,
+		Block:     te.Block,
+		Owner:     g.name,
+		EnteredAt: te.EnteredAt,
+		TS:        te.TS,
+	})
+	if err != nil {
+		return
+	}
+	key := "train." + sharedKey(te.Train)
+	g.shareWrite(func(ctx context.Context) error {
+		_, err := g.shared.kv.Put(ctx, key, data)
+		return err
+	})
+}
+
+// shareTrainLeft removes the entry of a train leaving a block of the
+// gateway, unless the train was reported by another gateway since.
+func (g *Gateway) shareTrainLeft(te *TrainEvent) {
+	if g.shared == nil {
+		return
+	}
+	key, block := "train."+sharedKey(te.Train), te.Block
+	g.shareWrite(func(ctx context.Context) error {
+		entry, err := g.shared.kv.Get(ctx, key)
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var current SharedTrain
+		if err := json.Unmarshal(entry.Value(), &current); err != nil || current.Owner != g.name || current.Block != block {
+			return nil
+		}
+		err = g.shared.kv.Delete(ctx, key, jetstream.LastRevision(entry.Revision()))
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			// another gateway took the entry meanwhile
+			return nil
+		}
+		return err
+	})
+}
@@ -0,0 +1,69 @@
+package gateway
+
+import (
+	"fmt"
+	"time"
+)
+
+// Shutdown reasons carried in the final gateway status.
+const (
+	ShutdownSignal = "signal"
+	ShutdownError  = "error"
+	ShutdownAdmin  = "admin"
+	// ShutdownSilent is set by the watchdog for a gateway that stopped
+	// publishing without announcing it, e.g. after a crash.
+	ShutdownSilent = "silent"
+	// ShutdownGuardrail stops a gateway exceeding its resource limits for
+	// its supervisor to restart it.
+	ShutdownGuardrail = "guardrail"
+)
+
+// GuardrailExitCode is the exit status after a guardrail shutdown, which
+// makes supervisors like systemd with Restart=on-failure restart the
+// gateway.
+const GuardrailExitCode = 3
+
+type shutdownReason struct {
+	reason  string
+	message string
+}
+
+// Shutdown stops the gateway for reason, the first reason given wins. The
+// caller of Start still has to call Stop.
+func (g *Gateway) Shutdown(reason, message string) {
+	g.stopReason.CompareAndSwap(nil, &shutdownReason{reason: reason, message: message})
+	g.cancel()
+}
+
+// StopReason returns why the gateway shut down, empty while it runs.
+func (g *Gateway) StopReason() string {
+	if r := g.stopReason.Load(); r != nil {
+		return r.reason
+	}
+	return ""
+}
+
+// Done is closed once the gateway shuts down.
+func (g *Gateway) Done() <-chan struct{} {
+	return g.ctx.Done()
+}
+
+type stopRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+func (g *Gateway) handleGatewayStop(cr *cmdRequest, req *stopRequest) CmdReply {
+	message := req.Reason
+	if message == "" {
+		message = "gateway.stop"
+	}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, TS: time.Now().Format(time.RFC3339)}
+	}
+	cr.logger.Warn().
+		Str("client", cr.msg.Header.Get(ClientIDHeader)).
+		Str("reason", message).
+		Msg("stop requested")
+	g.Shutdown(ShutdownAdmin, message)
+	return CmdReply{Ok: true, Data: fmt.Sprintf("stopping: %s", message), TS: time.Now().Format(time.RFC3339)}
+}
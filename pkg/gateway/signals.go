@@ -0,0 +1,59 @@
+package gateway
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/trains-io/z21.go"
+)
+
+// SignalConfig maps the aspects of a multi-aspect signal, driven by an
+// extended accessory decoder, to the decoder values.
+type SignalConfig struct {
+	Address uint16           `yaml:"address"`
+	Aspects map[string]uint8 `yaml:"aspects"`
+}
+
+// SignalRequest is the payload of the signal.set command.
+type SignalRequest struct {
+	Name   string `json:"name" payload:"required"`
+	Aspect string `json:"aspect" payload:"required"`
+}
+
+func validateSignals(signals map[string]SignalConfig) error {
+	for name, sig := range signals {
+		if sig.Address == 0 || sig.Address > MaxAccessoryAddress {
+			return fmt.Errorf("signal %q: address must be between 1 and %d", name, MaxAccessoryAddress)
+		}
+		if len(sig.Aspects) == 0 {
+			return fmt.Errorf("signal %q: no aspects", name)
+		}
+	}
+	return nil
+}
+
+func (g *Gateway) handleSignalSet(cr *cmdRequest, req *SignalRequest) CmdReply {
+	sig, ok := g.signals[req.Name]
+	if !ok {
+		return g.handleValidationError(cr, fmt.Errorf("unknown signal %q", req.Name))
+	}
+	value, ok := sig.Aspects[req.Aspect]
+	if !ok {
+		aspects := make([]string, 0, len(sig.Aspects))
+		for aspect := range sig.Aspects {
+			aspects = append(aspects, aspect)
+		}
+		slices.Sort(aspects)
+		return g.handleValidationError(cr, fmt.Errorf("signal %q has no aspect %q, want one of %s",
+			req.Name, req.Aspect, strings.Join(aspects, ", ")))
+	}
+	if err := g.validateAccessory(sig.Address); err != nil {
+		return g.handleValidationError(cr, err)
+	}
+
+	return g.handleRequest(cr, &z21.ExtAccessory{
+		Address: uint16(int(sig.Address) + g.accessoryOffset),
+		Value:   value,
+	})
+}
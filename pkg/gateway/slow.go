@@ -0,0 +1,39 @@
+package gateway
+
+import (
+	"fmt"
+	"time"
+)
+
+// cmdTiming splits the latency of a command into where the time was
+// spent.
+type cmdTiming struct {
+	// queued is the time from receiving the command to starting its
+	// execution, waiting for a worker and a command slot.
+	queued time.Duration
+	// executed is the time from starting the execution to the reply.
+	executed time.Duration
+	// z21 is the part of executed spent on Z21 requests, including the
+	// pulse of a turnout.
+	z21 time.Duration
+}
+
+// checkSlowCommand warns about a command whose end-to-end latency exceeds
+// --slow_command.
+func (g *Gateway) checkSlowCommand(reply CmdReply, timing *cmdTiming) {
+	total := timing.queued + timing.executed
+	if g.slowCommand <= 0 || total <= g.slowCommand {
+		return
+	}
+	g.stats.slowCommands.Add(1)
+	g.publishWarning("slow_command",
+		fmt.Sprintf("%s took %s, above --slow_command %s", reply.Type, total.Round(time.Millisecond), g.slowCommand),
+		map[string]any{
+			"command":    reply.Type,
+			"request_id": reply.RequestID,
+			"total_ms":   millis(total),
+			"queue_ms":   millis(timing.queued),
+			"z21_ms":     millis(timing.z21),
+			"gateway_ms": millis(timing.executed - timing.z21),
+		})
+}
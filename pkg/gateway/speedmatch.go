@@ -0,0 +1,357 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+const (
+	SpeedMatchRunTimeout = 2 * time.Minute
+	// speedMatchSettle is the pause after stopping a loco before it is
+	// driven back through the section.
+	speedMatchSettle = 3 * time.Second
+
+	SpeedMatchModeCV         = "cv"
+	SpeedMatchModeSpeedTable = "speed_table"
+
+	cvVstart = 2
+	cvVmax   = 5
+	cvVmid   = 6
+	// cvSpeedTable is the first of the 28 speed table CVs (67-94).
+	cvSpeedTable    = 67
+	speedTableSteps = 28
+)
+
+var defaultSpeedMatchSpeeds = []float64{20, 40, 60, 80, 100}
+
+// SpeedMatchLoco is a loco taking part in speed matching.
+type SpeedMatchLoco struct {
+	Address uint16 `json:"address"`
+	Name    string `json:"name,omitempty"`
+	// CVs holds the current values of the speed CVs of the loco; only
+	// needed for the loco being matched.
+	CVs map[uint16]uint8 `json:"cvs,omitempty"`
+}
+
+// SpeedMatchRequest is the payload of the cv.speedmatch command. Both locos
+// are placed in front of the measuring section between the entry and exit
+// detectors, which are DistanceMM apart. At every speed each loco in turn
+// runs forward through the section and back.
+type SpeedMatchRequest struct {
+	Reference SpeedMatchLoco `json:"reference"`
+	Loco      SpeedMatchLoco `json:"loco"`
+	// Entry and Exit are detector names or sources, e.g. "can.1234.2".
+	Entry      string  `json:"entry"`
+	Exit       string  `json:"exit"`
+	DistanceMM float64 `json:"distance_mm"`
+	// Scale, e.g. 87 for H0, adds scale speeds to the samples.
+	Scale  float64   `json:"scale,omitempty"`
+	Speeds []float64 `json:"speeds,omitempty"`
+	// Mode selects CV2/5/6 (cv) or the speed table (speed_table).
+	Mode       string `json:"mode,omitempty"`
+	Apply      bool   `json:"apply,omitempty"`
+	RunTimeout string `json:"run_timeout,omitempty"`
+}
+
+// SpeedSample is the measured speed of both locos at one speed.
+type SpeedSample struct {
+	Speed        float64 `json:"speed"`
+	Reference    float64 `json:"reference_mm_s"`
+	Loco         float64 `json:"loco_mm_s"`
+	ReferenceKMH float64 `json:"reference_kmh,omitempty"`
+	LocoKMH      float64 `json:"loco_kmh,omitempty"`
+	// Ratio is the factor the speed of the loco has to be scaled with to
+	// match the reference.
+	Ratio float64 `json:"ratio"`
+}
+
+// SpeedMatchResult is the result of a cv.speedmatch job.
+type SpeedMatchResult struct {
+	Samples []SpeedSample `json:"samples"`
+	// CVs are the suggested values for the matched loco.
+	CVs     map[uint16]uint8 `json:"cvs,omitempty"`
+	Applied bool             `json:"applied"`
+}
+
+type speedMatch struct {
+	req        *SpeedMatchRequest
+	ref, loco  uint16
+	entry      string
+	exit       string
+	runTimeout time.Duration
+}
+
+func (g *Gateway) handleSpeedMatch(cr *cmdRequest, req *SpeedMatchRequest) CmdReply {
+	sm, err := g.newSpeedMatch(cr, req)
+	if err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, Data: req, TS: time.Now().Format(time.RFC3339)}
+	}
+	return jobStarted(g.startJob(cr.name, sm.run))
+}
+
+func (g *Gateway) newSpeedMatch(cr *cmdRequest, req *SpeedMatchRequest) (*speedMatch, error) {
+	sm := &speedMatch{req: req, runTimeout: SpeedMatchRunTimeout}
+	var err error
+	if sm.ref, err = g.speedMatchLoco("reference", &req.Reference); err != nil {
+		return nil, err
+	}
+	if sm.loco, err = g.speedMatchLoco("loco", &req.Loco); err != nil {
+		return nil, err
+	}
+	if sm.ref == sm.loco {
+		return nil, fmt.Errorf("reference and loco must differ")
+	}
+	if sm.entry, err = g.names.resolveDetector(req.Entry); err != nil {
+		return nil, err
+	}
+	if sm.exit, err = g.names.resolveDetector(req.Exit); err != nil {
+		return nil, err
+	}
+	if sm.entry == sm.exit {
+		return nil, fmt.Errorf("entry and exit detector must differ")
+	}
+	if req.DistanceMM <= 0 {
+		return nil, fmt.Errorf("distance_mm must be positive")
+	}
+	if req.Scale < 0 {
+		return nil, fmt.Errorf("scale must not be negative")
+	}
+	if len(req.Speeds) == 0 {
+		req.Speeds = defaultSpeedMatchSpeeds
+	}
+	req.Speeds = slices.Sorted(slices.Values(req.Speeds))
+	for _, speed := range req.Speeds {
+		if speed <= 0 || speed > 100 {
+			return nil, fmt.Errorf("speeds must be between 0 and 100")
+		}
+		if cr.profile != nil && cr.profile.capSpeed(speed) != speed {
+			return nil, fmt.Errorf("speed %g exceeds the profile limit", speed)
+		}
+	}
+	switch req.Mode {
+	case "":
+		req.Mode = SpeedMatchModeCV
+	case SpeedMatchModeCV, SpeedMatchModeSpeedTable:
+	default:
+		return nil, fmt.Errorf("mode must be %s or %s", SpeedMatchModeCV, SpeedMatchModeSpeedTable)
+	}
+	if req.Apply && req.Mode == SpeedMatchModeCV {
+		for _, cv := range []uint16{cvVstart, cvVmid, cvVmax} {
+			if _, ok := req.Loco.CVs[cv]; !ok {
+				return nil, fmt.Errorf("apply needs the current value of CV%d", cv)
+			}
+		}
+	}
+	if req.RunTimeout != "" {
+		if sm.runTimeout, err = time.ParseDuration(req.RunTimeout); err != nil || sm.runTimeout <= 0 {
+			return nil, fmt.Errorf("invalid run_timeout %q", req.RunTimeout)
+		}
+	}
+	return sm, nil
+}
+
+func (g *Gateway) speedMatchLoco(role string, l *SpeedMatchLoco) (uint16, error) {
+	addr, err := g.names.resolveLoco(l.Name, l.Address)
+	if err != nil {
+		return 0, err
+	}
+	if addr == 0 || addr > MaxLocoAddress {
+		return 0, fmt.Errorf("%s address must be between 1 and %d", role, MaxLocoAddress)
+	}
+	return addr, nil
+}
+
+func (sm *speedMatch) run(ctx context.Context, j *job) (any, error) {
+	g := j.g
+	defer func() {
+		g.driveLoco(sm.ref, 0, true)
+		g.driveLoco(sm.loco, 0, true)
+	}()
+
+	res := &SpeedMatchResult{}
+	steps := float64(len(sm.req.Speeds) * 2)
+	for i, speed := range sm.req.Speeds {
+		sample := SpeedSample{Speed: speed}
+		var err error
+		j.progress(float64(2*i)/steps, fmt.Sprintf("measuring reference at %g%%", speed), res.Samples)
+		if sample.Reference, err = sm.measure(ctx, g, sm.ref, speed); err != nil {
+			return res, fmt.Errorf("reference at %g%%: %w", speed, err)
+		}
+		j.progress(float64(2*i+1)/steps, fmt.Sprintf("measuring loco at %g%%", speed), res.Samples)
+		if sample.Loco, err = sm.measure(ctx, g, sm.loco, speed); err != nil {
+			return res, fmt.Errorf("loco at %g%%: %w", speed, err)
+		}
+		sample.Ratio = sample.Reference / sample.Loco
+		if sm.req.Scale > 0 {
+			sample.ReferenceKMH = scaleSpeed(sample.Reference, sm.req.Scale)
+			sample.LocoKMH = scaleSpeed(sample.Loco, sm.req.Scale)
+		}
+		res.Samples = append(res.Samples, sample)
+	}
+
+	if sm.req.Mode == SpeedMatchModeSpeedTable {
+		res.CVs = speedTableCVs(res.Samples, sm.req.Loco.CVs)
+	} else {
+		res.CVs = speedCVs(res.Samples, sm.req.Loco.CVs)
+	}
+
+	if sm.req.Apply {
+		j.progress(1, "writing CVs", res.Samples)
+		for _, cv := range sortedKeys(res.CVs) {
+			if _, err := g.sendRcv(&z21.CVPOMWrite{Address: sm.loco, CV: cv, Value: res.CVs[cv]}); err != nil {
+				return res, fmt.Errorf("write CV%d: %w", cv, err)
+			}
+		}
+		res.Applied = true
+	}
+	return res, nil
+}
+
+// measure runs the loco forward through the measuring section and back and
+// returns its average speed in mm/s.
+func (sm *speedMatch) measure(ctx context.Context, g *Gateway, addr uint16, speed float64) (float64, error) {
+	var total time.Duration
+	for _, forward := range []bool{true, false} {
+		first, second := sm.entry, sm.exit
+		if !forward {
+			first, second = second, first
+		}
+		d, err := sm.pass(ctx, g, addr, speed, forward, first, second)
+		if err != nil {
+			return 0, err
+		}
+		total += d
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(speedMatchSettle):
+		}
+	}
+	return sm.req.DistanceMM / (total / 2).Seconds(), nil
+}
+
+// pass drives the loco until it has occupied first and then second and
+// returns the time in between.
+func (sm *speedMatch) pass(ctx context.Context, g *Gateway, addr uint16, speed float64, forward bool, first, second string) (time.Duration, error) {
+	events, untap := g.taps.tap()
+	defer untap()
+
+	ctx, cancel := context.WithTimeout(ctx, sm.runTimeout)
+	defer cancel()
+
+	if err := g.driveLoco(addr, speed, forward); err != nil {
+		return 0, err
+	}
+	defer g.driveLoco(addr, 0, forward)
+
+	var enteredAt time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return 0, fmt.Errorf("loco %d did not pass the measuring section within %s", addr, sm.runTimeout)
+			}
+			return 0, ctx.Err()
+		case ev := <-events:
+			occupied, _, ok := detectorReading(ev)
+			if !ok || occupied == nil || !*occupied {
+				continue
+			}
+			switch strings.Join(eventTokens(ev), ".") {
+			case first:
+				if enteredAt.IsZero() {
+					enteredAt = time.Now()
+				}
+			case second:
+				if !enteredAt.IsZero() {
+					return time.Since(enteredAt), nil
+				}
+			}
+		}
+	}
+}
+
+// driveLoco drives loco addr with speed in percent in its speed step mode.
+func (g *Gateway) driveLoco(addr uint16, speed float64, forward bool) error {
+	g.markActivity()
+	steps := g.speedSteps.mode(addr)
+	_, err := g.sendRcv(&z21.LocoDrive{
+		Address:    addr,
+		Speed:      speedCode(speed, steps),
+		Forward:    forward,
+		SpeedSteps: steps,
+	})
+	return err
+}
+
+// scaleSpeed converts a model speed in mm/s to the scale speed in km/h.
+func scaleSpeed(mmPerSecond, scale float64) float64 {
+	return math.Round(mmPerSecond*scale*3.6/1000*10) / 10
+}
+
+// speedCVs suggests CV2 (Vstart), CV6 (Vmid) and CV5 (Vmax) from the samples
+// at the lowest, middle and highest speed, for the CVs whose current value
+// is known.
+func speedCVs(samples []SpeedSample, current map[uint16]uint8) map[uint16]uint8 {
+	mid := samples[0]
+	for _, s := range samples {
+		if math.Abs(s.Speed-50) < math.Abs(mid.Speed-50) {
+			mid = s
+		}
+	}
+	points := map[uint16]SpeedSample{
+		cvVstart: samples[0],
+		cvVmid:   mid,
+		cvVmax:   samples[len(samples)-1],
+	}
+
+	cvs := make(map[uint16]uint8)
+	for cv, s := range points {
+		if v, ok := current[cv]; ok {
+			cvs[cv] = scaleCV(v, s.Ratio)
+		}
+	}
+	return cvs
+}
+
+// speedTableCVs suggests the speed table CVs 67-94, interpolating the ratio
+// between the samples. Missing current values default to a linear table.
+func speedTableCVs(samples []SpeedSample, current map[uint16]uint8) map[uint16]uint8 {
+	cvs := make(map[uint16]uint8)
+	for i := range speedTableSteps {
+		cv := uint16(cvSpeedTable + i)
+		v, ok := current[cv]
+		if !ok {
+			v = uint8(math.Round(float64(i+1) * 255 / speedTableSteps))
+		}
+		cvs[cv] = scaleCV(v, interpolateRatio(samples, float64(i+1)*100/speedTableSteps))
+	}
+	return cvs
+}
+
+func interpolateRatio(samples []SpeedSample, speed float64) float64 {
+	if speed <= samples[0].Speed {
+		return samples[0].Ratio
+	}
+	for i := 1; i < len(samples); i++ {
+		lo, hi := samples[i-1], samples[i]
+		if speed <= hi.Speed {
+			return lo.Ratio + (hi.Ratio-lo.Ratio)*(speed-lo.Speed)/(hi.Speed-lo.Speed)
+		}
+	}
+	return samples[len(samples)-1].Ratio
+}
+
+func scaleCV(v uint8, ratio float64) uint8 {
+	return uint8(math.Max(1, math.Min(255, math.Round(float64(v)*ratio))))
+}
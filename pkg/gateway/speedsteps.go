@@ -0,0 +1,116 @@
+package gateway
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/trains-io/z21.go"
+)
+
+// DefaultSpeedSteps is the speed step mode of locos neither configured nor
+// reported by the Z21.
+const DefaultSpeedSteps = 128
+
+// speedStepsByCode maps the speed step codes of LAN_X_LOCO_INFO to modes,
+// for events reporting the code rather than the mode.
+var speedStepsByCode = map[uint8]uint8{0: 14, 2: 28, 4: 128}
+
+// resolveSpeedSteps returns the configured speed step modes by loco address.
+// Locos are given by name or address.
+func resolveSpeedSteps(modes map[string]int, names NameConfig) (map[uint16]uint8, error) {
+	byAddr := make(map[uint16]uint8, len(modes))
+	for loco, steps := range modes {
+		addr, ok := names.Locos[loco]
+		if !ok {
+			n, err := strconv.ParseUint(loco, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("speed_steps: unknown loco %q", loco)
+			}
+			addr = uint16(n)
+		}
+		if addr == 0 || addr > MaxLocoAddress {
+			return nil, fmt.Errorf("speed_steps: %s: address must be between 1 and %d", loco, MaxLocoAddress)
+		}
+		if steps != 14 && steps != 28 && steps != 128 {
+			return nil, fmt.Errorf("speed_steps: %s: must be 14, 28 or 128", loco)
+		}
+		if _, dup := byAddr[addr]; dup {
+			return nil, fmt.Errorf("speed_steps: loco %d is configured twice", addr)
+		}
+		byAddr[addr] = uint8(steps)
+	}
+	return byAddr, nil
+}
+
+// speedStepTable holds the speed step mode of each loco: the configured
+// one, else the one the Z21 last reported in a loco info.
+type speedStepTable struct {
+	configured map[uint16]uint8
+	// mu guards detected, written by the events loop and read by the
+	// command workers.
+	mu       sync.Mutex
+	detected map[uint16]uint8
+}
+
+func newSpeedStepTable(configured map[uint16]uint8) *speedStepTable {
+	return &speedStepTable{configured: configured, detected: make(map[uint16]uint8)}
+}
+
+// mode returns the speed step mode of a loco.
+func (t *speedStepTable) mode(addr uint16) uint8 {
+	if steps, ok := t.configured[addr]; ok {
+		return steps
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if steps, ok := t.detected[addr]; ok {
+		return steps
+	}
+	return DefaultSpeedSteps
+}
+
+// detectSpeedSteps records the speed step mode of loco info events. It is
+// only called from the events loop.
+func (g *Gateway) detectSpeedSteps(ev z21.Serializable) {
+	info, ok := ev.(*z21.LocoInfo)
+	if !ok {
+		return
+	}
+	addr, v := info.Address, info.SpeedSteps
+	steps, ok := speedStepsByCode[v]
+	if !ok {
+		if v != 14 && v != 28 && v != 128 {
+			return
+		}
+		steps = v
+	}
+	t := g.speedSteps
+	t.mu.Lock()
+	t.detected[addr] = steps
+	t.mu.Unlock()
+}
+
+// speedCode converts a speed in percent to the speed byte of a speed step
+// mode, skipping the emergency stop codes.
+func speedCode(percent float64, steps uint8) uint8 {
+	switch steps {
+	case 14:
+		step := math.Round(percent / 100 * 14)
+		if step == 0 {
+			return 0
+		}
+		return uint8(step) + 1
+	case 28:
+		step := uint8(math.Round(percent / 100 * 28))
+		if step == 0 {
+			return 0
+		}
+		// codes 0 to 3 stop and emergency stop, the fifth bit is the least
+		// significant one
+		code := step + 3
+		return code>>1 | code&0x01<<4
+	}
+	return speedStep(percent)
+}
@@ -0,0 +1,29 @@
+package gateway
+
+import "testing"
+
+func TestSpeedCode(t *testing.T) {
+	for _, tt := range []struct {
+		percent float64
+		steps   uint8
+		want    uint8
+	}{
+		{0, 14, 0},
+		{1, 14, 0},
+		{50, 14, 8},
+		{100, 14, 15},
+		// the fifth bit is the least significant one of the 28 steps
+		{0, 28, 0},
+		{100.0 / 28, 28, 0x02},
+		{200.0 / 28, 28, 0x12},
+		{300.0 / 28, 28, 0x03},
+		{100, 28, 0x1f},
+		{0, 128, 0},
+		{40, 128, 51},
+		{100, 128, 127},
+	} {
+		if got := speedCode(tt.percent, tt.steps); got != tt.want {
+			t.Errorf("speedCode(%v, %d) = %#x, want %#x", tt.percent, tt.steps, got, tt.want)
+		}
+	}
+}
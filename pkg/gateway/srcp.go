@@ -0,0 +1,551 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/trains-io/z21.go"
+)
+
+const (
+	// SRCPVersion is the version of the Simple Railroad Command Protocol
+	// served on --srcp_addr, http://srcpd.sourceforge.net/srcp/.
+	SRCPVersion = "0.8.4"
+	// srcpBus is the bus of the Z21; bus 0 is the server itself.
+	srcpBus = "1"
+	// srcpVMax is the V_max of GL infos, the speed steps of LOCO_INFO
+	// without the emergency stop step.
+	srcpVMax = MaxSpeedStep
+)
+
+// SRCP drive modes of the GL device group.
+const (
+	srcpReverse       = 0
+	srcpForward       = 1
+	srcpEmergencyStop = 2
+)
+
+// srcpError is an SRCP error reply.
+type srcpError struct {
+	code int
+	text string
+}
+
+func (e *srcpError) Error() string {
+	return fmt.Sprintf("%d ERROR %s", e.code, e.text)
+}
+
+var (
+	errSRCPProtocol          = &srcpError{400, "unsupported protocol"}
+	errSRCPConnectionMode    = &srcpError{401, "unsupported connection mode"}
+	errSRCPUnknownCommand    = &srcpError{410, "unknown command"}
+	errSRCPWrongValue        = &srcpError{412, "wrong value"}
+	errSRCPForbidden         = &srcpError{415, "forbidden"}
+	errSRCPNoData            = &srcpError{416, "no data"}
+	errSRCPTimeout           = &srcpError{417, "timeout"}
+	errSRCPListTooShort      = &srcpError{419, "list too short"}
+	errSRCPDeviceProtocol    = &srcpError{420, "unsupported device protocol"}
+	errSRCPUnsupportedDevice = &srcpError{421, "unsupported device"}
+	errSRCPUnsupportedOp     = &srcpError{423, "unsupported operation"}
+	errSRCPUnspecified       = &srcpError{499, "unspecified error"}
+)
+
+// srcpSessions numbers the SRCP sessions of all listeners.
+var srcpSessions atomic.Uint64
+
+// srcpLoco is the last drive command of a loco, returned by GET GL.
+type srcpLoco struct {
+	driveMode int
+	v, vMax   int
+}
+
+// srcpSession is an SRCP client connection. Command sessions send their
+// commands as NATS requests, so that other consumers see them like any
+// other command; info sessions receive the Z21 events.
+type srcpSession struct {
+	g  *Gateway
+	id uint64
+	w  *bufio.Writer
+	// locos holds the last drive command of each loco set in the session.
+	locos map[uint16]srcpLoco
+}
+
+// startSRCP starts the SRCP listener, through which Rocrail and other SRCP
+// clients use the gateway as command station.
+func (g *Gateway) startSRCP() error {
+	ln, err := net.Listen("tcp", g.srcpAddr)
+	if err != nil {
+		return err
+	}
+	g.logger.Info().
+		Str("addr", ln.Addr().String()).
+		Str("version", SRCPVersion).
+		Msg("SRCP listener started")
+
+	g.wg.Add(2)
+	go func() {
+		defer g.wg.Done()
+		<-g.ctx.Done()
+		ln.Close()
+	}()
+	go func() {
+		defer g.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if g.ctx.Err() == nil {
+					g.logger.Error().
+						Err(err).
+						Msg("SRCP listener failed")
+				}
+				return
+			}
+			g.wg.Add(1)
+			go func() {
+				defer g.wg.Done()
+				g.serveSRCP(conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// serveSRCP runs an SRCP session: the handshake, then the command or info
+// mode chosen in it until the client or the gateway ends the session.
+func (g *Gateway) serveSRCP(conn net.Conn) {
+	defer conn.Close()
+	stop := context.AfterFunc(g.ctx, func() { conn.Close() })
+	defer stop()
+
+	s := &srcpSession{
+		g:     g,
+		id:    srcpSessions.Add(1),
+		w:     bufio.NewWriter(conn),
+		locos: make(map[uint16]srcpLoco),
+	}
+	lines := bufio.NewScanner(conn)
+	lines.Buffer(make([]byte, 0, 1024), MaxPayloadSize)
+
+	fmt.Fprintf(s.w, "z21-gateway; SRCP %s; SRCPOTHER 0.8.3\n", SRCPVersion)
+	if s.w.Flush() != nil {
+		return
+	}
+	mode, ok := s.handshake(lines)
+	if !ok {
+		return
+	}
+
+	logger := g.logger.With().
+		Uint64("session", s.id).
+		Str("remote", conn.RemoteAddr().String()).
+		Str("mode", strings.ToLower(mode)).
+		Logger()
+	logger.Info().Msg("SRCP session started")
+	defer logger.Info().Msg("SRCP session ended")
+
+	if mode == "INFO" {
+		s.info(lines)
+	} else {
+		s.commands(lines)
+		s.releaseLocos(logger)
+	}
+}
+
+// handshake answers the handshake commands until GO and returns the
+// connection mode, COMMAND unless the client chose INFO.
+func (s *srcpSession) handshake(lines *bufio.Scanner) (string, bool) {
+	mode := "COMMAND"
+	for lines.Scan() {
+		args := strings.Fields(strings.ToUpper(lines.Text()))
+		switch {
+		case len(args) == 0:
+			continue
+		case len(args) == 1 && args[0] == "GO":
+			return mode, s.reply(200, fmt.Sprintf("OK GO %d", s.id)) == nil
+		case len(args) == 4 && args[0] == "SET" && args[1] == "PROTOCOL" && args[2] == "SRCP":
+			if !strings.HasPrefix(args[3], "0.8") {
+				if s.replyError(errSRCPProtocol) != nil {
+					return "", false
+				}
+				continue
+			}
+			if s.reply(201, "OK PROTOCOL SRCP") != nil {
+				return "", false
+			}
+		case len(args) == 4 && args[0] == "SET" && args[1] == "CONNECTIONMODE" && args[2] == "SRCP":
+			if args[3] != "COMMAND" && args[3] != "INFO" {
+				if s.replyError(errSRCPConnectionMode) != nil {
+					return "", false
+				}
+				continue
+			}
+			mode = args[3]
+			if s.reply(202, "OK CONNECTIONMODE") != nil {
+				return "", false
+			}
+		default:
+			if s.replyError(errSRCPUnknownCommand) != nil {
+				return "", false
+			}
+		}
+	}
+	return "", false
+}
+
+// commands runs a command mode session, replying to each command line.
+func (s *srcpSession) commands(lines *bufio.Scanner) {
+	for lines.Scan() {
+		args := strings.Fields(lines.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if len(args) >= 3 && strings.EqualFold(args[0], "TERM") && args[1] == "0" && strings.EqualFold(args[2], "SESSION") {
+			s.reply(200, "OK")
+			return
+		}
+		info, err := s.command(args)
+		switch {
+		case err != nil:
+			var serr *srcpError
+			if !errors.As(err, &serr) {
+				serr = errSRCPUnspecified
+			}
+			err = s.replyError(serr)
+		case info != "":
+			err = s.reply(100, "INFO "+info)
+		default:
+			err = s.reply(200, "OK")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// command runs a command line and returns the info it answers with, if
+// any.
+func (s *srcpSession) command(args []string) (string, error) {
+	if len(args) < 3 {
+		return "", errSRCPListTooShort
+	}
+	cmd, bus, group := strings.ToUpper(args[0]), args[1], strings.ToUpper(args[2])
+	if bus == "0" && cmd == "GET" && group == "DESCRIPTION" {
+		return "0 DESCRIPTION SESSION SERVER", nil
+	}
+	if bus != srcpBus {
+		return "", errSRCPWrongValue
+	}
+	params := args[3:]
+
+	switch group {
+	case "DESCRIPTION":
+		if cmd != "GET" {
+			return "", errSRCPUnsupportedOp
+		}
+		return srcpBus + " DESCRIPTION GA GL POWER", nil
+	case "POWER":
+		return s.power(cmd, params)
+	case "GL":
+		return s.loco(cmd, params)
+	case "GA":
+		return s.accessory(cmd, params)
+	}
+	switch cmd {
+	case "GET", "SET", "INIT", "TERM", "CHECK", "WAIT", "VERIFY", "RESET":
+		return "", errSRCPUnsupportedDevice
+	}
+	return "", errSRCPUnknownCommand
+}
+
+// power handles the POWER device group. z21.go only provides the power off
+// request, so SET POWER ON is not supported.
+func (s *srcpSession) power(cmd string, params []string) (string, error) {
+	switch cmd {
+	case "GET":
+		state := s.g.trackPowerState.Load()
+		if state == nil {
+			return "", errSRCPNoData
+		}
+		return srcpBus + " POWER " + srcpPower(*state), nil
+	case "SET":
+		if len(params) < 1 {
+			return "", errSRCPListTooShort
+		}
+		switch strings.ToUpper(params[0]) {
+		case "OFF":
+			return "", s.request("power.off", struct{}{})
+		case "ON":
+			return "", errSRCPUnsupportedOp
+		}
+		return "", errSRCPWrongValue
+	case "INIT", "TERM":
+		return "", nil
+	}
+	return "", errSRCPUnsupportedOp
+}
+
+// loco handles the GL device group. Only DCC locos are supported; the
+// function states of SET GL are not applied.
+func (s *srcpSession) loco(cmd string, params []string) (string, error) {
+	if len(params) < 1 {
+		return "", errSRCPListTooShort
+	}
+	addr, err := srcpAddress(params[0], MaxLocoAddress)
+	if err != nil {
+		return "", err
+	}
+	switch cmd {
+	case "INIT":
+		// INIT GL <addr> <protocol> ...
+		if len(params) < 2 {
+			return "", errSRCPListTooShort
+		}
+		if strings.ToUpper(params[1]) != "N" {
+			return "", errSRCPDeviceProtocol
+		}
+		return "", nil
+	case "TERM":
+		l, ok := s.locos[addr]
+		delete(s.locos, addr)
+		if ok && s.g.purgeOnRelease {
+			return "", s.request("loco.purge", l.purgeRequest(addr))
+		}
+		return "", nil
+	case "GET":
+		l, ok := s.locos[addr]
+		if !ok {
+			return "", errSRCPNoData
+		}
+		return fmt.Sprintf("%s GL %d %d %d %d", srcpBus, addr, l.driveMode, l.v, l.vMax), nil
+	case "SET":
+		// SET GL <addr> <drivemode> <V> <V_max> <f0> ... <fn>
+		if len(params) < 4 {
+			return "", errSRCPListTooShort
+		}
+		var l srcpLoco
+		if l.driveMode, err = strconv.Atoi(params[1]); err != nil || l.driveMode < srcpReverse || l.driveMode > srcpEmergencyStop {
+			return "", errSRCPWrongValue
+		}
+		if l.v, err = strconv.Atoi(params[2]); err != nil || l.v < 0 {
+			return "", errSRCPWrongValue
+		}
+		if l.vMax, err = strconv.Atoi(params[3]); err != nil || l.vMax <= 0 || l.v > l.vMax {
+			return "", errSRCPWrongValue
+		}
+
+		req := DriveRequest{
+			Address: addr,
+			Speed:   float64(l.v) / float64(l.vMax) * 100,
+			Forward: l.driveMode == srcpForward,
+		}
+		if l.driveMode == srcpEmergencyStop {
+			// keep the direction of the last drive command
+			req.Speed = 0
+			req.Forward = s.locos[addr].driveMode != srcpReverse
+		}
+		if err := s.request("loco.drive", req); err != nil {
+			return "", err
+		}
+		s.locos[addr] = l
+		return "", nil
+	}
+	return "", errSRCPUnsupportedOp
+}
+
+// releaseLocos stops and purges the locos the session still drives when it
+// ends with --purge_on_release, so a crashed client leaves none creeping
+// along. Locos of a session ended by the gateway stopping are left as they
+// are.
+func (s *srcpSession) releaseLocos(logger zerolog.Logger) {
+	if !s.g.purgeOnRelease || s.g.ctx.Err() != nil {
+		return
+	}
+	for addr, l := range s.locos {
+		if err := s.request("loco.purge", l.purgeRequest(addr)); err != nil {
+			logger.Warn().
+				Err(err).
+				Uint16("address", addr).
+				Msg("failed to purge SRCP session loco")
+		}
+	}
+}
+
+func (l srcpLoco) purgeRequest(addr uint16) PurgeRequest {
+	return PurgeRequest{Address: addr, Forward: l.driveMode != srcpReverse}
+}
+
+// accessory handles the GA device group. The gateway switches turnouts off
+// after TurnoutPulse itself, so SET GA with value 0 is accepted without
+// sending anything.
+func (s *srcpSession) accessory(cmd string, params []string) (string, error) {
+	if len(params) < 1 {
+		return "", errSRCPListTooShort
+	}
+	addr, err := srcpAddress(params[0], MaxAccessoryAddress)
+	if err != nil {
+		return "", err
+	}
+	switch cmd {
+	case "INIT":
+		if len(params) < 2 {
+			return "", errSRCPListTooShort
+		}
+		if strings.ToUpper(params[1]) != "N" {
+			return "", errSRCPDeviceProtocol
+		}
+		return "", nil
+	case "TERM":
+		return "", nil
+	case "GET":
+		return "", errSRCPNoData
+	case "SET":
+		// SET GA <addr> <port> <value> <delay>
+		if len(params) < 3 {
+			return "", errSRCPListTooShort
+		}
+		port, err := strconv.Atoi(params[1])
+		if err != nil || port < 0 || port > 1 {
+			return "", errSRCPWrongValue
+		}
+		switch params[2] {
+		case "0":
+			return "", nil
+		case "1":
+			return "", s.request("turnout.set", TurnoutRequest{Address: addr, Output: uint8(port)})
+		}
+		return "", errSRCPWrongValue
+	}
+	return "", errSRCPUnsupportedOp
+}
+
+// request sends a command as NATS request, mapping a failed reply to the
+// closest SRCP error.
+func (s *srcpSession) request(command string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	raw, err := s.g.requestCommand(s.g.ctx, command, data)
+	if err != nil {
+		return errSRCPTimeout
+	}
+	var reply CmdReply
+	if err := json.Unmarshal(raw, &reply); err != nil {
+		return err
+	}
+	if reply.Ok {
+		return nil
+	}
+	switch reply.ErrorCode {
+	case ErrCodeValidationFailed, ErrCodeInvalidRequest:
+		return errSRCPWrongValue
+	case ErrCodeTimeout, ErrCodeZ21Offline:
+		return errSRCPTimeout
+	case ErrCodeForbidden, ErrCodeLocked:
+		return errSRCPForbidden
+	case ErrCodeUnsupported, ErrCodeUnsupportedByDevice:
+		return errSRCPUnsupportedOp
+	}
+	return errSRCPUnspecified
+}
+
+// info runs an info mode session, sending the Z21 events as infos until
+// the client disconnects.
+func (s *srcpSession) info(lines *bufio.Scanner) {
+	ctx, cancel := context.WithCancel(s.g.ctx)
+	defer cancel()
+	// info sessions only receive, a closed connection ends the scan
+	go func() {
+		defer cancel()
+		for lines.Scan() {
+		}
+	}()
+
+	events, untap := s.g.taps.tap()
+	defer untap()
+	if state := s.g.trackPowerState.Load(); state != nil {
+		if s.reply(100, "INFO "+srcpBus+" POWER "+srcpPower(*state)) != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-events:
+			info, ok := srcpEventInfo(ev)
+			if !ok {
+				continue
+			}
+			if s.reply(100, "INFO "+info) != nil {
+				return
+			}
+		}
+	}
+}
+
+// srcpEventInfo returns the info of a loco, turnout or system state event.
+func srcpEventInfo(ev z21.Serializable) (string, bool) {
+	switch ev := ev.(type) {
+	case *z21.LocoInfo:
+		driveMode := srcpReverse
+		if ev.Forward {
+			driveMode = srcpForward
+		}
+		v := 0
+		switch {
+		case ev.Speed == 1:
+			driveMode = srcpEmergencyStop
+		case ev.Speed > 1:
+			v = int(ev.Speed) - 1
+		}
+		return fmt.Sprintf("%s GL %d %d %d %d", srcpBus, ev.Address, driveMode, v, srcpVMax), true
+	case *z21.TurnoutInfo:
+		// LAN_X_TURNOUT_INFO reports output 1 as 1 and output 2 as 2, 0
+		// while the turnout was not switched yet
+		if ev.Position < 1 || ev.Position > 2 {
+			return "", false
+		}
+		return fmt.Sprintf("%s GA %d %d 1", srcpBus, ev.Address, ev.Position-1), true
+	case *z21.SystemState:
+		return srcpBus + " POWER " + srcpPower(trackPowerState(ev.CentralState)), true
+	}
+	return "", false
+}
+
+// srcpPower returns the SRCP power state of a track power state.
+func srcpPower(state string) string {
+	if state == TrackPowerOn {
+		return "ON"
+	}
+	return "OFF"
+}
+
+// srcpAddress parses a GL or GA address.
+func srcpAddress(s string, maxAddr int) (uint16, error) {
+	addr, err := strconv.Atoi(s)
+	if err != nil || addr < 1 || addr > maxAddr {
+		return 0, errSRCPWrongValue
+	}
+	return uint16(addr), nil
+}
+
+// reply sends a reply line with the current time.
+func (s *srcpSession) reply(code int, text string) error {
+	now := time.Now()
+	fmt.Fprintf(s.w, "%d.%03d %d %s\n", now.Unix(), now.Nanosecond()/int(time.Millisecond), code, text)
+	return s.w.Flush()
+}
+
+func (s *srcpSession) replyError(err *srcpError) error {
+	return s.reply(err.code, "ERROR "+err.text)
+}
@@ -0,0 +1,106 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// SSEKeepalive is the interval of the comments that keep idle event streams
+// open through proxies.
+const SSEKeepalive = 15 * time.Second
+
+// handleSSE streams the events matching the filter query parameters as
+// Server-Sent Events, each one the data of an event message of the WebSocket
+// stream. Filters are subject patterns after z21.<name>.event., repeated or
+// comma separated, all events by default.
+func (g *Gateway) handleSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	var filters []string
+	for _, f := range r.URL.Query()["filter"] {
+		for _, pattern := range strings.Split(f, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				filters = append(filters, pattern)
+			}
+		}
+	}
+	if len(filters) == 0 {
+		filters = []string{">"}
+	}
+
+	// the HTTP server does not cancel streaming requests on shutdown
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stop := context.AfterFunc(g.ctx, cancel)
+	defer stop()
+
+	out := make(chan StreamMessage, dashboardStreamBuffer)
+	handler := func(msg *nats.Msg) {
+		m, ok := g.streamEvent(msg)
+		if !ok {
+			return
+		}
+		select {
+		case out <- m:
+		default:
+			cancel()
+		}
+	}
+	for _, filter := range filters {
+		sub, err := g.nc.Subscribe(g.eventPrefix+filter, handler)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid filter %q: %v", filter, err), http.StatusBadRequest)
+			return
+		}
+		defer sub.Unsubscribe()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	g.logger.Info().
+		Str("remote", r.RemoteAddr).
+		Strs("filters", filters).
+		Msg("event stream connected")
+
+	keepalive := time.NewTicker(SSEKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			g.logger.Info().
+				Str("remote", r.RemoteAddr).
+				// a full buffer cancels while the client is still connected
+				Bool("slow", r.Context().Err() == nil && g.ctx.Err() == nil).
+				Msg("event stream disconnected")
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case m := <-out:
+			data, err := json.Marshal(m)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package gateway
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+// CachedState is the last event seen on an event subject.
+type CachedState struct {
+	Subject string `json:"subject"`
+	Event   any    `json:"event"`
+	TS      string `json:"ts"`
+	// Stale is set while the Z21 is re-establishing state after being
+	// offline, until a fresh event for the subject arrives.
+	Stale bool `json:"stale"`
+}
+
+const (
+	// StateLimit bounds the number of cached event subjects, well above
+	// the subjects of 1000 detectors and 200 locos.
+	StateLimit = 16384
+
+	// stateShards spreads the cache over several locks, so that state.get
+	// snapshots do not stall the publisher on large layouts.
+	stateShards = 16
+)
+
+// stateCache holds the last event per subject. Once a shard is full, the
+// least recently updated subject is evicted.
+type stateCache struct {
+	shards    [stateShards]stateShard
+	limit     int
+	evictions atomic.Uint64
+}
+
+type stateShard struct {
+	mu      sync.RWMutex
+	entries map[string]*CachedState
+	updated map[string]time.Time
+}
+
+func newStateCache(limit int) *stateCache {
+	c := &stateCache{limit: max(limit/stateShards, 1)}
+	for i := range c.shards {
+		c.shards[i].entries = make(map[string]*CachedState)
+		c.shards[i].updated = make(map[string]time.Time)
+	}
+	return c
+}
+
+func (c *stateCache) shard(subject string) *stateShard {
+	h := fnv.New32a()
+	h.Write([]byte(subject))
+	return &c.shards[h.Sum32()%stateShards]
+}
+
+func (c *stateCache) put(subject string, ev any) {
+	now := time.Now()
+	s := c.shard(subject)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[subject]; !ok && len(s.entries) >= c.limit {
+		s.evictOldest()
+		c.evictions.Add(1)
+	}
+	s.entries[subject] = &CachedState{
+		Subject: subject,
+		Event:   ev,
+		TS:      now.UTC().Format(time.RFC3339Nano),
+	}
+	s.updated[subject] = now
+}
+
+func (s *stateShard) evictOldest() {
+	var oldest string
+	var oldestAt time.Time
+	for subject, at := range s.updated {
+		if oldest == "" || at.Before(oldestAt) {
+			oldest, oldestAt = subject, at
+		}
+	}
+	delete(s.entries, oldest)
+	delete(s.updated, oldest)
+}
+
+func (c *stateCache) markStale() {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for _, e := range s.entries {
+			e.Stale = true
+		}
+		s.mu.Unlock()
+	}
+}
+
+// len returns the number of cached subjects.
+func (c *stateCache) len() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.RLock()
+		n += len(s.entries)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// snapshot returns the cached states whose subject starts with prefix,
+// sorted by subject.
+func (c *stateCache) snapshot(prefix string) []CachedState {
+	var states []CachedState
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.RLock()
+		for subject, e := range s.entries {
+			if strings.HasPrefix(subject, prefix) {
+				states = append(states, *e)
+			}
+		}
+		s.mu.RUnlock()
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Subject < states[j].Subject })
+	return states
+}
+
+// reestablishState brings the gateway back in sync after the Z21 came
+// online, which is also the case after a Z21 reboot: the Z21 forgets its
+// broadcast subscribers on restart, and anything cached may have changed
+// while it was unreachable.
+func (g *Gateway) reestablishState() {
+	g.state.markStale()
+	// the Z21 may have been replaced or updated meanwhile
+	g.detectDevice()
+	g.subscribeBroadcast()
+
+	ctx, cancel := context.WithTimeout(g.ctx, RequestTimeout)
+	defer cancel()
+
+	resp, err := g.z21SendRcv(ctx, &z21.SystemState{})
+	if err != nil {
+		g.logger.Error().
+			Err(err).
+			Msg("failed to query system state")
+		return
+	}
+	g.publishEvent(resp, time.Now())
+	g.trackPower(resp)
+	g.trackLock(resp)
+	g.replayFailover(ctx)
+}
+
+type stateRequest struct {
+	Prefix string `json:"prefix,omitempty"`
+}
+
+func (g *Gateway) handleStateGet(cr *cmdRequest, req *stateRequest) CmdReply {
+	prefix := g.eventSubjectPrefix()
+	if req.Prefix != "" {
+		prefix += req.Prefix
+	}
+	return CmdReply{
+		Ok:   true,
+		Data: g.state.snapshot(prefix),
+		TS:   time.Now().Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,172 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+	"github.com/trains-io/z21.go"
+)
+
+const (
+	benchDetectors = 1024
+	benchLocos     = 256
+)
+
+// newTestGateway returns a gateway of args publishing to an embedded NATS
+// server. It is not started, so the events loop does not run.
+func newTestGateway(tb testing.TB, args ...string) *Gateway {
+	tb.Helper()
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, NoLog: true, NoSigs: true})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		tb.Fatal("NATS server not ready")
+	}
+	tb.Cleanup(func() {
+		ns.Shutdown()
+		ns.WaitForShutdown()
+	})
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(nc.Close)
+
+	cfg, err := ParseConfig(append([]string{"--z21_name", "bench", "--z21_addr", "127.0.0.1:21105"}, args...))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cfg.Logger = zerolog.Nop()
+	g, err := New(context.Background(), nc, cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		g.cancel()
+		g.closeZ21()
+	})
+	return g
+}
+
+// testCmdRequest returns a command request of name with an empty payload.
+func testCmdRequest(name string, dryRun bool) *cmdRequest {
+	return &cmdRequest{
+		name:   name,
+		msg:    &nats.Msg{Subject: "z21.bench.cmd." + name, Header: nats.Header{}},
+		dryRun: dryRun,
+		logger: zerolog.Nop(),
+		timing: &cmdTiming{},
+	}
+}
+
+// layoutEvents returns a detector event per CAN detector port and a loco
+// info per loco of a large layout.
+func layoutEvents() []z21.Serializable {
+	events := make([]z21.Serializable, 0, benchDetectors+benchLocos)
+	for i := range benchDetectors {
+		events = append(events, &z21.CanDetector{NetworkID: uint16(0x1000 + i/8), Port: uint8(i % 8), Type: canDetectorOccupancy, Value1: 1})
+	}
+	for i := range benchLocos {
+		events = append(events, &z21.LocoInfo{Address: uint16(i + 1), SpeedSteps: 4, Forward: true, Speed: 40})
+	}
+	return events
+}
+
+// sameShardSubjects returns n loco subjects cached in the same shard.
+func sameShardSubjects(c *stateCache, n int) []string {
+	var subjects []string
+	shard := c.shard("z21.bench.event.loco.1")
+	for addr := 1; len(subjects) < n; addr++ {
+		subject := fmt.Sprintf("z21.bench.event.loco.%d", addr)
+		if c.shard(subject) == shard {
+			subjects = append(subjects, subject)
+		}
+	}
+	return subjects
+}
+
+func TestStateLimitEvictsLeastRecentlyUpdated(t *testing.T) {
+	// two subjects per shard
+	g := newTestGateway(t, "--state_limit", fmt.Sprint(2*stateShards))
+	subjects := sameShardSubjects(g.state, 3)
+	a, b, c := subjects[0], subjects[1], subjects[2]
+
+	g.state.put(a, 1)
+	g.state.put(b, 2)
+	// a is updated after b, so b is the least recently updated one
+	g.state.put(a, 3)
+	g.state.put(c, 4)
+
+	states := g.state.snapshot("z21.bench.event.loco.")
+	got := make(map[string]any, len(states))
+	for _, s := range states {
+		got[s.Subject] = s.Event
+	}
+	if _, ok := got[b]; ok || got[a] != 3 || got[c] != 4 || len(got) != 2 {
+		t.Errorf("cached %v, want %s=3 and %s=4 with %s evicted", got, a, c, b)
+	}
+
+	// updating a cached subject evicts nothing
+	g.state.put(c, 5)
+	var evictions float64
+	for _, m := range g.metrics() {
+		if m.Name == "z21_gateway_state_evictions_total" {
+			evictions = m.Value
+		}
+	}
+	if evictions != 1 {
+		t.Errorf("z21_gateway_state_evictions_total = %v, want 1", evictions)
+	}
+}
+
+func BenchmarkStateCachePut(b *testing.B) {
+	c := newStateCache(StateLimit)
+	subjects := make([]string, benchDetectors+benchLocos)
+	for i := range benchDetectors {
+		subjects[i] = fmt.Sprintf("z21.bench.event.can.%d.%d", 0x1000+i/8, i%8)
+	}
+	for i := range benchLocos {
+		subjects[benchDetectors+i] = fmt.Sprintf("z21.bench.event.loco.%d", i+1)
+	}
+	ev := &z21.LocoInfo{Address: 3}
+	b.ReportAllocs()
+	for i := 0; b.Loop(); i++ {
+		c.put(subjects[i%len(subjects)], ev)
+	}
+}
+
+func BenchmarkStateCacheSnapshot(b *testing.B) {
+	c := newStateCache(StateLimit)
+	for _, ev := range layoutEvents() {
+		c.put("z21.bench.event."+strings.Join(eventTokens(ev), "."), ev)
+	}
+	for _, prefix := range []string{"z21.bench.event.", "z21.bench.event.loco."} {
+		b.Run(prefix, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				c.snapshot(prefix)
+			}
+		})
+	}
+}
+
+// BenchmarkPublishEvent measures the event path from a decoded event to
+// the NATS publish and the state cache on a large layout.
+func BenchmarkPublishEvent(b *testing.B) {
+	g := newTestGateway(b)
+	events := layoutEvents()
+	b.ReportAllocs()
+	for i := 0; b.Loop(); i++ {
+		if err := g.publishEventNow(events[i%len(events)], time.Now()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
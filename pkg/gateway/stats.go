@@ -0,0 +1,132 @@
+package gateway
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	GatewayStatusInterval = 30 * time.Second
+
+	GatewayOnline  = "online"
+	GatewayStopped = "stopped"
+	GatewayOffline = "offline"
+)
+
+type gatewayStats struct {
+	commands      atomic.Uint64
+	commandErrors atomic.Uint64
+	// commandsRejected counts the commands rejected with a full queue.
+	commandsRejected atomic.Uint64
+	slowCommands     atomic.Uint64
+	events           atomic.Uint64
+	// batches counts the published event batches.
+	batches       atomic.Uint64
+	publishErrors atomic.Uint64
+	// eventsDropped counts the publishes dropped with a full publish queue.
+	eventsDropped atomic.Uint64
+	z21RTT        atomic.Int64
+	// foreignDatagrams counts the datagrams dropped by the relay for not
+	// coming from the Z21.
+	foreignDatagrams atomic.Uint64
+}
+
+// GatewayStatusMsg reports the health of the gateway process itself, as
+// opposed to StatusMsg which reports the reachability of the Z21.
+type GatewayStatusMsg struct {
+	State            string  `json:"state"`
+	Instance         string  `json:"instance"`
+	Uptime           string  `json:"uptime"`
+	StartedAt        string  `json:"started_at"`
+	Goroutines       int     `json:"goroutines"`
+	CommandsInFlight int     `json:"commands_in_flight"`
+	Commands         uint64  `json:"commands"`
+	CommandErrors    uint64  `json:"command_errors"`
+	Events           uint64  `json:"events"`
+	PublishErrors    uint64  `json:"publish_errors"`
+	NATSRTTMillis    float64 `json:"nats_rtt_ms"`
+	Z21RTTMillis     float64 `json:"z21_rtt_ms"`
+	Z21Online        bool    `json:"z21_online"`
+	// Mirror is set with --mirror_url.
+	Mirror *MirrorStatus `json:"mirror,omitempty"`
+	// Loops maps each started internal loop to ok, stalled or failed.
+	Loops map[string]string `json:"loops,omitempty"`
+	// Reason and ReasonMessage tell why a stopped or offline gateway
+	// stopped: signal, error, admin or silent.
+	Reason        string `json:"reason,omitempty"`
+	ReasonMessage string `json:"reason_message,omitempty"`
+	TS            string `json:"ts"`
+}
+
+func (g *Gateway) gatewayStatusLoop() {
+	defer g.wg.Done()
+	ticker := time.NewTicker(GatewayStatusInterval)
+	defer ticker.Stop()
+
+	g.publishGatewayStatus(GatewayOnline)
+
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-ticker.C:
+			g.publishGatewayStatus(GatewayOnline)
+		}
+	}
+}
+
+func (g *Gateway) gatewayStatus(state string) *GatewayStatusMsg {
+	var natsRTT time.Duration
+	if rtt, err := g.nc.RTT(); err == nil {
+		natsRTT = rtt
+	}
+
+	status := &GatewayStatusMsg{
+		State:            state,
+		Instance:         g.instance,
+		Uptime:           time.Since(g.startedAt).Truncate(time.Second).String(),
+		StartedAt:        g.startedAt.UTC().Format(time.RFC3339),
+		Goroutines:       runtime.NumGoroutine(),
+		CommandsInFlight: g.commandsInFlight(),
+		Commands:         g.stats.commands.Load(),
+		CommandErrors:    g.stats.commandErrors.Load(),
+		Events:           g.stats.events.Load(),
+		PublishErrors:    g.stats.publishErrors.Load(),
+		NATSRTTMillis:    millis(natsRTT),
+		Z21RTTMillis:     millis(time.Duration(g.stats.z21RTT.Load())),
+		Z21Online:        g.isOnline.Load(),
+		Loops:            g.loopStates(),
+		TS:               time.Now().UTC().Format(time.RFC3339),
+	}
+	if g.mirror != nil {
+		status.Mirror = g.mirror.status()
+	}
+	if r := g.stopReason.Load(); r != nil && state == GatewayStopped {
+		status.Reason, status.ReasonMessage = r.reason, r.message
+	}
+	return status
+}
+
+func (g *Gateway) publishGatewayStatus(state string) {
+	status := g.gatewayStatus(state)
+	subject := fmt.Sprintf("z21.%s.gateway.status", g.name)
+	if err := g.publish(subject, "gateway.status", 0, status); err != nil {
+		g.logger.Error().
+			Err(err).
+			Msg("failed to publish gateway status")
+		return
+	}
+	g.logger.Debug().
+		Str("subject", subject).
+		Str("state", status.State).
+		Str("uptime", status.Uptime).
+		Str("reason", status.Reason).
+		Int("goroutines", status.Goroutines).
+		Msg("NATS pub")
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,73 @@
+package gateway
+
+import (
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+// Track power states derived from the central state of system state
+// broadcasts.
+const (
+	TrackPowerOn            = "on"
+	TrackPowerOff           = "off"
+	TrackPowerEmergencyStop = "emergency_stop"
+	TrackPowerShortCircuit  = "short_circuit"
+	TrackPowerProgramming   = "programming"
+)
+
+// Central state bits of LAN_SYSTEMSTATE_DATAFRAME.
+const (
+	csEmergencyStop     = 0x01
+	csTrackVoltageOff   = 0x02
+	csShortCircuit      = 0x04
+	csProgrammingActive = 0x20
+)
+
+func trackPowerState(centralState uint8) string {
+	switch {
+	case centralState&csShortCircuit != 0:
+		return TrackPowerShortCircuit
+	case centralState&csEmergencyStop != 0:
+		return TrackPowerEmergencyStop
+	case centralState&csTrackVoltageOff != 0:
+		return TrackPowerOff
+	case centralState&csProgrammingActive != 0:
+		return TrackPowerProgramming
+	}
+	return TrackPowerOn
+}
+
+// trackPower follows the track power state from system state events. It
+// is only called from the events loop and for the system state probe.
+func (g *Gateway) trackPower(ev z21.Serializable) {
+	ss, ok := ev.(*z21.SystemState)
+	if !ok {
+		return
+	}
+	state := trackPowerState(ss.CentralState)
+	g.trackPowerState.Store(&state)
+}
+
+// completeStatus adds what is known about the Z21 beyond its reachability,
+// so that one status message tells whether the layout is OK.
+func (g *Gateway) completeStatus(status *StatusMsg) {
+	status.Instance = g.instance
+	if !status.Reachable {
+		return
+	}
+	if info := g.device.Load(); info != nil {
+		status.HardwareType = info.HardwareType
+		status.Model = info.Model
+		status.Firmware = info.Firmware
+	}
+	if since := g.onlineSince.Load(); since != 0 {
+		status.Uptime = time.Since(time.Unix(0, since)).Truncate(time.Second).String()
+	}
+	if state := g.trackPowerState.Load(); state != nil {
+		status.TrackPower = *state
+	}
+	if last := g.lastBroadcast.Load(); last != 0 {
+		status.LastBroadcast = time.Unix(0, last).UTC().Format(time.RFC3339)
+	}
+}
@@ -0,0 +1,106 @@
+package gateway
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/trains-io/z21.go"
+)
+
+// eventSource is the stable subject taxonomy of an event: its kind and, in
+// subject order, the numbers identifying the device it comes from.
+type eventSource struct {
+	kind string
+	ids  [2]uint16
+	n    int
+}
+
+// sourceOf returns the source of the z21.go event types with a subject
+// taxonomy, which are published below their kind.
+func sourceOf(ev z21.Serializable) (eventSource, bool) {
+	switch ev := ev.(type) {
+	case *z21.CanDetector:
+		return eventSource{kind: "can", ids: [2]uint16{ev.NetworkID, uint16(ev.Port)}, n: 2}, true
+	case *z21.LocoInfo:
+		return eventSource{kind: "loco", ids: [2]uint16{ev.Address}, n: 1}, true
+	case *z21.TurnoutInfo:
+		return eventSource{kind: "turnout", ids: [2]uint16{ev.Address}, n: 1}, true
+	case *z21.ExtAccessoryInfo:
+		return eventSource{kind: "accessory", ids: [2]uint16{ev.Address}, n: 1}, true
+	case *z21.SystemState:
+		return eventSource{kind: "systemstate"}, true
+	case *z21.TrackPower:
+		return eventSource{kind: "trackpower"}, true
+	case *z21.RailComData:
+		return eventSource{kind: "railcom", ids: [2]uint16{ev.Address}, n: 1}, true
+	case *z21.RBusData:
+		return eventSource{kind: "rbus", ids: [2]uint16{uint16(ev.GroupIndex)}, n: 1}, true
+	case *z21.LocoNetData:
+		return eventSource{kind: "loconet"}, true
+	}
+	return eventSource{}, false
+}
+
+// eventSubject returns the subject an event is published on.
+func (g *Gateway) eventSubject(ev z21.Serializable) string {
+	if g.legacySubjects {
+		return fmt.Sprintf("z21.%s.event.%s", g.name, ev)
+	}
+
+	src, ok := sourceOf(ev)
+	if !ok {
+		return g.eventPrefix + subjectToken(strings.ToLower(eventTypeName(ev)))
+	}
+	var b strings.Builder
+	b.Grow(len(g.eventPrefix) + len(src.kind) + 12)
+	b.WriteString(g.eventPrefix)
+	b.WriteString(src.kind)
+	for _, id := range src.ids[:src.n] {
+		b.WriteByte('.')
+		b.WriteString(strconv.FormatUint(uint64(id), 10))
+	}
+	return b.String()
+}
+
+func (g *Gateway) eventSubjectPrefix() string {
+	return g.eventPrefix
+}
+
+func eventTokens(ev z21.Serializable) []string {
+	src, ok := sourceOf(ev)
+	if !ok {
+		return []string{subjectToken(strings.ToLower(eventTypeName(ev)))}
+	}
+
+	tokens := make([]string, 1, 1+src.n)
+	tokens[0] = src.kind
+	for _, id := range src.ids[:src.n] {
+		tokens = append(tokens, strconv.FormatUint(uint64(id), 10))
+	}
+	return tokens
+}
+
+// eventKind returns the first subject token of an event, without the
+// source tokens.
+func eventKind(ev z21.Serializable) string {
+	if src, ok := sourceOf(ev); ok {
+		return src.kind
+	}
+	return subjectToken(strings.ToLower(eventTypeName(ev)))
+}
+
+// subjectToken replaces characters that are not allowed in a NATS subject
+// token.
+func subjectToken(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
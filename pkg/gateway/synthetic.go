@@ -0,0 +1,281 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+)
+
+const (
+	SyntheticRate      = 50
+	SyntheticLocos     = 10
+	SyntheticDetectors = 32
+	SyntheticTick      = 10 * time.Millisecond
+
+	// SyntheticNetworkID is the CAN network ID of the first synthetic
+	// occupancy detector, each detector module having 8 ports.
+	SyntheticNetworkID = 0x1000
+
+	SyntheticHeader = "Z21-Synthetic"
+)
+
+// SyntheticConfig describes the load generated by the synthetic event
+// generator.
+type SyntheticConfig struct {
+	// Rate is the number of events per second.
+	Rate      float64
+	Locos     int
+	Detectors int
+}
+
+func (c *SyntheticConfig) enabled() bool {
+	return c.Rate > 0
+}
+
+// parseSynthetic parses a comma separated list of generator settings, e.g.
+// "rate=200,locos=20,detectors=64".
+func parseSynthetic(s string) (SyntheticConfig, error) {
+	c := SyntheticConfig{Locos: SyntheticLocos, Detectors: SyntheticDetectors}
+	if s == "" {
+		return c, nil
+	}
+	for setting := range strings.SplitSeq(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(setting), "=")
+		if !ok {
+			return c, fmt.Errorf("invalid synthetic setting %q", setting)
+		}
+		var err error
+		switch key {
+		case "rate":
+			c.Rate, err = strconv.ParseFloat(value, 64)
+			if err == nil && c.Rate <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "locos":
+			c.Locos, err = strconv.Atoi(value)
+			if err == nil && (c.Locos < 1 || c.Locos > MaxLocoAddress) {
+				err = fmt.Errorf("must be within 1-%d", MaxLocoAddress)
+			}
+		case "detectors":
+			c.Detectors, err = strconv.Atoi(value)
+			if err == nil && c.Detectors < 2 {
+				err = fmt.Errorf("must be at least 2")
+			}
+		default:
+			return c, fmt.Errorf("unknown synthetic setting %q", key)
+		}
+		if err != nil {
+			return c, fmt.Errorf("invalid synthetic %s %q: %w", key, value, err)
+		}
+	}
+	return c, nil
+}
+
+// SyntheticLocoInfo approximates the loco event of the Z21.
+type SyntheticLocoInfo struct {
+	Address   uint16 `json:"address"`
+	Speed     uint8  `json:"speed"`
+	Forward   bool   `json:"forward"`
+	Functions uint32 `json:"functions"`
+}
+
+// SyntheticDetector approximates the CAN occupancy detector event of the
+// Z21.
+type SyntheticDetector struct {
+	NetworkID uint16 `json:"network_id"`
+	Port      uint8  `json:"port"`
+	Occupied  bool   `json:"occupied"`
+	// Address is the loco reported by RailCom, if any.
+	Address uint16 `json:"address,omitempty"`
+}
+
+type synthLoco struct {
+	addr     uint16
+	speed    uint8
+	target   uint8
+	forward  bool
+	detector int
+}
+
+// synthGenerator publishes a stream of events resembling locos running
+// laps over a loop of occupancy detectors, for sizing consumers and
+// JetStream retention without a layout.
+type synthGenerator struct {
+	nc       *nats.Conn
+	device   string
+	versions []int
+	cfg      SyntheticConfig
+	logger   zerolog.Logger
+
+	seq   uint64
+	locos []*synthLoco
+	// pending are events generated but not yet published, a step may
+	// generate more than one.
+	pending []synthEvent
+}
+
+type synthEvent struct {
+	subject string
+	kind    string
+	payload any
+}
+
+func newSynthGenerator(nc *nats.Conn, device string, versions []int, cfg SyntheticConfig, logger zerolog.Logger) *synthGenerator {
+	s := &synthGenerator{
+		nc:       nc,
+		device:   device,
+		versions: versions,
+		cfg:      cfg,
+		logger:   logger,
+	}
+	for i := range cfg.Locos {
+		s.locos = append(s.locos, &synthLoco{
+			addr:     uint16(i + 3),
+			forward:  true,
+			detector: i * cfg.Detectors / cfg.Locos,
+		})
+	}
+	return s
+}
+
+func (s *synthGenerator) Run(ctx context.Context) error {
+	s.logger.Info().
+		Str("device", s.device).
+		Float64("rate", s.cfg.Rate).
+		Int("locos", s.cfg.Locos).
+		Int("detectors", s.cfg.Detectors).
+		Msg("synthetic events")
+
+	for _, l := range s.locos {
+		s.occupancy(l, l.detector, true)
+	}
+
+	ticker := time.NewTicker(SyntheticTick)
+	defer ticker.Stop()
+	last := time.Now()
+	var due float64
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			// high rates emit several events per tick
+			due += s.cfg.Rate * now.Sub(last).Seconds()
+			last = now
+			for ; due >= 1; due-- {
+				if len(s.pending) == 0 {
+					s.step()
+				}
+				ev := s.pending[0]
+				s.pending = s.pending[1:]
+				if err := s.publish(ev); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// step moves a random loco: it accelerates or brakes towards its target
+// speed, enters the next detector or picks a new target speed.
+func (s *synthGenerator) step() {
+	l := s.locos[rand.IntN(len(s.locos))]
+	switch {
+	case l.speed != l.target:
+		delta := uint8(1 + rand.IntN(4))
+		if l.speed < l.target {
+			l.speed = min(l.target, l.speed+delta)
+		} else {
+			l.speed = max(l.target, l.speed-min(delta, l.speed))
+		}
+		s.loco(l)
+	case l.speed > 0 && rand.IntN(4) > 0:
+		next := (l.detector + 1) % s.cfg.Detectors
+		if !l.forward {
+			next = (l.detector + s.cfg.Detectors - 1) % s.cfg.Detectors
+		}
+		s.occupancy(l, next, true)
+		s.occupancy(l, l.detector, false)
+		l.detector = next
+	default:
+		l.target = uint8(rand.IntN(127))
+		if rand.IntN(4) == 0 {
+			l.target = 0
+		}
+		// only reverse once stopped
+		if l.speed == 0 && rand.IntN(8) == 0 {
+			l.forward = !l.forward
+		}
+		s.loco(l)
+	}
+}
+
+func (s *synthGenerator) loco(l *synthLoco) {
+	s.pending = append(s.pending, synthEvent{
+		subject: fmt.Sprintf("loco.%d", l.addr),
+		kind:    "event.loco",
+		payload: &SyntheticLocoInfo{
+			Address: l.addr,
+			Speed:   l.speed,
+			Forward: l.forward,
+			// headlights
+			Functions: 1,
+		},
+	})
+}
+
+func (s *synthGenerator) occupancy(l *synthLoco, detector int, occupied bool) {
+	ev := &SyntheticDetector{
+		NetworkID: uint16(SyntheticNetworkID + detector/8),
+		Port:      uint8(detector % 8),
+		Occupied:  occupied,
+	}
+	if occupied {
+		ev.Address = l.addr
+	}
+	s.pending = append(s.pending, synthEvent{
+		subject: fmt.Sprintf("can.%d.%d", ev.NetworkID, ev.Port),
+		kind:    "event.can",
+		payload: ev,
+	})
+}
+
+func (s *synthGenerator) publish(ev synthEvent) error {
+	s.seq++
+	ts := time.Now().UTC()
+	for i, version := range s.versions {
+		data, err := encodePayload(version, s.device, ev.kind, s.seq, ts, ev.payload)
+		if err != nil {
+			return err
+		}
+		subject := fmt.Sprintf("z21.%s.event.%s", s.device, ev.subject)
+		if i > 0 {
+			subject = fmt.Sprintf("z21.%s.v%d.event.%s", s.device, version, ev.subject)
+		}
+		msg := newMsg(subject, version, s.seq, ts)
+		msg.Header.Set(SyntheticHeader, "true")
+		msg.Data = data
+		if err := s.nc.PublishMsg(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syntheticLoop runs the synthetic event generator alongside the Z21, on
+// the subjects of device <name>-synthetic.
+func (g *Gateway) syntheticLoop() {
+	defer g.wg.Done()
+	s := newSynthGenerator(g.nc, g.name+"-synthetic", g.schemaVersions, g.synthetic, g.logger)
+	if err := s.Run(g.ctx); err != nil {
+		g.logger.Error().
+			Err(err).
+			Msg("synthetic events")
+	}
+}
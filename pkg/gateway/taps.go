@@ -0,0 +1,43 @@
+package gateway
+
+import (
+	"sync"
+
+	"github.com/trains-io/z21.go"
+)
+
+// eventTaps hands Z21 events to gateway internal consumers, e.g. jobs
+// waiting for a detector.
+type eventTaps struct {
+	mu   sync.Mutex
+	taps map[chan z21.Serializable]struct{}
+}
+
+func newEventTaps() *eventTaps {
+	return &eventTaps{taps: make(map[chan z21.Serializable]struct{})}
+}
+
+// tap returns a channel receiving all Z21 events until the returned func is
+// called. Events are dropped while the channel is full.
+func (t *eventTaps) tap() (<-chan z21.Serializable, func()) {
+	ch := make(chan z21.Serializable, 64)
+	t.mu.Lock()
+	t.taps[ch] = struct{}{}
+	t.mu.Unlock()
+	return ch, func() {
+		t.mu.Lock()
+		delete(t.taps, ch)
+		t.mu.Unlock()
+	}
+}
+
+func (t *eventTaps) send(ev z21.Serializable) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ch := range t.taps {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
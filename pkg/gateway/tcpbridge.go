@@ -0,0 +1,174 @@
+package gateway
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+const (
+	// TCPBridgeClients is the default number of concurrent TCP bridge
+	// clients. Each one is a LAN client of the Z21, which only serves a
+	// limited number of them.
+	TCPBridgeClients = 4
+
+	// z21FrameHeaderSize is the size of DataLen and Header, which start
+	// every frame of the Z21 LAN protocol.
+	z21FrameHeaderSize = 4
+	// z21MaxDatagram bounds the datagrams read from the Z21.
+	z21MaxDatagram = 1500
+)
+
+// z21LogoffFrame is LAN_LOGOFF, sent for clients that disconnect without
+// logging off so that the Z21 frees their slot.
+var z21LogoffFrame = []byte{0x04, 0x00, 0x30, 0x00}
+
+// startTCPBridge starts the TCP bridge listener. Each client gets its own
+// UDP socket to the Z21, so that the Z21 sends replies and the broadcasts
+// the client subscribes to back to it; the frames are relayed unchanged.
+// The gateway receives the broadcasts caused by bridge clients like those
+// of any other LAN client, so its state cache stays current.
+func (g *Gateway) startTCPBridge() error {
+	ln, err := net.Listen("tcp", g.tcpBridgeAddr)
+	if err != nil {
+		return err
+	}
+	g.logger.Info().
+		Str("addr", ln.Addr().String()).
+		Int("clients", cap(g.tcpBridgeSlots)).
+		Msg("TCP bridge listener started")
+
+	g.wg.Add(2)
+	go func() {
+		defer g.wg.Done()
+		<-g.ctx.Done()
+		ln.Close()
+	}()
+	go func() {
+		defer g.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if g.ctx.Err() == nil {
+					g.logger.Error().
+						Err(err).
+						Msg("TCP bridge listener failed")
+				}
+				return
+			}
+			select {
+			case g.tcpBridgeSlots <- struct{}{}:
+			default:
+				g.logger.Warn().
+					Str("remote", conn.RemoteAddr().String()).
+					Int("clients", cap(g.tcpBridgeSlots)).
+					Msg("TCP bridge client rejected, too many clients")
+				conn.Close()
+				continue
+			}
+			g.wg.Add(1)
+			go func() {
+				defer g.wg.Done()
+				defer func() { <-g.tcpBridgeSlots }()
+				g.serveTCPBridge(conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// serveTCPBridge relays the frames of a TCP bridge client to the active Z21
+// and the datagrams of the Z21 back until either side closes. Clients
+// connected before a failover stay with the Z21 they were connected to.
+func (g *Gateway) serveTCPBridge(conn net.Conn) {
+	defer conn.Close()
+	logger := g.logger.With().
+		Str("remote", conn.RemoteAddr().String()).
+		Logger()
+
+	udp, err := g.dialZ21()
+	if err != nil {
+		logger.Error().
+			Err(err).
+			Msg("TCP bridge client failed to reach the Z21")
+		return
+	}
+	defer udp.Close()
+
+	ctx, cancel := context.WithCancel(g.ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+		udp.Close()
+	})
+	defer stop()
+
+	logger.Info().
+		Str("local", udp.LocalAddr().String()).
+		Msg("TCP bridge client connected")
+
+	var rx, tx atomic.Uint64
+	go func() {
+		defer cancel()
+		buf := make([]byte, z21MaxDatagram)
+		for {
+			n, err := udp.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return
+			}
+			rx.Add(1)
+		}
+	}()
+
+	loggedOff := false
+	err = readZ21Frames(conn, func(frame []byte) error {
+		loggedOff = binary.LittleEndian.Uint16(frame[2:]) == 0x30
+		if isActivityFrame(frame) {
+			g.markActivity()
+		}
+		tx.Add(1)
+		_, err := udp.Write(frame)
+		return err
+	})
+	if !loggedOff && g.ctx.Err() == nil {
+		udp.Write(z21LogoffFrame)
+	}
+
+	ev := logger.Info()
+	if err != nil && !errors.Is(err, io.EOF) && ctx.Err() == nil {
+		ev = logger.Warn().Err(err)
+	}
+	ev.Uint64("frames_tx", tx.Load()).
+		Uint64("datagrams_rx", rx.Load()).
+		Msg("TCP bridge client disconnected")
+}
+
+// readZ21Frames splits the stream of a TCP bridge client into Z21 LAN
+// frames by their DataLen and calls send with each. A frame shorter than
+// its header ends the stream, as the following data cannot be framed.
+func readZ21Frames(r io.Reader, send func(frame []byte) error) error {
+	header := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		n := int(binary.LittleEndian.Uint16(header))
+		if n < z21FrameHeaderSize {
+			return errors.New("invalid frame length")
+		}
+		frame := make([]byte, n)
+		copy(frame, header)
+		if _, err := io.ReadFull(r, frame[2:]); err != nil {
+			return err
+		}
+		if err := send(frame); err != nil {
+			return err
+		}
+	}
+}
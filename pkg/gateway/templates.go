@@ -0,0 +1,164 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+const (
+	TrackMain = "main"
+	TrackProg = "prog"
+)
+
+// CVTemplate is a named bundle of CV values, e.g. momentum settings for
+// switchers, applied in the given order.
+type CVTemplate struct {
+	Description string `yaml:"description" json:"description,omitempty"`
+	// Track is main (POM, default) or prog (programming track).
+	Track string    `yaml:"track" json:"track"`
+	CVs   []CVValue `yaml:"cvs" json:"cvs"`
+}
+
+type CVValue struct {
+	CV    uint16 `yaml:"cv" json:"cv"`
+	Value uint8  `yaml:"value" json:"value"`
+}
+
+func validateTemplates(templates map[string]CVTemplate) error {
+	for name, t := range templates {
+		switch t.Track {
+		case "":
+			t.Track = TrackMain
+			templates[name] = t
+		case TrackMain, TrackProg:
+		default:
+			return fmt.Errorf("template %q: track must be %s or %s", name, TrackMain, TrackProg)
+		}
+		if len(t.CVs) == 0 {
+			return fmt.Errorf("template %q: no cvs", name)
+		}
+		for _, v := range t.CVs {
+			if v.CV < 1 || v.CV > MaxCV {
+				return fmt.Errorf("template %q: CV%d must be within 1-%d", name, v.CV, MaxCV)
+			}
+		}
+	}
+	return nil
+}
+
+// TemplateRequest is the payload of cv.template.apply. Address or Name
+// select the loco for main track templates.
+type TemplateRequest struct {
+	Template string `json:"template"`
+	Address  uint16 `json:"address,omitempty"`
+	Name     string `json:"name,omitempty"`
+	// Verify reads every CV back after writing it; on the main track this
+	// needs RailCom. Defaults to true.
+	Verify  *bool `json:"verify,omitempty"`
+	Retries *int  `json:"retries,omitempty"`
+}
+
+// TemplateResult is the result of cv.template.apply.
+type TemplateResult struct {
+	Template string   `json:"template"`
+	Written  []uint16 `json:"written"`
+	Failed   []uint16 `json:"failed,omitempty"`
+}
+
+func (g *Gateway) handleTemplateList(cr *cmdRequest, req *struct{}) CmdReply {
+	return CmdReply{Ok: true, Data: g.templates, TS: time.Now().Format(time.RFC3339)}
+}
+
+func (g *Gateway) handleTemplateApply(cr *cmdRequest, req *TemplateRequest) CmdReply {
+	t, ok := g.templates[req.Template]
+	if !ok {
+		return g.handleValidationError(cr, fmt.Errorf("unknown template %q", req.Template))
+	}
+	var addr uint16
+	if t.Track == TrackMain {
+		var err error
+		if addr, err = g.names.resolveLoco(req.Name, req.Address); err != nil {
+			return g.handleValidationError(cr, err)
+		}
+		if addr == 0 || addr > MaxLocoAddress {
+			return g.handleValidationError(cr, fmt.Errorf("address must be between 1 and %d", MaxLocoAddress))
+		}
+	}
+	n, err := retries(req.Retries)
+	if err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	verify := req.Verify == nil || *req.Verify
+	if t.Track == TrackMain && !g.hasFeature("pom_read") {
+		if req.Verify != nil && *req.Verify {
+			return g.handleUnsupportedByDevice(cr.name + " with verify")
+		}
+		verify = false
+	}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, Data: t, TS: time.Now().Format(time.RFC3339)}
+	}
+	if t.Track == TrackProg {
+		if reply, ok := g.lockProg(); !ok {
+			return reply
+		}
+	}
+
+	return jobStarted(g.startJob(cr.name, func(ctx context.Context, j *job) (any, error) {
+		if t.Track == TrackProg {
+			defer g.progLock.Unlock()
+		}
+
+		res := &TemplateResult{Template: req.Template}
+		for i, v := range t.CVs {
+			j.progress(float64(i)/float64(len(t.CVs)), fmt.Sprintf("writing CV%d", v.CV), nil)
+			err := g.writeTemplateCV(ctx, t.Track, addr, v, verify, n)
+			if errors.Is(err, context.Canceled) {
+				return res, err
+			}
+			if err != nil {
+				cr.logger.Warn().
+					Err(err).
+					Str("template", req.Template).
+					Uint16("cv", v.CV).
+					Msg("template CV failed")
+				res.Failed = append(res.Failed, v.CV)
+				continue
+			}
+			res.Written = append(res.Written, v.CV)
+		}
+		if len(res.Failed) > 0 {
+			return res, fmt.Errorf("%d CVs failed", len(res.Failed))
+		}
+		return res, nil
+	}))
+}
+
+func (g *Gateway) writeTemplateCV(ctx context.Context, track string, addr uint16, v CVValue, verify bool, retries int) error {
+	var value uint8
+	var err error
+	if track == TrackProg {
+		// service mode writes are answered with the written value
+		value, err = g.cvRequest(ctx, &z21.CVWrite{CV: v.CV, Value: v.Value}, retries)
+		if err == nil && verify {
+			value, err = g.cvRequest(ctx, &z21.CVRead{CV: v.CV}, retries)
+		}
+	} else {
+		// POM writes are not answered
+		if _, err = g.sendRcv(&z21.CVPOMWrite{Address: addr, CV: v.CV, Value: v.Value}); err != nil || !verify {
+			return err
+		}
+		value, err = g.cvRequest(ctx, &z21.CVPOMRead{Address: addr, CV: v.CV}, retries)
+	}
+	if err != nil {
+		return err
+	}
+	if value != v.Value {
+		return fmt.Errorf("CV%d reads %d instead of %d", v.CV, value, v.Value)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package gateway
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+// CAN detector report types, see the Z21 LAN protocol LAN_CAN_DETECTOR.
+const (
+	canDetectorOccupancy    = 0x01
+	canDetectorRailComFirst = 0x11
+	canDetectorRailComLast  = 0x1f
+	railComAddressMask      = 0x3fff
+)
+
+// BlockEvent is published on z21.<name>.event.block.<block> when the
+// occupancy or the trains of a block change.
+type BlockEvent struct {
+	Block    string   `json:"block"`
+	Occupied bool     `json:"occupied"`
+	Trains   []string `json:"trains"`
+	TS       string   `json:"ts"`
+}
+
+// TrainEvent is published on z21.<name>.event.train.<train>.entered and
+// .left when a train identified by RailCom enters or leaves a block.
+type TrainEvent struct {
+	Train       string `json:"train"`
+	Address     uint16 `json:"address"`
+	Block       string `json:"block"`
+	EnteredAt   string `json:"entered_at"`
+	LeftAt      string `json:"left_at,omitempty"`
+	DwellMillis int64  `json:"dwell_ms,omitempty"`
+	TS          string `json:"ts"`
+}
+
+type trackedBlock struct {
+	occupied map[string]bool
+	railcom  map[string][]uint16
+	// trains maps loco addresses to the time they entered the block.
+	trains map[uint16]time.Time
+}
+
+func (b *trackedBlock) isOccupied() bool {
+	for _, occ := range b.occupied {
+		if occ {
+			return true
+		}
+	}
+	return false
+}
+
+// blockTracker follows block occupancy and trains from CAN detector
+// occupancy and RailCom reports. A train leaves a block when it is reported
+// in another block or when its block becomes free.
+type blockTracker struct {
+	mu     sync.RWMutex
+	idx    *blockIndex
+	blocks map[string]*trackedBlock
+}
+
+func newBlockTracker(idx *blockIndex) *blockTracker {
+	t := &blockTracker{
+		idx:    idx,
+		blocks: make(map[string]*trackedBlock),
+	}
+	for _, name := range idx.names() {
+		t.blocks[name] = &trackedBlock{
+			occupied: make(map[string]bool),
+			railcom:  make(map[string][]uint16),
+			trains:   make(map[uint16]time.Time),
+		}
+	}
+	return t
+}
+
+// detectorReading decodes a CAN detector event into an occupancy state
+// and/or the loco addresses reported by RailCom.
+func detectorReading(ev z21.Serializable) (occupied *bool, railcom []uint16, ok bool) {
+	det, ok := ev.(*z21.CanDetector)
+	if !ok {
+		return nil, nil, false
+	}
+
+	switch {
+	case det.Type == canDetectorOccupancy:
+		occ := det.Value1 != 0
+		return &occ, nil, true
+	case det.Type >= canDetectorRailComFirst && det.Type <= canDetectorRailComLast:
+		for _, v := range [2]uint16{det.Value1, det.Value2} {
+			if addr := v & railComAddressMask; addr != 0 {
+				railcom = append(railcom, addr)
+			}
+		}
+		return nil, railcom, true
+	}
+	return nil, nil, false
+}
+
+// trackBlocks updates the block tracker from a detector event and publishes
+// the resulting block and train events. It is only called from the events
+// loop.
+func (g *Gateway) trackBlocks(ev z21.Serializable) {
+	if _, ok := ev.(*z21.CanDetector); len(g.tracker.blocks) == 0 || !ok {
+		return
+	}
+	source := strings.Join(eventTokens(ev), ".")
+	name, ok := g.tracker.idx.sources[source]
+	if !ok {
+		return
+	}
+	occupied, railcom, ok := detectorReading(ev)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	g.tracker.mu.Lock()
+	block := g.tracker.blocks[name]
+	wasOccupied := block.isOccupied()
+	oldTrains := len(block.trains)
+
+	var entered, left []TrainEvent
+	if occupied != nil {
+		block.occupied[source] = *occupied
+		if !*occupied {
+			delete(block.railcom, source)
+		}
+	}
+	if railcom != nil {
+		block.railcom[source] = railcom
+		block.occupied[source] = true
+		for _, addr := range railcom {
+			if _, ok := block.trains[addr]; ok {
+				continue
+			}
+			// a train is in one block at a time
+			for otherName, other := range g.tracker.blocks {
+				if since, ok := other.trains[addr]; ok && otherName != name {
+					delete(other.trains, addr)
+					left = append(left, g.trainEvent(addr, otherName, since, now, true))
+				}
+			}
+			block.trains[addr] = now
+			entered = append(entered, g.trainEvent(addr, name, now, now, false))
+		}
+	}
+	if !block.isOccupied() {
+		for addr, since := range block.trains {
+			delete(block.trains, addr)
+			left = append(left, g.trainEvent(addr, name, since, now, true))
+		}
+	}
+
+	changed := wasOccupied != block.isOccupied() || oldTrains != len(block.trains) || len(entered) > 0
+	blockEv := g.blockEvent(name, block, now)
+	g.tracker.mu.Unlock()
+
+	for _, te := range left {
+		g.publishDerivedEvent(fmt.Sprintf("train.%s.left", te.Train), "event.train", &te)
+		g.shareTrainLeft(&te)
+	}
+	for _, te := range entered {
+		g.publishDerivedEvent(fmt.Sprintf("train.%s.entered", te.Train), "event.train", &te)
+		g.shareTrainEntered(&te)
+	}
+	if changed {
+		g.publishDerivedEvent("block."+name, "event.block", blockEv)
+		g.shareBlock(blockEv)
+	}
+}
+
+func (g *Gateway) trainName(addr uint16) string {
+	if name, ok := g.names.sources[fmt.Sprintf("loco.%d", addr)]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", addr)
+}
+
+func (g *Gateway) trainEvent(addr uint16, block string, since, now time.Time, left bool) TrainEvent {
+	te := TrainEvent{
+		Train:     g.trainName(addr),
+		Address:   addr,
+		Block:     block,
+		EnteredAt: since.UTC().Format(time.RFC3339Nano),
+		TS:        now.UTC().Format(time.RFC3339Nano),
+	}
+	if left {
+		te.LeftAt = now.UTC().Format(time.RFC3339Nano)
+		te.DwellMillis = now.Sub(since).Milliseconds()
+	}
+	return te
+}
+
+func (g *Gateway) blockEvent(name string, block *trackedBlock, now time.Time) *BlockEvent {
+	trains := make([]string, 0, len(block.trains))
+	for addr := range block.trains {
+		trains = append(trains, g.trainName(addr))
+	}
+	slices.Sort(trains)
+	return &BlockEvent{
+		Block:    name,
+		Occupied: block.isOccupied(),
+		Trains:   trains,
+		TS:       now.UTC().Format(time.RFC3339Nano),
+	}
+}
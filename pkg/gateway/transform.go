@@ -0,0 +1,60 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/trains-io/z21.go"
+)
+
+// TransformedEvent is an event on its way to NATS, as seen by event
+// transforms. Transforms may change the subject and the payload; Kind is the
+// event kind of the taxonomy, e.g. "can".
+type TransformedEvent struct {
+	Kind    string          `json:"kind"`
+	Subject string          `json:"subject"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// eventTransform filters, enriches or renames events before they are
+// published. It returns false to drop the event.
+type eventTransform interface {
+	transformEvent(ev *TransformedEvent) (bool, error)
+}
+
+// transformEvent runs the event transforms on ev. A failing transform is
+// skipped, so a broken transform never loses events.
+func (g *Gateway) transformEvent(ev z21.Serializable, kind, subject string) (*TransformedEvent, bool) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return nil, false
+	}
+	te := &TransformedEvent{Kind: kind, Subject: subject, Payload: payload}
+	// events stay events; a transform must not publish on cmd.> or other
+	// subjects of the gateway
+	prefix := g.eventPrefix
+
+	for _, t := range g.transforms {
+		next := *te
+		keep, err := t.transformEvent(&next)
+		if err == nil && (!strings.HasPrefix(next.Subject, prefix) || len(next.Subject) == len(prefix)) {
+			err = fmt.Errorf("subject %q is outside of %s>", next.Subject, prefix)
+		}
+		if err == nil && !json.Valid(next.Payload) {
+			err = fmt.Errorf("invalid payload")
+		}
+		if err != nil {
+			g.logger.Warn().
+				Err(err).
+				Str("subject", subject).
+				Msg("event transform failed")
+			continue
+		}
+		if !keep {
+			return nil, false
+		}
+		te = &next
+	}
+	return te, true
+}
@@ -0,0 +1,43 @@
+package gateway
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/trains-io/z21.go"
+)
+
+// renameTransform moves every event to subject.
+type renameTransform string
+
+func (r renameTransform) transformEvent(ev *TransformedEvent) (bool, error) {
+	ev.Subject = string(r)
+	return true, nil
+}
+
+func TestTransformEventSubjects(t *testing.T) {
+	const subject = "z21.bench.event.can.4660.1"
+	for _, tt := range []struct {
+		rename string
+		want   string
+	}{
+		{"z21.bench.event.can.platform1", "z21.bench.event.can.platform1"},
+		{"z21.bench.event.", subject},
+		{"z21.bench.cmd.power.off", subject},
+		{"z21.bench.status", subject},
+		{"z21.other.event.can.4660.1", subject},
+	} {
+		g := &Gateway{
+			logger:      zerolog.Nop(),
+			eventPrefix: "z21.bench.event.",
+			transforms:  []eventTransform{renameTransform(tt.rename)},
+		}
+		te, ok := g.transformEvent(&z21.CanDetector{NetworkID: 0x1234, Port: 1}, "can", subject)
+		if !ok {
+			t.Fatalf("renaming to %s dropped the event", tt.rename)
+		}
+		if te.Subject != tt.want {
+			t.Errorf("renaming to %s published on %s, want %s", tt.rename, te.Subject, tt.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package gateway
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/trains-io/z21.go"
+)
+
+const (
+	MaxAccessoryAddress = 2048
+	TurnoutPulse        = 100 * time.Millisecond
+)
+
+// TurnoutRequest is the payload of the turnout.set command.
+type TurnoutRequest struct {
+	Address uint16 `json:"address"`
+	// Name is resolved to Address through the configured turnout names.
+	Name   string `json:"name,omitempty"`
+	Output uint8  `json:"output" payload:"required"`
+}
+
+func (g *Gateway) handleTurnoutSet(cr *cmdRequest, req *TurnoutRequest) CmdReply {
+	addr, err := g.names.resolveTurnout(req.Name, req.Address)
+	if err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	req.Address = addr
+	if err := g.validateAccessory(req.Address); err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	if req.Output > 1 {
+		return g.handleValidationError(cr, fmt.Errorf("output must be 0 or 1"))
+	}
+
+	if cr.dryRun {
+		return g.handleDryRun(cr, g.turnoutRequest(req.Address, req.Output, true))
+	}
+
+	g.markActivity()
+	reply := CmdReply{
+		Ok: true,
+		TS: time.Now().Format(time.RFC3339),
+	}
+	sent := time.Now()
+	err = g.switchTurnout(req.Address, req.Output)
+	cr.timing.z21 += time.Since(sent)
+	if err != nil {
+		reply.Ok = false
+		reply.Error = err.Error()
+		reply.ErrorCode = g.errorCode(err)
+	}
+	return reply
+}
+
+func (g *Gateway) validateAccessory(addr uint16) error {
+	z21Addr := int(addr) + g.accessoryOffset
+	if addr == 0 || z21Addr < 1 || z21Addr > MaxAccessoryAddress {
+		return fmt.Errorf("accessory address %d out of range with offset %d", addr, g.accessoryOffset)
+	}
+	return nil
+}
+
+// turnoutRequest builds the Z21 request for a layout plan address, applying
+// the accessory address offset.
+func (g *Gateway) turnoutRequest(addr uint16, output uint8, activate bool) *z21.Turnout {
+	return &z21.Turnout{
+		Address:  uint16(int(addr) + g.accessoryOffset),
+		Output:   output,
+		Activate: activate,
+	}
+}
+
+// switchTurnout activates output of the turnout at the layout plan address
+// addr for TurnoutPulse.
+func (g *Gateway) switchTurnout(addr uint16, output uint8) error {
+	if _, err := g.sendRcv(g.turnoutRequest(addr, output, true)); err != nil {
+		return err
+	}
+	time.Sleep(TurnoutPulse)
+	_, err := g.sendRcv(g.turnoutRequest(addr, output, false))
+	return err
+}
+
+// applyAccessoryOffset converts the address of accessory broadcasts back to
+// layout plan numbering, so that events match the addresses used in
+// commands.
+func (g *Gateway) applyAccessoryOffset(ev z21.Serializable) {
+	if g.accessoryOffset == 0 {
+		return
+	}
+	switch ev := ev.(type) {
+	case *z21.TurnoutInfo:
+		ev.Address = uint16(int(ev.Address) - g.accessoryOffset)
+	case *z21.ExtAccessoryInfo:
+		ev.Address = uint16(int(ev.Address) - g.accessoryOffset)
+	}
+}
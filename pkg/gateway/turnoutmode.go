@@ -0,0 +1,117 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	TurnoutModeDCC = "dcc"
+	TurnoutModeMM  = "mm"
+)
+
+// turnoutModeCodes are the modes of LAN_GET_TURNOUTMODE and
+// LAN_SET_TURNOUTMODE.
+var turnoutModeCodes = map[string]byte{TurnoutModeDCC: 0x00, TurnoutModeMM: 0x01}
+
+// TurnoutModeRequest is the payload of turnout.mode.get.
+type TurnoutModeRequest struct {
+	Address uint16 `json:"address"`
+	// Name is resolved to Address through the configured turnout names.
+	Name string `json:"name,omitempty"`
+}
+
+// TurnoutModeSetRequest is the payload of turnout.mode.set.
+type TurnoutModeSetRequest struct {
+	TurnoutModeRequest
+	// Mode is dcc or mm.
+	Mode string `json:"mode" payload:"required"`
+}
+
+// TurnoutModeResult is the reply to turnout.mode.get and turnout.mode.set.
+type TurnoutModeResult struct {
+	Address uint16 `json:"address"`
+	Mode    string `json:"mode"`
+}
+
+// turnoutModeAddr resolves the turnout of a request and returns the address
+// bytes of the turnout mode frames, which number the turnouts from 0 like
+// LAN_X_SET_TURNOUT.
+func (g *Gateway) turnoutModeAddr(req *TurnoutModeRequest) (msb, lsb byte, err error) {
+	addr, err := g.names.resolveTurnout(req.Name, req.Address)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Address = addr
+	if err := g.validateAccessory(req.Address); err != nil {
+		return 0, 0, err
+	}
+	z21Addr := uint16(int(req.Address) + g.accessoryOffset - 1)
+	return byte(z21Addr >> 8), byte(z21Addr), nil
+}
+
+func (g *Gateway) handleTurnoutModeGet(cr *cmdRequest, req *TurnoutModeRequest) CmdReply {
+	msb, lsb, err := g.turnoutModeAddr(req)
+	if err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, Data: req, TS: time.Now().Format(time.RFC3339)}
+	}
+	if !g.isOnline.Load() {
+		return CmdReply{Ok: false, Error: "z21 is offline", ErrorCode: ErrCodeZ21Offline, TS: time.Now().Format(time.RFC3339)}
+	}
+
+	ctx, cancel := context.WithTimeout(g.ctx, RequestTimeout)
+	defer cancel()
+	sent := time.Now()
+	data, err := g.requestFrame(ctx, lanFrame(lanGetTurnoutMode, msb, lsb), func(header uint16, data []byte) bool {
+		return header == lanGetTurnoutMode && len(data) == 3 && data[0] == msb && data[1] == lsb
+	})
+	cr.timing.z21 += time.Since(sent)
+	if err != nil {
+		return CmdReply{Ok: false, Error: err.Error(), ErrorCode: g.errorCode(err), TS: time.Now().Format(time.RFC3339)}
+	}
+	mode := TurnoutModeDCC
+	if data[2] == turnoutModeCodes[TurnoutModeMM] {
+		mode = TurnoutModeMM
+	}
+	return CmdReply{Ok: true, Data: &TurnoutModeResult{Address: req.Address, Mode: mode}, TS: time.Now().Format(time.RFC3339)}
+}
+
+// handleTurnoutModeSet switches a turnout between DCC and MM addressing.
+// The Z21 stores the mode and does not answer LAN_SET_TURNOUTMODE.
+func (g *Gateway) handleTurnoutModeSet(cr *cmdRequest, req *TurnoutModeSetRequest) CmdReply {
+	msb, lsb, err := g.turnoutModeAddr(&req.TurnoutModeRequest)
+	if err != nil {
+		return g.handleValidationError(cr, err)
+	}
+	code, ok := turnoutModeCodes[req.Mode]
+	if !ok {
+		return g.handleValidationError(cr, fmt.Errorf("mode must be %s or %s", TurnoutModeDCC, TurnoutModeMM))
+	}
+	res := &TurnoutModeResult{Address: req.Address, Mode: req.Mode}
+	if cr.dryRun {
+		return CmdReply{Ok: true, DryRun: true, Data: res, TS: time.Now().Format(time.RFC3339)}
+	}
+	if !g.isOnline.Load() {
+		return CmdReply{Ok: false, Error: "z21 is offline", ErrorCode: ErrCodeZ21Offline, TS: time.Now().Format(time.RFC3339)}
+	}
+
+	sent := time.Now()
+	err = g.sendZ21Frames(lanFrame(lanSetTurnoutMode, msb, lsb, code))
+	cr.timing.z21 += time.Since(sent)
+	if err != nil {
+		cr.logger.Error().
+			Err(err).
+			Uint16("address", req.Address).
+			Msg("failed to set turnout mode")
+		return CmdReply{Ok: false, Error: err.Error(), ErrorCode: ErrCodeZ21Offline, TS: time.Now().Format(time.RFC3339)}
+	}
+	cr.logger.Info().
+		Uint16("address", req.Address).
+		Str("mode", req.Mode).
+		Msg("turnout mode set")
+	return CmdReply{Ok: true, Data: res, TS: time.Now().Format(time.RFC3339)}
+}
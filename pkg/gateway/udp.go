@@ -0,0 +1,45 @@
+package gateway
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// udpStatsFile holds the UDP counters of the host on Linux.
+const udpStatsFile = "/proc/net/snmp"
+
+// udpRcvbufErrors returns the host wide number of UDP datagrams dropped
+// because a socket receive buffer was full. A rising value during
+// broadcast bursts points at too small relay buffers, or at the z21.go
+// socket, whose buffer the gateway cannot set.
+func udpRcvbufErrors() (uint64, bool) {
+	f, err := os.Open(udpStatsFile)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	// the file has a header line and a value line per protocol
+	var header []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "Udp:" {
+			continue
+		}
+		if header == nil {
+			header = fields
+			continue
+		}
+		for i, name := range header {
+			if name == "RcvbufErrors" && i < len(fields) {
+				n, err := strconv.ParseUint(fields[i], 10, 64)
+				return n, err == nil
+			}
+		}
+		return 0, false
+	}
+	return 0, false
+}
@@ -0,0 +1,154 @@
+package gateway
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	ValidateDuration = time.Minute
+)
+
+// LayoutReport is the result of validate-layout.
+type LayoutReport struct {
+	Device string `json:"device"`
+	// Mapped lists the detectors seen on the bus per block.
+	Mapped map[string][]string `json:"mapped"`
+	// Unmapped lists detectors seen on the bus that belong to no block.
+	Unmapped []string `json:"unmapped"`
+	// Silent lists the detectors per block that were not seen on the bus.
+	Silent map[string][]string `json:"silent"`
+}
+
+func (r *LayoutReport) ok() bool {
+	return len(r.Unmapped) == 0 && len(r.Silent) == 0
+}
+
+// validateLayout cross-checks the block mapping against the detectors seen
+// on the bus: the ones in the gateway's state cache plus the ones reporting
+// within duration.
+func validateLayout(nc *nats.Conn, cfg Config, duration time.Duration) (*LayoutReport, error) {
+	var (
+		mu   sync.Mutex
+		seen = make(map[string]bool)
+	)
+	prefix := fmt.Sprintf("z21.%s.event.", cfg.Z21Name)
+	record := func(subject string) {
+		source := strings.TrimPrefix(subject, prefix)
+		if detectorKinds[strings.SplitN(source, ".", 2)[0]] {
+			mu.Lock()
+			seen[source] = true
+			mu.Unlock()
+		}
+	}
+
+	sub, err := nc.Subscribe(prefix+">", func(m *nats.Msg) { record(m.Subject) })
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	states, err := requestState(nc, cfg.Z21Name)
+	if err != nil {
+		cfg.Logger.Warn().
+			Err(err).
+			Msg("state cache unavailable, relying on live events only")
+	}
+	for _, s := range states {
+		record(s.Subject)
+	}
+
+	cfg.Logger.Info().
+		Dur("duration", duration).
+		Msg("listening for detector events")
+	time.Sleep(duration)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	report := &LayoutReport{
+		Device:   cfg.Z21Name,
+		Mapped:   make(map[string][]string),
+		Unmapped: []string{},
+		Silent:   make(map[string][]string),
+	}
+	for _, block := range cfg.Blocks.names() {
+		for _, source := range cfg.Blocks.blocks[block] {
+			if seen[source] {
+				report.Mapped[block] = append(report.Mapped[block], source)
+			} else {
+				report.Silent[block] = append(report.Silent[block], source)
+			}
+		}
+	}
+	for source := range seen {
+		if _, ok := cfg.Blocks.sources[source]; !ok {
+			report.Unmapped = append(report.Unmapped, source)
+		}
+	}
+	sort.Strings(report.Unmapped)
+	return report, nil
+}
+
+// requestState fetches the state cache of a gateway.
+func requestState(nc *nats.Conn, name string) ([]CachedState, error) {
+	resp, err := nc.Request(fmt.Sprintf("z21.%s.cmd.state.get", name), nil, 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	var reply struct {
+		Ok    bool          `json:"ok"`
+		Error string        `json:"error"`
+		Data  []CachedState `json:"reply"`
+	}
+	if err := decodePayload(msgSchemaVersion(resp), resp.Data, &reply); err != nil {
+		return nil, err
+	}
+	if !reply.Ok {
+		return nil, fmt.Errorf("state.get: %s", reply.Error)
+	}
+	return reply.Data, nil
+}
+
+func (r *LayoutReport) write(w io.Writer, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+
+	fmt.Fprintf(w, "layout %s\n", r.Device)
+	for _, block := range sortedKeys(r.Mapped) {
+		fmt.Fprintf(w, "  block %-20s %s\n", block, strings.Join(r.Mapped[block], ", "))
+	}
+	for _, source := range r.Unmapped {
+		fmt.Fprintf(w, "  unmapped detector %s\n", source)
+	}
+	for _, block := range sortedKeys(r.Silent) {
+		for _, source := range r.Silent[block] {
+			fmt.Fprintf(w, "  silent detector %s (block %s)\n", source, block)
+		}
+	}
+	if r.ok() {
+		fmt.Fprintf(w, "OK\n")
+	}
+	return nil
+}
+
+func sortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,36 @@
+package gateway
+
+import (
+	"fmt"
+	"time"
+)
+
+// WarningMsg is published on z21.<name>.gateway.warning for conditions an
+// operator should look at, even though the gateway keeps running.
+type WarningMsg struct {
+	Code    string         `json:"code"`
+	Message string         `json:"message"`
+	Details map[string]any `json:"details,omitempty"`
+	TS      string         `json:"ts"`
+}
+
+func (g *Gateway) publishWarning(code, message string, details map[string]any) {
+	warning := &WarningMsg{
+		Code:    code,
+		Message: message,
+		Details: details,
+		TS:      time.Now().UTC().Format(time.RFC3339),
+	}
+
+	subject := fmt.Sprintf("z21.%s.gateway.warning", g.name)
+	if err := g.publish(subject, "gateway.warning", 0, warning); err != nil {
+		g.logger.Error().
+			Err(err).
+			Msg("failed to publish warning")
+		return
+	}
+	g.logger.Warn().
+		Str("subject", subject).
+		Str("code", code).
+		Msg(message)
+}
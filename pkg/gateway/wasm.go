@@ -0,0 +1,171 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+const (
+	// WasmFilterTimeout bounds a filter call per event.
+	WasmFilterTimeout = 50 * time.Millisecond
+	// wasmMemoryLimitPages limits filter memory to 16 MiB.
+	wasmMemoryLimitPages = 256
+)
+
+// FilterConfig loads a WASM event filter.
+//
+// The module exports its memory, alloc(size i32) i32 and
+// transform(ptr i32, len i32) i64, and optionally free(ptr i32, len i32).
+// transform receives the TransformedEvent JSON written to memory obtained by
+// alloc and returns the resulting event JSON as ptr<<32 | len, or 0 to drop
+// the event. The module has WASI without file system or network access.
+type FilterConfig struct {
+	Module string `yaml:"module"`
+	// Events are the event kinds the filter sees; empty means all.
+	Events []string `yaml:"events"`
+}
+
+type wasmFilter struct {
+	name     string
+	events   map[string]bool
+	rt       wazero.Runtime
+	compiled wazero.CompiledModule
+
+	mu  sync.Mutex
+	mod api.Module
+}
+
+// startFilters compiles the configured WASM filters and adds them to the
+// event transforms, after the plugins.
+func (g *Gateway) startFilters(configs []FilterConfig) error {
+	if len(configs) == 0 {
+		return nil
+	}
+	rt := wazero.NewRuntimeWithConfig(g.ctx, wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(wasmMemoryLimitPages))
+	if _, err := wasi_snapshot_preview1.Instantiate(g.ctx, rt); err != nil {
+		return err
+	}
+
+	for _, cfg := range configs {
+		code, err := os.ReadFile(cfg.Module)
+		if err != nil {
+			return fmt.Errorf("filter: %w", err)
+		}
+		compiled, err := rt.CompileModule(g.ctx, code)
+		if err != nil {
+			return fmt.Errorf("filter %s: %w", cfg.Module, err)
+		}
+		f := &wasmFilter{
+			name:     cfg.Module,
+			events:   make(map[string]bool),
+			rt:       rt,
+			compiled: compiled,
+		}
+		for _, kind := range cfg.Events {
+			f.events[kind] = true
+		}
+		if err := f.instantiate(g.ctx); err != nil {
+			return fmt.Errorf("filter %s: %w", cfg.Module, err)
+		}
+		g.transforms = append(g.transforms, f)
+		g.logger.Info().
+			Str("filter", cfg.Module).
+			Strs("events", cfg.Events).
+			Msg("WASM filter loaded")
+	}
+	return nil
+}
+
+// instantiate (re)creates the module instance. An instance is closed when a
+// call times out. The caller holds f.mu or has exclusive access.
+func (f *wasmFilter) instantiate(ctx context.Context) error {
+	mod, err := f.rt.InstantiateModule(ctx, f.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"alloc", "transform"} {
+		if mod.ExportedFunction(name) == nil {
+			_ = mod.Close(ctx)
+			return fmt.Errorf("missing export %s", name)
+		}
+	}
+	if mod.Memory() == nil {
+		_ = mod.Close(ctx)
+		return fmt.Errorf("missing exported memory")
+	}
+	f.mod = mod
+	return nil
+}
+
+func (f *wasmFilter) transformEvent(ev *TransformedEvent) (bool, error) {
+	if len(f.events) > 0 && !f.events[ev.Kind] {
+		return true, nil
+	}
+	in, err := json.Marshal(ev)
+	if err != nil {
+		return true, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.mod.IsClosed() {
+		if err := f.instantiate(context.Background()); err != nil {
+			return true, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), WasmFilterTimeout)
+	defer cancel()
+	res, err := f.mod.ExportedFunction("alloc").Call(ctx, uint64(len(in)))
+	if err != nil {
+		return true, err
+	}
+	ptr := uint32(res[0])
+	free := f.mod.ExportedFunction("free")
+	if free != nil {
+		defer func() { _, _ = free.Call(ctx, uint64(ptr), uint64(len(in))) }()
+	}
+	if !f.mod.Memory().Write(ptr, in) {
+		return true, fmt.Errorf("alloc returned memory out of range")
+	}
+	res, err = f.mod.ExportedFunction("transform").Call(ctx, uint64(ptr), uint64(len(in)))
+	if err != nil {
+		return true, err
+	}
+	outPtr, outLen := uint32(res[0]>>32), uint32(res[0])
+	if outLen == 0 {
+		return false, nil
+	}
+	// a filter transforming in place returns its input, freed above
+	if free != nil && outPtr != ptr {
+		defer func() { _, _ = free.Call(ctx, uint64(outPtr), uint64(outLen)) }()
+	}
+	out, ok := f.mod.Memory().Read(outPtr, outLen)
+	if !ok {
+		return true, fmt.Errorf("transform returned memory out of range")
+	}
+	var next TransformedEvent
+	if err := json.Unmarshal(out, &next); err != nil {
+		return true, err
+	}
+
+	if next.Subject != "" {
+		ev.Subject = next.Subject
+	}
+	if len(next.Payload) > 0 {
+		ev.Payload = next.Payload
+	}
+	return true, nil
+}
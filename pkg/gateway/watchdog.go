@@ -0,0 +1,175 @@
+package gateway
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+)
+
+const (
+	LivenessTimeout = 3 * GatewayStatusInterval
+)
+
+type watchedGateway struct {
+	lastSeen   time.Time
+	lastStatus GatewayStatusMsg
+	version    int
+}
+
+// Watchdog tracks the gateway status of all gateways on the bus and
+// publishes an offline tombstone on behalf of a gateway that went silent
+// without announcing a clean stop. It also publishes the status of all
+// devices combined.
+type Watchdog struct {
+	nc      *nats.Conn
+	timeout time.Duration
+	logger  zerolog.Logger
+	layout  *layoutTracker
+
+	mu       sync.Mutex
+	gateways map[string]*watchedGateway
+}
+
+func NewWatchdog(nc *nats.Conn, cfg Config) *Watchdog {
+	return &Watchdog{
+		nc:       nc,
+		timeout:  cfg.LivenessTimeout,
+		logger:   cfg.Logger,
+		layout:   newLayoutTracker(),
+		gateways: make(map[string]*watchedGateway),
+	}
+}
+
+func (w *Watchdog) Run(ctx context.Context) error {
+	sub, err := w.nc.Subscribe("z21.*.gateway.status", w.handleStatus)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	w.logger.Info().
+		Str("subject", sub.Subject).
+		Dur("timeout", w.timeout).
+		Msg("NATS sub")
+
+	for subject, handler := range map[string]nats.MsgHandler{
+		"z21.*.status":            w.handleZ21Status,
+		"z21.*.event.systemstate": w.handleSystemState,
+	} {
+		sub, err := w.nc.Subscribe(subject, handler)
+		if err != nil {
+			return err
+		}
+		defer sub.Unsubscribe()
+	}
+
+	ticker := time.NewTicker(w.timeout / 10)
+	defer ticker.Stop()
+	layoutTicker := time.NewTicker(LayoutStatusInterval)
+	defer layoutTicker.Stop()
+	changes := time.NewTicker(time.Second)
+	defer changes.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			w.checkLiveness()
+		case <-layoutTicker.C:
+			w.publishLayoutStatus(true)
+		case <-changes.C:
+			w.publishLayoutStatus(false)
+		}
+	}
+}
+
+func (w *Watchdog) handleStatus(msg *nats.Msg) {
+	name := strings.Split(msg.Subject, ".")[1]
+	version := msgSchemaVersion(msg)
+
+	var status GatewayStatusMsg
+	if err := decodePayload(version, msg.Data, &status); err != nil {
+		w.logger.Warn().
+			Err(err).
+			Str("subject", msg.Subject).
+			Msg("invalid gateway status")
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.layout.setGateway(name, status.State, status.Z21Online)
+	switch status.State {
+	case GatewayOffline:
+		// our own tombstone
+		return
+	case GatewayStopped:
+		delete(w.gateways, name)
+		w.logger.Info().
+			Str("gateway", name).
+			Msg("gateway stopped")
+		return
+	}
+
+	if _, ok := w.gateways[name]; !ok {
+		w.logger.Info().
+			Str("gateway", name).
+			Msg("gateway online")
+	}
+	w.gateways[name] = &watchedGateway{
+		lastSeen:   time.Now(),
+		lastStatus: status,
+		version:    version,
+	}
+}
+
+func (w *Watchdog) checkLiveness() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for name, gw := range w.gateways {
+		if time.Since(gw.lastSeen) < w.timeout {
+			continue
+		}
+		delete(w.gateways, name)
+		w.publishTombstone(name, gw)
+	}
+}
+
+func (w *Watchdog) publishTombstone(name string, gw *watchedGateway) {
+	status := gw.lastStatus
+	status.State = GatewayOffline
+	status.Z21Online = false
+	status.Loops = nil
+	status.Reason = ShutdownSilent
+	status.ReasonMessage = "no gateway status for " + w.timeout.String()
+	status.TS = time.Now().UTC().Format(time.RFC3339)
+
+	ts := time.Now().UTC()
+	data, err := encodePayload(gw.version, name, "gateway.status", 0, ts, &status)
+	if err != nil {
+		w.logger.Error().
+			Err(err).
+			Msg("failed to marshall tombstone")
+		return
+	}
+
+	msg := newMsg("z21."+name+".gateway.status", gw.version, 0, ts)
+	msg.Data = data
+	if err := w.nc.PublishMsg(msg); err != nil {
+		w.logger.Error().
+			Err(err).
+			Msg("failed to publish tombstone")
+		return
+	}
+	w.logger.Warn().
+		Str("gateway", name).
+		Time("last_seen", gw.lastSeen).
+		Msg("gateway offline")
+}
@@ -0,0 +1,35 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	WebhookTimeout = 5 * time.Second
+)
+
+// postWebhook posts v as JSON to the configured webhook URL.
+func (g *Gateway) postWebhook(v any) error {
+	if g.webhookURL == "" {
+		return fmt.Errorf("no webhook URL configured")
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: WebhookTimeout}
+	resp, err := client.Post(g.webhookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}